@@ -0,0 +1,74 @@
+package grammar
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// AnyWeights weighs the identifiers GenerateAny picks from: an identifier with weight 3 is three times as likely to be
+// picked as one with the default weight of 1, and one with weight 0 is never picked. Other calls ignore it.
+func AnyWeights(weights map[string]float64) GenerateOption {
+	return func(config *generateConfig) {
+		config.anyWeights = weights
+	}
+}
+
+// GenerateAny generates a phrase for an identifier starting with prefix, picked at random among all of them, using the
+// tree's default session. See Session.GenerateAny.
+func (tree *Tree) GenerateAny(prefix string, options ...GenerateOption) (string, error) {
+	return tree.defaultSession().GenerateAny(prefix, options...)
+}
+
+// GenerateAny generates a phrase for an identifier starting with prefix, e.g. "monster." for every monster of a pack
+// (see LoadPack), without an index definition listing them that must be kept up to date:
+//
+//	line, err := s.GenerateAny("monster.")
+//
+// The identifiers are equally likely to be picked unless weighted with AnyWeights. Localized definitions
+// (greeting@sv) aren't picked themselves but used for their identifiers as usual (see Locale), and private definitions
+// and those which aren't allowed entry points (see AllowEntries) are left out. It returns an error if no identifier can
+// be picked.
+func (s *Session) GenerateAny(prefix string, options ...GenerateOption) (string, error) {
+	g := s.newGenerator(options)
+	ids, weights := g.candidates(prefix)
+
+	if !slices.ContainsFunc(weights, func(weight float64) bool { return weight > 0 }) {
+		return "", fmt.Errorf("no identifiers starting with %s to pick from", prefix)
+	}
+
+	return s.Generate(ids[pickWeighted(weights, g.draw)], options...)
+}
+
+// candidates returns the identifiers GenerateAny can pick for prefix, in the order of the tree, with their weights.
+func (g *generator) candidates(prefix string) (ids []string, weights []float64) {
+	seen := make(map[string]bool)
+
+	for _, def := range g.tree.root.child {
+		id, _, localized := strings.Cut(def.Text, "@")
+
+		if !strings.HasPrefix(id, prefix) || seen[id] {
+			continue
+		}
+
+		seen[id] = true
+
+		// A localized definition without a plain one is a candidate only if it exists in a preferred locale
+		if localized && g.findDefinition(id) == nil || g.checkEntry(id) != nil {
+			continue
+		}
+
+		weight, found := g.config.anyWeights[id]
+
+		if !found {
+			weight = 1
+		}
+
+		if weight > 0 {
+			ids = append(ids, id)
+			weights = append(weights, weight)
+		}
+	}
+
+	return ids, weights
+}
@@ -0,0 +1,82 @@
+package grammar
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// article matches an article token such as der/die/das (without braces): forms separated by slashes.
+var article = regexp.MustCompile(`^[^\s/{}:=?*#%\\]+(?:/[^\s/{}:=?*#%\\]+)+$`)
+
+// genders maps the values of gender metadata to the position of the article form for the gender.
+var genders = map[string]int{
+	"m": 0, "masculine": 0,
+	"f": 1, "feminine": 1,
+	"n": 2, "neuter": 2,
+}
+
+// Article markers stand in for article tokens until the gender of the following noun is known.
+const (
+	articleOpen  = '\x03'
+	articleClose = '\x04'
+)
+
+// A pendingArticle is an article token waiting for the gender of the noun after it.
+type pendingArticle struct {
+	forms []string // Masculine, feminine and neuter form, in that order
+	form  int      // The form picked, or -1 until the gender is known
+}
+
+// article returns a marker for an article token such as der/die/das, to be resolved once the gender of the following
+// noun is known.
+func (g *generator) article(tag string) string {
+	g.articles = append(g.articles, &pendingArticle{forms: strings.Split(tag, "/"), form: -1})
+	return string(articleOpen) + strconv.Itoa(len(g.articles)-1) + string(articleClose)
+}
+
+// agree picks the form of every pending article for a noun of gender.
+func (g *generator) agree(gender string) {
+	form, found := genders[strings.ToLower(gender)]
+
+	if !found {
+		return
+	}
+
+	for _, a := range g.articles {
+		if a.form < 0 {
+			a.form = form
+		}
+	}
+}
+
+// resolveArticles replaces the markers of articles in s with their forms. If final is false, markers of articles
+// still waiting for a gender are left in place; otherwise they get their first form.
+func (g *generator) resolveArticles(s string, final bool) string {
+	var b strings.Builder
+
+	for {
+		open := strings.IndexRune(s, articleOpen)
+
+		if open < 0 {
+			break
+		}
+
+		end := strings.IndexRune(s[open:], articleClose) + open
+		i, _ := strconv.Atoi(s[open+1 : end])
+		a := g.articles[i]
+
+		switch {
+		case a.form >= 0:
+			b.WriteString(s[:open] + strings.ReplaceAll(a.forms[min(a.form, len(a.forms)-1)], "_", " "))
+		case final:
+			b.WriteString(s[:open] + strings.ReplaceAll(a.forms[0], "_", " "))
+		default:
+			b.WriteString(s[:end+1])
+		}
+
+		s = s[end+1:]
+	}
+
+	return b.String() + s
+}
@@ -0,0 +1,128 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Ways of dealing with unbalanced delimiters in the output (see CheckBalance and CloseDelimiters).
+const (
+	balanceIgnore = iota // Leave the output as it is
+	balanceCheck         // Fail if delimiters are unbalanced
+	balanceClose         // Close delimiters left open, and fail on other imbalances
+)
+
+// closers maps each opening delimiter to its closing one, by language. A delimiter may be its own closer, like the
+// straight double quote. Languages not listed use the delimiters of English, under "".
+var closers = map[string]map[rune]rune{
+	"":   {'(': ')', '[': ']', '{': '}', '“': '”', '«': '»', '"': '"'},
+	"da": {'(': ')', '[': ']', '{': '}', '„': '“', '»': '«', '"': '"'},
+	"de": {'(': ')', '[': ']', '{': '}', '„': '“', '»': '«', '"': '"'},
+	"fi": {'(': ')', '[': ']', '{': '}', '”': '”', '»': '»', '"': '"'},
+	"sv": {'(': ')', '[': ']', '{': '}', '”': '”', '»': '»', '"': '"'},
+}
+
+// CheckBalance makes generation fail with an *UnbalancedError if the parentheses, brackets, braces or double quotes of
+// the output don't pair up, e.g. because one branch opens a parenthesis and the branch meant to close it wasn't picked.
+// Single quotes aren't checked, since they can't be told apart from apostrophes, and neither is the text of literals.
+//
+// Quotes are paired as in the most preferred locale (see Locale), e.g. „Hallo“ in German and »hej» in
+// Swedish, and as in English if none is given.
+func CheckBalance() GenerateOption {
+	return func(config *generateConfig) {
+		config.balance = balanceCheck
+	}
+}
+
+// CloseDelimiters is like CheckBalance, but delimiters left open are closed at the end of the output, innermost first,
+// rather than failing: "(see {note}" may give "(see page 4)". A delimiter closing one that was never opened, or closing
+// the wrong one, still fails.
+func CloseDelimiters() GenerateOption {
+	return func(config *generateConfig) {
+		config.balance = balanceClose
+	}
+}
+
+// An UnbalancedError is returned when the delimiters of the output don't pair up (see CheckBalance).
+type UnbalancedError struct {
+	Delimiter string // The delimiter without a partner, e.g. "("
+	Offset    int    // Its byte offset in the output
+	Text      string // The output
+}
+
+func (err *UnbalancedError) Error() string {
+	return fmt.Sprintf("unbalanced %s at offset %d of %q", err.Delimiter, err.Offset, err.Text)
+}
+
+// A delimiter is an opening delimiter of the output and its byte offset.
+type delimiter struct {
+	r      rune
+	offset int
+}
+
+// delimiters returns the delimiters of the most preferred locale, mapping each opening delimiter to its closing one.
+func (g *generator) delimiters() map[rune]rune {
+	language, _, _ := strings.Cut(strings.ToLower(g.locale()), "-")
+
+	if ret, found := closers[language]; found {
+		return ret
+	}
+
+	return closers[""]
+}
+
+// balance checks that the delimiters of s, as paired by closers, pair up, and closes those left open if close.
+func balance(s string, closers map[rune]rune, close bool) (string, error) {
+	var open []delimiter // Delimiters still open, innermost last
+
+	for i, r := range s {
+		var top rune
+
+		if len(open) > 0 {
+			top = open[len(open)-1].r
+		}
+
+		switch {
+		case closers[top] == r:
+			open = open[:len(open)-1]
+		case closers[r] != 0:
+			open = append(open, delimiter{r, i})
+		case isCloser(closers, r):
+			return "", unbalanced(s, r, i)
+		}
+	}
+
+	if len(open) == 0 {
+		return s, nil
+	} else if !close {
+		last := open[len(open)-1]
+		return "", unbalanced(s, last.r, last.offset)
+	}
+
+	// Close before any trailing whitespace, such as a final newline
+	end := len(strings.TrimRightFunc(s, unicode.IsSpace))
+	var closing strings.Builder
+
+	for i := len(open) - 1; i >= 0; i-- {
+		closing.WriteRune(closers[open[i].r])
+	}
+
+	return s[:end] + closing.String() + s[end:], nil
+}
+
+// isCloser reports whether r closes one of the delimiters of closers.
+func isCloser(closers map[rune]rune, r rune) bool {
+	for _, closer := range closers {
+		if closer == r {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unbalanced returns an *UnbalancedError for the delimiter r at offset of s, which may contain encoded literals.
+func unbalanced(s string, r rune, offset int) *UnbalancedError {
+	return &UnbalancedError{Delimiter: string(r), Offset: len(decodeLiterals(s[:offset])), Text: decodeLiterals(s)}
+}
@@ -0,0 +1,66 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Blank is a substitution left for the user to fill in, as with Mad Libs (see Blanks).
+type Blank struct {
+	ID     string // The identifier, e.g. "noun"
+	Prompt string // What to ask the user for, e.g. "noun (plural)"
+}
+
+// Blanks leaves the substitutions of ids as blanks instead of generating them, for fill-in-the-blank games. The Result
+// (see GenerateResult) lists the Blanks in the order they appear, and Fill inserts the answers into the phrase.
+//
+// The prompt of a blank is the documentation of the identifier (see //!doc) or the identifier itself, followed by
+// any modifiers in parentheses, e.g. "noun (plural)". The answers are inserted as given.
+func Blanks(ids ...string) GenerateOption {
+	return func(config *generateConfig) {
+		if config.blanks == nil {
+			config.blanks = make(map[string]bool)
+		}
+
+		for _, id := range ids {
+			config.blanks[id] = true
+		}
+	}
+}
+
+// blankMarker returns the placeholder for blank i in the generated text.
+func blankMarker(i int) string {
+	return fmt.Sprintf("{?%d}", i)
+}
+
+// blank leaves the substitution of id (with modifiers) as a blank and returns its placeholder.
+func (g *generator) blank(id string, modifiers []string) string {
+	prompt := id
+
+	if def := g.findDefinition(id); def != nil && def.directives.doc != "" {
+		prompt = def.directives.doc
+	}
+
+	if len(modifiers) > 0 {
+		prompt += " (" + strings.Join(modifiers, ", ") + ")"
+	}
+
+	g.result.Blanks = append(g.result.Blanks, Blank{ID: id, Prompt: prompt})
+	return blankMarker(len(g.result.Blanks) - 1)
+}
+
+// Fill inserts answers into the blanks of the phrase, one for each of Blanks in order, and returns the completed
+// phrase.
+func (result *Result) Fill(answers ...string) (string, error) {
+	if len(answers) != len(result.Blanks) {
+		return "", fmt.Errorf("%d answers for %d blanks", len(answers), len(result.Blanks))
+	}
+
+	text := result.Text
+
+	for i, answer := range answers {
+		text = strings.Replace(text, blankMarker(i), answer, 1)
+	}
+
+	return text, nil
+}
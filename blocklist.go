@@ -0,0 +1,62 @@
+package grammar
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// BlockWords rejects output containing any of words, as whole words, ignoring case. A rejected phrase is generated
+// again, up to a number of attempts, after which Generate fails with a *BlockedError. Use it as a safety net for
+// public-facing output.
+func BlockWords(words ...string) GenerateOption {
+	return func(config *generateConfig) {
+		if config.blockWords == nil {
+			config.blockWords = make(map[string]bool)
+		}
+
+		for _, word := range words {
+			config.blockWords[strings.ToLower(word)] = true
+		}
+	}
+}
+
+// BlockPatterns rejects output matching any of patterns, like BlockWords.
+func BlockPatterns(patterns ...*regexp.Regexp) GenerateOption {
+	return func(config *generateConfig) {
+		config.blockPatterns = append(config.blockPatterns, patterns...)
+	}
+}
+
+// A BlockedError is returned when every phrase generated contained blocked text (see BlockWords and BlockPatterns).
+type BlockedError struct {
+	Match string // The blocked text found in the last phrase
+}
+
+func (err *BlockedError) Error() string {
+	return fmt.Sprintf("output keeps containing blocked text %q", err.Match)
+}
+
+// blocked returns a *BlockedError if s contains blocked text, or nil.
+func (g *generator) blocked(s string) *BlockedError {
+	if len(g.config.blockWords) > 0 {
+		words := strings.FieldsFunc(s, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '-'
+		})
+
+		for _, word := range words {
+			if g.config.blockWords[strings.ToLower(word)] {
+				return &BlockedError{Match: word}
+			}
+		}
+	}
+
+	for _, pattern := range g.config.blockPatterns {
+		if loc := pattern.FindStringIndex(s); loc != nil {
+			return &BlockedError{Match: s[loc[0]:loc[1]]}
+		}
+	}
+
+	return nil
+}
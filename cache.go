@@ -0,0 +1,150 @@
+package grammar
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// tokenFormat is the version of the token layout, which is part of the key of every cached file so tokens written by
+// an older version are never reused. Bump it whenever tokenize changes what it produces.
+const tokenFormat = 1
+
+// A Cache speeds up loading the same grammar files over and over, e.g. when an application starts or a file watcher
+// reloads them. Pass it to ParseFile or ParseFiles with UseCache. Files are recognized by their contents, so only
+// changed files are tokenized again, and if no file changed the tree parsed last time is reused.
+//
+// A Cache can be kept on disk, so tokenized files survive a restart. It is safe for concurrent use.
+type Cache struct {
+	dir string // Where tokenized files are kept; "" keeps them in memory only
+
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte][]token // Tokens of files by the hash of their name, contents and tokenFormat
+	key    [sha256.Size]byte             // Hash of the files of tree
+	tree   *Tree                         // The tree parsed last
+}
+
+// NewCache returns an empty Cache which keeps tokenized files in dir, creating it if need be. If dir is "", the cache
+// is kept in memory only. Failing to write to dir is not an error; the files are just parsed again next time.
+func NewCache(dir string) *Cache {
+	if dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+
+	return &Cache{dir: dir, tokens: make(map[[sha256.Size]byte][]token)}
+}
+
+// UseCache reads files through a Cache.
+func UseCache(cache *Cache) ParseOption {
+	return func(config *parseConfig) {
+		config.cache = cache
+	}
+}
+
+// tokenize returns the tokens of a file, from the cache if it has been tokenized before, and the key of the file. A
+// nil cache just tokenizes the file.
+func (cache *Cache) tokenize(filename string, text string) ([]token, [sha256.Size]byte) {
+	if cache == nil {
+		return tokenize(text, filename), [sha256.Size]byte{}
+	}
+
+	key := cacheKey(filename, text)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if ret, found := cache.tokens[key]; found {
+		return ret, key
+	}
+
+	if ret, err := cache.load(key); err == nil {
+		cache.tokens[key] = ret
+		return ret, key
+	}
+
+	ret := tokenize(text, filename)
+	cache.tokens[key] = ret
+	cache.save(key, ret)
+	return ret, key
+}
+
+// cacheKey returns the key of a file with the given name and contents.
+func cacheKey(filename string, text string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(strconv.Itoa(tokenFormat) + "\x00" + filename + "\x00" + text))
+}
+
+// parse parses tokens into a tree, or copies the tree parsed last time if key (the hash of the keys of all files) is
+// the same. A nil cache just parses the tokens.
+func (cache *Cache) parse(key [sha256.Size]byte, token []token) (*Tree, error) {
+	if cache == nil {
+		return parseInternal(token)
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.tree == nil || cache.key != key {
+		tree, err := parseInternal(token)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cache.key, cache.tree = key, tree
+	}
+
+	// Trees keep state, so every caller gets a copy of its own
+	return &Tree{root: cache.tree.root.clone()}, nil
+}
+
+// path returns the name of the file keeping the tokens of the file with key.
+func (cache *Cache) path(key [sha256.Size]byte) string {
+	return filepath.Join(cache.dir, hex.EncodeToString(key[:])+".tokens")
+}
+
+// load reads the tokens of the file with key from disk.
+func (cache *Cache) load(key [sha256.Size]byte) ([]token, error) {
+	if cache.dir == "" {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := os.Open(cache.path(key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var ret []token
+	err = gob.NewDecoder(f).Decode(&ret)
+	return ret, err
+}
+
+// save writes the tokens of the file with key to disk, if the cache is kept there.
+func (cache *Cache) save(key [sha256.Size]byte, token []token) {
+	if cache.dir == "" {
+		return
+	}
+
+	f, err := os.CreateTemp(cache.dir, "tokens")
+
+	if err != nil {
+		return
+	}
+
+	err = gob.NewEncoder(f).Encode(token)
+
+	if closeErr := f.Close(); err == nil && closeErr == nil {
+		// Rename, so a concurrent reader never sees half a file
+		err = os.Rename(f.Name(), cache.path(key))
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
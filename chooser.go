@@ -0,0 +1,92 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A Chooser generates phrases from one of several grammars, picked at random by weight, for applications that mix
+// content sources, e.g. normal banter 80% of the time and a seasonal grammar 20% of the time:
+//
+//	chooser := grammar.NewChooser()
+//	chooser.Add(banter, "line", 80)
+//	chooser.Add(seasonal, "line", 20)
+//	line, err := chooser.Generate()
+//
+// Phrases are generated in the default sessions of the trees, so like Tree.Generate, a Chooser isn't safe for
+// concurrent use.
+type Chooser struct {
+	choices []choice
+	total   float64 // Sum of the weights
+}
+
+// A choice is an entry of a Chooser.
+type choice struct {
+	tree   *Tree
+	id     string
+	weight float64
+}
+
+// NewChooser returns a Chooser without entries.
+func NewChooser() *Chooser {
+	return &Chooser{}
+}
+
+// Add adds an entry generating id from tree, picked with odds in proportion to weight. If id is empty, the default
+// identifier of the tree is generated.
+func (c *Chooser) Add(tree *Tree, id string, weight float64) error {
+	if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return fmt.Errorf("invalid weight %g", weight)
+	}
+
+	if id != "" && !tree.Has(id) {
+		return fmt.Errorf("%w: %s", ErrUnknownIdentifier, id)
+	}
+
+	c.choices = append(c.choices, choice{tree: tree, id: id, weight: weight})
+	c.total += weight
+	return nil
+}
+
+// Generate picks an entry and generates a phrase from it. Options are passed on to the tree; a random source given
+// with RandSource or Seed picks the entry too.
+func (c *Chooser) Generate(options ...GenerateOption) (string, error) {
+	result, err := c.GenerateResult(options...)
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.Text, nil
+}
+
+// GenerateResult picks an entry and generates a phrase from it like Generate, along with details on how it was
+// generated.
+func (c *Chooser) GenerateResult(options ...GenerateOption) (*Result, error) {
+	if c.total == 0 {
+		return nil, errors.New("no entries to choose from")
+	}
+
+	var config generateConfig
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	// The entry and its phrase are drawn from the same source
+	config.applySeed()
+
+	if config.source != nil {
+		options = append(options[:len(options):len(options)], RandSource(config.source))
+	}
+
+	weights := make([]float64, len(c.choices))
+
+	for i := range c.choices {
+		weights[i] = c.choices[i].weight
+	}
+
+	picked := &c.choices[pickWeighted(weights, func(n int) int { return random(config.source, 0, n-1) })]
+	return picked.tree.GenerateResult(picked.id, options...)
+}
@@ -0,0 +1,161 @@
+package grammar
+
+import (
+	"strings"
+)
+
+// A TokenKind classifies a span of grammar source, for syntax highlighting.
+type TokenKind int
+
+const (
+	// TokenText is text that ends up in the generated phrases
+	TokenText TokenKind = iota
+	// TokenIdentifier is the identifier of a definition
+	TokenIdentifier
+	// TokenGroup is a group delimiter: [, | or ]
+	TokenGroup
+	// TokenSubstitution is a substitution, including its braces, e.g. {*weekday} or {1-6}
+	TokenSubstitution
+	// TokenComment is a comment, from // to the end of the line
+	TokenComment
+	// TokenDirective is a directive, from //! to the end of the line
+	TokenDirective
+	// TokenOperator is a control token: ^, ^^, ~~, <<, _ (or _:4) or the * of an exclusive group
+	TokenOperator
+)
+
+// String returns the name of the kind, e.g. "identifier".
+func (kind TokenKind) String() string {
+	switch kind {
+	case TokenText:
+		return "text"
+	case TokenIdentifier:
+		return "identifier"
+	case TokenGroup:
+		return "group"
+	case TokenSubstitution:
+		return "substitution"
+	case TokenComment:
+		return "comment"
+	case TokenDirective:
+		return "directive"
+	case TokenOperator:
+		return "operator"
+	default:
+		return "unknown"
+	}
+}
+
+// A Span is a classified range of grammar source.
+type Span struct {
+	Start int       // Byte offset of the first byte
+	End   int       // Byte offset after the last byte
+	Line  int       // Line number, starting from 1 like source positions
+	Kind  TokenKind // What the span is
+}
+
+// Classify splits grammar source into classified spans, in order, for editors and web UIs to highlight it the way the
+// parser reads it. Whitespace isn't included. Classify doesn't check the syntax, so it works on grammars with errors
+// as well; text after a stray ] is classified as identifiers.
+func Classify(source string) []Span {
+	var ret []Span
+	depth := 0
+	offset := 0
+
+	for lineNo, line := range strings.Split(source, "\n") {
+		span := func(start int, end int, kind TokenKind) {
+			ret = append(ret, Span{Start: offset + start, End: offset + end, Line: lineNo + 1, Kind: kind})
+		}
+
+		groupStart := false // At the start of a group, where * makes it exclusive
+
+		for i := 0; i < len(line); {
+			c := line[i]
+
+			switch {
+			case strings.HasPrefix(line[i:], "//!"):
+				span(i, len(line), TokenDirective)
+				i = len(line)
+			case strings.HasPrefix(line[i:], "//"):
+				span(i, len(line), TokenComment)
+				i = len(line)
+			case c == '`' && strings.IndexByte(line[i+1:], '`') >= 0:
+				// A literal is text, whatever characters it holds
+				end := i + 1 + strings.IndexByte(line[i+1:], '`') + 1
+				span(i, end, TokenText)
+				i = end
+			case c == ' ' || c == '\t' || c == '\r':
+				i++
+			case c == '[' || c == '|' || c == ']':
+				span(i, i+1, TokenGroup)
+				i++
+
+				if c == '[' {
+					depth++
+				} else if c == ']' && depth > 0 {
+					depth--
+				}
+
+				groupStart = c == '['
+				continue
+			case c == '{':
+				end := strings.IndexByte(line[i:], '}')
+
+				if end < 0 {
+					end = len(line)
+				} else {
+					end += i + 1
+				}
+
+				span(i, end, TokenSubstitution)
+				i = end
+			default:
+				end := i
+
+				for end < len(line) && !strings.ContainsRune(" \t\r[|]{", rune(line[end])) &&
+					!strings.HasPrefix(line[end:], "//") && (end == i || line[end] != '`') {
+					end++
+				}
+
+				classifyWord(line[i:end], i, depth == 0, groupStart, span)
+				i = end
+			}
+
+			groupStart = false
+		}
+
+		offset += len(line) + 1
+	}
+
+	return ret
+}
+
+// classifyWord classifies a word starting at offset start of a line, splitting off operators.
+func classifyWord(word string, start int, identifier bool, groupStart bool, span func(int, int, TokenKind)) {
+	if identifier {
+		span(start, start+len(word), TokenIdentifier)
+		return
+	}
+
+	if word == "<<" || word == "_" || emptyWeight.MatchString(word) {
+		span(start, start+len(word), TokenOperator)
+		return
+	}
+
+	if groupStart && word[0] == '*' {
+		span(start, start+1, TokenOperator)
+		word, start = word[1:], start+1
+	}
+
+	for _, marker := range []string{"^^", "~~", "^"} {
+		if strings.HasPrefix(word, marker) {
+			span(start, start+len(marker), TokenOperator)
+			word, start = word[len(marker):], start+len(marker)
+			break
+		}
+	}
+
+	if word != "" {
+		span(start, start+len(word), TokenText)
+	}
+}
@@ -0,0 +1,245 @@
+package grammar
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// CountPhrases returns the number of phrases id can produce, i.e. the number of different ways of picking its
+// branches, numbers and substitutions, e.g. 6 for "greeting [ Hello | Hi ] {name}" if name has three branches. This is
+// handy to judge whether a grammar is rich enough before shipping it.
+//
+// The count is an upper bound on the number of distinct phrases: different choices that happen to read the same are
+// counted separately, and so are both branches of a condition ({n>5?many:few}). A recursive definition can produce
+// infinitely many phrases, so it is reported as an error, as is a substitution of an unknown identifier.
+func (tree *Tree) CountPhrases(id string) (*big.Int, error) {
+	c := phraseCounter{tree: tree, counts: make(map[*node]*big.Int), counting: make(map[*node]bool)}
+
+	if id == "" && len(tree.root.child) > 0 {
+		id = tree.root.child[len(tree.root.child)-1].Text
+	}
+
+	return c.identifier(id)
+}
+
+// phraseCounter counts the phrases of definitions (see CountPhrases), remembering the count of each.
+type phraseCounter struct {
+	tree     *Tree
+	counts   map[*node]*big.Int
+	counting map[*node]bool // Definitions being counted, to detect recursion
+}
+
+// identifier returns the number of phrases a substitution of id (possibly with * and modifiers) can produce.
+func (c *phraseCounter) identifier(id string) (*big.Int, error) {
+	id, _, _ = strings.Cut(id, ":")
+	def := c.tree.findDefinition(id)
+
+	if def == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownIdentifier, strings.TrimPrefix(id, "*"))
+	}
+
+	if count, found := c.counts[def]; found {
+		return count, nil
+	}
+
+	if c.counting[def] {
+		return nil, fmt.Errorf("%s is recursive and can produce infinitely many phrases", def.Text)
+	}
+
+	c.counting[def] = true
+	count, err := c.sequence(def.child)
+	delete(c.counting, def)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.counts[def] = count
+	return count, nil
+}
+
+// sequence returns the number of phrases of nodes following each other, which is the product of their counts.
+func (c *phraseCounter) sequence(nodes []node) (*big.Int, error) {
+	product := big.NewInt(1)
+
+	for i := range nodes {
+		count, err := c.node(&nodes[i])
+
+		if err != nil {
+			return nil, err
+		}
+
+		product.Mul(product, count)
+	}
+
+	return product, nil
+}
+
+// node returns the number of phrases of n: the sum of its branches if it's a group, otherwise the product of its parts.
+func (c *phraseCounter) node(n *node) (*big.Int, error) {
+	switch n.internalType {
+	case group:
+		sum := new(big.Int)
+
+		for i := range n.child {
+			count, err := c.node(&n.child[i])
+
+			if err != nil {
+				return nil, err
+			}
+
+			sum.Add(sum, count)
+		}
+
+		return sum, nil
+	case text:
+		count, err := c.text(n.Text)
+
+		if err != nil {
+			return nil, err
+		}
+
+		children, err := c.sequence(n.child)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return count.Mul(count, children), nil
+	default:
+		return c.sequence(n.child)
+	}
+}
+
+// text returns the number of phrases of the {...} sequences in s, following the same rules as inflate.
+func (c *phraseCounter) text(s string) (*big.Int, error) {
+	product := big.NewInt(1)
+
+	for _, tag := range sequences(s) {
+		count, err := c.tag(tag)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w (%s)", err, tag)
+		}
+
+		product.Mul(product, count)
+	}
+
+	return product, nil
+}
+
+// tag returns the number of phrases of a single {...} sequence (without the braces).
+func (c *phraseCounter) tag(tag string) (*big.Int, error) {
+	switch classifyTag(tag) {
+	case tagEmpty, tagBlank, tagNewline, tagMetadata, tagParagraphBreak, tagSpeech, tagArticle, tagPlural:
+		return big.NewInt(1), nil
+	case tagParagraphs:
+		return c.paragraphs(tag)
+	case tagRange:
+		low, high, _ := parseRange(tag)
+		return big.NewInt(int64(max(high-low+1, 0))), nil
+	case tagRepetition:
+		return c.repetition(repetition.FindStringSubmatch(tag))
+	case tagConditional:
+		_, branches, _ := strings.Cut(tag, "?")
+		yes, no, _ := strings.Cut(branches, ":")
+		sum := new(big.Int)
+
+		for _, branch := range []string{yes, no} {
+			count := big.NewInt(1)
+
+			if c.tree.Has(branch) {
+				var err error
+
+				if count, err = c.identifier(branch); err != nil {
+					return nil, err
+				}
+			}
+
+			sum.Add(sum, count)
+		}
+
+		return sum, nil
+	case tagCapture:
+		_, inner, _ := strings.Cut(tag, "=")
+		return c.tag(inner)
+	}
+
+	return c.identifier(tag)
+}
+
+// paragraphs returns the number of phrases of a paragraph sequence: the product of the counts of its parts and, if it
+// is shuffled, the number of orders of the parts that aren't fixed in place.
+func (c *phraseCounter) paragraphs(spec string) (*big.Int, error) {
+	product := big.NewInt(1)
+	movable := int64(0)
+
+	for _, id := range strings.Split(spec[1:], ",") {
+		if fixed := strings.HasPrefix(id, "="); !fixed {
+			movable++
+		}
+
+		count, err := c.identifier(strings.TrimPrefix(id, "="))
+
+		if err != nil {
+			return nil, err
+		}
+
+		product.Mul(product, count)
+	}
+
+	if spec[0] == '~' && movable > 1 {
+		product.Mul(product, new(big.Int).MulRange(1, movable))
+	}
+
+	return product, nil
+}
+
+// repetition returns the number of phrases of a loop such as {line*1-5}: the sum, over the numbers of repetitions, of
+// the count of line raised to that number.
+func (c *phraseCounter) repetition(match []string) (*big.Int, error) {
+	low, _ := strconv.Atoi(match[2])
+	high := low
+
+	if match[3] != "" {
+		high, _ = strconv.Atoi(match[3])
+	}
+
+	count, err := c.identifier(match[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	sum := new(big.Int)
+
+	for n := low; n <= high; n++ {
+		sum.Add(sum, new(big.Int).Exp(count, big.NewInt(int64(n)), nil))
+	}
+
+	return sum, nil
+}
+
+// sequences returns the contents of the {...} sequences in s, without the braces.
+func sequences(s string) []string {
+	var ret []string
+
+	for {
+		open := strings.IndexByte(s, '{')
+
+		if open < 0 {
+			return ret
+		}
+
+		end := strings.IndexByte(s[open:], '}')
+
+		if end < 0 {
+			return ret
+		}
+
+		ret = append(ret, s[open+1:open+end])
+		s = s[open+end+1:]
+	}
+}
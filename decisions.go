@@ -0,0 +1,58 @@
+package grammar
+
+import (
+	"fmt"
+)
+
+// A Decision is a node in the decision tree of a generation, as recorded with RecordDecisions. It marshals to JSON
+// with encoding/json, e.g. for audit logs or to visualize why a phrase came out the way it did.
+type Decision struct {
+	Kind     string      `json:"kind"`              // "definition", "group" or "substitution"
+	ID       string      `json:"id,omitempty"`      // The identifier of a definition, or the substitution as written
+	Group    string      `json:"group,omitempty"`   // The group, e.g. "weekday/[1"
+	Options  []string    `json:"options,omitempty"` // The branches of a group, as grammar text
+	Chosen   int         `json:"chosen"`            // The branch picked from a group
+	Text     string      `json:"text"`              // The resulting text
+	Children []*Decision `json:"children,omitempty"`
+}
+
+// RecordDecisions records the decision tree of a generation in the Decisions of the Result (see GenerateResult): the
+// groups encountered, the branches they had to offer, the branch picked and the text that resulted, along with the
+// substitutions made along the way.
+func RecordDecisions() GenerateOption {
+	return func(config *generateConfig) {
+		config.decisions = true
+	}
+}
+
+// decide starts recording a decision as a child of the current one, and returns a function which finishes it with
+// the resulting text. Nothing is recorded unless RecordDecisions was given.
+func (g *generator) decide(d *Decision) func(text string) {
+	if g.decision == nil {
+		return func(string) {}
+	}
+
+	parent := g.decision
+	parent.Children = append(parent.Children, d)
+	g.decision = d
+
+	return func(text string) {
+		d.Text = text
+		g.decision = parent
+	}
+}
+
+// decideGroup starts recording the choice of branch i of group.
+func (g *generator) decideGroup(group *node, i int) func(text string) {
+	if g.decision == nil {
+		return func(string) {}
+	}
+
+	d := &Decision{Kind: "group", Group: fmt.Sprintf("%s/%s", g.def.Text, group.Text), Chosen: i}
+
+	for j := range group.child {
+		d.Options = append(d.Options, group.child[j].grammarText())
+	}
+
+	return g.decide(d)
+}
@@ -0,0 +1,62 @@
+package grammar
+
+import "strings"
+
+// A Definition describes a top-level identifier of a tree, as returned by Lookup.
+type Definition struct {
+	ID       string // The identifier
+	Branches int    // Number of branches of its outermost group (1 if it isn't a group)
+	Source   string // Where it was defined, e.g. "names.g:12"
+	Doc      string // Documentation given with //!doc directives
+	Private  bool   // Only usable through substitutions (see //!private)
+	Comment  string // The comments written right before the definition, without //, one per line
+}
+
+// Has reports whether the tree has a definition for id. A leading * (for exclusive substitutions) is ignored.
+func (tree *Tree) Has(id string) bool {
+	return tree.findDefinition(id) != nil
+}
+
+// Lookup returns a description of the definition of id, or false if there is none. Applications can use it to check
+// user-requested identifiers before generating them, and to show what they are. A leading * is ignored.
+func (tree *Tree) Lookup(id string) (Definition, bool) {
+	def := tree.findDefinition(id)
+
+	if def == nil {
+		return Definition{}, false
+	}
+
+	ret := Definition{ID: def.Text, Branches: 1, Source: def.Source, Doc: def.directives.doc,
+		Private: def.directives.private}
+
+	if len(def.child) == 1 && def.child[0].internalType == group {
+		ret.Branches = len(def.child[0].child)
+	}
+
+	lines := make([]string, len(def.comments))
+
+	for i, comment := range def.comments {
+		lines[i] = strings.TrimSpace(strings.TrimPrefix(comment, "//"))
+	}
+
+	ret.Comment = strings.Join(lines, "\n")
+
+	return ret, true
+}
+
+// findDefinition returns the top-level node defining id, or nil. Like generate, the last definition wins.
+func (tree *Tree) findDefinition(id string) *node {
+	var ret *node
+
+	if len(id) > 0 && id[0] == '*' {
+		id = id[1:]
+	}
+
+	for i, n := range tree.root.child {
+		if n.Text == id {
+			ret = &tree.root.child[i]
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,140 @@
+package grammar
+
+import (
+	"strconv"
+	"strings"
+)
+
+// directives holds the settings of a top-level definition, as given by //! directives.
+type directives struct {
+	pool     string        // Name of a shared exclusion pool
+	cooldown int           // Number of generations a picked branch is ineligible for
+	doc      string        // Documentation, one line per //!doc directive
+	merge    MergeStrategy // How to combine with an earlier definition of the same identifier
+	private  bool          // Only usable through substitutions, not generated directly
+	expect   []expectation // Tests every expansion must pass (see RunTests)
+	stock    bool          // Exclusive substitutions use up the weight of a branch one at a time
+}
+
+// features are the names of the language features a grammar can require with //!requires.
+var features = map[string]bool{
+	"articles": true, "constraints": true, "cooldown": true, "dashes": true, "doc": true, "expect": true,
+	"literals": true, "locales": true, "loops": true, "merge": true, "metadata": true, "modifiers": true,
+	"paragraphs": true, "plurals": true, "pool": true, "private": true, "requires": true, "speech": true, "stock": true,
+	"tiers": true, "variables": true, "weights": true,
+}
+
+// checkRequirements checks the //!requires directives among tokens, returning the other tokens. These are checked
+// before anything else is parsed, so a grammar using a feature this version doesn't have fails with a clear message
+// instead of a syntax error.
+func checkRequirements(tokens []token) ([]token, error) {
+	ret := tokens[:0:0]
+
+	for _, t := range tokens {
+		fields := strings.Fields(strings.TrimPrefix(t.Text, "//!"))
+
+		if !isDirective(t) || len(fields) == 0 || fields[0] != "requires" {
+			ret = append(ret, t)
+			continue
+		}
+
+		required := strings.FieldsFunc(strings.Join(fields[1:], " "), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+
+		if len(required) == 0 {
+			return nil, tokenError(t, "directive requires expects feature names")
+		}
+
+		for _, feature := range required {
+			if !features[feature] {
+				return nil, tokenError(t, "grammar requires %s, which this version of the grammar package doesn't support",
+					feature)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// isDirective reports whether a token is a directive, i.e. a comment starting with //!
+func isDirective(t token) bool {
+	return strings.HasPrefix(t.Text, "//!")
+}
+
+// isComment reports whether a token is a comment other than a directive.
+func isComment(t token) bool {
+	return strings.HasPrefix(t.Text, "//") && !isDirective(t)
+}
+
+// applyDirective parses the directive t and applies it to the definition def.
+func applyDirective(def *node, t token) error {
+	fields := strings.Fields(strings.TrimPrefix(t.Text, "//!"))
+
+	if len(fields) == 0 {
+		return tokenError(t, "empty directive")
+	}
+
+	name, args := fields[0], fields[1:]
+
+	switch name {
+	case "pool":
+		if len(args) != 1 {
+			return tokenError(t, "directive %s expects a pool name", name)
+		}
+
+		def.directives.pool = args[0]
+	case "cooldown":
+		var err error
+
+		if len(args) == 1 {
+			def.directives.cooldown, err = strconv.Atoi(args[0])
+		}
+
+		if len(args) != 1 || err != nil || def.directives.cooldown < 0 {
+			return tokenError(t, "directive %s expects a number of generations", name)
+		}
+	case "merge":
+		var found bool
+
+		if len(args) == 1 {
+			def.directives.merge, found = mergeStrategies[args[0]]
+		}
+
+		if !found {
+			return tokenError(t, "directive %s expects error, replace, append or interleave", name)
+		}
+	case "private":
+		if len(args) != 0 {
+			return tokenError(t, "directive %s expects no arguments", name)
+		}
+
+		def.directives.private = true
+	case "stock":
+		if len(args) != 0 {
+			return tokenError(t, "directive %s expects no arguments", name)
+		}
+
+		def.directives.stock = true
+	case "expect":
+		e, err := parseExpectation(strings.TrimSpace(strings.TrimPrefix(t.Text, "//!expect")), t.Source)
+
+		if err != nil {
+			return err
+		}
+
+		def.directives.expect = append(def.directives.expect, e)
+	case "doc":
+		text := strings.TrimSpace(strings.TrimPrefix(t.Text, "//!doc"))
+
+		if def.directives.doc != "" {
+			text = def.directives.doc + "\n" + text
+		}
+
+		def.directives.doc = text
+	default:
+		return tokenError(t, "unknown directive %s", name)
+	}
+
+	return nil
+}
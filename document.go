@@ -0,0 +1,60 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// paragraphBreak separates paragraphs, both for {\p} and between the parts of a paragraph sequence.
+const paragraphBreak = "\n\n"
+
+// paragraphs expands a paragraph sequence such as "+intro,body,outro" or "~=intro,a,b,c,=outro" (without the braces).
+//
+// Each identifier in the comma-separated list is expanded to a paragraph of its own, and the paragraphs are joined with
+// blank lines in between. With + they are kept in order; with ~ they are shuffled, except for identifiers prefixed
+// with =, which stay in place. Each paragraph is a substitution of its own, subject to the same limits.
+func (g *generator) paragraphs(spec string) (string, error) {
+	ids := strings.Split(spec[1:], ",")
+	fixed := make([]bool, len(ids))
+
+	for i, id := range ids {
+		if strings.HasPrefix(id, "=") {
+			ids[i] = id[1:]
+			fixed[i] = true
+		}
+
+		if ids[i] == "" {
+			return "", fmt.Errorf("empty identifier in paragraph sequence {%s}", spec)
+		}
+	}
+
+	if spec[0] == '~' {
+		// Fisher-Yates shuffle of the entries that aren't fixed in place
+		var movable []int
+
+		for i := range ids {
+			if !fixed[i] {
+				movable = append(movable, i)
+			}
+		}
+
+		for i := len(movable) - 1; i > 0; i-- {
+			j := g.random(0, i)
+			ids[movable[i]], ids[movable[j]] = ids[movable[j]], ids[movable[i]]
+		}
+	}
+
+	var parts []string
+
+	for _, id := range ids {
+		part, err := g.substitute(id)
+
+		if err != nil {
+			return "", fmt.Errorf("%w (%s)", err, id)
+		}
+
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, paragraphBreak), nil
+}
@@ -0,0 +1,85 @@
+package grammar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// windows1252 maps the bytes 0x80-0x9f of Windows-1252 to runes; the rest of its upper half is the same as Latin-1.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+// decode converts the contents of a grammar file to a string, whatever encoding a text editor saved it in. A byte
+// order mark selects UTF-8, UTF-16LE or UTF-16BE (and is dropped). Without one, text with zero bytes in every other
+// position is taken to be UTF-16, valid UTF-8 is used as is, and anything else is read as Windows-1252, which covers
+// Latin-1 files.
+func decode(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return string(data[3:]), nil
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return decodeUTF16(data[2:], binary.LittleEndian)
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return decodeUTF16(data[2:], binary.BigEndian)
+	}
+
+	if len(data) >= 2 && len(data)%2 == 0 {
+		even, odd := zeros(data, 0), zeros(data, 1)
+
+		if odd > even && odd >= len(data)/4 {
+			return decodeUTF16(data, binary.LittleEndian)
+		} else if even > odd && even >= len(data)/4 {
+			return decodeUTF16(data, binary.BigEndian)
+		}
+	}
+
+	if utf8.Valid(data) {
+		return string(data), nil
+	}
+
+	runes := make([]rune, len(data))
+
+	for i, b := range data {
+		if b >= 0x80 && b < 0xa0 {
+			runes[i] = windows1252[b-0x80]
+		} else {
+			runes[i] = rune(b)
+		}
+	}
+
+	return string(runes), nil
+}
+
+// zeros counts the zero bytes in every other position of data, starting at offset. Text has no zero bytes, except in
+// UTF-16, where most characters have one in the same position.
+func zeros(data []byte, offset int) int {
+	n := 0
+
+	for i := offset; i < len(data); i += 2 {
+		if data[i] == 0 {
+			n++
+		}
+	}
+
+	return n
+}
+
+// decodeUTF16 decodes UTF-16 text in the given byte order.
+func decodeUTF16(data []byte, order binary.ByteOrder) (string, error) {
+	if len(data)%2 != 0 {
+		return "", fmt.Errorf("invalid UTF-16: odd number of bytes")
+	}
+
+	units := make([]uint16, len(data)/2)
+
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+
+	return string(utf16.Decode(units)), nil
+}
@@ -0,0 +1,77 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPrivate is returned when generating a private definition (see //!private) directly.
+var ErrPrivate = errors.New("private definition")
+
+// An EntryError is returned when generating an identifier which isn't among the allowed entry points (see
+// AllowEntries).
+type EntryError struct {
+	ID string // The identifier that was requested
+}
+
+func (err *EntryError) Error() string {
+	return fmt.Sprintf("%s is not an entry point", err.ID)
+}
+
+// AllowEntries restricts the identifiers that can be generated directly to ids, in all sessions of the tree that don't
+// have entry points of their own. Anything else fails with an *EntryError, although all definitions can still be
+// substituted.
+// This makes it safe to generate identifiers chosen by users, e.g. from an HTTP request. Calling it without any ids
+// removes the restriction.
+func (tree *Tree) AllowEntries(ids ...string) {
+	tree.entries = entrySet(ids)
+}
+
+// AllowEntries restricts the identifiers that can be generated directly in this session, like Tree.AllowEntries. It
+// takes precedence over the entry points of the tree.
+func (s *Session) AllowEntries(ids ...string) {
+	s.entries = entrySet(ids)
+}
+
+// entrySet returns ids as a set, or nil if there are none.
+func entrySet(ids []string) map[string]bool {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ret := make(map[string]bool, len(ids))
+
+	for _, id := range ids {
+		ret[id] = true
+	}
+
+	return ret
+}
+
+// checkEntry returns an error if id may not be generated directly, but only through substitutions.
+func (g *generator) checkEntry(id string) error {
+	s := g.session
+	def := g.findDefinition(id)
+
+	if id == "" && len(s.tree.root.child) > 0 {
+		def = &s.tree.root.child[len(s.tree.root.child)-1]
+	}
+
+	if def != nil && def.directives.private {
+		return fmt.Errorf("%w: %s", ErrPrivate, def.Text)
+	}
+
+	entries := s.entries
+
+	if entries == nil {
+		entries = s.tree.entries
+	}
+
+	// A localized definition (e.g. greeting@sv) is allowed if its identifier is
+	if entries != nil && (def == nil || !entries[def.Text] && !entries[strings.TrimPrefix(id, "*")]) {
+		return &EntryError{ID: id}
+	}
+
+	return nil
+}
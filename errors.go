@@ -0,0 +1,21 @@
+package grammar
+
+import "errors"
+
+// Errors returned by parsing and generating wrap these, so callers can tell kinds of errors apart with errors.Is
+// instead of matching messages:
+//
+//	if errors.Is(err, grammar.ErrExhausted) {
+//		tree.Reset()
+//	}
+//
+// Other kinds of errors have types of their own, e.g. *ParseError, *LimitError and *EntryError, for errors.As.
+var (
+	ErrEmptyInput               = errors.New("empty input")               // The grammar has no tokens at all
+	ErrEmptyTree                = errors.New("empty tree")                // The tree has no definitions to generate
+	ErrUnknownIdentifier        = errors.New("no such definition")        // An identifier isn't defined
+	ErrExhausted                = errors.New("all options exhausted")     // No branch is left to pick
+	ErrDuplicateIdentifier      = errors.New("duplicate identifier")      // An identifier is defined twice (a *ParseError)
+	ErrUnterminatedGroup        = errors.New("unterminated [")            // A group isn't closed (a *ParseError)
+	ErrUnterminatedSubstitution = errors.New("unterminated substitution") // A { isn't closed (a *ParseError)
+)
@@ -0,0 +1,45 @@
+package grammar
+
+import (
+	"strings"
+)
+
+// Exclusive makes every substitution of ids exclusive, as if written {*id}, so the same grammar can serve features
+// with different uniqueness requirements without editing it, e.g. prizes that must not repeat:
+//
+//	tree.Generate("raffle", grammar.Exclusive("prize"), grammar.Shared("adjective"))
+//
+// It also applies when generating one of ids directly. Like {*id}, exclusive substitutions use up branches in the
+// session until it is reset.
+func Exclusive(ids ...string) GenerateOption {
+	return func(config *generateConfig) {
+		config.setExclusivity(ids, true)
+	}
+}
+
+// Shared makes every substitution of ids shared, even if written {*id} or if the groups of the definition are
+// exclusive ([* ...]), so their branches can repeat and aren't used up.
+func Shared(ids ...string) GenerateOption {
+	return func(config *generateConfig) {
+		config.setExclusivity(ids, false)
+	}
+}
+
+// setExclusivity records whether substitutions of ids are exclusive (see Exclusive and Shared).
+func (config *generateConfig) setExclusivity(ids []string, exclusive bool) {
+	if config.exclusivity == nil {
+		config.exclusivity = make(map[string]bool)
+	}
+
+	for _, id := range ids {
+		config.exclusivity[strings.TrimPrefix(id, "*")] = exclusive
+	}
+}
+
+// exclusivity returns whether substitutions of id (in any locale) are exclusive, and whether Exclusive or Shared said
+// so at all.
+func (g *generator) exclusivity(id string) (exclusive bool, set bool) {
+	id, _, _ = strings.Cut(id, "@")
+	exclusive, set = g.config.exclusivity[id]
+	return exclusive, set
+}
@@ -0,0 +1,215 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"iter"
+)
+
+// maxEnumerateExpand bounds the substitutions of each derivation made by Enumerate, unless MaxExpansions is given, so
+// that recursive definitions don't expand forever.
+const maxEnumerateExpand = 50
+
+// Enumerate returns every distinct phrase id can produce, e.g. to review the wording of a small grammar:
+//
+//	for phrase, err := range s.Enumerate("greeting") {
+//		if err != nil {
+//			return err
+//		}
+//
+//		fmt.Println(phrase)
+//	}
+//
+// The derivations are explored depth-first in the order of the grammar and phrases are yielded as they are found, so
+// the whole set is never held in memory; only a hash of each phrase is kept to skip duplicates.
+//
+// Derivations that make more than 50 substitutions (or as many as given by MaxExpansions) are skipped, which bounds
+// recursive definitions. Exploration also stops once 100,000 derivations in a row have produced nothing new, or when a
+// derivation fails with an error other than a *LimitError (e.g. an unknown identifier), which is yielded along with an
+// empty phrase as the last element. A phrase rejected by an option of the output, such as CheckBalance, is yielded as
+// an error in its place, and exploration goes on. Branches used up by exclusive substitutions of the session or
+// cooling down (see the cooldown directive) are enumerated all the same, without using them up or starting cooldowns.
+func (s *Session) Enumerate(id string, options ...GenerateOption) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		stopped := false
+
+		err := s.enumerate(id, options, func(phrase string, err error) bool {
+			stopped = !yield(phrase, err)
+			return !stopped
+		})
+
+		if err != nil && !stopped {
+			yield("", err)
+		}
+	}
+}
+
+// WriteAll writes the phrases of id, as returned by Enumerate, to w, one per line, up to limit phrases (0 is
+// unlimited). It returns the error that stopped the enumeration, if any, or the first phrase rejected.
+func (s *Session) WriteAll(w io.Writer, id string, limit int, options ...GenerateOption) error {
+	var writeErr error
+	written := 0
+
+	err := s.enumerate(id, options, func(phrase string, err error) bool {
+		if err != nil {
+			writeErr = err
+			return false
+		}
+
+		if _, writeErr = fmt.Fprintln(w, phrase); writeErr != nil {
+			return false
+		}
+
+		written++
+		return limit <= 0 || written < limit
+	})
+
+	if writeErr != nil {
+		return writeErr
+	}
+
+	return err
+}
+
+// GenerateDistinct generates n phrases for id that all differ, e.g. the answer options of a quiz. Phrases are
+// generated as by Generate, regenerating duplicates; if duplicates keep coming up, the rest are found by enumerating
+// the phrases of id (see Enumerate) instead. It returns an error if id can't produce n distinct phrases.
+func (s *Session) GenerateDistinct(id string, n int, options ...GenerateOption) ([]string, error) {
+	ret := make([]string, 0, n)
+	seen := make(map[string]bool)
+
+	for misses := 0; len(ret) < n && misses < maxRegenerate; {
+		out, err := s.Generate(id, options...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[out] {
+			misses++
+			continue
+		}
+
+		seen[out] = true
+		ret = append(ret, out)
+		misses = 0
+	}
+
+	if len(ret) < n {
+		var phraseErr error
+
+		err := s.enumerate(id, options, func(phrase string, err error) bool {
+			if err != nil {
+				phraseErr = err
+				return false
+			}
+
+			if !seen[phrase] {
+				seen[phrase] = true
+				ret = append(ret, phrase)
+			}
+
+			return len(ret) < n
+		})
+
+		if err == nil {
+			err = phraseErr
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ret) < n {
+		return nil, fmt.Errorf("%s can't produce %d distinct phrases: %w", id, n, ErrExhausted)
+	}
+
+	return ret, nil
+}
+
+// enumerate passes every distinct phrase of id to yield until it returns false (see Enumerate). A phrase rejected by
+// finish is passed as an error instead, once for every distinct error.
+func (s *Session) enumerate(id string, options []GenerateOption, yield func(string, error) bool) error {
+	g := s.newGenerator(options)
+	g.script = &choiceScript{ordered: true}
+
+	if err := g.checkEntry(id); err != nil {
+		return err
+	}
+
+	if g.config.maxExpand == 0 {
+		g.config.maxExpand = maxEnumerateExpand
+	}
+
+	// Every derivation starts from a fresh state, ignoring the branches used up and cooling down, and the session's own
+	// state is left as it was
+	saved, cooldowns := s.saveUsed(), s.cooldowns
+
+	defer func() {
+		s.restoreUsed(saved)
+		s.cooldowns = cooldowns
+	}()
+
+	seen := make(map[uint64]bool)
+
+	for stale := 0; stale < maxSearch; {
+		s.uniqueUsed = make(map[string]int)
+		s.cooldowns = make(map[string]int)
+		g.reset(id)
+		out, err := g.generate(id)
+		var limitErr *LimitError
+
+		switch {
+		case errors.As(err, &limitErr) || errors.Is(err, errConstraint):
+			// Too deep or failing a constraint; try the next derivation
+			stale++
+		case err != nil:
+			return err
+		default:
+			text, err := g.finish(out)
+			hash := fnv.New64a()
+
+			if err != nil {
+				// Rejected phrases are told apart from phrases by a leading zero byte
+				hash.Write([]byte("\x00" + err.Error()))
+			} else {
+				hash.Write([]byte(text))
+			}
+
+			if sum := hash.Sum64(); seen[sum] {
+				stale++
+			} else {
+				seen[sum] = true
+				stale = 0
+
+				if !yield(text, err) {
+					return nil
+				}
+			}
+		}
+
+		if !g.script.backtrack() {
+			break
+		}
+	}
+
+	return nil
+}
+
+// WriteAll writes every distinct phrase of id to w using the tree's default session. See Session.WriteAll.
+func (tree *Tree) WriteAll(w io.Writer, id string, limit int, options ...GenerateOption) error {
+	return tree.defaultSession().WriteAll(w, id, limit, options...)
+}
+
+// Enumerate returns every distinct phrase of id using the tree's default session. See Session.Enumerate.
+func (tree *Tree) Enumerate(id string, options ...GenerateOption) iter.Seq2[string, error] {
+	return tree.defaultSession().Enumerate(id, options...)
+}
+
+// GenerateDistinct generates n different phrases for id using the tree's default session. See Session.GenerateDistinct.
+func (tree *Tree) GenerateDistinct(id string, n int, options ...GenerateOption) ([]string, error) {
+	return tree.defaultSession().GenerateDistinct(id, n, options...)
+}
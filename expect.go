@@ -0,0 +1,114 @@
+package grammar
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// testSamples is the number of phrases generated for each definition by RunTests.
+const testSamples = 100
+
+// An expectation is a test given with //!expect, which every expansion of a definition must pass.
+type expectation struct {
+	text   string         // The expectation as written, e.g. "!/foo/"
+	exact  string         // The exact expansion required, if not a regular expression
+	re     *regexp.Regexp // A regular expression the expansion must match
+	negate bool           // The expansion must not match
+	source string         // Where the directive is
+}
+
+// parseExpectation parses the argument of //!expect: /regex/ or exact text, either optionally preceded by ! to negate
+// it.
+func parseExpectation(text string, source string) (expectation, error) {
+	e := expectation{text: text, source: source}
+
+	if strings.HasPrefix(text, "!") {
+		e.negate = true
+		text = strings.TrimSpace(text[1:])
+	}
+
+	if len(text) >= 2 && text[0] == '/' && text[len(text)-1] == '/' {
+		re, err := regexp.Compile(text[1 : len(text)-1])
+
+		if err != nil {
+			return e, newParseError(source, 0, text, "invalid expectation: %s", err)
+		}
+
+		e.re = re
+	} else if text == "" {
+		return e, newParseError(source, 0, "", "directive expect needs an expectation")
+	} else {
+		e.exact = text
+	}
+
+	return e, nil
+}
+
+// passes reports whether out meets the expectation.
+func (e *expectation) passes(out string) bool {
+	var match bool
+
+	if e.re != nil {
+		match = e.re.MatchString(out)
+	} else {
+		match = out == e.exact
+	}
+
+	return match != e.negate
+}
+
+// A TestFailure is a phrase which failed an expectation given with //!expect, as returned by RunTests.
+type TestFailure struct {
+	ID          string // The definition
+	Expectation string // The expectation, as written
+	Source      string // Where the expectation is
+	Output      string // The phrase which failed it; empty if generation failed
+	Err         error  // Why generation failed, if it did
+}
+
+func (f *TestFailure) Error() string {
+	if f.Err != nil {
+		return fmt.Sprintf("%s: %s failed (%s)", f.Source, f.ID, f.Err)
+	}
+
+	return fmt.Sprintf("%s: %s gave \"%s\", expected %s", f.Source, f.ID, f.Output, f.Expectation)
+}
+
+// RunTests runs the tests that grammar authors put in their grammars with //!expect directives, and returns the
+// failures. Every definition with expectations is generated a number of times (in a fresh session each time, so the
+// tree is left untouched) and each phrase is checked against all of its expectations. At most one failure is returned
+// per expectation.
+func (tree *Tree) RunTests(options ...GenerateOption) []*TestFailure {
+	var ret []*TestFailure
+
+	for i := range tree.root.child {
+		def := &tree.root.child[i]
+		failed := make([]bool, len(def.directives.expect))
+
+		if len(def.directives.expect) == 0 {
+			continue
+		}
+
+		for n := 0; n < testSamples; n++ {
+			s := tree.NewSession()
+			result, err := s.newGenerator(options).run(def.Text)
+
+			if err != nil {
+				e := def.directives.expect[0]
+				ret = append(ret, &TestFailure{ID: def.Text, Expectation: e.text, Source: e.source, Err: err})
+				break
+			}
+
+			for j, e := range def.directives.expect {
+				if !failed[j] && !e.passes(result.Text) {
+					failed[j] = true
+					ret = append(ret, &TestFailure{ID: def.Text, Expectation: e.text, Source: e.source,
+						Output: result.Text})
+				}
+			}
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,104 @@
+package grammar
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// maxTraces is the number of recent generations a session remembers for Reinforce.
+const maxTraces = 1000
+
+// maxFactor limits how far Reinforce can adjust a weight, in either direction, so weights stay finite and non-zero.
+const maxFactor = 1e6
+
+// traceLog remembers the branches picked by recent generations, so feedback can be given on them later.
+type traceLog struct {
+	branches map[string][]string // Branch keys picked, by trace ID
+	order    []string            // Trace IDs, oldest first
+}
+
+// add remembers the branches picked by a generation and returns its trace ID. The oldest trace is forgotten if there
+// are too many.
+func (log *traceLog) add(generation int, branches []string) string {
+	id := strconv.Itoa(generation)
+
+	if log.branches == nil {
+		log.branches = make(map[string][]string)
+	}
+
+	log.branches[id] = branches
+	log.order = append(log.order, id)
+
+	if len(log.order) > maxTraces {
+		delete(log.branches, log.order[0])
+		log.order = log.order[1:]
+	}
+
+	return id
+}
+
+// cloneTraces returns a deep copy of the branches of a traceLog, or nil if there are none.
+func cloneTraces(branches map[string][]string) map[string][]string {
+	if len(branches) == 0 {
+		return nil
+	}
+
+	ret := make(map[string][]string, len(branches))
+
+	for id, keys := range branches {
+		ret[id] = slices.Clone(keys)
+	}
+
+	return ret
+}
+
+// Reinforce adjusts the weights of the branches picked by an earlier generation, identified by the TraceID of its
+// Result, so a bot can learn to favor the kind of phrases people react well to. A positive delta makes the branches
+// more likely to be picked again, a negative delta less likely.
+//
+// The weight of each branch is multiplied by e^delta, so adjustments accumulate smoothly and a weight never reaches
+// zero: a delta of 0.1 makes a branch about 10% more likely, and -0.1 about 10% less. The accumulated factor is kept
+// within a million times either way. Adjustments apply on top of the weights of the tree (see LoadWeights) and only
+// to this session.
+//
+// Only the most recent 1000 generations of the session can be reinforced.
+func (s *Session) Reinforce(traceID string, delta float64) error {
+	branches, found := s.traces.branches[traceID]
+
+	if !found {
+		return fmt.Errorf("no such trace: %s", traceID)
+	}
+
+	if math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return fmt.Errorf("invalid delta %v", delta)
+	}
+
+	if s.weights == nil {
+		s.weights = make(map[string]float64)
+	}
+
+	for _, key := range branches {
+		factor, found := s.weights[key]
+
+		if !found {
+			factor = 1
+		}
+
+		s.weights[key] = math.Max(1/maxFactor, math.Min(maxFactor, factor*math.Exp(delta)))
+	}
+
+	return nil
+}
+
+// Weights returns the adjustments made by Reinforce, as factors by branch key.
+func (s *Session) Weights() map[string]float64 {
+	ret := make(map[string]float64, len(s.weights))
+
+	for k, v := range s.weights {
+		ret[k] = v
+	}
+
+	return ret
+}
@@ -0,0 +1,297 @@
+package grammar
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ParseDir reads and parses all files in a directory and returns a syntax tree. If recursive is set, subdirectories
+// are included as well. If any extensions are given (e.g. ".g"), only files ending with one of them are read.
+//
+// Files are read in lexical order, so the last definition of the last file becomes the default identifier.
+func ParseDir(dir string, recursive bool, extensions ...string) (*Tree, error) {
+	files, err := listDir(dir, recursive, extensions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no grammar files in %s", dir)
+	}
+
+	return parseFiles(files, parseConfig{})
+}
+
+// expandPaths resolves a list of file names, directories and glob patterns into a list of files.
+//
+// Plain file names are passed through untouched (even if they don't exist; reading them will fail later). Directories
+// are expanded to the files directly inside them. Glob patterns are expanded with filepath.Match syntax, with the
+// addition of ** which matches any number of directories. Each directory or pattern is sorted individually, but the
+// overall order of the arguments is kept.
+func expandPaths(paths []string) ([]string, error) {
+	var ret []string
+
+	for _, p := range paths {
+		if isGlob(p) {
+			matches, err := glob(p)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files matching %s", p)
+			}
+
+			ret = append(ret, matches...)
+			continue
+		}
+
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			files, err := listDir(p, false, nil)
+
+			if err != nil {
+				return nil, err
+			}
+
+			ret = append(ret, files...)
+			continue
+		}
+
+		ret = append(ret, p)
+	}
+
+	return ret, nil
+}
+
+// isGlob reports whether path contains any glob meta characters.
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// listDir returns the (sorted) regular files in dir, optionally descending into subdirectories and filtering by
+// extension.
+func listDir(dir string, recursive bool, extensions []string) ([]string, error) {
+	var ret []string
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if d.Type().IsRegular() && hasExtension(path, extensions) {
+			ret = append(ret, path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// hasExtension reports whether path ends with any of extensions. An empty list matches everything.
+func hasExtension(path string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+
+	for _, ext := range extensions {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// glob expands a glob pattern into a sorted list of regular files. Unlike filepath.Glob it understands **, which
+// matches zero or more directories.
+func glob(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pattern)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return onlyFiles(matches), nil
+	}
+
+	// Split the pattern into a static base directory (which we can walk) and the remaining pattern parts.
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+	base := []string{}
+
+	for len(parts) > 0 && !isGlob(parts[0]) {
+		base = append(base, parts[0])
+		parts = parts[1:]
+	}
+
+	root := filepath.FromSlash(strings.Join(base, "/"))
+
+	if root == "" {
+		root = "."
+	} else if len(base) == 1 && base[0] == "" {
+		root = "/"
+	}
+
+	var ret []string
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+
+		if err != nil {
+			return err
+		}
+
+		if matchParts(parts, strings.Split(filepath.ToSlash(rel), "/")) {
+			ret = append(ret, path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// matchParts matches a path split into parts against a pattern split into parts. ** matches any number of parts.
+func matchParts(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// onlyFiles filters a list of paths, keeping only regular files.
+func onlyFiles(paths []string) []string {
+	var ret []string
+
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			ret = append(ret, p)
+		}
+	}
+
+	return ret
+}
+
+// A DuplicateFileError is returned when two different grammar files have the same contents, which is usually a copy
+// left behind by mistake. Files holding only whitespace and comments are never considered copies.
+type DuplicateFileError struct {
+	First  string // The file read first
+	Second string // The copy of it read later
+}
+
+func (err *DuplicateFileError) Error() string {
+	return fmt.Sprintf("%s has the same contents as %s", err.Second, err.First)
+}
+
+// A fileSet keeps track of the files read, to skip files read before and detect copies.
+type fileSet struct {
+	infos    []os.FileInfo
+	contents map[[sha256.Size]byte]string
+}
+
+// seen reports whether filename is a file read before, possibly under another name, and if not adds it.
+func (files *fileSet) seen(filename string) bool {
+	info, err := os.Stat(filename)
+
+	if err != nil {
+		// Reading it will fail with a better error
+		return false
+	}
+
+	for _, other := range files.infos {
+		if os.SameFile(info, other) {
+			return true
+		}
+	}
+
+	files.infos = append(files.infos, info)
+	return false
+}
+
+// checkContents returns a *DuplicateFileError if another file read before has the same contents as filename. Stubs
+// are exempt, since empty placeholders are commonly identical.
+func (files *fileSet) checkContents(filename string, contents []byte) error {
+	if isStub(contents) {
+		return nil
+	}
+
+	if files.contents == nil {
+		files.contents = make(map[[sha256.Size]byte]string)
+	}
+
+	sum := sha256.Sum256(contents)
+
+	if other, found := files.contents[sum]; found {
+		return &DuplicateFileError{First: other, Second: filename}
+	}
+
+	files.contents[sum] = filename
+	return nil
+}
+
+// isStub reports whether contents consist of nothing but whitespace and plain comments. Directives count as content.
+func isStub(contents []byte) bool {
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line != "" && (!strings.HasPrefix(line, "//") || strings.HasPrefix(line, "//!")) {
+			return false
+		}
+	}
+
+	return true
+}
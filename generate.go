@@ -3,56 +3,424 @@ package grammar
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"math/rand/v2"
+	"regexp"
 	"strings"
 )
 
-// Generates a random phrase for id based on a syntax tree.
+// A GenerateOption alters the behaviour of a single call to Generate.
+type GenerateOption func(*generateConfig)
+
+type generateConfig struct {
+	maxLength     int                 // Maximum output length in bytes; 0 is unlimited
+	maxExpand     int                 // Maximum number of substitutions; 0 is unlimited
+	maxDepth      int                 // Maximum nesting depth of substitutions; 0 is unlimited
+	source        rand.Source         // Random source for this call only; nil uses the default
+	seed          *uint64             // Seed of a new random source for each call; nil uses source (see Seed)
+	once          bool                // Leave substitutions and control tokens unexpanded (see ExpandOnce)
+	pinned        map[string]string   // Fixed results for some identifiers (see Pin)
+	resolvers     map[string]Resolver // Functions computing the results of some identifiers (see Resolve)
+	required      map[string][]string // Text that must be present in the expansions of some identifiers (see Require)
+	wrap          int                 // Column to wrap the output at; 0 doesn't wrap
+	trim          bool                // Remove leading and trailing whitespace from the output
+	newline       bool                // End the output with a newline
+	newlines      int                 // Maximum number of consecutive newlines; 0 is unlimited
+	forced        map[*node]int       // Branches that must be picked for some groups (see SmokeTest and ForceBranch)
+	forceKeys     []string            // Keys of branches to add to forced (see ForceBranch)
+	forbidKeys    []string            // Keys of branches to add to forbidden (see ForbidBranch)
+	forbidden     map[string]bool     // Keys of branches that mustn't be picked (see ForbidBranch)
+	locales       []string            // Preferred locales, most preferred first (see Locale)
+	morphology    Morphology          // Inflects substitutions with modifiers; nil is English (see UseMorphology)
+	blanks        map[string]bool     // Identifiers left as blanks (see Blanks)
+	ssml          bool                // Render the output as SSML (see SSML)
+	decisions     bool                // Record the decision tree (see RecordDecisions)
+	noRepeats     bool                // Don't pick the same branch of a group twice in a row (see NoRepeats)
+	typography    bool                // Use typographic quotes, dashes and ellipses (see Typography)
+	blockWords    map[string]bool     // Words the output must not contain, in lower case (see BlockWords)
+	synonyms      map[string][]string // Synonyms to replace words with, by word in lower case (see Synonyms)
+	synonymRate   float64             // Probability of replacing a word with a synonym
+	tierOdds      map[string]float64  // Odds of rarity tiers, overriding the defaults (see TierOdds)
+	minTier       int                 // Rank of the least rare tier that can be picked (see MinTier)
+	phonetics     Phonetics           // Decides what rhymes and alliterates; nil is EnglishSpelling (see UsePhonetics)
+	blockPatterns []*regexp.Regexp    // Patterns the output must not match (see BlockPatterns)
+	joiner        string              // Separates the repetitions of a loop; "" is a space (see SessionConfig)
+	caseMode      Case                // Case of the output (see SessionConfig)
+	anyWeights    map[string]float64  // Weights of the identifiers GenerateAny picks from (see AnyWeights)
+	exclusivity   map[string]bool     // Whether substitutions of some identifiers are exclusive (see Exclusive and Shared)
+	lenient       bool                // Render substitutions of undefined identifiers as placeholders (see Lenient)
+	balance       int                 // How unbalanced delimiters are dealt with (see CheckBalance and CloseDelimiters)
+	tokens        *[]Token            // Where to leave the tokens of the output; nil doesn't split it (see GenerateTokens)
+	variables     map[string]string   // Variables captured before the phrase starts, e.g. by GenerateMap
+}
+
+// MaxLength limits the length (in bytes) of the generated phrase. Generation is aborted with a *LimitError as soon as
+// the limit is exceeded, rather than after the whole phrase has been composed.
+func MaxLength(n int) GenerateOption {
+	return func(config *generateConfig) {
+		config.maxLength = n
+	}
+}
+
+// MaxExpansions limits the total number of substitutions made while generating a phrase, however deeply they are
+// nested. Generation is aborted with a *LimitError when the budget runs out. This keeps grammars which expand
+// combinatorially (e.g. definitions that refer to each other several times over) from running away, even if no
+// single chain of substitutions is deep.
+func MaxExpansions(n int) GenerateOption {
+	return func(config *generateConfig) {
+		config.maxExpand = n
+	}
+}
+
+// MaxDepth limits how deeply substitutions may be nested, e.g. in recursive definitions such as
+// list [ {item} | {item}, {list} ]. Generation is aborted with a *LimitError when a substitution would be nested more
+// than n deep; the error names the chain of substitutions that led there.
+func MaxDepth(n int) GenerateOption {
+	return func(config *generateConfig) {
+		config.maxDepth = n
+	}
+}
+
+// NoRepeats prevents the same branch of a group from being picked twice in a row within one phrase, so {word} {word}
+// never gives "blue blue". This usually reads better than truly independent choices. A branch is only repeated if the
+// group has nothing else to pick.
+func NoRepeats() GenerateOption {
+	return func(config *generateConfig) {
+		config.noRepeats = true
+	}
+}
+
+// Pin fixes the result of id for a single call, e.g. Pin("weekday", "Friday") makes every {weekday} (or {*weekday})
+// substitution result in "Friday", while the rest of the grammar is randomized as usual. Use several Pin options to
+// pin several identifiers.
+func Pin(id string, value string) GenerateOption {
+	return func(config *generateConfig) {
+		if config.pinned == nil {
+			config.pinned = make(map[string]string)
+		}
+
+		config.pinned[id] = value
+	}
+}
+
+// A LimitError is returned when generation or parsing exceeds one of the configured limits.
+type LimitError struct {
+	Limit string   // Name of the limit, e.g. "output length"
+	Max   int      // The configured maximum
+	Chain []string // The substitutions nested too deep, outermost first (substitution depth only)
+}
+
+func (err *LimitError) Error() string {
+	if len(err.Chain) > 0 {
+		return fmt.Sprintf("%s limit (%d) exceeded: %s", err.Limit, err.Max, strings.Join(err.Chain, " > "))
+	}
+
+	return fmt.Sprintf("%s limit (%d) exceeded", err.Limit, err.Max)
+}
+
+// A SubstitutionError is returned when a {substitution} fails to generate, pointing out where it is written. Errors
+// of nested substitutions aren't wrapped again, so the source is that of the innermost substitution that failed,
+// where the problem is.
+type SubstitutionError struct {
+	Source string // Where the substitution is written, e.g. "quests.g:12"
+	ID     string // The substitution as written, without braces, e.g. "villain" or "n=1-20"
+	Err    error  // What went wrong
+}
+
+func (err *SubstitutionError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", err.Source, err.Err, err.ID)
+}
+
+func (err *SubstitutionError) Unwrap() error {
+	return err.Err
+}
+
+// locate returns err as a *SubstitutionError of the substitution tag at source, unless it already is one.
+func locate(err error, source string, tag string) error {
+	var located *SubstitutionError
+
+	if errors.As(err, &located) {
+		return err
+	}
+
+	return &SubstitutionError{Source: source, ID: tag, Err: err}
+}
+
+// A generator holds the state of a single call to Generate, including nested substitutions.
+type generator struct {
+	tree    *Tree
+	session *Session
+	config  generateConfig
+	def     *node         // The definition currently being expanded
+	script  *choiceScript // Makes choices systematically when searching for a derivation
+	index   *indexDecoder // Makes choices from a phrase index (see GenerateIndex)
+	result  Result        // Details of the phrase being generated
+	depth   int           // Nesting depth of substitutions
+	chain   []string      // The substitutions being generated, outermost first
+	last    map[*node]int // The branch last picked from each group
+
+	expansions int               // Number of substitutions made so far
+	decision   *Decision         // The decision being recorded, if recording (see RecordDecisions)
+	variables  map[string]string // Captured values, e.g. {n=1-20}
+	articles   []*pendingArticle // Article tokens, e.g. {der/die/das} (see article)
+	expanded   []string          // Identifiers of the definitions expanded, in order (see TrackUsage)
+}
+
+// random returns a random number between low and high (inclusive). When searching for a derivation (see Require), the
+// choice is made by the search script instead.
+func (g *generator) random(low int, high int) int {
+	if g.script != nil {
+		return low + g.script.next(high-low+1, g.draw)
+	}
+
+	if g.index != nil {
+		return low + g.index.next(high-low+1)
+	}
+
+	return low + g.draw(high-low+1)
+}
+
+// draw returns a random number in [0, n). A random source given for the current call takes precedence, followed by
+// the stream of the identifier being expanded (see SeedStream), and then the random source of the session (see Seed and
+// SetRand).
+func (g *generator) draw(n int) int {
+	if g.config.source != nil {
+		return random(g.config.source, 0, n-1)
+	}
+
+	if g.def != nil {
+		if stream, found := g.session.streams[g.def.Text]; found {
+			return random(stream, 0, n-1)
+		}
+	}
+
+	if g.session.rand != nil {
+		return random(g.session.rand, 0, n-1)
+	}
+
+	return random(g.session.source, 0, n-1)
+}
+
+// RandSource makes a call draw all of its random choices from src, e.g. CryptoSource or a seeded rand.PCG.
+func RandSource(src rand.Source) GenerateOption {
+	return func(config *generateConfig) {
+		config.source, config.seed = src, nil
+	}
+}
+
+// Generates a random phrase for id based on a syntax tree, using the tree's default session.
 // If id is empty the last identifier in the tree is used.
-func (tree *Tree) Generate(id string) (string, error) {
+//
+// Accepts any number of [GenerateOption] to alter the output.
+func (tree *Tree) Generate(id string, options ...GenerateOption) (string, error) {
+	return tree.defaultSession().Generate(id, options...)
+}
+
+// Generate generates a random phrase for id, like Tree.Generate but with the state of this session.
+func (s *Session) Generate(id string, options ...GenerateOption) (string, error) {
+	result, err := s.GenerateResult(id, options...)
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.Text, nil
+}
+
+// GenerateMany generates count phrases for id using the tree's default session. See Session.GenerateMany.
+func (tree *Tree) GenerateMany(id string, count int, options ...GenerateOption) ([]string, error) {
+	return tree.defaultSession().GenerateMany(id, count, options...)
+}
+
+// GenerateMany generates count phrases for id, as if by calling Generate count times, so exclusive substitutions
+// ({*id}) don't repeat across the batch. If a call fails, e.g. because the exclusive branches run out, it returns the
+// phrases generated so far along with the error. A negative count is an error.
+func (s *Session) GenerateMany(id string, count int, options ...GenerateOption) ([]string, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("negative count %d", count)
+	}
+
+	// A large count mustn't allocate up front, as the phrases may well run out first
+	ret := make([]string, 0, min(count, 1024))
+
+	for i := 0; i < count; i++ {
+		out, err := s.Generate(id, options...)
+
+		if err != nil {
+			return ret, err
+		}
+
+		ret = append(ret, out)
+	}
+
+	return ret, nil
+}
+
+// newGenerator returns a generator for a single call in this session.
+func (s *Session) newGenerator(options []GenerateOption) *generator {
+	g := generator{tree: s.tree, session: s}
+
+	for _, option := range options {
+		option(&g.config)
+	}
+
+	g.config.applySeed()
+	s.applyConfig(&g.config)
+	return &g
+}
+
+// run generates id, searching for a derivation if there are any constraints, and finishes the output.
+func (g *generator) run(id string) (*Result, error) {
+	var out string
+	var err error
+
+	if err := g.pinBranches(); err != nil {
+		return nil, err
+	}
+
+	g.reset(id)
+
+	if len(g.config.required) > 0 {
+		out, err = g.search(id)
+	} else {
+		out, err = g.generate(id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := g.result
+
+	if result.Text, err = g.finish(out); err != nil {
+		return nil, err
+	}
+
+	if result.Decisions != nil {
+		result.Decisions.Text = result.Text
+	}
+	return &result, nil
+}
+
+// reset prepares the generator for an attempt at generating id, discarding the details of any previous attempt.
+func (g *generator) reset(id string) {
+	g.result = Result{}
+	g.last = make(map[*node]int)
+	g.expansions = 0
+	g.decision = nil
+	g.variables = maps.Clone(g.config.variables)
+	g.articles = nil
+	g.expanded = g.expanded[:0]
+
+	if g.config.decisions {
+		g.result.Decisions = &Decision{Kind: "definition", ID: id}
+		g.decision = g.result.Decisions
+	}
+}
+
+// GenerateFor generates a phrase for id with every random choice derived from a hash of key, so the same key always
+// maps to the same phrase (e.g. a stable codename for each user ID). The phrase will only change if the grammar does.
+//
+// Note that exclusive substitutions still depend on which branches have been used before.
+func (tree *Tree) GenerateFor(id string, key string, options ...GenerateOption) (string, error) {
+	return tree.defaultSession().GenerateFor(id, key, options...)
+}
+
+// GenerateFor generates a phrase for id with every random choice derived from key, like Tree.GenerateFor.
+func (s *Session) GenerateFor(id string, key string, options ...GenerateOption) (string, error) {
+	return s.Generate(id, append(options, RandSource(newSource(hashString(key))))...)
+}
+
+// ExpandOnce expands a single level of id: groups are resolved to one of their branches, but {substitutions} are left
+// unresolved in the returned string, as are << and ^. The result is an intermediate form which tools can show as-is
+// or expand further in stages of their own.
+func (tree *Tree) ExpandOnce(id string, options ...GenerateOption) (string, error) {
+	return tree.defaultSession().ExpandOnce(id, options...)
+}
+
+// ExpandOnce expands a single level of id, like Tree.ExpandOnce.
+func (s *Session) ExpandOnce(id string, options ...GenerateOption) (string, error) {
+	return s.Generate(id, append(options, func(config *generateConfig) {
+		config.once = true
+	})...)
+}
+
+// generate looks up id and composes a phrase from it. This is also used for nested substitutions.
+func (g *generator) generate(id string) (string, error) {
+	tree := g.tree
 
 	var node *node = nil
+	var def = node // The top-level (tag) node of the definition
 	unique := false
 
 	// Find base node for identifier
 	if len(tree.root.child) == 0 {
-		return "", errors.New("empty tree")
+		return "", ErrEmptyTree
 	}
 
 	if id == "" {
 		// Empty string selects the last identifier
 		node = &tree.root.child[len(tree.root.child)-1]
+		def = node
+		id = node.Text
 	} else {
 		if id[0] == '*' {
 			id = id[1:]
 			unique = true
 		}
 
-		for i, n := range tree.root.child {
-			if n.Text == id {
-				node = &tree.root.child[i]
-			}
+		if value, found := g.config.pinned[id]; found {
+			return value, nil
 		}
 
+		if resolver, found := g.config.resolvers[id]; found {
+			return g.resolve(id, resolver)
+		}
+
+		node = g.findDefinition(id)
+
 		if node == nil {
-			return "", fmt.Errorf("no such definition: %s", id)
+			return "", fmt.Errorf("%w: %s", ErrUnknownIdentifier, id)
 		}
 
 		if len(node.child) == 0 {
 			return "", fmt.Errorf("root identifier %s lacks children", id)
 		}
 
+		def = node
 		node = &node.child[0]
 	}
 
+	if exclusive, set := g.exclusivity(def.Text); set {
+		unique = exclusive
+	}
+
+	g.expanded = append(g.expanded, def.Text)
+
+	// Draw from the stream (and pool) of this definition until we're done with it
+	previous := g.def
+	g.def = def
+	defer func() { g.def = previous }()
+
 	// Found a starting node, compose a phrase from it
-	part, err := tree.compose(node, unique)
+	part, err := g.compose(node, unique)
 
 	if err != nil {
 		return "", err
 	}
 
+	if g.config.once {
+		return part, nil
+	}
+
 	// The phrase is done, do some post-processing
 
+	// Articles agree with the nouns after them, which have been generated by now if they are part of this phrase
+	part = g.resolveArticles(part, false)
+
+	// A dash between < and > joins the words around it, like << on both sides
+	part = joinedDashes.Replace(part)
+
 	// Remove spaces before and after newlines and control tokes
 	part = strings.ReplaceAll(part, " << ", "")
 	part = strings.ReplaceAll(part, " <<", "")
@@ -61,6 +429,9 @@ func (tree *Tree) Generate(id string) (string, error) {
 	part = strings.ReplaceAll(part, " \n", "\n")
 	part = strings.ReplaceAll(part, "\n ", "\n")
 
+	// ^^ and ~~ change the case of the whole following word
+	part = changeWordCase(part)
+
 	// ^ capitalize the following letter, so they need to be flush
 	part = strings.ReplaceAll(part, "^ ", "^")
 
@@ -73,42 +444,63 @@ func (tree *Tree) Generate(id string) (string, error) {
 		}
 	}
 
+	if err := g.checkRequired(id, part); err != nil {
+		return "", err
+	}
+
 	return part, nil
 }
 
 // compose builds a phrase starting from node, concatenating words
 // from its children, choosing randomly among branches.
 //
-// If unique is true (and node is a group), picks a branch that hasn't been used before.
-func (tree *Tree) compose(node *node, unique bool) (string, error) {
-
+// If unique is true (and node is a group), picks a branch that hasn't been used before. Exclusive groups always do.
+func (g *generator) compose(node *node, unique bool) (string, error) {
 	if node.internalType == group {
+		if exclusive, set := g.exclusivity(g.def.Text); node.exclusive && (!set || exclusive) {
+			unique = true
+		}
+
 		// Randomly pick one of the branches in the group
-		opts := len(node.child)
-		pick := random(0, opts-1)
+		weights := g.branchWeights(node)
 
-		for i := 0; i < opts; i++ {
-			p := &node.child[(pick+i)%opts]
+		if g.index != nil {
+			weights = nil
+		}
 
-			// With unique flag, keep retrying until we get something we haven't used before.
-			if unique {
-				if _, found := tree.uniqueUsed[p]; found {
-					goto next
-				}
+		if unique && g.def != nil && g.def.directives.stock {
+			weights = g.remainingStock(node, weights)
+		}
 
-				// This branch hasn't been used before, so it's ok.
-				// Only make it as exhausted it if we are actually requesting a unique substitution!
-				tree.uniqueUsed[p] = true
+		// A forced branch is picked even if it is weighted to zero or cooling down, but not if it is used up
+		if forced, isForced := g.config.forced[node]; isForced {
+			if !g.isEligible(node, nil, unique, false, forced) {
+				return "", ErrExhausted
 			}
 
-			// Fall through by default
-			return tree.compose(p, false)
+			return g.pickBranch(node, g.choose(node, weights), unique, weights)
+		}
+
+		// Branches that are cooling down or were just picked are left out, unless there is nothing else to pick
+		for avoid := g.def.directives.cooldown > 0 || g.config.noRepeats; ; avoid = false {
+			if eligible, found := g.eligible(node, weights, unique, avoid); found {
+				pick := g.choose(node, eligible)
+
+				// A search or phrase index may pick a branch that is left out; take the next one instead
+				for !g.isEligible(node, eligible, unique, avoid, pick) {
+					pick = (pick + 1) % len(node.child)
+				}
 
-		next:
+				return g.pickBranch(node, pick, unique, weights)
+			}
+
+			if !avoid {
+				break
+			}
 		}
 
 		// There were no unused branches remaining
-		return "", errors.New("all options exhausted")
+		return "", ErrExhausted
 	}
 
 	collect := []string{}
@@ -116,18 +508,26 @@ func (tree *Tree) compose(node *node, unique bool) (string, error) {
 	// Only "text" nodes have their text included in the composition.
 	// tag, dummy and group (already handled) don't add any text of their own.
 
-	if node.internalType == text {
-		part, err := tree.inflate(node.Text, unique)
+	if node.internalType == text && g.config.once {
+		collect = append(collect, node.Text)
+	} else if node.internalType == text {
+		part, err := g.inflate(node.Text, node.Source, unique)
+		var located *SubstitutionError
 
-		if err != nil {
-			return "", fmt.Errorf("from %s: %s", node.Source, err)
+		if err != nil && !errors.As(err, &located) {
+			return "", fmt.Errorf("from %s: %w", node.Source, err)
+		} else if err != nil {
+			return "", err
 		}
 
-		collect = append(collect, part)
+		// Text which vanished entirely (e.g. metadata) shouldn't leave a gap
+		if part != "" || len(node.child) == 0 {
+			collect = append(collect, part)
+		}
 	}
 
 	for i := range node.child {
-		part, err := tree.compose(&node.child[i], false)
+		part, err := g.compose(&node.child[i], false)
 
 		if err != nil {
 			return "", err
@@ -136,37 +536,233 @@ func (tree *Tree) compose(node *node, unique bool) (string, error) {
 		collect = append(collect, part)
 	}
 
-	ret := strings.Join(collect, " ")
+	// ^^ or ~~ right before a group changes the case of everything the group produced
+	if node.internalType == text && len(collect) > 1 && node.child[0].internalType == group {
+		if before, change, found := cutCaseMarkers(collect[0]); found {
+			collect[1] = change(collect[1])
+			collect[0] = strings.TrimRight(before, " ")
 
-	// Try to "dwim" by cleaning up spaces around punctuation
-	substitutions := map[string]string{
-		" )":  ")",
-		"( ":  "(",
-		" ,":  ",",
-		" .":  ".",
-		" ?":  "?",
-		" !":  "!",
-		" :":  ":",
-		" ;":  ";",
-		" _ ": " ",
-		" _":  "",
-		"_ ":  "",
+			if collect[0] == "" {
+				collect = collect[1:]
+			}
+		}
 	}
 
-	for from, to := range substitutions {
-		ret = strings.ReplaceAll(ret, from, to)
+	ret := tidySpaces(strings.Join(collect, " "))
+
+	if err := g.checkLength(ret); err != nil {
+		return "", err
 	}
 
 	return ret, nil
 }
 
-// inflate expands the string s, substituting aliases from a syntax tree, evaluating numerical expressions, etc.
-func (tree *Tree) inflate(s string, unique bool) (string, error) {
+// spacing maps the spacing around punctuation and empty tokens (_) in a composed phrase to how it should be.
+var spacing = map[string]string{
+	" )":  ")",
+	"( ":  "(",
+	" ,":  ",",
+	" .":  ".",
+	" ?":  "?",
+	" !":  "!",
+	" :":  ":",
+	" ;":  ";",
+	" _ ": " ",
+	" _":  "",
+	"_ ":  "",
+}
+
+// joinedDashes maps the dash tokens (<->, <–> and <—>) to the dash between force concatenation tokens.
+var joinedDashes = strings.NewReplacer("<->", "<<-<<", "<–>", "<<–<<", "<—>", "<<—<<")
+
+// numberRange matches an en dash between numbers, e.g. "1 – 5".
+var numberRange = regexp.MustCompile(`(\d) – (\d)`)
+
+// clitic matches an apostrophe starting a clitic or possessive after a space, e.g. "Bob 's".
+var clitic = regexp.MustCompile(` (['’](?:s|d|ll|re|ve|m)\b)`)
+
+// tidySpaces tries to "dwim" by cleaning up spaces around punctuation, as given by spacing. An en dash between
+// numbers is tightened as a range, and an apostrophe starting a clitic ('s, 'll, 're...) is joined to the word before.
+func tidySpaces(s string) string {
+	for from, to := range spacing {
+		s = strings.ReplaceAll(s, from, to)
+	}
+
+	// A number can end one range and start the next, as in "1 – 2 – 3", so matches may overlap
+	for ranged := numberRange.ReplaceAllString(s, "$1–$2"); ranged != s; {
+		s, ranged = ranged, numberRange.ReplaceAllString(ranged, "$1–$2")
+	}
+
+	return clitic.ReplaceAllString(s, "$1")
+}
+
+// eligible returns the weights to pick a branch of group with, leaving out the branches that can't be picked: those
+// weighted to zero, used up by exclusive substitutions (if unique) and, if avoid, those cooling down or just picked.
+// Picking among these alone, rather than skipping past a branch that can't be picked, keeps the odds of the others in
+// proportion. The weights are returned unchanged if no branch is left out. found is false if none can be picked.
+func (g *generator) eligible(group *node, weights []float64, unique bool, avoid bool) (eligible []float64, found bool) {
+	for i := range group.child {
+		if g.isEligible(group, weights, unique, avoid, i) {
+			found = true
+			continue
+		}
+
+		if eligible == nil {
+			eligible = make([]float64, len(group.child))
+
+			for j := range eligible {
+				eligible[j] = 1
+
+				if weights != nil {
+					eligible[j] = weights[j]
+				}
+			}
+		}
+
+		eligible[i] = 0
+	}
+
+	if eligible == nil {
+		return weights, found
+	}
+
+	return eligible, found
+}
+
+// isEligible reports whether branch i of group can be picked (see eligible).
+func (g *generator) isEligible(group *node, weights []float64, unique bool, avoid bool, i int) bool {
+	if weights != nil && weights[i] == 0 {
+		return false
+	}
+
+	if len(g.config.forbidden) > 0 && g.config.forbidden[branchKey(g.def, group, i)] {
+		return false
+	}
+
+	if avoid && (g.coolingDown(group, i) || g.repeats(group, i)) {
+		return false
+	}
+
+	return !unique || !g.used(group, i)
+}
+
+// pickBranch composes branch i of group, using it up if unique.
+func (g *generator) pickBranch(group *node, i int, unique bool, weights []float64) (string, error) {
+	// Only mark it as exhausted if we are actually requesting a unique substitution!
+	if unique && g.def != nil && g.def.directives.stock {
+		g.consume(group, i, weights)
+	} else if unique {
+		g.markUsed(group, i)
+	}
+
+	g.startCooldown(group, i)
+	g.last[group] = i
+	g.result.Branches = append(g.result.Branches, branchKey(g.def, group, i))
+
+	return g.composeBranch(group, i)
+}
+
+// composeBranch composes branch i of group, which has been picked.
+func (g *generator) composeBranch(group *node, i int) (string, error) {
+	done := g.decideGroup(group, i)
+	out, err := g.compose(&group.child[i], false)
+	done(out)
+
+	if g.index != nil {
+		g.index.leave()
+	}
+
+	return out, err
+}
+
+// used reports whether branch i of group has been used exclusively, either directly or (if group is the top-level
+// group of a definition in a pool) through a matching branch of another definition in the same pool.
+func (g *generator) used(group *node, i int) bool {
+	if g.session.uniqueUsed[branchKey(g.def, group, i)] > 0 {
+		return true
+	}
+
+	if pool := g.pool(group); pool != "" {
+		return g.session.uniqueUsed[poolKey(pool, &group.child[i])] > 0
+	}
+
+	return false
+}
+
+// markUsed marks branch i of group as used.
+func (g *generator) markUsed(group *node, i int) {
+	g.session.uniqueUsed[branchKey(g.def, group, i)] = 1
+
+	if pool := g.pool(group); pool != "" {
+		g.session.uniqueUsed[poolKey(pool, &group.child[i])] = 1
+	}
+}
+
+// pool returns the name of the exclusion pool group belongs to. Only the top-level group of a definition can be in a
+// pool.
+func (g *generator) pool(group *node) string {
+	if g.def == nil || len(g.def.child) == 0 || &g.def.child[0] != group {
+		return ""
+	}
+
+	return g.def.directives.pool
+}
+
+// coolingDown reports whether branch i of group was picked too recently to be picked again (see //!cooldown).
+func (g *generator) coolingDown(group *node, i int) bool {
+	last, found := g.session.cooldowns[branchKey(g.def, group, i)]
+	return found && g.session.generations-last <= g.def.directives.cooldown
+}
+
+// startCooldown records that branch i of group was picked, if the current definition has a cooldown.
+func (g *generator) startCooldown(group *node, i int) {
+	if g.def.directives.cooldown > 0 {
+		g.session.cooldowns[branchKey(g.def, group, i)] = g.session.generations
+	}
+}
+
+// repeats reports whether branch i of group is the one picked from it last, if avoiding repeats.
+func (g *generator) repeats(group *node, i int) bool {
+	last, found := g.last[group]
+	return g.config.noRepeats && found && last == i
+}
+
+// branchKey identifies branch i of group in the definition def, e.g. "diary/[2/3". Groups are numbered from the start
+// of each definition, so keys stay the same when other definitions are added, removed or reordered.
+func branchKey(def *node, group *node, i int) string {
+	return fmt.Sprintf("%s/%s/%d", def.Text, group.Text, i)
+}
+
+// poolKey identifies a branch within a pool. Branches with the same text are the same concept, regardless of which
+// definition they belong to. Identifiers can't contain spaces, so these never clash with branch keys.
+func poolKey(pool string, p *node) string {
+	return "pool " + pool + ": " + p.grammarText()
+}
+
+// checkLength returns a *LimitError if s is longer than the maximum output length.
+func (g *generator) checkLength(s string) error {
+	// Literals take more bytes while encoded than in the output
+	if g.config.maxLength > 0 && len(s) > g.config.maxLength && len(decodeLiterals(s)) > g.config.maxLength {
+		return &LimitError{Limit: "output length", Max: g.config.maxLength}
+	}
+
+	return nil
+}
+
+// inflate expands the string s, substituting aliases from a syntax tree, evaluating numerical expressions, etc. Errors
+// of substitutions are returned as a *SubstitutionError, pointing out source, where s is written.
+func (g *generator) inflate(s string, source string, unique bool) (string, error) {
 
 	// Scan s for a {...} sequence. This can be either;
 	//
 	// - a string substitution (recurse and use another key from the tree)
 	// - a random number range
+	// - a sequence of paragraphs ({+...} or {~...})
+	// - metadata ({#key=value})
+	// - a captured substitution ({n=1-20}) or a condition on one ({n>5?many:few})
+	// - a loop ({line*1-5})
+	// - a plural form for a captured number ({%n:one=item,other=items})
+	// - an article agreeing with the gender of the following noun ({der/die/das})
 	//
 	// Keep doing this until there are no more substitutions
 	// remaining, i.e. changed remains false through the loop.
@@ -190,32 +786,90 @@ func (tree *Tree) inflate(s string, unique bool) (string, error) {
 			} else if s[p] == '}' {
 				// Make sure the } is paired with an opening {!
 
-				// A stray } is actually an error, but it should have been detected during parsing.
-				// There's no meaningful way to report it at this stage, since we have discarded source metadata!
+				// A stray } is actually an error, but it should have been detected during parsing, which reports it
+				// along with its source.
 				if sequenceOpen >= 0 {
-					replace := s[sequenceOpen : p+1]
-
-					var replaceWith string = "(ERROR)"
+					tag := s[sequenceOpen+1 : p]
+					var replaceWith string
 					var err error
-					var bottomBound, topBound int
 
-					if replace == "{\\n}" {
+					switch classifyTag(tag) {
+					case tagEmpty:
+						return "", fmt.Errorf("empty substitution {} at %s", source)
+					case tagBlank:
+						// A blank left by an earlier substitution (see Blanks)
+						sequenceOpen = -1
+						continue
+					case tagNewline:
 						replaceWith = "\n"
-					} else if _, err = fmt.Sscanf(replace, "{%d-%d}", &bottomBound, &topBound); err == nil {
-						replaceWith = fmt.Sprintf("%d", random(bottomBound, topBound))
-					} else {
-						tag := s[sequenceOpen+1 : p]
+					case tagMetadata:
+						// Metadata doesn't show up in the phrase, and neither does the space next to it
+						g.annotate(tag[1:])
+
+						if sequenceOpen > 0 && s[sequenceOpen-1] == ' ' {
+							sequenceOpen--
+						} else if p+1 < len(s) && s[p+1] == ' ' {
+							p++
+						}
+					case tagParagraphBreak:
+						replaceWith = paragraphBreak
+					case tagSpeech:
+						replaceWith, _ = speechToken(tag)
+					case tagArticle:
+						replaceWith = g.article(tag)
+					case tagParagraphs:
+						if replaceWith, err = g.paragraphs(tag); err != nil {
+							return "", err
+						}
+					case tagRange:
+						low, high, _ := parseRange(tag)
+						replaceWith = fmt.Sprintf("%d", g.random(low, high))
+						g.record(tag, replaceWith)
+					case tagPlural:
+						if replaceWith, err = g.plural(tag); err != nil {
+							return "", locate(err, source, tag)
+						}
+					case tagRepetition:
+						if replaceWith, err = g.repeat(repetition.FindStringSubmatch(tag)); err != nil {
+							return "", locate(err, source, tag)
+						}
+					case tagConditional:
+						if replaceWith, err = g.conditional(tag); err != nil {
+							return "", locate(err, source, tag)
+						}
 
-						replaceWith, err = tree.Generate(tag)
+						// Like metadata, an empty text shouldn't leave a gap
+						if replaceWith == "" && sequenceOpen > 0 && s[sequenceOpen-1] == ' ' {
+							sequenceOpen--
+						} else if replaceWith == "" && p+1 < len(s) && s[p+1] == ' ' {
+							p++
+						}
+					case tagCapture:
+						name, inner, _ := strings.Cut(tag, "=")
 
-						if err != nil {
-							return "", fmt.Errorf("%s (%s)", err, tag)
+						if replaceWith, err = g.capture(name, inner); err != nil {
+							return "", locate(err, source, tag)
+						}
+					default:
+						if replaceWith, err = g.substitute(tag); err != nil {
+							return "", locate(err, source, tag)
 						}
 					}
 
+					// ^^ or ~~ right before a substitution changes the case of all of it
+					if before, change, found := cutCaseMarkers(s[0:sequenceOpen]); found {
+						replaceWith = change(replaceWith)
+						sequenceOpen = len(before)
+					}
+
 					//s = strings.Replace(s, replace, replaceWith, 1)
 					s = s[0:sequenceOpen] + replaceWith + s[p+1:]
 					changed = true
+
+					if err := g.checkLength(s); err != nil {
+						return "", err
+					}
+
 					break
 				}
 			}
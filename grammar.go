@@ -85,7 +85,9 @@
 //
 //	diary   [ It was {weekday}, the {ordinal} week of {month}. I had just had my {ordinal} cup of coffee for the day... ]
 //
-// // can be used for comments; anything to the end of line is ignored.
+// // can be used for comments; anything to the end of line is ignored when generating. Comments are kept in the tree
+// with the definition or branch that follows them, though, or with the definition they end the line of, as shown by
+// Format with DisplayComments.
 //
 //	excuse  [ My [dog | cat] ate my homework. ]  // What a jerk!!
 //
@@ -106,18 +108,45 @@
 //
 //	weekday [ [Mon|Tues|Wednes|Thurs|Fri|Satur|Sun] << day, next week? ]  // "Tuesday, next week?", not "Tues day, next week?"
 //
+// A hyphen or dash between < and > (<->, <–> or <—>) joins the words around it, akin to << on both sides:
+//
+//	trait [ [well | ill] <-> [read | bred] ]  // "well-read", "ill-bred"...
+//
+// An en dash between numbers is tightened to a range ("{1-5} – {6-9}" gives "3–7"), and an apostrophe starting a
+// clitic ('s, 'd, 'll, 're, 've or 'm) is joined to the word before it ("{name} 's hat" gives "Bob's hat"). Spaced
+// dashes are otherwise left as written.
+//
 // Newlines can be explicitly inserted with {\n}. Note that spaces are omitted before and after {\n}, akin to <<.
 //
 //	lines [ This is a line. {\n} This is another line. ]  // "This is a line.\nThis is another line."
 //
+// Paragraph breaks (a blank line) can be inserted with {\p}.
+//
+// Text between backticks is a literal, output exactly as written: its spaces are kept and characters such as [ | ] {
+// } and // mean nothing in it. A literal must end on the line where it starts.
+//
+//	code [ `if (x  ==  y) {` {statement} `}` ]  // "if (x  ==  y) { return }"
+//
 // An empty group or branch is a syntax error. The special "empty" token _ can be used to explicitly omit output:
 //
 //	verdict [ I'm not angry, but I'm [very | _] disappointed. ]
 //
+// An empty branch can be given a weight relative to the other branches, which have a weight of 1, to make leaving
+// something out more (or less) likely. This is "very" one time in five:
+//
+//	verdict [ I'm not angry, but I'm [very | _:4] disappointed. ]
+//
 // ^ will convert the following character to uppercase:
 //
 //	where [ ^ here and ^ there ]  // Here and There
 //
+// ^^ converts the whole following word to uppercase, and ~~ to lowercase. If followed by a substitution or a group, all
+// of its output is converted:
+//
+//	warning [ ^^ [danger | high voltage] ! ~~ {name} was ^^here ]  // HIGH VOLTAGE! bob was HERE
+//
+// Of several markers in a row, the first one decides, so ^^ ~~ Hello gives HELLO.
+//
 // # Substitution Options
 //
 // Substitution can generate random numbers by specifying an interval:
@@ -183,50 +212,247 @@
 // The exclusive substitution list will persist between calls to Generate(). It can be cleared with Reset(). The *
 // prefix can also be used directly in calls to Generate().
 //
+// A * at the very start of a group makes that group exclusive, wherever it is. Each of its branches is used only once:
+//
+//	magic [ Your lucky number is [* 1 | 2 | 3 | 4 | 5]. ]
+//
+// Modifiers after the identifier inflect a substitution, e.g. {verb:past} or {noun:plural:possessive}. They are
+// applied in order by the Morphology, which is English unless UseMorphology says otherwise:
+//
+//	verb   [ fly | run | stop ]
+//	noun   [ child | goose ]
+//	story  [ The {noun:plural} {verb:past} away. ]
+//
+// The title modifier capitalizes a phrase like a headline, leaving stop words such as "of" and "the" in lower case
+// (see TitleCase). It works in any language, by the rules of the language given with Locale:
+//
+//	headline [ {listicle:title} ]
+//
+// The alternating, leet and smallcaps modifiers stylize a substitution, like AlternatingCase, Leet and SmallCaps:
+//
+//	mock [ Oh, {excuse:alternating}. ]  // Oh, i FoRgOt.
+//
+// A substitution can be captured in a variable with {name=identifier} or {name=1-20}, which generates it as usual.
+// Conditions on captured variables pick between two texts: {name>5?yes:no}, where the operator is one of == != < <= >
+// >=. Numbers are compared as numbers, anything else as text. Each text is either an identifier to substitute, or
+// text to use as is, with underscores for spaces:
+//
+//	roll  [ You rolled {n=1-20}{n==20?,_a_critical_hit!:.} ]
+//	mood  [ {m=feeling} {m==happy?smile:frown} ]
+//
+// Constraints make a substitution rhyme or alliterate with a captured variable: {word:rhyme=a} and
+// {word:alliterate=a} are generated again until they do (see UsePhonetics for what counts as a rhyme):
+//
+//	couplet [ Roses are {a=color}, {\n} the sky is {color:rhyme=a} ]
+//	slogan  [ {b=adjective} {noun:alliterate=b} ]
+//
+// {%name:one=item,other=items} picks a plural form for a captured number, by the plural rules (from CLDR) of the
+// language given with Locale, or English. The categories are zero, one, two, few, many and other; other is used for any
+// category without a form of its own. In the forms, # stands for the number and underscores for spaces:
+//
+//	loot@en [ You found {n=1-5} {%n:one=coin,other=coins}. ]
+//	loot@pl [ Znalazłeś {n=1-5} {%n:one=monetę,few=monety,many=monet}. ]
+//
+// A substitution can be repeated a random number of times with {identifier*1-5}, or a fixed number of times with
+// {identifier*3}. Each repetition is generated independently, and they are separated by spaces:
+//
+//	line   [ {verse} {\n} ]
+//	poem   [ {line*2-4} ]
+//
+// Branches can carry metadata for the application, which doesn't show up in the phrase. {#key=value} (or {#key}, for a
+// value of "true") sets a key in the Metadata of the Result returned by GenerateResult:
+//
+//	weapon [ a rusty sword {#rarity=common} | Excalibur {#rarity=legendary} {#unique} ]
+//
+// The tier key gives a branch a rarity tier, which makes it less likely to be picked: common, uncommon, rare or
+// legendary. In a group with tiers, branches without one are common, and the odds of the tiers are 60, 25, 10 and 5
+// (e.g. a legendary branch is picked one time in twelve against a common one). TierOdds changes the odds, and MinTier
+// leaves out branches below a tier:
+//
+//	loot [ a stick | a sword {#tier=uncommon} | a wand {#tier=rare} | the Crown {#tier=legendary} ]
+//
+// Articles can agree with the gender of the noun after them. An article token lists the masculine, feminine and
+// neuter form, separated by slashes, and the noun sets its gender with {#gender=m}, {#gender=f} or {#gender=n}. A
+// form is picked for every article before the next noun with a gender; an article without one gets its first form:
+//
+//	noun   [ Tisch {#gender=m} | Lampe {#gender=f} | Buch {#gender=n} ]
+//	thing  [ ^{der/die/das} {noun} ]
+//
+// # Documents
+//
+// Longer texts can be put together from a sequence of paragraphs. {+a,b,c} expands each of the listed identifiers into
+// a paragraph of its own, in order, with blank lines in between. {~a,b,c} does the same, but shuffles the paragraphs;
+// identifiers prefixed with = stay in place:
+//
+//	letter [ {~=greeting,news,weather,gossip,=farewell} ]
+//
+// # Directives
+//
+// Comments starting with //! are directives, which alter how a definition behaves. A directive inside a definition
+// applies to that definition; anywhere else it applies to the definition that follows.
+//
+// //!pool puts a definition in a named exclusion pool. An exclusive substitution of any definition in the pool uses up
+// the branch in all of them, as long as the branch text is the same:
+//
+//	//!pool names
+//	hero     [ Alice | Bob | Carol ]
+//	//!pool names
+//	villain  [ Bob | Carol | Dave ]
+//	duel     [ {*hero} versus {*villain} ]  // never "Bob versus Bob"
+//
+// //!cooldown makes each branch of a definition ineligible for a number of generations after it has been picked. Unlike
+// exclusive substitutions this never fails: if every branch is cooling down, one is picked anyway.
+//
+//	//!cooldown 3
+//	greeting [ Hello! | Hi there! | Good day! | Howdy! | Greetings! ]
+//
+// //!stock makes the weight of each branch of a definition a limited stock for exclusive substitutions: every use takes
+// one from the weight, rather than using up the branch at once, and the branch is used up when nothing is left. Weights
+// come from the weight profile (see Tree.LoadWeights) or from the grammar (_:3). In the meantime, a branch is picked
+// in proportion to what is left of it. Only exclusive substitutions ({*joke}, or generating "*joke") take from the
+// stock; others pick by weight as usual.
+//
+//	//!stock
+//	joke [ Why did the chicken... | Knock knock... | _:3 ]  // three times nothing, but each joke only once
+//
+// //!merge allows a definition to reuse the identifier of an earlier one (e.g. in another file), and says how to
+// combine them: "replace" keeps only the new definition, "append" adds its branches after the earlier ones and
+// "interleave" alternates between them. This lets grammar packs extend each other's word lists. See Tree.Merge for
+// merging trees.
+//
+//	animal [ cat | dog ]
+//	//!merge append
+//	animal [ wombat | platypus ]
+//
+// //!private makes a definition a helper, only usable through substitutions. Generating it directly fails with
+// ErrPrivate, so helpers don't become part of the public interface of a phrase service.
+//
+//	//!private
+//	adjective [ shiny | rusty ]
+//	item      [ a {adjective} sword ]
+//
+// //!expect adds a test to a definition, which Tree.RunTests runs. Every expansion of the definition must match a
+// /regular expression/ or equal an exact text; a leading ! means it must not:
+//
+//	//!expect /^[A-Z]/
+//	//!expect !/ $/
+//	sentence [ ^{subject} {verb} ]
+//
+// //!doc documents a definition. The text (one line per directive) is available from Tree.Lookup:
+//
+//	//!doc A polite way to start a letter.
+//	greeting [ Dear | To whom it may concern, ]
+//
+// //!requires names language features a grammar needs, separated by commas or spaces, and applies to the whole file
+// rather than a definition. A version of this package without one of them fails to parse the grammar with an error
+// saying so, rather than with a syntax error somewhere. The features are articles, constraints, cooldown, doc,
+// expect, locales, loops, merge, metadata, modifiers, paragraphs, plurals, pool, private, requires, speech, stock,
+// tiers, variables and weights:
+//
+//	//!requires variables,plurals
+//	loot [ {n=1-5} {%n:one=coin,other=coins} ]
+//
 package grammar
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"strings"
 )
 
 // Parse parses an input grammar string and returns a syntax tree.
 //
-// If a syntax error is encountered it returns an error and an empty string.
-func Parse(grammar string) (*Tree, error) {
-	return parseInternal(tokenize(grammar, ""))
+// If a syntax error is encountered it returns a *ParseError and a nil tree. Parsing goes on after an error, resuming at
+// the next definition that starts a line, so that all errors can be fixed in one go; if there are several, they are
+// joined with errors.Join (see ParseErrors).
+func Parse(grammar string, options ...ParseOption) (*Tree, error) {
+	config := newParseConfig(options)
+
+	if err := config.checkSize(len(grammar)); err != nil {
+		return nil, err
+	}
+
+	token := tokenize(grammar, "")
+
+	if err := config.checkTokens(len(token)); err != nil {
+		return nil, err
+	}
+
+	return parseInternal(token)
 }
 
 // ParseFile reads and parses an input grammar from filename and returns a syntax tree.
-func ParseFile(filename string) (*Tree, error) {
-	return ParseFiles([]string{filename})
+//
+// Files may be encoded in UTF-8 (with or without a byte order mark), UTF-16 or Windows-1252, as saved by most editors.
+func ParseFile(filename string, options ...ParseOption) (*Tree, error) {
+	return ParseFiles([]string{filename}, options...)
 }
 
 // ParseFiles reads and parses an input grammar from multiple files and returns a syntax tree. Files are processed
 // individually, not concatenated, so each file must be self-contained and syntactically complete. Note that if any of
-// the files contains an error the whole operation will fail.
-func ParseFiles(filenames []string) (*Tree, error) {
+// the files contains an error the whole operation will fail; a syntax error is returned as a *ParseError naming the
+// file.
+//
+// A file given more than once (also by way of a directory, a pattern or a link) is only read once. Two different files
+// with the same contents fail with a *DuplicateFileError, rather than with errors about every definition in them.
+// Files with nothing but whitespace and comments in them are exempt.
+//
+// Each entry may also be a directory, in which case the files directly inside it are read, or a glob pattern such as
+// "grammars/**/*.g", where ** matches any number of directories. See ParseDir for recursive directory loading.
+//
+// MaxInputSize and MaxTokens limit how much input is accepted, over all files together.
+func ParseFiles(filenames []string, options ...ParseOption) (*Tree, error) {
+	files, err := expandPaths(filenames)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFiles(files, newParseConfig(options))
+}
+
+// parseFiles reads and parses a list of plain files.
+func parseFiles(filenames []string, config parseConfig) (*Tree, error) {
 	var token []token
+	var files fileSet
+	var keys []byte // Keys of the files in the cache
+	size := 0
 
 	for _, f := range filenames {
-		contents, err := ioutil.ReadFile(f)
+		if files.seen(f) {
+			continue
+		}
+
+		contents, err := config.readFile(f, config.maxSize-size)
 
 		if err != nil {
 			return nil, err
 		}
 
-		moreTokens := tokenize(string(contents), f)
+		if err := files.checkContents(f, contents); err != nil {
+			return nil, err
+		}
+
+		size += len(contents)
+
+		text, err := decode(contents)
 
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %w", f, err)
 		}
 
+		moreTokens, key := config.cache.tokenize(f, text)
+		keys = append(keys, key[:]...)
+
 		token = append(token, moreTokens...)
+
+		if err := config.checkTokens(len(token)); err != nil {
+			return nil, err
+		}
 	}
 
-	return parseInternal(token)
+	return config.cache.parse(sha256.Sum256(keys), token)
 }
 
 // parseInternal parses an input grammar in the form of a slice of input tokens and constructs a syntax tree.
@@ -237,168 +463,303 @@ func ParseFiles(filenames []string) (*Tree, error) {
 // e.g. [[a|b]]. Dummy nodes internally have the text // which is used for comments and should never be found in the
 // tree otherwise.
 //
-// Since there are often multiple sequential group, group nodes are assigned a unique identifier ([ + number) to enable
-// unambiguous paths. In the formatted print, these numbers are suppressed unless the IncludeGroupNumbers option is set.
+// Since there are often multiple sequential group, group nodes are assigned an identifier ([ + number) to enable
+// unambiguous paths. Groups are numbered from the start of each definition, so the identifier is unique within the
+// definition and doesn't change when other definitions are added or removed. In the formatted print, these numbers are
+// suppressed unless the DisplayGroupNumbers option is set.
 func parseInternal(token []token) (*Tree, error) {
-	if len(token) == 0 {
-		return nil, fmt.Errorf("empty input")
+	comments := 0
+
+	for _, t := range token {
+		if isComment(t) {
+			comments++
+		}
+	}
+
+	if comments == len(token) {
+		return nil, ErrEmptyInput
 	}
 
-	var root node = node{Text: "", internalType: root}
-	groupID := 0        // unique ID; incremented when used
-	stack := []string{} // used to keep track of the current tree path
-	collect := ""
-	previousSource := "" // syntax errors are sometimes at the previous token, not the current
+	p := parser{root: node{Text: "", internalType: root}, previous: token[0]}
+	token, err := checkRequirements(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.pending = token[:0:0]
 
 	// Iterate over input tokens. Scan for [ | ] control tokens; everything else is concatenated onto collect. When
 	// a control token is encountered there should be *something* in collect or it is a syntax error.
 
 	// After any control token collect should be set to empty.
 
-	for _, t := range token {
+	for i := 0; i < len(token); i++ {
+		t := token[i]
 
 		// These should have been removed by tokenize()!
 		if t.Text == "" {
 			return nil, errors.New("empty token")
 		}
 
-		source := t.Source
-
-		//fmt.Println(stack, ">", t.Text);
-
-		if t.Text == "[" {
-			if collect == "" && len(stack) == 0 {
-				return nil, fmt.Errorf("missing definition identifier at %s", t.Source)
-			} else if collect == "" && len(stack) > 1 && stack[len(stack)-1][0] == '[' {
-				// [ after [ without anything in between - need to insert a dummy node
-				stack = append(stack, "//")
-				root.add(stack, source, dummy)
-			} else if collect != "" {
-				if len(stack) == 0 {
-					for _, s := range root.child {
-						if s.Text == collect {
-							return nil, fmt.Errorf("duplicate identifier \"%s\" at %s and %s",
-								t.Text, s.Source, t.Source)
-						}
+		//fmt.Println(p.stack, ">", t.Text);
+
+		// Comments are kept with the definition or branch that follows them, except for a comment after the end of a
+		// definition on the same line, which belongs to that definition
+		if isComment(t) && len(p.stack) == 0 && len(p.root.child) > 0 && t.Source == p.previousSource {
+			def := &p.root.child[len(p.root.child)-1]
+			def.comments = append(def.comments, t.Text)
+			continue
+		} else if isComment(t) {
+			p.comments = append(p.comments, t.Text)
+			continue
+		}
+
+		// Directives inside a definition apply to it; anywhere else, they apply to the following definition
+		if isDirective(t) {
+			if len(p.stack) == 0 {
+				p.pending = append(p.pending, t)
+			} else if err := applyDirective(&p.root.child[len(p.root.child)-1], t); err != nil {
+				p.errs = append(p.errs, err)
+			}
+
+			continue
+		}
+
+		if err := p.parseToken(t); err != nil {
+			p.errs = append(p.errs, err)
+			i = p.recover(token, i)
+			continue
+		}
+
+		p.previousSource = t.Source
+		p.previous = t
+	}
+
+	// We're out of tokens; make sure the last group was closed properly
+	if len(p.stack) > 0 {
+		p.errs = append(p.errs, tokenError(p.previous, "unterminated [").is(ErrUnterminatedGroup))
+	}
+
+	if len(p.pending) > 0 {
+		p.errs = append(p.errs, tokenError(p.pending[0], "directive not followed by a definition"))
+	}
+
+	// Comments after the last definition belong to the tree
+	p.root.comments = p.comments
+
+	if err := weighEmptyBranches(&p.root); err != nil {
+		p.errs = append(p.errs, err)
+	}
+
+	if err := findTiers(&p.root); err != nil {
+		p.errs = append(p.errs, err)
+	}
+
+	if err := mergeDuplicates(&p.root); err != nil {
+		p.errs = append(p.errs, err)
+	}
+
+	if len(p.errs) == 1 {
+		return nil, p.errs[0]
+	} else if len(p.errs) > 0 {
+		return nil, errors.Join(p.errs...)
+	}
+
+	tree := Tree{root: p.root}
+
+	return &tree, nil
+}
+
+// A parser holds the state of parseInternal between tokens.
+type parser struct {
+	root           node
+	groupID        int      // unique ID within the definition; incremented when used
+	stack          []string // used to keep track of the current tree path
+	collect        string
+	previousSource string   // syntax errors are sometimes at the previous token, not the current
+	previous       token    // the token previousSource is from
+	pending        []token  // directives waiting for the next definition
+	comments       []string // comments waiting for the next definition or branch
+	errs           []error  // syntax errors found so far
+}
+
+// parseToken adds a token other than a directive to the tree.
+func (p *parser) parseToken(t token) error {
+	source := t.Source
+
+	if t.Text == "[" {
+		if p.collect == "" && len(p.stack) == 0 {
+			return tokenError(t, "missing definition identifier")
+		} else if p.collect == "" && len(p.stack) > 1 && p.stack[len(p.stack)-1][0] == '[' {
+			// [ after [ without anything in between - need to insert a dummy node
+			p.stack = append(p.stack, "//")
+			p.root.add(p.stack, source, dummy)
+		} else if p.collect != "" {
+			if len(p.stack) == 0 && !mergeDirective(p.pending) {
+				for _, s := range p.root.child {
+					if s.Text == p.collect {
+						return tokenError(p.previous, "duplicate identifier \"%s\" (also defined at %s)", p.collect,
+							s.Source).is(ErrDuplicateIdentifier)
 					}
 				}
+			}
+
+			p.stack = append(p.stack, p.collect)
+			p.collect = ""
 
-				stack = append(stack, collect)
-				collect = ""
+			// Top-level nodes get the "tag" type; these are purely labels
+			// and its text won't be included by compose()!
+			if len(p.stack) == 1 {
+				p.add(p.stack, p.previousSource, tag)
+				p.groupID = 0
 
-				// Top-level nodes get the "tag" type; these are purely labels
-				// and its text won't be included by compose()!
-				if len(stack) == 1 {
-					root.add(stack, previousSource, tag)
-				} else {
-					root.add(stack, previousSource, text)
+				// A bad directive leaves the definition intact, so it is parsed all the same
+				for _, d := range p.pending {
+					if err := applyDirective(&p.root.child[len(p.root.child)-1], d); err != nil {
+						p.errs = append(p.errs, err)
+					}
 				}
-			}
 
-			stack = append(stack, fmt.Sprintf("[%d", next(&groupID)))
-			root.add(stack, source, group)
-		} else if t.Text == "|" {
-			if len(stack) == 0 {
-				return nil, fmt.Errorf("stray | at root level at %s", t.Source)
-			} else if collect == "" && len(stack) > 0 && stack[len(stack)-1][0] == '[' {
-				// If there has been nothing collected since the last
-				// control token, AND we are currently in a group
-				return nil, fmt.Errorf("stray | in group at %s", t.Source)
+				p.pending = p.pending[:0]
+			} else {
+				p.add(p.stack, p.previousSource, text)
 			}
+		}
 
-			if stack[len(stack)-1][0] != '[' && collect != "" {
-				root.add(append(stack, collect), source, text)
-				collect = ""
-			}
+		p.stack = append(p.stack, fmt.Sprintf("[%d", next(&p.groupID)))
+		p.root.add(p.stack, source, group)
+	} else if t.Text == "|" {
+		if len(p.stack) == 0 {
+			return tokenError(t, "stray | at root level")
+		} else if p.collect == "" && len(p.stack) > 0 && p.stack[len(p.stack)-1][0] == '[' {
+			// If there has been nothing collected since the last
+			// control token, AND we are currently in a group
+			return tokenError(t, "stray | in group")
+		}
 
-			// Unwind to the most recent group
-			for i := len(stack) - 1; i >= 0; i-- {
-				s := stack[i]
+		if p.stack[len(p.stack)-1][0] != '[' && p.collect != "" {
+			p.add(append(p.stack, p.collect), source, text)
+			p.collect = ""
+		}
 
-				if s[0] == '[' {
-					break
-				}
+		// Unwind to the most recent group
+		for i := len(p.stack) - 1; i >= 0; i-- {
+			s := p.stack[i]
 
-				stack = stack[:(len(stack) - 1)]
+			if s[0] == '[' {
+				break
 			}
 
-			if collect == "" && stack[len(stack)-1][0] != '[' {
-				return nil, fmt.Errorf("stray | in group at %s", t.Source)
-			} else if collect != "" {
-				// Add the current stack + the token(s) collected since
-				// the last control character, to add it under the current group
-				root.add(append(stack, collect), source, text)
-				collect = ""
-			}
+			p.stack = p.stack[:(len(p.stack) - 1)]
+		}
 
-			// [ ] directly followed by |; do not add an empty text token
+		if p.collect == "" && p.stack[len(p.stack)-1][0] != '[' {
+			return tokenError(t, "stray | in group")
+		} else if p.collect != "" {
+			// Add the current stack + the token(s) collected since
+			// the last control character, to add it under the current group
+			p.add(append(p.stack, p.collect), source, text)
+			p.collect = ""
+		}
 
-		} else if t.Text == "]" {
-			if collect == "" && len(stack) == 0 {
-				return nil, fmt.Errorf("stray ] at %s", t.Source)
-			} else if collect == "" && len(stack) > 0 && stack[len(stack)-1][0] == '[' {
-				return nil, fmt.Errorf("empty group at %s", t.Source)
-			} else if collect != "" {
-				root.add(append(stack, collect), previousSource, text)
-				collect = ""
-			}
+		// [ ] directly followed by |; do not add an empty text token
+
+	} else if t.Text == "]" {
+		if p.collect == "" && len(p.stack) == 0 {
+			return tokenError(t, "stray ]")
+		} else if p.collect == "" && len(p.stack) > 0 && p.stack[len(p.stack)-1][0] == '[' {
+			return tokenError(t, "empty group")
+		} else if p.collect != "" {
+			p.add(append(p.stack, p.collect), p.previousSource, text)
+			p.collect = ""
+		}
 
-			// Scan the stack top-down, pop anything that isn't a group open [
-			// and stop after the first group open we encounter
-			for i := len(stack) - 1; i >= 0; i-- {
-				s := stack[i]
+		// Scan the stack top-down, pop anything that isn't a group open [
+		// and stop after the first group open we encounter
+		for i := len(p.stack) - 1; i >= 0; i-- {
+			s := p.stack[i]
 
-				stack = stack[:(len(stack) - 1)]
+			p.stack = p.stack[:(len(p.stack) - 1)]
 
-				if s[0] == '[' {
-					break
-				}
+			if s[0] == '[' {
+				break
 			}
+		}
 
-			// If we are back at the top-level identifier, wipe the stack
-			if len(stack) == 1 {
-				stack = []string{}
+		// If we are back at the top-level identifier, wipe the stack
+		if len(p.stack) == 1 {
+			p.stack = []string{}
+		}
+	} else {
+		// * at the very start of a group makes the group exclusive
+		if p.collect == "" && len(p.stack) > 0 && p.stack[len(p.stack)-1][0] == '[' && t.Text[0] == '*' {
+			if g := p.root.find(p.stack); g != nil && len(g.child) == 0 {
+				g.exclusive = true
+
+				if t.Text = t.Text[1:]; t.Text == "" {
+					return nil
+				}
 			}
-		} else {
-			if collect == "" {
-				if len(stack) == 0 {
-					// Use separate strings and Contains rather than ContainsAny,
-					// since we want to know specifically which character was encountered
-					invalidInIdentifier := []string{"{", "}", "<", "*", "^"}
-
-					for _, find := range invalidInIdentifier {
-						if strings.Contains(t.Text, find) {
-							return nil, fmt.Errorf("invalid character %s in identifier at %s", find, t.Source)
-						}
+		}
+
+		if p.collect == "" {
+			if len(p.stack) == 0 {
+				// Use separate strings and Contains rather than ContainsAny,
+				// since we want to know specifically which character was encountered
+				invalidInIdentifier := []string{"{", "}", "<", "*", "^"}
+
+				for _, find := range invalidInIdentifier {
+					if strings.Contains(t.Text, find) {
+						return tokenError(t, "invalid character %s in identifier", find)
 					}
 				}
-
-				collect = t.Text
-			} else if len(stack) == 0 {
-				return nil, fmt.Errorf("expecting [ after identifier at %s", t.Source)
-			} else {
-				collect += " " + t.Text
 			}
 
-			if t.Text[0] == '{' && t.Text[len(t.Text)-1] != '}' {
-				return nil, fmt.Errorf("unterminated substitution \"%s\" at %s", t.Text, t.Source)
-			} else if t.Text[0] != '{' && t.Text[len(t.Text)-1] == '}' {
-				return nil, fmt.Errorf("stray } (substitution missing { ?) at %s", t.Source)
-			}
+			p.collect = t.Text
+		} else if len(p.stack) == 0 {
+			return tokenError(t, "expecting [ after identifier")
+		} else {
+			p.collect += " " + t.Text
 		}
 
-		previousSource = source
+		if t.Text[0] == '{' && t.Text[len(t.Text)-1] != '}' {
+			return tokenError(t, "unterminated substitution \"%s\"", t.Text).is(ErrUnterminatedSubstitution)
+		} else if t.Text[0] != '{' && t.Text[len(t.Text)-1] == '}' {
+			return tokenError(t, "stray } (substitution missing { ?)")
+		}
 	}
 
-	// We're out of tokens; make sure the last group was closed properly
-	if len(stack) > 0 {
-		return nil, fmt.Errorf("unterminated [ at %s", previousSource)
+	return nil
+}
+
+// add adds a definition (tag) or text node at path, with the comments written before it.
+func (p *parser) add(path []string, source string, nodeType nodeType) {
+	if n, err := p.root.add(path, source, nodeType); err == nil {
+		n.comments, p.comments = p.comments, nil
 	}
+}
 
-	tree := Tree{root: root}
-	tree.Reset()
+// recover gets the parser going again after a syntax error at token i, so that the errors in the rest of the input
+// are found as well. The definition with the error is dropped, and parsing resumes at the next line that starts a
+// definition, in the first column: an identifier followed by [, or a directive. It returns the index of the token
+// before that line.
+func (p *parser) recover(token []token, i int) int {
+	if len(p.stack) > 0 {
+		p.root.child = p.root.child[:len(p.root.child)-1]
+	}
 
-	return &tree, nil
+	p.stack, p.collect, p.pending, p.comments = p.stack[:0], "", p.pending[:0], nil
+
+	for i++; i < len(token)-1; i++ {
+		t := token[i]
+
+		if t.Column == 1 && t.Source != token[i-1].Source && (isDirective(t) || token[i+1].Text == "[") {
+			return i - 1
+		}
+	}
+
+	return len(token)
 }
 
 // Quick parses a grammar and generates the default (last) definition.
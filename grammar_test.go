@@ -1,9 +1,26 @@
 package grammar
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
 	"math/rand"
+	randv2 "math/rand/v2"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -329,6 +346,27 @@ func TestTreeFormatOptions(t *testing.T) {
 	}
 }
 
+func TestFormatLegend(t *testing.T) {
+	in := "a [ b | c {d} ] d [ x | [ y | z ] ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	out := tree.Format(DisplayLegend)
+
+	for _, want := range []string{"Legend:", "  a: 3 nodes, 2 branches, depth 2", "  d: 6 nodes, 4 branches, depth 4"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Format(DisplayLegend) lacks \"%s\":\n%s", want, out)
+		}
+	}
+
+	if strings.Contains(tree.Format(), "Legend:") {
+		t.Error("Format() had a legend, even though it shouldn't")
+	}
+}
+
 // Make sure Generate() called with *identifier returns the same output only once
 func TestGenerateExclusive(t *testing.T) {
 
@@ -362,3 +400,4055 @@ func TestGenerateExclusive(t *testing.T) {
 		previous += out
 	}
 }
+
+// Check that ParseFiles expands directories and glob patterns, including **
+func TestParseFilesGlob(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"a.g":           "a [ a ]",
+		"sub/b.g":       "b [ b ]",
+		"sub/deep/c.g":  "c [ c ]",
+		"sub/notes.txt": "not a grammar",
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Value is the expected number of definitions
+	input := map[string]int{
+		filepath.Join(dir, "**", "*.g"):  3,
+		filepath.Join(dir, "sub", "*.g"): 1,
+		filepath.Join(dir, "*.g"):        1,
+	}
+
+	for pattern, expected := range input {
+		tree, err := ParseFiles([]string{pattern})
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", pattern, err)
+		}
+
+		if count := len(tree.root.child); count != expected {
+			t.Fatalf("\"%s\" loaded %d definitions, expected %d", pattern, count, expected)
+		}
+	}
+
+	if _, err := ParseFiles([]string{filepath.Join(dir, "**", "*.missing")}); err == nil {
+		t.Fatalf("ParseFiles() should have failed (no matches), but didn't")
+	}
+
+	tree, err := ParseDir(dir, true, ".g")
+
+	if err != nil {
+		t.Fatalf("ParseDir() failed (%s)", err)
+	}
+
+	if count := len(tree.root.child); count != 3 {
+		t.Fatalf("ParseDir() loaded %d definitions, expected 3", count)
+	}
+}
+
+// Make sure MaxLength aborts runaway output with a *LimitError
+func TestMaxLength(t *testing.T) {
+	tree, err := Parse(`b [ bbbbbbbbbb ]
+	                    c [ {b} {b} {b} {b} {b} {b} {b} {b} {b} {b} ]
+	                    d [ {c} {c} {c} {c} {c} {c} {c} {c} {c} {c} ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tree.Generate("", MaxLength(100))
+
+	var limitErr *LimitError
+
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Generate() should have failed with a LimitError, got %v", err)
+	}
+
+	tree, _ = Parse("a [ short ]")
+
+	if _, err = tree.Generate("", MaxLength(5)); err != nil {
+		t.Fatalf("Generate() failed (%s)", err)
+	}
+
+	if _, err = tree.Generate("", MaxLength(4)); err == nil {
+		t.Fatalf("Generate() should have exceeded the limit, but didn't")
+	}
+}
+
+// Check that the expansion budget is shared by all nested substitutions
+func TestMaxExpansions(t *testing.T) {
+	tree, err := Parse(`b [ x ]
+	                    c [ {b} {b} {b} ]
+	                    d [ {c} {c} {c} ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// d makes 3 substitutions of c, which make 3 of b each
+	if _, err = tree.Generate("d", MaxExpansions(12)); err != nil {
+		t.Fatalf("Generate() failed (%s)", err)
+	}
+
+	_, err = tree.Generate("d", MaxExpansions(11))
+
+	var limitErr *LimitError
+
+	if !errors.As(err, &limitErr) || limitErr.Limit != "expansion" {
+		t.Fatalf("Generate() should have failed with a LimitError, got %v", err)
+	}
+}
+
+// Make sure GenerateFor gives the same output for the same key
+func TestGenerateFor(t *testing.T) {
+	tree, err := Parse("a [ {1-1000000} [b|c|d|e|f|g] ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "user1", "user2", "ünïcødé"} {
+		first, err := tree.GenerateFor("a", key)
+
+		if err != nil {
+			t.Fatalf("GenerateFor(\"%s\") failed (%s)", key, err)
+		}
+
+		for i := 0; i < 10; i++ {
+			if out, _ := tree.GenerateFor("a", key); out != first {
+				t.Fatalf("GenerateFor(\"%s\") is not stable (\"%s\", then \"%s\")", key, first, out)
+			}
+		}
+	}
+}
+
+// Make sure a seeded identifier stream isn't perturbed by other definitions
+func TestSeedStream(t *testing.T) {
+	sequence := func(grammar string, interleave bool) []string {
+		tree, err := Parse(grammar)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tree.SeedStream("a", 42)
+
+		var ret []string
+
+		for i := 0; i < 20; i++ {
+			out, err := tree.Generate("a")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ret = append(ret, out)
+
+			if interleave {
+				tree.Generate("b")
+			}
+		}
+
+		return ret
+	}
+
+	first := sequence("a [ b | c | d | e | {1-100} ]", false)
+	second := sequence("b [ x | {1-100} ] a [ b | c | d | e | {1-100} ]", true)
+
+	if strings.Join(first, ",") != strings.Join(second, ",") {
+		t.Fatalf("seeded stream was perturbed:\n%s\n%s", first, second)
+	}
+}
+
+// Seeded output must not change between releases; these values are fixed by PCG and intn()
+func TestRandSource(t *testing.T) {
+	tree, err := Parse("a [ {1-1000000} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, _ := tree.GenerateFor("a", "golden"); out != "443381" {
+		t.Fatalf("GenerateFor() output has changed (got %s)", out)
+	}
+
+	if out, _ := tree.Generate("a", RandSource(newSource(1))); out != "964823" {
+		t.Fatalf("seeded output has changed (got %s)", out)
+	}
+
+	if _, err := tree.Generate("a", RandSource(CryptoSource)); err != nil {
+		t.Fatalf("Generate() with CryptoSource failed (%s)", err)
+	}
+
+	// Check that calls reusing a Seed option draw the same choices
+	seed := Seed(1)
+	first, _ := tree.Generate("a", seed)
+
+	if out, _ := tree.Generate("a", seed); out != first {
+		t.Fatalf("Generate() with the same Seed option returned \"%s\", then \"%s\"", first, out)
+	}
+}
+
+// Make sure ExpandOnce resolves groups but leaves substitutions alone
+func TestExpandOnce(t *testing.T) {
+	tree, err := Parse("b [ x ] a [ ^ [c|d] << {b} {1-5} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := tree.ExpandOnce("a")
+
+	if err != nil {
+		t.Fatalf("ExpandOnce() failed (%s)", err)
+	}
+
+	if out != "^ c << {b} {1-5}" && out != "^ d << {b} {1-5}" {
+		t.Fatalf("ExpandOnce() gave \"%s\"", out)
+	}
+}
+
+// Make sure pinned identifiers always give the pinned value
+func TestPin(t *testing.T) {
+	tree, err := Parse("weekday [ Monday | Tuesday ] a [ {weekday} and {*weekday} [x|y] ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		out, err := tree.Generate("a", Pin("weekday", "Friday"))
+
+		if err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+
+		if !strings.HasPrefix(out, "Friday and Friday ") {
+			t.Fatalf("pinned identifier was ignored (got \"%s\")", out)
+		}
+	}
+}
+
+// Make sure Require finds derivations that satisfy the constraints
+func TestRequire(t *testing.T) {
+	tree, err := Parse(`season [ spring | summer | autumn | winter ]
+	                    month  [ {1-12} ]
+	                    a      [ In [early|late] {season}, month {month}. ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		out, err := tree.Generate("a", Require("season", "winter"), Require("month", "11"), Require("a", "late"))
+
+		if err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+
+		if out != "In late winter, month 11." {
+			t.Fatalf("constraints not satisfied (got \"%s\")", out)
+		}
+	}
+
+	if _, err := tree.Generate("a", Require("season", "monsoon")); err == nil {
+		t.Fatalf("Generate() should have failed (unsatisfiable), but didn't")
+	}
+}
+
+// Make sure Deduplicate prevents repeats within the history size
+func TestDeduplicate(t *testing.T) {
+	tree, err := Parse("a [ b | c | d | e ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Deduplicate(4)
+	seen := map[string]bool{}
+
+	for i := 0; i < 4; i++ {
+		out, err := tree.Generate("a")
+
+		if err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+
+		if seen[out] {
+			t.Fatalf("\"%s\" was repeated", out)
+		}
+
+		seen[out] = true
+	}
+
+	if _, err := tree.Generate("a"); err == nil {
+		t.Fatalf("Generate() should have failed (all phrases remembered), but didn't")
+	}
+
+	tree.Deduplicate(3)
+
+	for i := 0; i < 20; i++ {
+		if _, err := tree.Generate("a"); err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+	}
+}
+
+// Check the histogram statistics for a simple uniform grammar
+func TestHistogram(t *testing.T) {
+	tree, err := Parse("a [ b | c | d | e ] f [ {*a} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := tree.Histogram("f", 4000)
+
+	if err != nil {
+		t.Fatalf("Histogram() failed (%s)", err)
+	}
+
+	t.Logf("\n%s", h)
+
+	if h.Samples != 4000 || h.Distinct != 4 {
+		t.Fatalf("wrong histogram (%d samples, %d distinct)", h.Samples, h.Distinct)
+	}
+
+	if h.Entropy < 1.9 || h.Entropy > 2.0 {
+		t.Fatalf("entropy should be close to 2 bits, got %f", h.Entropy)
+	}
+}
+
+// Make sure definitions sharing a pool never give the same exclusive branch
+func TestPools(t *testing.T) {
+	in := `//!pool names
+	       hero    [ Alice | Bob ]
+	       villain [ //!pool names
+	                 Bob | Alice ]
+	       duel    [ {*hero} versus {*villain} ]`
+
+	for i := 0; i < 50; i++ {
+		tree, err := Parse(in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		out, err := tree.Generate("duel")
+
+		if err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+
+		if out != "Alice versus Bob" && out != "Bob versus Alice" {
+			t.Fatalf("pool was not shared (got \"%s\")", out)
+		}
+
+		if _, err := tree.Generate("duel"); err == nil {
+			t.Fatalf("pool should have been exhausted")
+		}
+	}
+
+	for _, in := range []string{"//!pool\na [b]", "//!bogus\na [b]", "a [b] //!pool x"} {
+		if _, err := Parse(in); err == nil {
+			t.Fatalf("\"%s\" should have failed, but didn't", in)
+		}
+	}
+}
+
+// Make sure inline exclusive groups only give each branch once
+func TestExclusiveGroup(t *testing.T) {
+	in := "a [ x [*b|c|d] ] e [ {a} {a} {a} ]"
+
+	for i := 0; i < 50; i++ {
+		tree, err := Parse(in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		out, err := tree.Generate("e")
+
+		if err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+
+		if strings.Count(out, "b") != 1 || strings.Count(out, "c") != 1 || strings.Count(out, "d") != 1 {
+			t.Fatalf("exclusive group failed: \"%s\" => \"%s\"", in, out)
+		}
+
+		if _, err := tree.Generate("a"); err == nil {
+			t.Fatalf("exclusive group should have been exhausted")
+		}
+	}
+
+	// A lone * is fine, and a * later in the group is just text
+	tree, err := Parse("a [ * [b] | c ] f [ [b | *c] ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, _ := tree.Generate("f", Require("f", "*")); out != "*c" {
+		t.Fatalf("expected \"*c\", got \"%s\"", out)
+	}
+}
+
+// Make sure used exclusive branches can be carried over to a re-parsed tree
+func TestStableUsedKeys(t *testing.T) {
+	in := "a [b|c|d] e [ x [y|z] ]"
+	tree, _ := Parse(in)
+
+	tree.Generate("*a")
+	tree.Generate("*a")
+
+	used := tree.Used()
+
+	if len(used) != 2 || !strings.HasPrefix(used[0], "a/[1/") {
+		t.Fatalf("unexpected used keys %v", used)
+	}
+
+	// Adding a definition up front must not change the keys
+	other, _ := Parse("new [ [q|r] [s|t] ] " + in)
+	other.SetUsed(used)
+
+	out, err := other.Generate("*a")
+
+	if err != nil {
+		t.Fatalf("Generate() failed (%s)", err)
+	}
+
+	first, _ := tree.Generate("*a")
+
+	if out != first {
+		t.Fatalf("expected the remaining branch \"%s\", got \"%s\"", first, out)
+	}
+
+	if _, err := other.Generate("*a"); err == nil {
+		t.Fatalf("Generate() should have failed (exhausted), but didn't")
+	}
+}
+
+// Make sure a restored session generates exactly what the original did after the snapshot
+func TestSnapshot(t *testing.T) {
+	tree, err := Parse("a [ b | c | d | e | f | g ] h [ {*a} {1-1000} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := tree.NewSession()
+	s.SeedStream("a", 7)
+	s.Deduplicate(10)
+	s.KeepRecent(3)
+	first, _ := s.GenerateResult("h")
+
+	snapshot, err := s.Snapshot()
+
+	if err != nil {
+		t.Fatalf("Snapshot() failed (%s)", err)
+	}
+
+	var expected []string
+
+	for i := 0; i < 5; i++ {
+		out, err := s.Generate("h")
+
+		if err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+
+		expected = append(expected, out)
+	}
+
+	restored := tree.NewSession()
+
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatalf("Restore() failed (%s)", err)
+	}
+
+	// Recent phrases and traces of earlier generations are restored too
+	if recent := restored.Recent(); !reflect.DeepEqual(recent, []string{first.Text}) {
+		t.Fatalf("restored session has recent phrases %v, expected [%s]", recent, first.Text)
+	}
+
+	if err := restored.Reinforce(first.TraceID, 0.1); err != nil {
+		t.Fatalf("Reinforce() failed on a restored session (%s)", err)
+	}
+
+	restored.Restore(snapshot)
+
+	for i := 0; i < 5; i++ {
+		if out, _ := restored.Generate("h"); out != expected[i] {
+			t.Fatalf("restored session diverged: got \"%s\", expected \"%s\"", out, expected[i])
+		}
+	}
+
+	// The remaining branch of a is the same in both, then both are exhausted
+	if _, err := restored.Generate("h"); err == nil {
+		t.Fatalf("restored session should have been exhausted")
+	}
+}
+
+// Make sure weight profiles are validated and affect the distribution
+func TestLoadWeights(t *testing.T) {
+	tree, err := Parse("a [ b | c | d ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badProfiles := []string{
+		`{"a/[1/3": 1}`,
+		`{"x/[1/0": 1}`,
+		`{"a/[2/0": 1}`,
+		`{"a/0": 1}`,
+		`{"a/[1/0": -1}`,
+		`not json`,
+	}
+
+	for _, profile := range badProfiles {
+		if err := tree.LoadWeights(strings.NewReader(profile)); err == nil {
+			t.Fatalf("\"%s\" should have failed, but didn't", profile)
+		}
+	}
+
+	if err := tree.LoadWeights(strings.NewReader(`{"a/[1/0": 0, "a/[1/1": 9}`)); err != nil {
+		t.Fatalf("LoadWeights() failed (%s)", err)
+	}
+
+	h, err := tree.Histogram("a", 1000)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Counts["b"] != 0 || h.Counts["c"] < 800 {
+		t.Fatalf("weights were not applied:\n%s", h)
+	}
+
+	// Zero-weighted branches aren't picked by exclusive substitutions either
+	tree.Generate("*a")
+	tree.Generate("*a")
+
+	if _, err := tree.Generate("*a"); err == nil {
+		t.Fatalf("Generate() should have failed (exhausted), but didn't")
+	}
+}
+
+// Make sure branches with a cooldown aren't repeated too soon, and that it never fails
+func TestCooldown(t *testing.T) {
+	tree, err := Parse("//!cooldown 2\na [ b | c | d ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var previous []string
+
+	for i := 0; i < 30; i++ {
+		out, err := tree.Generate("a")
+
+		if err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+
+		for _, p := range previous {
+			if p == out {
+				t.Fatalf("\"%s\" was repeated within the cooldown (%v)", out, previous)
+			}
+		}
+
+		previous = append(previous, out)
+
+		if len(previous) > 2 {
+			previous = previous[1:]
+		}
+	}
+
+	// Cooldown longer than the number of branches must not fail
+	tree, _ = Parse("//!cooldown 10\na [ b | c ]")
+
+	for i := 0; i < 10; i++ {
+		if _, err := tree.Generate("a"); err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+	}
+}
+
+// Check paragraph breaks and paragraph sequences
+func TestParagraphs(t *testing.T) {
+	in := `a [ A. ] b [ B. ] c [ C. ] d [ D. ]
+	       ordered  [ {+a,b,c,d} ]
+	       shuffled [ {~=a,b,c,=d} ]
+	       breaks   [ A. {\p} B. ]`
+
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	if out, _ := tree.Generate("ordered"); out != "A.\n\nB.\n\nC.\n\nD." {
+		t.Fatalf("wrong paragraph sequence \"%s\"", out)
+	}
+
+	if out, _ := tree.Generate("breaks"); out != "A.\n\nB." {
+		t.Fatalf("wrong paragraph break \"%s\"", out)
+	}
+
+	for i := 0; i < 20; i++ {
+		out, err := tree.Generate("shuffled")
+
+		if err != nil {
+			t.Fatalf("Generate() failed (%s)", err)
+		}
+
+		if out != "A.\n\nB.\n\nC.\n\nD." && out != "A.\n\nC.\n\nB.\n\nD." {
+			t.Fatalf("wrong shuffled sequence \"%s\"", out)
+		}
+	}
+
+	tree, _ = Parse("a [ b ] c [ {+a,,a} ]")
+
+	if _, err := tree.Generate("c"); err == nil {
+		t.Fatalf("Generate() should have failed (empty identifier), but didn't")
+	}
+
+	tree, _ = Parse("a [ x {+a} ] b [ {+nope} ]")
+	var limit *LimitError
+
+	if _, err := tree.Generate("a", MaxDepth(5), MaxExpansions(1000)); !errors.As(err, &limit) {
+		t.Fatalf("Generate() of a recursive paragraph sequence returned %v", err)
+	}
+
+	if out, err := tree.Generate("b", Lenient()); err != nil || out != "⟨nope⟩" {
+		t.Fatalf("Generate(\"b\", Lenient()) returned \"%s\", %v", out, err)
+	}
+
+	tree, _ = Parse("a [ x {} ]")
+
+	if _, err := tree.Generate("a"); err == nil {
+		t.Fatalf("Generate() should have failed (empty substitution), but didn't")
+	}
+}
+
+// Check that Wrap breaks lines between words and keeps existing line breaks
+func TestWrap(t *testing.T) {
+	input := map[string]string{
+		"a [ one two three four five ]":             "one two\nthree\nfour five",
+		"a [ one {\\n} two three ]":                 "one\ntwo three",
+		"a [ supercalifragilistic is a long word ]": "supercalifragilistic\nis a long\nword",
+		"a [ åäö åäö åäö ]":                         "åäö åäö\nåäö",
+	}
+
+	for in, expected := range input {
+		tree, err := Parse(in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		if out, _ := tree.Generate("", Wrap(9)); out != expected {
+			t.Fatalf("\"%s\" wrapped to %q, expected %q", in, out, expected)
+		}
+	}
+}
+
+// Check ^^ and ~~ for words, substitutions and groups
+func TestCaseMarkers(t *testing.T) {
+	input := map[string]string{
+		"a [ ^^hello world ]":                 "HELLO world",
+		"a [ ^^ hello world ]":                "HELLO world",
+		"a [ x ~~HeLLo World ]":               "x hello World",
+		"b [ Bob Smith ] a [ hi ^^ {b}! ]":    "hi BOB SMITH!",
+		"b [ Bob Smith ] a [ hi ~~{b} ]":      "hi bob smith",
+		"a [ x ^^ [ yes sir | yes sir ] ok ]": "x YES SIR ok",
+		"a [ ^^ [ yes sir ] ok ]":             "YES SIR ok",
+		"a [ ~~ [ NO WAY ] ]":                 "no way",
+		"a [ ^hello ^^there ]":                "Hello THERE",
+		"a [ ^^ ~~ Hello ]":                   "HELLO",
+		"a [ ~~^^Hello ]":                     "hello",
+		"b [ Bob ] a [ ~~ ^^ {b} ]":           "bob",
+		"a [ ^^ ~~ [ Yes Sir ] ]":             "YES SIR",
+	}
+
+	for in, expected := range input {
+		tree, err := Parse(in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		if out, _ := tree.Generate(""); out != expected {
+			t.Fatalf("\"%s\" gave \"%s\", expected \"%s\"", in, out, expected)
+		}
+	}
+}
+
+// Check the options for trimming and newlines
+func TestNewlinePolicy(t *testing.T) {
+	tree, err := Parse(`a [ {\n} one {\n}{\n}{\n} two {\p}{\p} three {\n} ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := []struct {
+		options  []GenerateOption
+		expected string
+	}{
+		{nil, "\none\n\n\ntwo\n\n\n\nthree\n"},
+		{[]GenerateOption{Trim()}, "one\n\n\ntwo\n\n\n\nthree"},
+		{[]GenerateOption{MaxNewlines(1), Trim(), FinalNewline()}, "one\ntwo\nthree\n"},
+		{[]GenerateOption{MaxNewlines(2)}, "\none\n\ntwo\n\nthree\n"},
+		{[]GenerateOption{FinalNewline()}, "\none\n\n\ntwo\n\n\n\nthree\n"},
+	}
+
+	for _, in := range input {
+		if out, _ := tree.Generate("a", in.options...); out != in.expected {
+			t.Fatalf("got %q, expected %q", out, in.expected)
+		}
+	}
+}
+
+// Check that the substitutions made are returned with the phrase
+func TestGenerateResult(t *testing.T) {
+	tree, err := Parse("day [ monday ] time [ {1-1} pm ] a [ on {day} at {time} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := tree.GenerateResult("a")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Substitution{{"day", "monday", 0}, {"time", "1 pm", 0}, {"1-1", "1", 1}}
+
+	if result.Text != "on monday at 1 pm" || !reflect.DeepEqual(result.Substitutions, expected) {
+		t.Fatalf("got %q %v, expected %v", result.Text, result.Substitutions, expected)
+	}
+
+	if values := result.Values("day"); len(values) != 1 || values[0] != "monday" {
+		t.Fatalf("got %v for day", values)
+	}
+}
+
+// Check that GenerateMap shares state between the identifiers
+func TestGenerateMap(t *testing.T) {
+	tree, err := Parse("name [ alice | bob | carol ] motto [ {name} rules ] title [ {*name} | {*name} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		tree.Reset()
+		m, err := tree.GenerateMap("name", "motto", "title")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m["motto"] != m["name"]+" rules" || m["title"] != m["name"] {
+			t.Fatalf("inconsistent map %v", m)
+		}
+	}
+
+	if _, err := tree.GenerateMap("name", "nope"); err == nil {
+		t.Fatal("expected an error for a missing identifier")
+	}
+
+	// Check that variables captured by a phrase carry over to the next ones
+	in := "count [ {n=1-20} ] verdict [ {n>10?many:few} ]"
+	tree, err = Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	for i := 0; i < 20; i++ {
+		m, err := tree.GenerateMap("count", "verdict")
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		if n, _ := strconv.Atoi(m["count"]); (n > 10) != (m["verdict"] == "many") {
+			t.Fatalf("inconsistent map %v", m)
+		}
+	}
+}
+
+// Check looking up definitions
+func TestLookup(t *testing.T) {
+	tree, err := Parse("//!doc Ways to say hello.\n//!doc Used by letters.\ngreeting [ hi | hello | hey ]\nletter [ {greeting} there ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tree.Has("greeting") || !tree.Has("*greeting") || tree.Has("farewell") {
+		t.Fatal("Has gave wrong results")
+	}
+
+	def, found := tree.Lookup("greeting")
+
+	if !found || def.ID != "greeting" || def.Branches != 3 || def.Source != ":3" || def.Doc != "Ways to say hello.\nUsed by letters." {
+		t.Fatalf("got %+v", def)
+	}
+
+	if _, found := tree.Lookup("farewell"); found {
+		t.Fatal("found a missing definition")
+	}
+}
+
+// Check that the smoke test finds broken branches, however rare
+func TestSmokeTest(t *testing.T) {
+	tree, err := Parse("x [ one | two ] a [ fine | also [ fine | {missing} ] | {*x} {*x} {*x} ] b [ {x} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := tree.SmokeTest()
+	var keys []string
+
+	for _, e := range errs {
+		keys = append(keys, e.Key)
+	}
+
+	if expected := []string{"a/[2/1", "a/[1/2"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("got %v, expected %v", errs, expected)
+	}
+
+	if tree, err := Parse("a [ fine | good ]"); err != nil || len(tree.SmokeTest()) != 0 {
+		t.Fatal("a working grammar failed the smoke test")
+	}
+}
+
+// Check that the spellchecker flags unknown words
+func TestSpellcheck(t *testing.T) {
+	tree, err := Parse("a [ ^Hello {b}'s wrold | on the 3rd day, don't << stop! ]\nb [ {1-6} well-konwn ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dict, err := ReadWordList(strings.NewReader("hello\non\nthe\nday\ndon't\nstop\nwell\nknown\n"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Misspelling{{"wrold", ":1"}, {"konwn", ":2"}}
+
+	if found := tree.Spellcheck(dict); !reflect.DeepEqual(found, expected) {
+		t.Fatalf("got %v, expected %v", found, expected)
+	}
+}
+
+// Check that feedback shifts the weights of the branches picked
+func TestReinforce(t *testing.T) {
+	tree, err := Parse("a [ good | bad ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := tree.NewSession()
+
+	for i := 0; i < 200; i++ {
+		result, err := s.GenerateResult("a")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Text == "good" {
+			err = s.Reinforce(result.TraceID, 0.5)
+		} else {
+			err = s.Reinforce(result.TraceID, -0.5)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bad := 0
+
+	for i := 0; i < 100; i++ {
+		if out, _ := s.Generate("a"); out == "bad" {
+			bad++
+		}
+	}
+
+	if bad > 5 {
+		t.Fatalf("got %d bad phrases out of 100 after feedback", bad)
+	}
+
+	if weights := s.Weights(); weights["a/[1/0"] <= 1 || weights["a/[1/1"] >= 1 {
+		t.Fatalf("unexpected weights %v", weights)
+	}
+
+	if err := s.Reinforce("nope", 1); err == nil {
+		t.Fatal("expected an error for an unknown trace")
+	}
+}
+
+// Check matching phrases against a grammar
+func TestMatches(t *testing.T) {
+	tree, err := Parse("color [ red | blue | light [ green | grey ] ] a [ ^the {color} car, {1-10} years old | a bike ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, found := tree.Matches("a", "The  light grey car, 7 years old")
+
+	if !found {
+		t.Fatal("no match")
+	}
+
+	expected := []Substitution{{"color", "light grey", 0}, {"1-10", "7", 0}}
+
+	if !reflect.DeepEqual(result.Substitutions, expected) {
+		t.Fatalf("got %v, expected %v", result.Substitutions, expected)
+	}
+
+	if branches := []string{"a/[1/0", "color/[1/2", "color/[2/1"}; !reflect.DeepEqual(result.Branches, branches) {
+		t.Fatalf("got %v, expected %v", result.Branches, branches)
+	}
+
+	for _, phrase := range []string{"the purple car, 7 years old", "the red car, 11 years old", "a bike!", "a"} {
+		if _, found := tree.Matches("a", phrase); found {
+			t.Fatalf("\"%s\" matched", phrase)
+		}
+	}
+
+	// Everything generated should match
+	for i := 0; i < 20; i++ {
+		out, _ := tree.Generate("a")
+
+		if _, found := tree.Matches("a", out); !found {
+			t.Fatalf("\"%s\" didn't match", out)
+		}
+	}
+
+	// Non-ASCII letters, some of which take fewer bytes in lower case
+	tree, err = Parse("a [ café in {city} ] city [ İstanbul | Zürich ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for phrase, city := range map[string]string{"café in Zürich": "Zürich", "CAFÉ IN İSTANBUL": "İSTANBUL"} {
+		result, found := tree.Matches("a", phrase)
+
+		if !found {
+			t.Fatalf("\"%s\" didn't match", phrase)
+		}
+
+		if result.Substitutions[0].Value != city {
+			t.Fatalf("\"%s\" gave %v, expected %s", phrase, result.Substitutions, city)
+		}
+	}
+}
+
+// Check that NoRepeats avoids picking the same branch twice in a row
+func TestNoRepeats(t *testing.T) {
+	tree, err := Parse("word [ red | blue ] a [ {word} {word} {word} {word} ] b [ x ] c [ {b}{b} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		out, err := tree.Generate("a", NoRepeats())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out != "red blue red blue" && out != "blue red blue red" {
+			t.Fatalf("got \"%s\"", out)
+		}
+	}
+
+	// A group with a single branch has to repeat it
+	if out, err := tree.Generate("c", NoRepeats()); err != nil || out != "x x" {
+		t.Fatalf("got \"%s\" (%v)", out, err)
+	}
+}
+
+// Check the strategies for merging definitions
+func TestMerge(t *testing.T) {
+	input := map[string]string{
+		"a [ x | y ]\na [ z ]":                          "error",
+		"a [ x | y ]\n//!merge replace\na [ z ]":        "z",
+		"a [ x | y ]\n//!merge append\na [ z ]":         "x y z",
+		"a [ x | y ]\n//!merge interleave\na [ z | w ]": "x z y w",
+	}
+
+	for in, expected := range input {
+		tree, err := Parse(in)
+
+		if err != nil {
+			if expected != "error" {
+				t.Fatalf("\"%s\" failed (%s)", in, err)
+			}
+
+			continue
+		}
+
+		var out []string
+
+		for i := 0; i < len(tree.root.child[0].child[0].child); i++ {
+			out = append(out, tree.root.child[0].child[0].child[i].grammarText())
+		}
+
+		if strings.Join(out, " ") != expected {
+			t.Fatalf("\"%s\" gave \"%s\", expected \"%s\"", in, strings.Join(out, " "), expected)
+		}
+	}
+
+	// Merging trees
+	tree, _ := Parse("a [ x [ 1 | 2 ] ]\nb [ {a} ]")
+	other, _ := Parse("a [ y [ 3 | 4 ] ]\nc [ {b} ]")
+
+	if err := tree.Merge(other, nil); err == nil {
+		t.Fatal("merging a duplicate identifier should have failed")
+	}
+
+	if err := tree.Merge(other, map[string]MergeStrategy{"a": MergeAppend}); err != nil {
+		t.Fatal(err)
+	}
+
+	if text := tree.root.child[0].grammarText(); text != "a [ x [ 1 | 2 ] | y [ 3 | 4 ] ]" {
+		t.Fatalf("got %s", text)
+	}
+
+	if _, _, _, err := tree.findBranch("a/[4/1"); err != nil || !tree.Has("c") {
+		t.Fatalf("merged groups were not renumbered (%v)", err)
+	}
+}
+
+// Check that private definitions can only be substituted
+func TestPrivate(t *testing.T) {
+	tree, err := Parse("//!private\nadjective [ shiny ]\nitem [ a {adjective} sword ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := tree.Generate("item"); err != nil || out != "a shiny sword" {
+		t.Fatalf("got \"%s\" (%v)", out, err)
+	}
+
+	if _, err := tree.Generate("adjective"); !errors.Is(err, ErrPrivate) {
+		t.Fatalf("expected ErrPrivate, got %v", err)
+	}
+
+	if _, err := tree.GenerateMap("item", "*adjective"); !errors.Is(err, ErrPrivate) {
+		t.Fatalf("expected ErrPrivate, got %v", err)
+	}
+
+	if def, _ := tree.Lookup("adjective"); !def.Private {
+		t.Fatal("Lookup didn't report a private definition")
+	}
+}
+
+// Check that only allowed entry points can be generated
+func TestAllowEntries(t *testing.T) {
+	tree, err := Parse("name [ alice ] greeting [ hello {name} ] secret [ xyzzy ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.AllowEntries("greeting")
+
+	if out, err := tree.Generate("greeting"); err != nil || out != "hello alice" {
+		t.Fatalf("got \"%s\" (%v)", out, err)
+	}
+
+	var entryErr *EntryError
+
+	for _, id := range []string{"secret", "name", "missing", ""} {
+		if _, err := tree.Generate(id); !errors.As(err, &entryErr) || entryErr.ID != id {
+			t.Fatalf("\"%s\" should have failed with an EntryError, got %v", id, err)
+		}
+	}
+
+	s := tree.NewSession()
+	s.AllowEntries("secret")
+
+	if _, err := s.Generate("secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.AllowEntries()
+
+	if _, err := tree.Generate("secret"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Check that definitions are resolved in the preferred locale
+func TestLocale(t *testing.T) {
+	tree, err := Parse(`greeting@en [ hello ]
+	                    greeting@sv [ hej ]
+	                    name [ world ]
+	                    name@sv-FI [ Finland ]
+	                    phrase [ {greeting} {name}! ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := []struct {
+		locales  []string
+		expected string
+	}{
+		{[]string{"en"}, "hello world!"},
+		{[]string{"sv"}, "hej world!"},
+		{[]string{"sv-SE"}, "hej world!"},
+		{[]string{"sv-FI"}, "hej Finland!"},
+		{[]string{"de", "en-GB"}, "hello world!"},
+	}
+
+	for _, in := range input {
+		if out, err := tree.Generate("phrase", Locale(in.locales...)); err != nil || out != in.expected {
+			t.Fatalf("%v gave \"%s\" (%v), expected \"%s\"", in.locales, out, err, in.expected)
+		}
+	}
+
+	if _, err := tree.Generate("phrase"); err == nil {
+		t.Fatal("greeting should be missing without a locale")
+	}
+
+	tree.AllowEntries("greeting")
+
+	if out, err := tree.Generate("greeting", Locale("sv")); err != nil || out != "hej" {
+		t.Fatalf("got \"%s\" (%v)", out, err)
+	}
+}
+
+// Check English inflection through modifiers
+func TestMorphology(t *testing.T) {
+	input := map[string]string{
+		"walk:past": "walked", "go:past": "went", "go:participle": "gone", "carry:past": "carried",
+		"stop:past": "stopped", "bake:past": "baked", "run:ing": "running", "make:ing": "making", "die:ing": "dying",
+		"watch:present": "watches", "have:present": "has", "cat:plural": "cats", "box:plural": "boxes",
+		"city:plural": "cities", "day:plural": "days", "child:plural": "children", "Wolf:plural": "Wolves",
+		"cat:possessive": "cat's", "child:plural:possessive": "children's", "big:comparative": "bigger",
+		"happy:superlative": "happiest", "good:comparative": "better", "curious:superlative": "most curious",
+		"nice:comparative": "nicer",
+	}
+
+	for in, expected := range input {
+		id, _, _ := strings.Cut(in, ":")
+		tree, err := Parse(id + " [ " + id + " ] a [ {" + in + "} ]")
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		if out, err := tree.Generate("a"); err != nil || out != expected {
+			t.Fatalf("\"%s\" gave \"%s\" (%v), expected \"%s\"", in, out, err, expected)
+		}
+	}
+
+	tree, _ := Parse("v [ pick up ] n [ cup of tea ] a [ {v:past} two {n:plural} ] b [ {v:nope} ]")
+
+	if out, _ := tree.Generate("a"); out != "picked up two cups of tea" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if _, err := tree.Generate("b"); err == nil {
+		t.Fatal("expected an error for an unknown modifier")
+	}
+}
+
+// Check the tests given with //!expect
+func TestRunTests(t *testing.T) {
+	tree, err := Parse(`//!expect /^[A-Z]/
+	                    //!expect !/blue/
+	                    color [ ^red | ^green | Blue ]
+	                    //!expect hello
+	                    greeting [ hello ]
+	                    //!expect hello
+	                    other [ hi ]
+	                    //!expect /x/
+	                    broken [ {missing} ]
+	                    untested [ {missing} ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures := tree.RunTests()
+	var ids []string
+
+	for _, f := range failures {
+		ids = append(ids, f.ID)
+	}
+
+	if expected := []string{"other", "broken"}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("got %v, expected %v", failures, expected)
+	}
+
+	if _, err := Parse("//!expect /[/\na [ b ]"); err == nil {
+		t.Fatal("expected an error for an invalid regular expression")
+	}
+}
+
+// Check that metadata is returned but not generated
+func TestMetadata(t *testing.T) {
+	tree, err := Parse("weapon [ Excalibur {#rarity=legendary} {#unique} ] a [ {#mood=dark} [ the | thy ] {weapon}! ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := tree.GenerateResult("a")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Text != "the Excalibur!" && result.Text != "thy Excalibur!" {
+		t.Fatalf("got \"%s\"", result.Text)
+	}
+
+	expected := map[string]string{"rarity": "legendary", "unique": "true", "mood": "dark"}
+
+	if !reflect.DeepEqual(result.Metadata, expected) {
+		t.Fatalf("got %v, expected %v", result.Metadata, expected)
+	}
+
+	if _, found := tree.Matches("a", result.Text); !found {
+		t.Fatal("no match")
+	}
+}
+
+// Check the language server with a short session
+func TestServeLSP(t *testing.T) {
+	var in, out bytes.Buffer
+
+	send := func(id int, method string, params string) {
+		body := fmt.Sprintf(`{"jsonrpc":"2.0","method":"%s","params":%s`, method, params)
+
+		if id > 0 {
+			body += fmt.Sprintf(`,"id":%d`, id)
+		}
+
+		body += "}"
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+
+	text := `//!doc A greeting.\ngreeting [ hello | hi ]\nphrase [ {greeting} {*nope:plural} ]`
+	at := func(line, character int) string {
+		return fmt.Sprintf(`{"textDocument":{"uri":"file:///a.g"},"position":{"line":%d,"character":%d}}`, line, character)
+	}
+
+	send(1, "initialize", `{}`)
+	send(0, "textDocument/didOpen", `{"textDocument":{"uri":"file:///a.g","text":"`+text+`"}}`)
+	send(2, "textDocument/definition", at(2, 12))
+	send(3, "textDocument/hover", at(2, 12))
+	send(4, "textDocument/completion", at(2, 10))
+	send(5, "textDocument/definition", at(2, 2))
+	send(6, "textDocument/semanticTokens/full", at(0, 0))
+	send(7, "shutdown", `null`)
+	send(0, "exit", `null`)
+
+	if err := ServeLSP(&in, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := map[string]string{}
+	reader := bufio.NewReader(&out)
+
+	for {
+		var length int
+
+		if _, err := fmt.Fscanf(reader, "Content-Length: %d\r\n\r\n", &length); err != nil {
+			break
+		}
+
+		body := make([]byte, length)
+		io.ReadFull(reader, body)
+
+		var msg struct {
+			ID     json.RawMessage
+			Method string
+			Result json.RawMessage
+			Params json.RawMessage
+		}
+
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Method == "textDocument/publishDiagnostics" {
+			responses["diagnostics"] = string(msg.Params)
+		} else {
+			responses[string(msg.ID)] = string(msg.Result)
+		}
+	}
+
+	expected := map[string]string{
+		"diagnostics": `"start":{"line":2,"character":22},"end":{"line":2,"character":26}`,
+		"2":           `"range":{"start":{"line":1,"character":0},"end":{"line":1,"character":8}}`,
+		"3":           `A greeting.`,
+		"4":           `"label":"phrase"`,
+		"5":           `null`,
+		"6":           `{"data":[0,0,18,5,0,1,0,8,1,0,`,
+		"7":           `null`,
+	}
+
+	for key, fragment := range expected {
+		if !strings.Contains(responses[key], fragment) {
+			t.Fatalf("%s: \"%s\" doesn't contain \"%s\"", key, responses[key], fragment)
+		}
+	}
+}
+
+// Check the classification of grammar source
+func TestClassify(t *testing.T) {
+	source := "//!pool x\nname [* ^^{a} b | _ << c ] // note"
+	var got []string
+
+	for _, span := range Classify(source) {
+		got = append(got, fmt.Sprintf("%d:%s:%s", span.Line, span.Kind, source[span.Start:span.End]))
+	}
+
+	expected := []string{
+		"1:directive://!pool x", "2:identifier:name", "2:group:[", "2:operator:*", "2:operator:^^",
+		"2:substitution:{a}", "2:text:b", "2:group:|", "2:operator:_", "2:operator:<<", "2:text:c", "2:group:]",
+		"2:comment:// note",
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+}
+
+// Check leaving blanks and filling them in
+func TestBlanks(t *testing.T) {
+	tree, err := Parse("//!doc A kind of animal\nanimal [ cat ]\nverb [ run ]\na [ ^the {animal:plural} {verb:past} to the {*animal} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := tree.GenerateResult("a", Blanks("animal"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Blank{{"animal", "A kind of animal (plural)"}, {"animal", "A kind of animal"}}
+
+	if !reflect.DeepEqual(result.Blanks, expected) {
+		t.Fatalf("got %v, expected %v", result.Blanks, expected)
+	}
+
+	if out, err := result.Fill("wombats", "shop"); err != nil || out != "The wombats ran to the shop" {
+		t.Fatalf("got \"%s\" (%v)", out, err)
+	}
+
+	if _, err := result.Fill("wombats"); err == nil {
+		t.Fatal("expected an error for too few answers")
+	}
+}
+
+// Check SSML output and speech tokens
+func TestSSML(t *testing.T) {
+	tree, err := Parse(`a [ Tom & Jerry {\pause} say {\em} hello {\/em} {\pause=1s} {\n} bye ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, _ := tree.Generate("a"); out != "Tom & Jerry say hello\nbye" {
+		t.Fatalf("got %q", out)
+	}
+
+	expected := `<speak>Tom &amp; Jerry <break/> say <emphasis> hello </emphasis> <break time="1s"/>` +
+		`<break strength="strong"/>bye</speak>`
+
+	if out, _ := tree.Generate("a", SSML()); out != expected {
+		t.Fatalf("got %q, expected %q", out, expected)
+	}
+
+	tree, _ = Parse(`a [ hello {\pause=500ms} world {\em} now {\/em} ]`)
+
+	for mode, words := range map[Case][]any{CaseUpper: {"HELLO", "WORLD", "NOW"}, CaseTitle: {"Hello", "World", "Now"}} {
+		s := tree.NewSession()
+		s.SetConfig(SessionConfig{Case: mode})
+		expected := fmt.Sprintf(`<speak>%s <break time="500ms"/> %s <emphasis> %s </emphasis></speak>`, words...)
+
+		if out, _ := s.Generate("a", SSML()); out != expected {
+			t.Fatalf("got %q, expected %q", out, expected)
+		}
+	}
+}
+
+// Check the decision tree of a generation
+func TestRecordDecisions(t *testing.T) {
+	tree, err := Parse("b [ x ] a [ [ one | two ] {b} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := tree.GenerateResult("a", RecordDecisions())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := json.Marshal(result.Decisions)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"kind":"definition","id":"a","chosen":0,"text":"%s x","children":[` +
+		`{"kind":"group","group":"a/[1","options":["[ one | two ] {b}"],"chosen":0,"text":"%s x","children":[` +
+		`{"kind":"group","group":"a/[2","options":["one","two"],"chosen":%d,"text":"%s"},` +
+		`{"kind":"substitution","id":"b","chosen":0,"text":"x","children":[` +
+		`{"kind":"group","group":"b/[1","options":["x"],"chosen":0,"text":"x"}]}]}]}`
+
+	if string(out) != fmt.Sprintf(expected, "one", "one", 0, "one") &&
+		string(out) != fmt.Sprintf(expected, "two", "two", 1, "two") {
+		t.Fatalf("got %s", out)
+	}
+
+	if result, _ := tree.GenerateResult("a"); result.Decisions != nil {
+		t.Fatal("decisions recorded without RecordDecisions")
+	}
+}
+
+// Check captured variables and conditions on them
+func TestConditional(t *testing.T) {
+	tree, err := Parse(`crit [ critical hit! ]
+	                    roll [ rolled {n=1-20} {n>=15?crit:miss} {n<10?,_ouch:} ]
+	                    word [ x | y ]
+	                    same [ {w=word} {w==x?is_x:is_y} ]
+	                    bad [ {nope>1?a:b} ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		result, err := tree.GenerateResult("roll")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, _ := strconv.Atoi(result.Values("n=1-20")[0])
+		expected := fmt.Sprintf("rolled %d miss", n)
+
+		if n >= 15 {
+			expected = fmt.Sprintf("rolled %d critical hit!", n)
+		} else if n < 10 {
+			expected += ", ouch"
+		}
+
+		if result.Text != expected {
+			t.Fatalf("got \"%s\", expected \"%s\"", result.Text, expected)
+		}
+
+		if out, _ := tree.Generate("same"); out != "x is x" && out != "y is y" {
+			t.Fatalf("got \"%s\"", out)
+		}
+	}
+
+	if _, err := tree.Generate("bad"); err == nil {
+		t.Fatal("expected an error for an unknown variable")
+	}
+}
+
+// Check loops with a random count
+func TestRepeat(t *testing.T) {
+	tree, err := Parse("word [ a | b ] line [ {word*2-4} ] three [ {word*3} ] unique [ {*word*2} ] bad [ {*word*3} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[int]bool{}
+
+	for i := 0; i < 100; i++ {
+		out, err := tree.Generate("line")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counts[len(strings.Fields(out))] = true
+	}
+
+	if len(counts) != 3 || !counts[2] || !counts[3] || !counts[4] {
+		t.Fatalf("got word counts %v, expected 2 to 4", counts)
+	}
+
+	if out, _ := tree.Generate("three"); len(strings.Fields(out)) != 3 {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	tree.Reset()
+
+	if out, _ := tree.Generate("unique"); out != "a b" && out != "b a" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if _, err := tree.Generate("bad"); err == nil {
+		t.Fatal("expected exclusive repetitions to run out")
+	}
+}
+
+// Check plural categories and plural forms of captured numbers
+func TestPlural(t *testing.T) {
+	for _, test := range []struct {
+		locale   string
+		n        int
+		category string
+	}{
+		{"en", 1, "one"}, {"en", 0, "other"}, {"fr", 0, "one"}, {"ru", 21, "one"}, {"ru", 22, "few"},
+		{"ru", 12, "many"}, {"pl", 5, "many"}, {"cs", 3, "few"}, {"ar", 2, "two"}, {"ar", 11, "many"},
+		{"ja", 1, "other"}, {"pt-BR", 1, "one"}, {"xx", 1, "one"},
+	} {
+		if category := PluralCategory(test.locale, test.n); category != test.category {
+			t.Fatalf("got %s for %d in %s, expected %s", category, test.n, test.locale, test.category)
+		}
+	}
+
+	tree, err := Parse(`loot [ {n=1-5} {%n:one=coin,other=coins} ]
+		loot@pl [ {n=1-5} {%n:one=moneta,few=monety,many=monet} ]
+		total [ {n=1-2} {%n:one=one_#,other=many_#} ]
+		polish [ {loot@pl} ]
+		bad [ {%m:other=x} ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		out, err := tree.Generate("loot")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out != "1 coin" && !strings.HasSuffix(out, "coins") || strings.HasPrefix(out, "1 ") && out != "1 coin" {
+			t.Fatalf("got \"%s\"", out)
+		}
+
+		out, err = tree.Generate("loot", Locale("pl"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{"1": "moneta", "2": "monety", "3": "monety", "4": "monety", "5": "monet"}
+
+		if n, word, _ := strings.Cut(out, " "); expected[n] != word {
+			t.Fatalf("got \"%s\"", out)
+		}
+
+		// A localized definition follows its own plural rules, whatever the preferred locale
+		out, err = tree.Generate("polish", Locale("en"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n, word, _ := strings.Cut(out, " "); expected[n] != word {
+			t.Fatalf("got \"%s\" from loot@pl with English preferred", out)
+		}
+
+		out, err = tree.Generate("total")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out != "1 one 1" && out != "2 many 2" {
+			t.Fatalf("got \"%s\"", out)
+		}
+	}
+
+	if _, err := tree.Generate("bad"); err == nil {
+		t.Fatal("expected an undefined variable to fail")
+	}
+}
+
+// Check that articles agree with the gender of the nouns after them
+func TestArticles(t *testing.T) {
+	tree, err := Parse(`noun [ Tisch {#gender=m} | Lampe {#gender=f} | Buch {#gender=n} ]
+		adjective [ alte | neue ]
+		thing [ ^{der/die/das} {adjective} {noun} ]
+		french [ {le/la} {nom} ]
+		nom [ chat {#gender=m} | maison {#gender=f} ]
+		nothing [ {der/die/das} ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"Tisch": "Der", "Lampe": "Die", "Buch": "Das", "chat": "le", "maison": "la"}
+
+	for i := 0; i < 50; i++ {
+		for _, id := range []string{"thing", "french"} {
+			out, err := tree.Generate(id)
+
+			if err != nil {
+				t.Fatalf("\"%s\" failed (%s)", id, err)
+			}
+
+			fields := strings.Fields(out)
+
+			if expected[fields[len(fields)-1]] != fields[0] {
+				t.Fatalf("got \"%s\"", out)
+			}
+		}
+	}
+
+	if out, _ := tree.Generate("nothing"); out != "der" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if _, found := tree.Matches("thing", "Die neue Lampe"); !found {
+		t.Fatal("expected an article to match")
+	}
+}
+
+// Check typographic quotes, dashes and ellipses
+func TestTypography(t *testing.T) {
+	input := map[string]string{
+		`a [ "Hello," she said -- and left... ]`: "“Hello,” she said — and left…",
+		`a [ It's '90s ( "quoted" ) ]`:           "It’s ’90s (“quoted”)",
+		`a [ class of '99 '05 ]`:                 "class of ’99 ’05",
+		`a [ "'Nested'" ]`:                       "“‘Nested’”",
+		`a [ '42' is quoted ]`:                   "‘42’ is quoted",
+	}
+
+	for in, expected := range input {
+		tree, err := Parse(in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		if out, _ := tree.Generate("", Typography()); out != expected {
+			t.Fatalf("\"%s\" gave \"%s\", expected \"%s\"", in, out, expected)
+		}
+	}
+}
+
+// Check title case by language, and the stop words it keeps in lower case
+func TestTitleCase(t *testing.T) {
+	input := map[string]string{
+		"en:the lord of the rings":              "The Lord of the Rings",
+		"en:10 things to do in an emergency":    "10 Things to Do in an Emergency",
+		"en:what it's made of":                  "What It's Made Of",
+		"en:star wars: the empire strikes back": "Star Wars: The Empire Strikes Back",
+		"en:a well-known iPhone app":            "A Well-Known iPhone App",
+		"fr:le tour du monde en 80 jours":       "Le Tour du Monde en 80 Jours",
+		"sv:sagan om ringen":                    "Sagan Om Ringen",
+	}
+
+	for in, expected := range input {
+		locale, phrase, _ := strings.Cut(in, ":")
+
+		if out := TitleCase(phrase, locale); out != expected {
+			t.Fatalf("\"%s\" gave \"%s\", expected \"%s\"", in, out, expected)
+		}
+	}
+
+	tree, err := Parse("things [ tips for the beginner ] headline [ {things:title} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := tree.Generate("headline"); err != nil || out != "Tips for the Beginner" {
+		t.Fatalf("got \"%s\" (%v)", out, err)
+	}
+
+	// Check that stop words are copied out, and that a session can have its own
+	words := StopWords("en-GB")
+
+	if !slices.Contains(words, "the") {
+		t.Fatalf("StopWords(\"en-GB\") returned %v", words)
+	}
+
+	words[slices.Index(words, "the")] = "tips"
+
+	if slices.Contains(StopWords("en"), "tips") {
+		t.Fatal("changing the result of StopWords changed the stop words")
+	}
+
+	session := tree.NewSession()
+	session.SetConfig(SessionConfig{StopWords: map[string][]string{"en": {"tips", "for"}}})
+
+	if out, err := session.Generate("headline"); err != nil || out != "Tips for The Beginner" {
+		t.Fatalf("got \"%s\" (%v) with stop words of the session", out, err)
+	}
+
+	if out, err := tree.Generate("headline"); err != nil || out != "Tips for the Beginner" {
+		t.Fatalf("got \"%s\" (%v) after another session changed its stop words", out, err)
+	}
+}
+
+// Check that grammar files in UTF-16, with byte order marks and in Windows-1252 are decoded
+func TestEncodings(t *testing.T) {
+	text := "a [ smörgåsbord – “yes” ]"
+	utf16le := []byte{0xff, 0xfe}
+	utf16be := []byte{0xfe, 0xff}
+
+	for _, r := range text {
+		utf16le = append(utf16le, byte(r), byte(r>>8))
+		utf16be = append(utf16be, byte(r>>8), byte(r))
+	}
+
+	input := map[string][]byte{
+		"utf-8":        []byte(text),
+		"utf-8 bom":    append([]byte{0xef, 0xbb, 0xbf}, text...),
+		"utf-16le":     utf16le,
+		"utf-16be":     utf16be,
+		"utf-16le raw": utf16le[2:],
+		"windows-1252": []byte("a [ sm\xf6rg\xe5sbord \x96 \x93yes\x94 ]"),
+	}
+
+	dir := t.TempDir()
+
+	for name, contents := range input {
+		path := filepath.Join(dir, name)
+
+		if err := os.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err := ParseFile(path)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", name, err)
+		}
+
+		if out, _ := tree.Generate("a"); out != "smörgåsbord – “yes”" {
+			t.Fatalf("%s gave \"%s\"", name, out)
+		}
+	}
+}
+
+// Check the limits on the size of parsed input
+func TestParseLimits(t *testing.T) {
+	grammar := "a [ one two three | four ]"
+	var limitErr *LimitError
+
+	if _, err := Parse(grammar, MaxInputSize(10)); !errors.As(err, &limitErr) || limitErr.Limit != "input size" {
+		t.Fatalf("expected an input size error, got %v", err)
+	}
+
+	if _, err := Parse(grammar, MaxTokens(5)); !errors.As(err, &limitErr) || limitErr.Limit != "token count" {
+		t.Fatalf("expected a token count error, got %v", err)
+	}
+
+	if _, err := Parse(grammar, MaxInputSize(len(grammar)), MaxTokens(100)); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+
+	for _, name := range []string{"a.g", "b.g"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name[:1]+" [ x ]"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ParseFiles([]string{dir}, MaxInputSize(10)); !errors.As(err, &limitErr) {
+		t.Fatalf("expected the total size to be limited, got %v", err)
+	}
+
+	if _, err := ParseFiles([]string{dir}, MaxInputSize(14)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Check that files are read once, and that copies of files are rejected
+func TestDuplicateFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.g")
+
+	if err := os.WriteFile(a, []byte("a [ x ]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseFiles([]string{a, dir, filepath.Join(dir, "*.g")}); err != nil {
+		t.Fatalf("expected the same file to be read once, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "copy.g"), []byte("a [ x ]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var duplicate *DuplicateFileError
+
+	if _, err := ParseDir(dir, false); !errors.As(err, &duplicate) || duplicate.First != a {
+		t.Fatalf("expected a duplicate file error, got %v", err)
+	}
+
+	// Check that empty and comment-only stubs are not considered copies
+	stubs := t.TempDir()
+
+	if err := os.Mkdir(filepath.Join(stubs, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, contents := range map[string]string{
+		"a.g": "", "sub/a.g": "", "b.g": "// TODO\n", "sub/b.g": "  // TODO\n\n", "sub/c.g": "// TODO\n",
+	} {
+		if err := os.WriteFile(filepath.Join(stubs, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(stubs, "main.g"), []byte("main [ x ]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseDir(stubs, true); err != nil {
+		t.Fatalf("expected stubs to be accepted, got %v", err)
+	}
+}
+
+// Check that cached tokens and trees are reused only while the files are unchanged
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.g"), filepath.Join(dir, "b.g")
+	cacheDir := filepath.Join(dir, "cache")
+
+	if err := os.WriteFile(a, []byte("a [ x | y ]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(b, []byte("b [ {a} ]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache(cacheDir)
+	first, err := ParseFiles([]string{a, b}, UseCache(cache))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := ParseFiles([]string{a, b}, UseCache(cache))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second || first.Format() != second.Format() {
+		t.Fatal("expected a copy of the cached tree")
+	}
+
+	if err := os.WriteFile(b, []byte("b [ {a} {a} ]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new cache on the same directory loads the unchanged file from disk
+	tree, err := ParseFiles([]string{a, b}, UseCache(NewCache(cacheDir)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, _ := tree.Generate("b"); len(strings.Fields(out)) != 2 {
+		t.Fatalf("got \"%s\", expected the changed file", out)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(cacheDir, "*.tokens")); len(files) != 3 {
+		t.Fatalf("got %d cached files, expected 3", len(files))
+	}
+
+	// Check that tokens cached in an older format are not reused
+	c := filepath.Join(dir, "c.g")
+	text := "c [ z ]"
+
+	if err := os.WriteFile(c, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := NewCache(cacheDir)
+	stale.save(sha256.Sum256([]byte(c+"\x00"+text)), tokenize("c [ stale ]", c))
+
+	tree, err = ParseFiles([]string{c}, UseCache(stale))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, _ := tree.Generate("c"); out != "z" {
+		t.Fatalf("got \"%s\", expected the file to be tokenized again", out)
+	}
+}
+
+// Check the branches left for exclusive substitutions
+func TestRemaining(t *testing.T) {
+	tree, err := Parse("name [ Alice | Bob | Carol ] pick [ {*name} ] single [ x ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if left, _ := tree.Remaining("name"); len(left) != 3 {
+		t.Fatalf("got %v, expected all names", left)
+	}
+
+	out, err := tree.Generate("pick")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	left, err := tree.Remaining("name")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(left) != 2 || strings.Contains(strings.Join(left, " "), out) {
+		t.Fatalf("got %v after picking %s", left, out)
+	}
+
+	if left, _ := tree.Remaining("single"); len(left) != 1 || left[0] != "x" {
+		t.Fatalf("got %v, expected [x]", left)
+	}
+
+	if _, err := tree.Remaining("nothing"); err == nil {
+		t.Fatal("expected an undefined identifier to fail")
+	}
+}
+
+// Check marking branches of exclusive substitutions as used
+func TestMarkUsed(t *testing.T) {
+	tree, err := Parse("name [ Alice | Bob | Carol ] pick [ {*name} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.MarkUsedText("name", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.MarkUsed("name/[1/1")
+
+	if err := tree.MarkUsedText("name", "Dave"); err == nil {
+		t.Fatal("expected an unknown branch to fail")
+	}
+
+	if out, err := tree.Generate("pick"); err != nil || out != "Carol" {
+		t.Fatalf("got \"%s\" (%v), expected Carol", out, err)
+	}
+
+	if _, err := tree.Generate("pick"); err == nil {
+		t.Fatal("expected the names to run out")
+	}
+}
+
+// Check that phrases with blocked words are regenerated
+func TestBlockWords(t *testing.T) {
+	tree, err := Parse("word [ darn | heck | gosh ] a [ oh {word}! ] b [ oh heck ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		out, err := tree.Generate("a", BlockWords("DARN"), BlockPatterns(regexp.MustCompile(`h[e]ck`)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out != "oh gosh!" {
+			t.Fatalf("got \"%s\"", out)
+		}
+	}
+
+	var blocked *BlockedError
+
+	if _, err := tree.Generate("b", BlockWords("heck")); !errors.As(err, &blocked) || blocked.Match != "heck" {
+		t.Fatalf("expected a blocked error, got %v", err)
+	}
+
+	if _, err := tree.Generate("b", BlockWords("he")); err != nil {
+		t.Fatal("expected only whole words to be blocked")
+	}
+
+	// Check that blocked phrases don't start cooldowns
+	for i := 0; i < 20; i++ {
+		tree, _ = Parse("//!cooldown 3\na [ x | y ]")
+
+		if out, err := tree.Generate("a", BlockWords("x")); err != nil || out != "y" {
+			t.Fatalf("Generate(\"a\") returned \"%s\", %v", out, err)
+		}
+
+		if cooldowns := tree.defaultSession().cooldowns; len(cooldowns) != 1 {
+			t.Fatalf("Generate(\"a\") left cooldowns %v", cooldowns)
+		}
+	}
+}
+
+// Check replacing words of the output with synonyms
+func TestSynonyms(t *testing.T) {
+	tree, err := Parse("a [ Good food, good company. ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dictionary := map[string][]string{"good": {"great", "very fine"}}
+
+	if out, _ := tree.Generate("a", Synonyms(dictionary, 0)); out != "Good food, good company." {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	seen := map[string]bool{}
+
+	for i := 0; i < 50; i++ {
+		out, err := tree.Generate("a", Synonyms(dictionary, 1))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(strings.ToLower(out), "good") || !strings.HasSuffix(out, "company.") {
+			t.Fatalf("got \"%s\"", out)
+		}
+
+		seen[strings.Fields(out)[0]] = true
+	}
+
+	if !seen["Great"] || !seen["Very"] {
+		t.Fatalf("got first words %v, expected capitalized synonyms", seen)
+	}
+}
+
+// Check loading grammar packs, with their definitions namespaced
+func TestLoadPack(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"names/pack.json":   `{"name": "names", "version": "1.0.0", "files": ["*.g"]}`,
+		"names/first.g":     "first [ Alice | Bob ] title [ Sir ]",
+		"fantasy/pack.json": `{"name": "fantasy", "entries": ["npc", "quest", "hail"], "dependencies": ["../names"]}`,
+		"fantasy/npc.g":     "title [ the Brave ] npc [ {names.first} {title} {n=job}{n==smith?!:.} ] job [ smith ]",
+		"fantasy/quest.g": "quest [ {n=job} {n==smith?forge:farm} ] forge [ at the forge ] farm [ on a farm ] " +
+			"hail [ {greeting}! ] greeting@sv [ hej ]",
+		"loop/pack.json": `{"name": "loop", "dependencies": ["."]}`,
+		"loop/a.g":       "a [ x ]",
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree, err := LoadPack(filepath.Join(dir, "fantasy"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := tree.Generate("fantasy.npc")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out != "Alice the Brave smith!" && out != "Bob the Brave smith!" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if _, err := tree.Generate("names.first"); err == nil {
+		t.Fatal("expected only the entry points to be allowed")
+	}
+
+	if !tree.Has("names.title") || tree.Has("title") {
+		t.Fatal("expected every identifier to be namespaced")
+	}
+
+	if out, err := tree.Generate("fantasy.quest"); err != nil || out != "smith at the forge" {
+		t.Fatalf("Generate(\"fantasy.quest\") returned \"%s\", %v", out, err)
+	}
+
+	if out, err := tree.Generate("fantasy.hail", Locale("sv")); err != nil || out != "hej!" {
+		t.Fatalf("Generate(\"fantasy.hail\") returned \"%s\", %v", out, err)
+	}
+
+	if _, err := LoadPack(filepath.Join(dir, "loop", "pack.json")); err == nil {
+		t.Fatal("expected a pack depending on itself to fail")
+	}
+}
+
+// Check that grammars requiring unknown features are rejected
+func TestRequires(t *testing.T) {
+	if _, err := Parse("//!requires variables, plurals\na [ {n=1-5} {%n:one=coin,other=coins} ]"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Parse("//!requires variables,teleportation\na [ {n=1-5} {n@@@} ]")
+
+	if err == nil || !strings.Contains(err.Error(), "teleportation") {
+		t.Fatalf("expected an error about the missing feature, got %v", err)
+	}
+
+	if _, err := Parse("//!requires\na [ x ]"); err == nil {
+		t.Fatal("expected a requirement without features to fail")
+	}
+
+	if _, err := Parse("//!requires literals\na [ `{x}` ]"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Parse("//!requires dashes\na [ well <-> read ]"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Check counting the expansions of each definition
+func TestTrackUsage(t *testing.T) {
+	tree, err := Parse("name [ Alice | Bob ] greeting [ Hi {name}, bye {name} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tree.Usage() != nil {
+		t.Fatal("expected no usage before tracking it")
+	}
+
+	tree.TrackUsage()
+
+	for i := 0; i < 10; i++ {
+		if _, err := tree.Generate("greeting"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage := tree.Usage()
+
+	if usage.Phrases != 10 || usage.Definitions["greeting"] != 10 || usage.Definitions["name"] != 20 {
+		t.Fatalf("got %+v", usage)
+	}
+
+	if usage.Branches["name/[1/0"]+usage.Branches["name/[1/1"] != 20 {
+		t.Fatalf("got branches %v", usage.Branches)
+	}
+
+	usage.Phrases = 0
+
+	if tree.Usage().Phrases != 10 {
+		t.Fatal("expected Usage to return a copy")
+	}
+}
+
+// Check that an empty branch can be weighted
+func TestEmptyWeight(t *testing.T) {
+	tree, err := Parse("verdict [ I'm [very | _:4] sad ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	very := 0
+
+	for i := 0; i < 1000; i++ {
+		out, err := tree.Generate("verdict")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out == "I'm very sad" {
+			very++
+		} else if out != "I'm sad" {
+			t.Fatalf("got \"%s\"", out)
+		}
+	}
+
+	if very < 120 || very > 280 {
+		t.Fatalf("got \"very\" %d times out of 1000, expected about 200", very)
+	}
+
+	if def, _ := tree.Lookup("verdict"); def.Branches != 1 {
+		t.Fatalf("got %d branches", def.Branches)
+	}
+
+	for _, in := range []string{"a [ x | _:0 ]", "a [ x | _:4 y ]"} {
+		if _, err := Parse(in); err == nil {
+			t.Fatalf("\"%s\" should have failed", in)
+		}
+	}
+}
+
+// Check picking branches by rarity tier
+func TestTiers(t *testing.T) {
+	tree, err := Parse(`loot [ stick | sword {#tier=uncommon} | wand {#tier=rare} | crown {#tier=legendary} ]
+		chest [ [ gold | silver {#tier=rare} ] coins ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+
+	for i := 0; i < 2000; i++ {
+		result, err := tree.GenerateResult("loot")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counts[result.Text]++
+
+		if result.Text != "stick" && result.Metadata["tier"] == "" {
+			t.Fatalf("expected the tier in the metadata of \"%s\"", result.Text)
+		}
+	}
+
+	if counts["stick"] < 1000 || counts["crown"] < 40 || counts["crown"] > 200 {
+		t.Fatalf("got %v, expected about 1200 sticks and 100 crowns", counts)
+	}
+
+	for i := 0; i < 50; i++ {
+		out, err := tree.Generate("loot", MinTier("rare"), TierOdds(map[string]float64{"legendary": 0}))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out != "wand" {
+			t.Fatalf("got \"%s\", expected a wand", out)
+		}
+
+		if out, _ := tree.Generate("chest", MinTier("rare")); out != "silver coins" {
+			t.Fatalf("got \"%s\", expected silver", out)
+		}
+	}
+
+	if _, err := Parse("a [ x {#tier=mythic} ]"); err == nil {
+		t.Fatal("expected an unknown tier to fail")
+	}
+}
+
+// Check looking up and swapping trees in a registry
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	names, _ := Parse("first [ Alice ] last [ Smith ]")
+	quests, _ := Parse("quest [ Find the sword ]")
+
+	for name, tree := range map[string]*Tree{"names": names, "quests": quests} {
+		if _, err := registry.Swap(name, tree); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out, err := registry.Generate("names:first"); err != nil || out != "Alice" {
+		t.Fatalf("got \"%s\" (%v)", out, err)
+	}
+
+	if out, err := registry.Generate("names"); err != nil || out != "Smith" {
+		t.Fatalf("got \"%s\" (%v), expected the default identifier", out, err)
+	}
+
+	other, _ := Parse("first [ Bob ]")
+
+	if previous, _ := registry.Swap("names", other); previous != names {
+		t.Fatal("expected Swap to return the previous tree")
+	}
+
+	if out, _ := registry.Generate("names:first"); out != "Bob" {
+		t.Fatalf("got \"%s\" after swapping", out)
+	}
+
+	if !registry.Remove("quests") || registry.Remove("quests") {
+		t.Fatal("expected quests to be removed once")
+	}
+
+	if _, err := registry.Generate("quests:quest"); err == nil {
+		t.Fatal("expected a removed grammar to fail")
+	}
+
+	if !reflect.DeepEqual(registry.Names(), []string{"names"}) {
+		t.Fatalf("got %v", registry.Names())
+	}
+
+	if err := registry.Load("broken", filepath.Join(t.TempDir(), "missing.g")); err == nil || registry.Tree("broken") != nil {
+		t.Fatal("expected a failed load to leave the registry unchanged")
+	}
+
+	if _, err := registry.Swap("a:b", other); err == nil {
+		t.Fatal("expected a name with a colon to fail")
+	}
+}
+
+// Check writing generated phrases as JSON lines
+func TestWriteJSONL(t *testing.T) {
+	tree, err := Parse("name [ Alice {#female} | Bob | Carol {#female} ] greeting [ Hello, {name}! ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	if err := tree.WriteJSONL(&buf, "greeting", 5, JSONLSeed|JSONLID|JSONLMetadata); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	lines := 0
+
+	for scanner.Scan() {
+		var record struct {
+			Text     string            `json:"text"`
+			ID       string            `json:"id"`
+			Seed     uint64            `json:"seed"`
+			TraceID  string            `json:"trace_id"`
+			Metadata map[string]string `json:"metadata"`
+		}
+
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("\"%s\" failed (%s)", scanner.Text(), err)
+		}
+
+		if record.ID != "greeting" || record.TraceID != "" || (record.Metadata["female"] == "") != (record.Text == "Hello, Bob!") {
+			t.Fatalf("got %s", scanner.Text())
+		}
+
+		if out, _ := tree.Generate("greeting", Seed(record.Seed)); out != record.Text {
+			t.Fatalf("seed %d gave \"%s\", expected \"%s\"", record.Seed, out, record.Text)
+		}
+
+		lines++
+	}
+
+	if lines != 5 {
+		t.Fatalf("got %d lines", lines)
+	}
+
+	// Check that seeds are drawn from a source set with SetRand
+	var outs [2]string
+
+	for i := range outs {
+		var buf bytes.Buffer
+		s := tree.NewSession()
+		s.SetRand(randv2.New(randv2.NewPCG(1, 2)))
+
+		if err := s.WriteJSONL(&buf, "greeting", 3, JSONLSeed); err != nil {
+			t.Fatal(err)
+		}
+
+		outs[i] = buf.String()
+	}
+
+	if outs[0] != outs[1] {
+		t.Fatalf("got different seeds from the same source:\n%s\n%s", outs[0], outs[1])
+	}
+}
+
+// Check that a tree survives a round trip through protocol buffers
+func TestMarshalProto(t *testing.T) {
+	tree, err := Parse(`//!private
+		//!stock
+		//!expect /^[A-Z]/
+		//!cooldown 2
+		name [ Alice | Bob {#tier=rare} ]
+		greeting [ Hello [* dear | _:3 ] {name}! ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.LoadWeights(strings.NewReader(`{"name/[1/0": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.AllowEntries("greeting")
+	data, err := tree.MarshalProto()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := UnmarshalProto(data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied.Format(DisplaySource) != tree.Format(DisplaySource) {
+		t.Fatalf("got\n%s\nexpected\n%s", copied.Format(DisplaySource), tree.Format(DisplaySource))
+	}
+
+	if again, _ := copied.MarshalProto(); !bytes.Equal(again, data) {
+		t.Fatal("expected the copy to marshal to the same bytes")
+	}
+
+	for seed := uint64(0); seed < 20; seed++ {
+		expected, _ := tree.NewSession().Generate("greeting", Seed(seed))
+
+		if out, _ := copied.NewSession().Generate("greeting", Seed(seed)); out != expected {
+			t.Fatalf("got \"%s\", expected \"%s\"", out, expected)
+		}
+	}
+
+	if def := copied.findDefinition("name"); !def.directives.stock {
+		t.Fatal("expected //!stock to be kept")
+	}
+
+	if _, err := copied.Generate("name"); !errors.Is(err, ErrPrivate) {
+		t.Fatalf("expected the directives to be kept, got %v", err)
+	}
+
+	if failures := copied.RunTests(); len(failures) != 0 {
+		t.Fatalf("got %v", failures)
+	}
+
+	if _, err := UnmarshalProto(data[:len(data)-1]); err == nil {
+		t.Fatal("expected truncated data to fail")
+	}
+}
+
+// Check rhymes, alliteration and the constraints that use them
+func TestRhyme(t *testing.T) {
+	for _, pair := range [][2]string{{"cat", "hat"}, {"night", "light"}, {"cake", "lake"}, {"play", "day"}} {
+		if EnglishSpelling.Rhyme(pair[0]) != EnglishSpelling.Rhyme(pair[1]) {
+			t.Fatalf("expected %s to rhyme with %s", pair[0], pair[1])
+		}
+	}
+
+	if EnglishSpelling.Rhyme("cat") == EnglishSpelling.Rhyme("cake") {
+		t.Fatal("expected cat not to rhyme with cake")
+	}
+
+	tree, err := Parse(`word [ cat | hat | dog | log | bat | fog ]
+		adjective [ big | fluffy | brave | daring ]
+		noun [ bear | dragon | fox | bee ]
+		couplet [ {a=word} {word:rhyme=a} ]
+		slogan [ {b=adjective} {noun:alliterate=b} ]
+		never [ {a=word} {adjective:rhyme=a} ]`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		out, err := tree.Generate("couplet")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if words := strings.Fields(out); words[0] == words[1] || words[0][1:] != words[1][1:] {
+			t.Fatalf("got \"%s\"", out)
+		}
+
+		out, err = tree.Generate("slogan")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out[0] != strings.Fields(out)[1][0] {
+			t.Fatalf("got \"%s\"", out)
+		}
+	}
+
+	if _, err := tree.Generate("never"); err == nil {
+		t.Fatal("expected an impossible rhyme to fail")
+	}
+
+	// Rejected attempts leave no trace
+	s := tree.NewSession()
+	s.TrackUsage()
+
+	for i := 0; i < 100; i++ {
+		result, err := s.GenerateResult("couplet", RecordDecisions())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result.Branches) != 3 || len(result.Decisions.Children[0].Children) != 2 {
+			t.Fatalf("got branches %v and decisions %v", result.Branches, result.Decisions.Children[0].Children)
+		}
+	}
+
+	if usage := s.Usage(); usage.Definitions["word"] != 200 {
+		t.Fatalf("got usage %v", usage.Definitions)
+	}
+}
+
+// Check that stock uses up branches by their weights
+func TestStock(t *testing.T) {
+	tree, err := Parse("//!stock\nitem [ sword | shield ] loot [ {*item} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.LoadWeights(strings.NewReader(`{"item/[1/0": 3}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+
+	for i := 0; i < 4; i++ {
+		out, err := tree.Generate("loot")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counts[out]++
+	}
+
+	if counts["sword"] != 3 || counts["shield"] != 1 {
+		t.Fatalf("got %v", counts)
+	}
+
+	if _, err := tree.Generate("loot"); err == nil {
+		t.Fatal("expected the stock to run out")
+	}
+
+	// Uses are counted in a single key, which can be restored
+	if used := tree.defaultSession().Used(); !slices.Contains(used, "stock item/[1/0 3") {
+		t.Fatalf("got %v", used)
+	}
+
+	tree.defaultSession().SetUsed([]string{"stock item/[1/0 1", "stock item/[1/0 2"})
+
+	if out, err := tree.Generate("loot"); err != nil || out != "sword" && out != "shield" {
+		t.Fatalf("got \"%s\" (%v) after SetUsed", out, err)
+	}
+
+	if n := tree.defaultSession().uniqueUsed["stock item/[1/0"]; n != 2 && n != 3 {
+		t.Fatalf("got %d uses after SetUsed", n)
+	}
+
+	tree.Reset()
+
+	if left, _ := tree.Remaining("item"); len(left) != 2 {
+		t.Fatalf("got %v after a reset", left)
+	}
+
+	// Check that an empty branch generated directly leaves nothing
+	tree, _ = Parse("//!stock\njoke [ Why did the chicken... | Knock knock... | _:3 ]")
+
+	for i := 0; i < 50; i++ {
+		if out, err := tree.Generate("joke"); err != nil || out == "_" {
+			t.Fatalf("got \"%s\" (%v)", out, err)
+		}
+	}
+}
+
+// Check the transforms of the output
+func TestTransforms(t *testing.T) {
+	if out := AlternatingCase("no way, really"); out != "nO wAy, ReAlLy" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if out := Leet("Elite hackers"); out != "3l173 h4ck3r5" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if out := SmallCaps("Hello, x!"); out != "ʜᴇʟʟᴏ, x!" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	tree, err := Parse("excuse [ i forgot ] mock [ Oh, {excuse:alternating}. ] cool [ {excuse:leet:smallcaps} ]")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, _ := tree.Generate("mock"); out != "Oh, i FoRgOt." {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if out, _ := tree.Generate("cool"); out != "1 ꜰ0ʀɢ07" {
+		t.Fatalf("got \"%s\"", out)
+	}
+}
+
+// Check that the same seed gives the same phrases
+func TestSeed(t *testing.T) {
+	in := "a [ 1 | 2 | 3 | 4 | 5 | 6 | 7 | 8 | 9 ]"
+	var outs [2]string
+
+	for i := range outs {
+		tree, err := Parse(in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		tree.Seed(42)
+
+		for j := 0; j < 10; j++ {
+			out, _ := tree.Generate("a")
+			outs[i] += out
+		}
+	}
+
+	if outs[0] != outs[1] {
+		t.Fatalf("trees seeded alike generated \"%s\" and \"%s\"", outs[0], outs[1])
+	}
+
+	tree, _ := Parse(in)
+	tree.SetRand(randv2.New(newSource(42)))
+	out := ""
+
+	for j := 0; j < 10; j++ {
+		phrase, _ := tree.Generate("a")
+		out += phrase
+	}
+
+	if out != outs[0] {
+		t.Fatalf("SetRand generated \"%s\", expected \"%s\"", out, outs[0])
+	}
+
+	if _, err := tree.defaultSession().Snapshot(); err == nil {
+		t.Fatal("Snapshot() succeeded with a source set by SetRand")
+	}
+}
+
+// Check writing every phrase of a definition
+func TestWriteAll(t *testing.T) {
+	in := "a [ x | y | x ] b [ {a} {a} | z ] c [ x | {c} x ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	var out bytes.Buffer
+
+	if err := tree.WriteAll(&out, "b", 0); err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	if out.String() != "x x\nx y\ny x\ny y\nz\n" {
+		t.Fatalf("WriteAll(\"b\") wrote %q", out.String())
+	}
+
+	out.Reset()
+
+	if err := tree.WriteAll(&out, "c", 3); err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	if out.String() != "x\nx x\nx x x\n" {
+		t.Fatalf("WriteAll(\"c\", 3) wrote %q", out.String())
+	}
+
+	out.Reset()
+
+	if err := tree.WriteAll(&out, "c", 0, MaxExpansions(2)); err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	if out.String() != "x\nx x\nx x x\n" {
+		t.Fatalf("WriteAll(\"c\", 0, MaxExpansions(2)) wrote %q", out.String())
+	}
+}
+
+// Check that sessions of one tree can be used concurrently
+func TestConcurrentSessions(t *testing.T) {
+	in := "name [* Alice | Bob | Carol | Dave ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	var wg sync.WaitGroup
+	names := make([][]string, 8)
+
+	for i := range names {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			s := tree.NewSession()
+
+			for j := 0; j < 4; j++ {
+				out, _ := s.Generate("*name")
+				names[i] = append(names[i], out)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Each session uses up the names on its own
+	for _, got := range names {
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, []string{"Alice", "Bob", "Carol", "Dave"}) {
+			t.Fatalf("session generated %v", got)
+		}
+	}
+}
+
+// Check enumerating every distinct phrase of a definition
+func TestEnumerate(t *testing.T) {
+	in := "greeting [ [ Hello | Hi ] {*name} | Hey ] name [* Alice | Bob ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	var got []string
+
+	for phrase, err := range tree.Enumerate("greeting") {
+		if err != nil {
+			t.Fatalf("Enumerate(\"greeting\") failed (%s)", err)
+		}
+
+		got = append(got, phrase)
+	}
+
+	if expected := []string{"Hello Alice", "Hello Bob", "Hi Alice", "Hi Bob", "Hey"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Enumerate(\"greeting\") returned %v, expected %v", got, expected)
+	}
+
+	// Enumeration doesn't use up exclusive substitutions
+	if remaining, _ := tree.Remaining("name"); len(remaining) != 2 {
+		t.Fatalf("Remaining(\"name\") returned %v after enumeration", remaining)
+	}
+
+	for range tree.Enumerate("greeting") {
+		break
+	}
+
+	// Branches already used up by exclusive substitutions are enumerated all the same
+	tree.Generate("greeting")
+	tree.Generate("greeting")
+	used := tree.Used()
+
+	if got := slices.Collect(maps.Keys(maps.Collect(tree.Enumerate("greeting")))); len(got) != 5 {
+		t.Fatalf("Enumerate(\"greeting\") after exclusive use returned %v", got)
+	}
+
+	if !reflect.DeepEqual(tree.Used(), used) {
+		t.Fatalf("Enumerate(\"greeting\") changed the used branches to %v, expected %v", tree.Used(), used)
+	}
+
+	tree, _ = Parse("//!cooldown 3\na [ x | y | z ]")
+	tree.Generate("a")
+	cooldowns := maps.Clone(tree.defaultSession().cooldowns)
+
+	if got := slices.Collect(maps.Keys(maps.Collect(tree.Enumerate("a")))); len(got) != 3 {
+		t.Fatalf("Enumerate(\"a\") with a cooldown returned %v", got)
+	}
+
+	if !maps.Equal(tree.defaultSession().cooldowns, cooldowns) {
+		t.Fatalf("Enumerate(\"a\") changed the cooldowns to %v", tree.defaultSession().cooldowns)
+	}
+
+	for phrase, err := range tree.Enumerate("nosuchid") {
+		if !errors.Is(err, ErrUnknownIdentifier) {
+			t.Fatalf("Enumerate(\"nosuchid\") returned \"%s\", %v", phrase, err)
+		}
+	}
+
+	if len(maps.Collect(tree.Enumerate("nosuchid"))) != 1 {
+		t.Fatalf("Enumerate(\"nosuchid\") didn't return an error")
+	}
+}
+
+// Check counting the phrases a definition can produce
+func TestCountPhrases(t *testing.T) {
+	in := "name [ Alice | Bob | Carol ] greeting [ [ Hello | Hi ] {*name:title} | Hey ] dice [ {n=1-6} {d=1-6} ] " +
+		"song [ {line*1-2} ] line [ la | da ] story [ {~intro,=end} ] intro [ a | b ] end [ c ] loop [ x | {loop} ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	for id, expected := range map[string]int64{"greeting": 7, "dice": 36, "song": 6, "story": 2} {
+		count, err := tree.CountPhrases(id)
+
+		if err != nil {
+			t.Fatalf("CountPhrases(\"%s\") failed (%s)", id, err)
+		}
+
+		if count.Int64() != expected {
+			t.Errorf("CountPhrases(\"%s\") returned %s, expected %d", id, count, expected)
+		}
+	}
+
+	if _, err := tree.CountPhrases("loop"); err == nil {
+		t.Error("CountPhrases(\"loop\") didn't fail for a recursive definition")
+	}
+
+	// Check that counting and patterns read sequences the way generation does
+	for _, in := range []string{"a [ {1-6x} ]", "a [ {1-3*2} ]"} {
+		tree, err := Parse(in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		_, generateErr := tree.Generate("a")
+		_, countErr := tree.CountPhrases("a")
+		_, patternErr := tree.Regexp("a")
+
+		if generateErr == nil || countErr == nil || patternErr == nil {
+			t.Errorf("\"%s\" gave %v, %v and %v, expected no such definition", in, generateErr, countErr, patternErr)
+		}
+	}
+}
+
+// Check truncating phrases between words
+func TestTruncate(t *testing.T) {
+	for _, test := range []struct {
+		in       string
+		max      int
+		options  TruncateOption
+		expected string
+	}{
+		{"The Lord of the Rings", 30, 0, "The Lord of the Rings"},
+		{"The Lord of the Rings", 14, 0, "The Lord of"},
+		{"The Lord of the Rings", 14, TruncateStopWords, "The Lord"},
+		{"Swords, sorcery and more", 20, 0, "Swords, sorcery and"},
+		{"Swords, sorcery and more", 20, TruncateStopWords, "Swords, sorcery"},
+		{"Swords, sorcery and more", 20, TruncateStopWords | TruncatePunctuation, "Swords, sorcery"},
+		{"Swords, sorcery and more", 10, TruncatePunctuation, "Swords"},
+		{"Swords — and sorcery", 10, TruncatePunctuation, "Swords"},
+		{"Supercalifragilistic day", 5, 0, "Super"},
+	} {
+		if out := Truncate(test.in, test.max, "en", test.options); out != test.expected {
+			t.Errorf("Truncate(\"%s\", %d) returned \"%s\", expected \"%s\"", test.in, test.max, out, test.expected)
+		}
+	}
+}
+
+// Check that every phrase index gives a phrase of its own
+func TestGenerateIndex(t *testing.T) {
+	in := "greeting [ [ Hello | Hi ] {name} {n=1-2} | Hey ] name [ Alice | Bob | Carol ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	var all []string
+
+	for phrase := range tree.Enumerate("greeting") {
+		all = append(all, phrase)
+	}
+
+	var got []string
+
+	for n := uint64(0); n < 13; n++ {
+		out, err := tree.GenerateIndex("greeting", n)
+
+		if err != nil {
+			t.Fatalf("GenerateIndex(\"greeting\", %d) failed (%s)", n, err)
+		}
+
+		if again, _ := tree.GenerateIndex("greeting", n); again != out {
+			t.Fatalf("GenerateIndex(\"greeting\", %d) returned \"%s\", then \"%s\"", n, out, again)
+		}
+
+		got = append(got, out)
+	}
+
+	if len(all) != 13 {
+		t.Fatalf("Enumerate(\"greeting\") returned %d phrases", len(all))
+	}
+
+	sort.Strings(all)
+	sort.Strings(got)
+
+	if !reflect.DeepEqual(got, all) {
+		t.Fatalf("GenerateIndex returned %v, expected %v", got, all)
+	}
+
+	// Indexes wrap around
+	first, _ := tree.GenerateIndex("greeting", 0)
+
+	if out, _ := tree.GenerateIndex("greeting", 13); out != first {
+		t.Fatalf("GenerateIndex(\"greeting\", 13) returned \"%s\", expected \"%s\"", out, first)
+	}
+
+	// Check that cooldowns neither change the phrase nor are started
+	tree, _ = Parse("//!cooldown 3\na [ x | y | z ]")
+	before := make([]string, 3)
+
+	for n := range before {
+		before[n], _ = tree.GenerateIndex("a", uint64(n))
+	}
+
+	if len(tree.defaultSession().cooldowns) != 0 {
+		t.Fatalf("GenerateIndex(\"a\") started cooldowns %v", tree.defaultSession().cooldowns)
+	}
+
+	tree.Generate("a")
+	tree.Generate("a")
+
+	for n, expected := range before {
+		if out, _ := tree.GenerateIndex("a", uint64(n)); out != expected {
+			t.Fatalf("GenerateIndex(\"a\", %d) returned \"%s\" during a cooldown, expected \"%s\"", n, out, expected)
+		}
+	}
+
+	// Check that branches used up by exclusive substitutions neither change the phrase nor are used up
+	tree, _ = Parse("a [ x | y | z ] b [ {*a} ]")
+
+	for n := range before {
+		before[n], _ = tree.GenerateIndex("b", uint64(n))
+	}
+
+	tree.Generate("b")
+	tree.Generate("b")
+	used := tree.Used()
+
+	for n, expected := range before {
+		if out, _ := tree.GenerateIndex("b", uint64(n)); out != expected {
+			t.Fatalf("GenerateIndex(\"b\", %d) returned \"%s\" after exclusive use, expected \"%s\"", n, out, expected)
+		}
+	}
+
+	if !reflect.DeepEqual(tree.Used(), used) {
+		t.Fatalf("GenerateIndex(\"b\") changed the used branches to %v, expected %v", tree.Used(), used)
+	}
+}
+
+// Check the output settings of sessions
+func TestSessionConfig(t *testing.T) {
+	in := "greeting [ hello -- {name} ] greeting@sv [ hej -- {name} ] greeting@en-GB [ hi -- {name} ] " +
+		"name [ the lord of the rings ] list [ {item*3} ] item [ a ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	swedish := tree.NewSession()
+	swedish.SetConfig(SessionConfig{Locales: []string{"sv"}, Case: CaseSentence})
+	english := tree.NewSession()
+	english.SetConfig(SessionConfig{Joiner: ", ", Typography: true, Case: CaseTitle})
+
+	if out, _ := swedish.Generate("greeting"); out != "Hej -- the lord of the rings" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if out, _ := english.Generate("greeting"); out != "Hello — the Lord of the Rings" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if out, _ := english.Generate("list"); out != "A, a, A" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	// Locales of a call are preferred to those of the session
+	if out, _ := swedish.Generate("greeting", Locale("en-GB")); out != "Hi -- the lord of the rings" {
+		t.Fatalf("got \"%s\"", out)
+	}
+
+	if out, _ := tree.Generate("greeting"); out != "hello -- the lord of the rings" {
+		t.Fatalf("got \"%s\"", out)
+	}
+}
+
+// Check generating a batch of phrases
+func TestGenerateMany(t *testing.T) {
+	in := "name [* Alice | Bob | Carol ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	names, err := tree.GenerateMany("*name", 3)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	sort.Strings(names)
+
+	if !reflect.DeepEqual(names, []string{"Alice", "Bob", "Carol"}) {
+		t.Fatalf("GenerateMany(\"*name\", 3) returned %v", names)
+	}
+
+	tree.Reset()
+
+	if names, err := tree.GenerateMany("*name", 4); err == nil || len(names) != 3 {
+		t.Fatalf("GenerateMany(\"*name\", 4) returned %v, %v", names, err)
+	}
+
+	if names, err := tree.GenerateMany("name", -1); err == nil || names != nil {
+		t.Fatalf("GenerateMany(\"name\", -1) returned %v, %v", names, err)
+	}
+
+	tree.Reset()
+
+	if names, err := tree.GenerateMany("*name", math.MaxInt); err == nil || len(names) != 3 {
+		t.Fatalf("GenerateMany(\"*name\", math.MaxInt) returned %v, %v", names, err)
+	}
+}
+
+// Check that branches which can't be picked are left out with the odds of the others kept
+func TestEligibleBranches(t *testing.T) {
+	in := "name [* Alice | Bob | Carol ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	if err := tree.MarkUsedText("name", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	used := tree.Used()
+	counts := make(map[string]int)
+
+	// Bob and Carol are equally likely, even though Bob follows the branch left out
+	for i := 0; i < 4000; i++ {
+		tree.SetUsed(used)
+		out, _ := tree.Generate("*name")
+		counts[out]++
+	}
+
+	if counts["Alice"] > 0 || counts["Bob"] < 1800 || counts["Carol"] < 1800 {
+		t.Fatalf("picked %v", counts)
+	}
+}
+
+// Check generating phrases that all differ
+func TestGenerateDistinct(t *testing.T) {
+	in := "answer [ red | red | red | red | red | red | red | red | red | blue | green ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	answers, err := tree.GenerateDistinct("answer", 3)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	sort.Strings(answers)
+
+	if !reflect.DeepEqual(answers, []string{"blue", "green", "red"}) {
+		t.Fatalf("GenerateDistinct(\"answer\", 3) returned %v", answers)
+	}
+
+	if _, err := tree.GenerateDistinct("answer", 4); err == nil {
+		t.Fatal("GenerateDistinct(\"answer\", 4) didn't fail")
+	}
+}
+
+// Check the issues found by the linter
+func TestLint(t *testing.T) {
+	in := "colors [ red | green | blue | cyan ]\nnested [ a [ b [ c | d ] | e ] | f ]\nlength [ a | " +
+		strings.Repeat("x", 50) + " ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	issues := tree.Lint(LintThresholds{MaxBranches: 3, MaxDepth: 2, MaxLengthDeviation: 10})
+
+	if len(issues) != 3 {
+		t.Fatalf("Lint returned %v", issues)
+	}
+
+	for i, expected := range []string{":1: colors: group has 4 branches", ":2: nested: groups are nested 3 deep",
+		":3: length: phrase length deviates"} {
+		if !strings.Contains(issues[i].String(), expected) {
+			t.Errorf("issue %d is \"%s\", expected \"%s\"", i, issues[i], expected)
+		}
+	}
+
+	if issues := tree.Lint(LintThresholds{}); len(issues) != 0 {
+		t.Fatalf("Lint without thresholds returned %v", issues)
+	}
+
+	tree, _ = Parse("a [ x {a} ]")
+
+	if issues := tree.Lint(LintThresholds{MaxLengthDeviation: 3}); len(issues) != 0 {
+		t.Fatalf("Lint of a runaway definition returned %v", issues)
+	}
+}
+
+// Check splitting the output into words and punctuation
+func TestGenerateTokens(t *testing.T) {
+	in := "line [ Well-known? Don't \"panic\"... ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	tokens, err := tree.GenerateTokens("line")
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	expected := []Token{{"Well-known", ""}, {"?", " "}, {"Don't", " "}, {"\"", ""}, {"panic", ""}, {"\"...", ""}}
+
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Fatalf("GenerateTokens(\"line\") returned %q", tokens)
+	}
+
+	// Check that literals stay single tokens, and that the tokens follow the options of the output
+	in = "line [ Type `rm -rf /tmp` now ]"
+	tree, err = Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	tokens, err = tree.GenerateTokens("line", FinalNewline())
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	expected = []Token{{"Type", " "}, {"rm -rf /tmp", " "}, {"now", "\n"}}
+
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Fatalf("GenerateTokens(\"line\", FinalNewline()) returned %q", tokens)
+	}
+}
+
+// Check that validation finds undefined identifiers
+func TestValidate(t *testing.T) {
+	in := "greeting@en [ Hello ] quest [ Find {*item:plural} | {~=intro,middle} | {n=1-5} {greeting} ] item [ sword ]\n" +
+		"intro [ {itme} ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	err = tree.Validate()
+	var undefined *UndefinedError
+
+	if !errors.As(err, &undefined) || undefined.ID != "middle" || !strings.HasSuffix(undefined.Source, ":1") {
+		t.Fatalf("Validate() returned %v", err)
+	}
+
+	if !strings.Contains(err.Error(), ":2: no such definition: itme") {
+		t.Fatalf("Validate() returned %v", err)
+	}
+
+	if tree, _ := Parse("a [ {b} ] b [ c ]"); tree.Validate() != nil {
+		t.Fatalf("Validate() returned %v", tree.Validate())
+	}
+}
+
+// Check that validation finds definitions that can't terminate
+func TestValidateCycles(t *testing.T) {
+	in := "a [ {b} ] b [ x {a} | {a} ] list [ {item} | {item}, {list} ] item [ x ] song [ {song*0-2} la ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	var ids []string
+
+	for _, err := range tree.Validate().(interface{ Unwrap() []error }).Unwrap() {
+		var cycle *CycleError
+
+		if !errors.As(err, &cycle) {
+			t.Fatalf("Validate() returned %v", err)
+		}
+
+		ids = append(ids, cycle.ID)
+	}
+
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Fatalf("Validate() reported cycles of %v", ids)
+	}
+}
+
+// Check picking trees by weight
+func TestChooser(t *testing.T) {
+	banter, _ := Parse("line [ Nice weather. ]")
+	seasonal, _ := Parse("line [ Happy holidays! ] other [ x ]")
+	chooser := NewChooser()
+
+	if _, err := chooser.Generate(); err == nil {
+		t.Fatal("Generate() succeeded without entries")
+	}
+
+	if err := chooser.Add(seasonal, "missing", 1); err == nil {
+		t.Fatal("Add() accepted an undefined identifier")
+	}
+
+	if err := chooser.Add(banter, "line", 80); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chooser.Add(seasonal, "line", 20); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+
+	for i := 0; i < 2000; i++ {
+		out, err := chooser.Generate()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counts[out]++
+	}
+
+	if counts["Nice weather."] < 1500 || counts["Happy holidays!"] < 300 {
+		t.Fatalf("generated %v", counts)
+	}
+
+	first, _ := chooser.Generate(Seed(7))
+
+	for i := 0; i < 10; i++ {
+		if out, _ := chooser.Generate(Seed(7)); out != first {
+			t.Fatalf("Generate(Seed(7)) returned \"%s\", then \"%s\"", first, out)
+		}
+	}
+}
+
+// Check generating regular expressions matching the phrases of a definition
+func TestRegexp(t *testing.T) {
+	in := "name [ Alice | Bob ] greeting [ [ Hello | Hi ] {name:title}, you have {n=1-9} {%n:one=cat,other=cats}! | " +
+		"^hey {name}. ] loop [ x {loop} | y ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	re, err := tree.Regexp("greeting")
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if out, _ := tree.Generate("greeting"); !re.MatchString(out) {
+			t.Fatalf("%s doesn't match \"%s\"", re, out)
+		}
+	}
+
+	for _, out := range []string{"Bye Alice", "Hello Carol, you have 3 cats!", "Hey Alice"} {
+		if re.MatchString(out) {
+			t.Fatalf("%s matches \"%s\"", re, out)
+		}
+	}
+
+	if _, err := tree.Regexp("loop"); err == nil {
+		t.Fatal("Regexp(\"loop\") didn't fail for a recursive definition")
+	}
+}
+
+// Check the limit on the nesting depth of substitutions
+func TestMaxDepth(t *testing.T) {
+	in := "list [ {list}, x ] short [ {item} ] item [ {thing} ] thing [ x ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	_, err = tree.Generate("list", MaxDepth(5))
+	var limit *LimitError
+
+	if !errors.As(err, &limit) || limit.Max != 5 || !strings.Contains(err.Error(), "(list)") {
+		t.Fatalf("Generate(\"list\", MaxDepth(5)) returned %v", err)
+	}
+
+	if out, err := tree.Generate("short", MaxDepth(2)); err != nil || out != "x" {
+		t.Fatalf("Generate(\"short\", MaxDepth(2)) returned \"%s\", %v", out, err)
+	}
+
+	if _, err := tree.Generate("short", MaxDepth(1)); !errors.As(err, &limit) {
+		t.Fatalf("Generate(\"short\", MaxDepth(1)) returned %v", err)
+	}
+
+	tree, _ = Parse("d [ x ] c [ {d} ] b [ {c} ] a [ {b} ]")
+
+	_, err = tree.Generate("a", MaxDepth(2))
+
+	if !errors.As(err, &limit) || !slices.Equal(limit.Chain, []string{"b", "c", "d"}) {
+		t.Fatalf("Generate(\"a\", MaxDepth(2)) returned %v", err)
+	}
+}
+
+// Check identifiers computed by resolvers
+func TestResolve(t *testing.T) {
+	in := "reply [ {n=2-2} {recall:title} ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	recall := func(ctx *ResolveContext) (string, error) {
+		if len(ctx.Recent) == 0 {
+			return "first " + ctx.Variables["n"], nil
+		}
+
+		return "after " + ctx.Recent[0], nil
+	}
+
+	tree.KeepRecent(2)
+	var outs []string
+
+	for i := 0; i < 3; i++ {
+		out, err := tree.Generate("reply", Resolve("recall", recall))
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		outs = append(outs, out)
+	}
+
+	expected := []string{"2 First 2", "2 After 2 First 2", "2 After 2 After 2 First 2"}
+
+	if !reflect.DeepEqual(outs, expected) {
+		t.Fatalf("generated %q, expected %q", outs, expected)
+	}
+
+	if recent := tree.defaultSession().Recent(); len(recent) != 2 || recent[0] != outs[2] {
+		t.Fatalf("Recent() returned %q", recent)
+	}
+}
+
+// Check the limits set on a session
+func TestSessionLimits(t *testing.T) {
+	in := "bomb [ {bomb} {bomb} ] word [ abcdefghij ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	s := tree.NewSession()
+	s.SetConfig(SessionConfig{MaxExpansions: 100, MaxLength: 5})
+	var limit *LimitError
+
+	if _, err := s.Generate("bomb"); !errors.As(err, &limit) || limit.Limit != "expansion" {
+		t.Fatalf("Generate(\"bomb\") returned %v", err)
+	}
+
+	if _, err := s.Generate("word"); !errors.As(err, &limit) || limit.Limit != "output length" {
+		t.Fatalf("Generate(\"word\") returned %v", err)
+	}
+
+	// The limits of a call are preferred
+	if out, err := s.Generate("word", MaxLength(20)); err != nil || out != "abcdefghij" {
+		t.Fatalf("Generate(\"word\", MaxLength(20)) returned \"%s\", %v", out, err)
+	}
+}
+
+// Check the location and snippet of parse errors
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		in      string
+		line    int
+		column  int
+		snippet string
+		message string
+	}{
+		{"a [ b ]\nc [ d ] ]", 2, 9, "]", "stray ]"},
+		{"a [ b | c ]\n\n  é [ x ] ] [ y ]", 3, 11, "]", "stray ]"},
+		{"a [ b ]\nb [ {c ]", 2, 5, "{c", "unterminated substitution \"{c\""},
+		{"a [ b ]\na [ c ]", 2, 1, "a", "duplicate identifier \"a\" (also defined at :1)"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.in)
+		var parseErr *ParseError
+
+		if !errors.As(err, &parseErr) {
+			t.Fatalf("\"%s\" returned %v", test.in, err)
+		}
+
+		if parseErr.File != "" || parseErr.Line != test.line || parseErr.Column != test.column ||
+			parseErr.Snippet != test.snippet || parseErr.Message != test.message {
+			t.Fatalf("\"%s\" returned %+v", test.in, *parseErr)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "broken.g")
+
+	if err := os.WriteFile(path, []byte("a [ b ]\n\nc [ d | e ] ]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ParseFiles([]string{path})
+	var parseErr *ParseError
+
+	if !errors.As(err, &parseErr) || parseErr.File != path || parseErr.Line != 3 || parseErr.Column != 13 {
+		t.Fatalf("ParseFiles returned %v", err)
+	}
+
+	if want := "stray ] at " + path + ":3"; err.Error() != want {
+		t.Fatalf("ParseFiles returned \"%s\", expecting \"%s\"", err, want)
+	}
+}
+
+// Check generating any definition with a prefix
+func TestGenerateAny(t *testing.T) {
+	in := `monster.orc [ orc ] monster.troll [ troll ] monster.ghost@sv [ spöke ]
+//!private
+monster.helper [ helper ] item.sword [ sword ]`
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	tree.Seed(1)
+	seen := make(map[string]int)
+
+	for i := 0; i < 200; i++ {
+		out, err := tree.GenerateAny("monster.")
+
+		if err != nil {
+			t.Fatalf("GenerateAny(\"monster.\") failed (%s)", err)
+		}
+
+		seen[out]++
+	}
+
+	if len(seen) != 2 || seen["orc"] < 60 || seen["troll"] < 60 {
+		t.Fatalf("GenerateAny(\"monster.\") returned %v", seen)
+	}
+
+	if out, err := tree.GenerateAny("monster.", Locale("sv"), AnyWeights(map[string]float64{"monster.orc": 0,
+		"monster.troll": 0})); err != nil || out != "spöke" {
+		t.Fatalf("GenerateAny(\"monster.\") with weights returned \"%s\", %v", out, err)
+	}
+
+	if _, err := tree.GenerateAny("vehicle."); err == nil {
+		t.Fatalf("GenerateAny(\"vehicle.\") succeeded")
+	}
+}
+
+// Check that a parse reports all errors it finds
+func TestParseErrors(t *testing.T) {
+	in := `greeting [ hello | hi ] ]
+name [ {first last ]
+//!cooldown x
+place [ here | there ]
+broken [ a | | b ]
+place [ elsewhere ]
+end [ done ]`
+	_, err := Parse(in)
+	errs := ParseErrors(err)
+	want := []struct {
+		line    int
+		message string
+	}{
+		{1, "stray ]"},
+		{2, "unterminated substitution \"{first\""},
+		{3, "directive cooldown expects a number of generations"},
+		{5, "stray | in group"},
+		{6, "duplicate identifier \"place\" (also defined at :4)"},
+	}
+
+	if len(errs) != len(want) {
+		t.Fatalf("\"%s\" returned %v", in, err)
+	}
+
+	for i, w := range want {
+		if errs[i].Line != w.line || !strings.HasPrefix(errs[i].Message, w.message) {
+			t.Fatalf("error %d is %+v, expecting %s at line %d", i, *errs[i], w.message, w.line)
+		}
+	}
+
+	// A single error isn't joined
+	if _, err := Parse("a [ b ] ]"); len(ParseErrors(err)) != 1 {
+		t.Fatalf("\"a [ b ] ]\" returned %v", err)
+	} else if _, ok := err.(*ParseError); !ok {
+		t.Fatalf("\"a [ b ] ]\" returned %T", err)
+	}
+}
+
+// Check rendering undefined identifiers as placeholders
+func TestLenient(t *testing.T) {
+	in := "quest [ {Villain} steals the {*artifact:plural} from {hero} ] hero [ Ada ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	if _, err := tree.Generate("quest"); err == nil {
+		t.Fatalf("Generate(\"quest\") succeeded")
+	}
+
+	result, err := tree.GenerateResult("quest", Lenient())
+
+	if err != nil {
+		t.Fatalf("GenerateResult(\"quest\", Lenient()) failed (%s)", err)
+	}
+
+	if want := "⟨Villain⟩ steals the ⟨artifact⟩ from Ada"; result.Text != want {
+		t.Fatalf("GenerateResult(\"quest\", Lenient()) returned \"%s\", expecting \"%s\"", result.Text, want)
+	}
+
+	want := []string{"no such definition: Villain", "no such definition: artifact"}
+
+	if !reflect.DeepEqual(result.Warnings, want) {
+		t.Fatalf("GenerateResult(\"quest\", Lenient()) warned %q", result.Warnings)
+	}
+
+	if _, err := tree.Generate("villain", Lenient()); err == nil {
+		t.Fatalf("Generate(\"villain\", Lenient()) succeeded")
+	}
+}
+
+// Check forcing and forbidding branches
+func TestForceBranch(t *testing.T) {
+	in := "diary [ Monday [ rain | sun ] | Tuesday | Wednesday ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	branches, err := tree.Branches("diary")
+
+	if err != nil {
+		t.Fatalf("Branches(\"diary\") failed (%s)", err)
+	}
+
+	want := []Branch{{"diary/[1/0", "Monday [ rain | sun ]"}, {"diary/[2/0", "rain"}, {"diary/[2/1", "sun"},
+		{"diary/[1/1", "Tuesday"}, {"diary/[1/2", "Wednesday"}}
+
+	if !reflect.DeepEqual(branches, want) {
+		t.Fatalf("Branches(\"diary\") returned %v", branches)
+	}
+
+	for i := 0; i < 20; i++ {
+		if out, err := tree.Generate("diary", ForceBranch("diary/[1/0", "diary/[2/1")); err != nil || out != "Monday sun" {
+			t.Fatalf("Generate with ForceBranch returned \"%s\", %v", out, err)
+		}
+
+		if out, err := tree.Generate("diary", ForbidBranch("diary/[1/0", "diary/[1/1")); err != nil || out != "Wednesday" {
+			t.Fatalf("Generate with ForbidBranch returned \"%s\", %v", out, err)
+		}
+	}
+
+	if _, err := tree.Generate("diary", ForceBranch("diary/[1/7")); err == nil {
+		t.Fatalf("Generate with ForceBranch(\"diary/[1/7\") succeeded")
+	}
+
+	if _, err := tree.Generate("diary", ForbidBranch("diary/[1/0", "diary/[1/1", "diary/[1/2")); err == nil {
+		t.Fatalf("Generate forbidding every branch succeeded")
+	}
+
+	tree, _ = Parse("b [ p | q ] c [ m | n ] a [ {b} {b} {b} {c} ] d [ {*b} {*b} ]")
+
+	for n := uint64(0); n < 16; n++ {
+		out, err := tree.GenerateIndex("a", n, ForceBranch("b/[1/1"))
+
+		if err != nil || !strings.HasPrefix(out, "q q q ") {
+			t.Fatalf("GenerateIndex(\"a\", %d) with ForceBranch returned \"%s\", %v", n, out, err)
+		}
+	}
+
+	if _, err := tree.NewSession().Generate("d", ForceBranch("b/[1/0")); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("Generate forcing a used up branch returned %v", err)
+	}
+}
+
+// Check that errors can be told apart with errors.Is
+func TestSentinelErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		kind error
+	}{
+		{"", ErrEmptyInput},
+		{"a [ b ] a [ c ]", ErrDuplicateIdentifier},
+		{"a [ b [ c ]", ErrUnterminatedGroup},
+		{"a [ {b ]", ErrUnterminatedSubstitution},
+	}
+
+	for _, test := range tests {
+		if _, err := Parse(test.in); !errors.Is(err, test.kind) {
+			t.Fatalf("\"%s\" returned %v, expecting %v", test.in, err, test.kind)
+		}
+	}
+
+	in := "name [ *Ada | Grace ] pair [ {*name} and {*name} ] story [ {hero} ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	if _, err := tree.Generate("story"); !errors.Is(err, ErrUnknownIdentifier) {
+		t.Fatalf("Generate(\"story\") returned %v", err)
+	}
+
+	if _, err := tree.Generate("nothing"); !errors.Is(err, ErrUnknownIdentifier) {
+		t.Fatalf("Generate(\"nothing\") returned %v", err)
+	}
+
+	tree.Generate("pair")
+
+	if _, err := tree.Generate("pair"); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("Generate(\"pair\") returned %v", err)
+	}
+
+	if !errors.Is(tree.Validate(), ErrUnknownIdentifier) {
+		t.Fatalf("Validate() returned %v", tree.Validate())
+	}
+}
+
+// Check exporting definitions as tables
+func TestExportTables(t *testing.T) {
+	in := `name [ Ada | Grace ]
+greeting [ [ hello | hi | hey ] , {*name} ! | _:2 ]
+roll [ {greeting} You rolled {1-6} . ]`
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	if err := tree.LoadWeights(strings.NewReader(`{"greeting/[2/2": 0}`)); err != nil {
+		t.Fatalf("LoadWeights() failed (%s)", err)
+	}
+
+	var buf bytes.Buffer
+
+	if err := tree.ExportTables(&buf); err != nil {
+		t.Fatalf("ExportTables() failed (%s)", err)
+	}
+
+	var got struct {
+		Start  string
+		Tables map[string][]struct {
+			Text   string
+			Weight float64
+		}
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("ExportTables() wrote %s (%s)", buf.String(), err)
+	}
+
+	want := map[string]string{
+		"name":        "Ada:1 Grace:1",
+		"greeting":    "{greeting/[2}, {name}!:1 :2",
+		"greeting/[2": "hello:1 hi:1",
+		"roll":        "{greeting} You rolled {1-6}.:1",
+	}
+
+	if got.Start != "roll" || len(got.Tables) != len(want) {
+		t.Fatalf("ExportTables() wrote %s", buf.String())
+	}
+
+	for name, entries := range got.Tables {
+		var texts []string
+
+		for _, entry := range entries {
+			texts = append(texts, fmt.Sprintf("%s:%g", entry.Text, entry.Weight))
+		}
+
+		if strings.Join(texts, " ") != want[name] {
+			t.Fatalf("table %s is %q, expecting %s", name, texts, want[name])
+		}
+	}
+
+	for _, in := range []string{"a [ {b} ] b [ x | {a} ]", "a [ {b:upper} ] b [ x ]", "a [ {c} ]"} {
+		tree, err := Parse(in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		if err := tree.ExportTables(io.Discard); err == nil {
+			t.Fatalf("\"%s\" was exported", in)
+		}
+	}
+}
+
+// Check that failed substitutions are located in the source
+func TestSubstitutionError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quests.g")
+	in := "quest [ Defeat {foe} ]\nfoe [ the {villain:upper} ]\n"
+
+	if err := os.WriteFile(path, []byte(in), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := ParseFiles([]string{path})
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	_, err = tree.Generate("quest")
+	var located *SubstitutionError
+
+	if !errors.As(err, &located) || located.Source != path+":2" || located.ID != "villain:upper" {
+		t.Fatalf("Generate(\"quest\") returned %v", err)
+	}
+
+	if !errors.Is(err, ErrUnknownIdentifier) {
+		t.Fatalf("Generate(\"quest\") returned %v", err)
+	}
+
+	if want := path + ":2: no such definition: villain (villain:upper)"; err.Error() != want {
+		t.Fatalf("Generate(\"quest\") returned \"%s\", expecting \"%s\"", err, want)
+	}
+}
+
+// Check making substitutions exclusive or shared by identifier
+func TestExclusivity(t *testing.T) {
+	in := "prize [ car | boat | cake ] adjective [* shiny | new ] raffle [ a {adjective} {prize} ]"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	s := tree.NewSession()
+	prizes := make(map[string]bool)
+
+	for i := 0; i < 3; i++ {
+		out, err := s.Generate("raffle", Exclusive("prize"), Shared("adjective"))
+
+		if err != nil {
+			t.Fatalf("Generate(\"raffle\") failed (%s)", err)
+		}
+
+		prizes[strings.Fields(out)[2]] = true
+	}
+
+	if len(prizes) != 3 {
+		t.Fatalf("Exclusive(\"prize\") gave the prizes %v", prizes)
+	}
+
+	if _, err := s.Generate("raffle", Exclusive("prize"), Shared("adjective")); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("Generate(\"raffle\") returned %v after the prizes ran out", err)
+	}
+
+	// Without the options, prizes repeat but the adjectives run out
+	s = tree.NewSession()
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.Generate("raffle"); err != nil {
+			t.Fatalf("Generate(\"raffle\") failed (%s)", err)
+		}
+	}
+
+	if _, err := s.Generate("raffle"); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("Generate(\"raffle\") returned %v after the adjectives ran out", err)
+	}
+}
+
+// Check that comments are kept in the tree and attached to definitions
+func TestComments(t *testing.T) {
+	in := `// Ways to say hello
+// to the player
+greeting [
+	// formal
+	good day |
+	hi // casual
+]
+// end`
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	if def, _ := tree.Lookup("greeting"); def.Comment != "Ways to say hello\nto the player" {
+		t.Fatalf("Lookup(\"greeting\") returned comment %q", def.Comment)
+	}
+
+	trailing, _ := Parse("excuse [ My [dog | cat] ate my homework. ]  // What a jerk!!\nother [ x ]")
+
+	for id, comment := range map[string]string{"excuse": "What a jerk!!", "other": ""} {
+		if def, _ := trailing.Lookup(id); def.Comment != comment {
+			t.Fatalf("Lookup(\"%s\") returned comment %q", id, def.Comment)
+		}
+	}
+
+	want := `// Ways to say hello
+// to the player
+greeting
+└─ [
+   ├─ // formal
+   ├─ good day
+   ├─ // casual
+   └─ hi
+// end`
+
+	if out := tree.Format(DisplayComments); out != want {
+		t.Fatalf("Format(DisplayComments) returned\n%s\nexpecting\n%s", out, want)
+	}
+
+	if out := tree.Format(); strings.Contains(out, "//") {
+		t.Fatalf("Format() returned\n%s", out)
+	}
+
+	data, err := tree.MarshalProto()
+
+	if err != nil {
+		t.Fatalf("MarshalProto() failed (%s)", err)
+	}
+
+	decoded, err := UnmarshalProto(data)
+
+	if err != nil {
+		t.Fatalf("UnmarshalProto() failed (%s)", err)
+	}
+
+	if out := decoded.Format(DisplayComments); out != want {
+		t.Fatalf("decoded Format(DisplayComments) returned\n%s", out)
+	}
+
+	for i := 0; i < 10; i++ {
+		if out, err := tree.Generate("greeting"); err != nil || strings.Contains(out, "/") {
+			t.Fatalf("Generate(\"greeting\") returned \"%s\", %v", out, err)
+		}
+	}
+}
+
+// Check that literals are output as written
+func TestLiterals(t *testing.T) {
+	in := "statement [ return ] code [ `if (x  ==  y) {` {statement} `}` ] url [ see `http://x.org/[a|b]` ! ] // `no`"
+	tree, err := Parse(in)
+
+	if err != nil {
+		t.Fatalf("\"%s\" failed (%s)", in, err)
+	}
+
+	for id, want := range map[string]string{"code": "if (x  ==  y) { return }", "url": "see http://x.org/[a|b]!"} {
+		if out, err := tree.Generate(id); err != nil || out != want {
+			t.Fatalf("Generate(\"%s\") returned \"%s\", %v, expecting \"%s\"", id, out, err, want)
+		}
+	}
+
+	s := tree.NewSession()
+	s.SetConfig(SessionConfig{Case: CaseUpper})
+
+	if out, err := s.Generate("code"); err != nil || out != "if (x  ==  y) { RETURN }" {
+		t.Fatalf("Generate(\"code\") with CaseUpper returned \"%s\", %v", out, err)
+	}
+
+	if out := tree.Format(); !strings.Contains(out, "see `http://x.org/[a|b]` !") {
+		t.Fatalf("Format() returned\n%s", out)
+	}
+
+	if _, ok := tree.Matches("code", "if (x == y) { return }"); !ok {
+		t.Fatalf("Matches(\"code\") failed")
+	}
+
+	if out := Quick("a [ `unterminated ]"); out != "`unterminated" {
+		t.Fatalf("unterminated literal returned \"%s\"", out)
+	}
+
+	tree, _ = Parse("a [ `0123456789` ]")
+
+	if out, err := tree.Generate("a", MaxLength(15)); err != nil || out != "0123456789" {
+		t.Fatalf("Generate(\"a\", MaxLength(15)) returned \"%s\", %v", out, err)
+	}
+
+	for in, col := range map[string]int{"a [ `lit` ] ]": 13, "a [ `l i t` x ] ]": 17} {
+		if _, err := Parse(in); len(ParseErrors(err)) != 1 || ParseErrors(err)[0].Column != col {
+			t.Fatalf("\"%s\" returned %v, expecting an error at column %d", in, err, col)
+		}
+	}
+
+	tree, _ = Parse("a [ `x  ,  y` ] b [ `{a}` ]")
+	var tables bytes.Buffer
+
+	if err := tree.ExportTables(&tables); err == nil {
+		t.Fatalf("ExportTables() of a literal with braces succeeded")
+	}
+
+	tree, _ = Parse("a [ [`x  ,  y` | z] ]")
+	tables.Reset()
+
+	if err := tree.ExportTables(&tables); err != nil || !strings.Contains(tables.String(), `"x  ,  y"`) {
+		t.Fatalf("ExportTables() wrote %s, %v", tables.String(), err)
+	}
+
+	source := "code [ `a [ b // c` {x} ]"
+	var kinds []string
+
+	for _, span := range Classify(source) {
+		kinds = append(kinds, source[span.Start:span.End]+"="+span.Kind.String())
+	}
+
+	if want := "code=identifier [=group `a [ b // c`=text {x}=substitution ]=group"; strings.Join(kinds, " ") != want {
+		t.Fatalf("Classify(\"%s\") returned %v", source, kinds)
+	}
+}
+
+// Check the spacing of dashes, ranges and clitics
+func TestDashesAndApostrophes(t *testing.T) {
+	tests := map[string]string{
+		"a [ well <-> read ]":                    "well-read",
+		"a [ [well] <–> [ill] <—> bred ]":        "well–ill—bred",
+		"a [ pages 12 – 14 – 16 ]":               "pages 12–14–16",
+		"a [ smörgåsbord – yes ]":                "smörgåsbord – yes",
+		"n [ Bob ] a [ {n} 's hat, {n} 'll go ]": "Bob's hat, Bob'll go",
+		"a [ and 'tis done ]":                    "and 'tis done",
+	}
+
+	for in, want := range tests {
+		tree, err := Parse(in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", in, err)
+		}
+
+		if out, err := tree.Generate("a"); err != nil || out != want {
+			t.Fatalf("\"%s\" returned \"%s\", %v, expecting \"%s\"", in, out, err, want)
+		}
+	}
+
+	tree, _ := Parse(`a [ 'Tis the '90s, he said 'hello' ]`)
+
+	if out, _ := tree.Generate("a", Typography()); out != "’Tis the ’90s, he said ‘hello’" {
+		t.Fatalf("Generate(\"a\", Typography()) returned \"%s\"", out)
+	}
+
+	tree, _ = Parse("a [ well <-> read ]")
+
+	if _, ok := tree.Matches("a", "well-read"); !ok {
+		t.Fatalf("Matches(\"a\", \"well-read\") failed")
+	}
+}
+
+// Check checking and closing the delimiters of the output
+func TestCheckBalance(t *testing.T) {
+	tests := []struct {
+		in       string
+		locale   string
+		balanced bool
+		closed   string // Output with CloseDelimiters; "" if it fails
+	}{
+		{`a [ (see "page 4") ]`, "", true, `(see "page 4")`},
+		{"a [ `if (x` then ]", "", true, "if (x then"},
+		{`a [ (see "page 4 ]`, "", false, `(see "page 4")`},
+		{`a [ she said “hello ]`, "", false, `she said “hello”`},
+		{`a [ see page 4) ]`, "", false, ""},
+		{`a [ (see page 4” ]`, "", false, ""},
+		{`a [ Er sagte „Hallo“. ]`, "de", true, `Er sagte „Hallo“.`},
+		{`a [ Er sagte „Hallo ]`, "de-AT", false, `Er sagte „Hallo“`},
+		{`a [ Er sagte »Hallo« ]`, "de", true, `Er sagte »Hallo«`},
+		{`a [ Er sagte “Hallo ]`, "de", false, ""},
+		{`a [ Hon sa »hej» ]`, "sv", true, `Hon sa »hej»`},
+		{`a [ Hon sa ”hej ]`, "sv", false, `Hon sa ”hej”`},
+	}
+
+	for _, test := range tests {
+		tree, err := Parse(test.in)
+
+		if err != nil {
+			t.Fatalf("\"%s\" failed (%s)", test.in, err)
+		}
+
+		out, err := tree.Generate("a", CloseDelimiters(), Locale(test.locale))
+
+		if test.closed == "" && err == nil || test.closed != "" && (err != nil || out != test.closed) {
+			t.Fatalf("\"%s\" with CloseDelimiters() returned \"%s\", %v", test.in, out, err)
+		}
+
+		_, err = tree.Generate("a", CheckBalance(), Locale(test.locale))
+		var unbalanced *UnbalancedError
+
+		if test.balanced && err != nil || !test.balanced && !errors.As(err, &unbalanced) {
+			t.Fatalf("\"%s\" with CheckBalance() returned %v", test.in, err)
+		}
+	}
+
+	tree, _ := Parse(`a [ (see page 4 ]`)
+
+	if out, err := tree.Generate("a", CloseDelimiters(), FinalNewline()); err != nil || out != "(see page 4)\n" {
+		t.Fatalf("Generate(\"a\", CloseDelimiters(), FinalNewline()) returned \"%s\", %v", out, err)
+	}
+
+	_, err := tree.Generate("a", CheckBalance())
+	var unbalanced *UnbalancedError
+
+	if !errors.As(err, &unbalanced) || unbalanced.Delimiter != "(" || unbalanced.Offset != 0 {
+		t.Fatalf("Generate(\"a\", CheckBalance()) returned %v", err)
+	}
+
+	// Check that an unbalanced phrase doesn't stop an enumeration
+	tree, _ = Parse(`a [ (x) | (y | (z) ]`)
+	var phrases, failed int
+
+	for _, err := range tree.Enumerate("a", CheckBalance()) {
+		if errors.As(err, &unbalanced) {
+			failed++
+		} else if err == nil {
+			phrases++
+		}
+	}
+
+	if phrases != 2 || failed != 1 {
+		t.Fatalf("Enumerate(\"a\", CheckBalance()) returned %d phrases and %d errors", phrases, failed)
+	}
+}
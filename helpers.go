@@ -1,21 +1,71 @@
 package grammar
 
 import (
-	"math/rand"
-	"time"
+	crand "crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
 )
 
-var rnd *rand.Rand
+// Seeded random sources use PCG, whose output is fixed by math/rand/v2 across Go releases. This is the (arbitrary but
+// fixed) second half of the PCG seed.
+const pcgIncrement = 0x6a09e667f3bcc909
 
-func init() {
-	rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+// newSource returns a seeded random source. The same seed always produces the same sequence.
+func newSource(seed uint64) rand.Source {
+	return rand.NewPCG(seed, pcgIncrement)
 }
 
-func random(low int, high int) int {
-	return low + rnd.Intn(high - low + 1)
+// CryptoSource is a random source backed by crypto/rand, for security-sensitive output such as generated tokens or
+// passphrases. It can't be seeded. Use it with the RandSource option:
+//
+//	tree.Generate("passphrase", grammar.RandSource(grammar.CryptoSource))
+var CryptoSource rand.Source = cryptoSource{}
+
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	crand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// random returns a random number between low and high (inclusive) drawn from src. If src is nil, the (goroutine safe)
+// default source of math/rand/v2 is used instead.
+func random(src rand.Source, low int, high int) int {
+	if src == nil {
+		return low + rand.IntN(high-low+1)
+	}
+
+	return low + intn(src, high-low+1)
+}
+
+// intn returns a uniform random number in [0, n) drawn from src. Unlike rand.Rand.IntN, the mapping from source values
+// is defined here, so seeded output won't change between Go releases.
+func intn(src rand.Source, n int) int {
+	max := uint64(n)
+
+	// Reject the top values that would skew the modulo; remainder is 2^64 % max
+	remainder := (math.MaxUint64%max + 1) % max
+
+	for {
+		v := src.Uint64()
+
+		if remainder == 0 || v < -remainder {
+			return int(v % max)
+		}
+	}
 }
 
 func next(i *int) int {
 	*i += 1
 	return *i
 }
+
+// hashString returns a 64-bit FNV-1a hash of s.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
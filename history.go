@@ -0,0 +1,57 @@
+package grammar
+
+import (
+	"container/list"
+)
+
+// maxRegenerate is the number of times a phrase is regenerated when it collides with a recently emitted one.
+const maxRegenerate = 100
+
+// An outputHistory remembers a bounded number of emitted phrases, evicting the least recently emitted first.
+type outputHistory struct {
+	size  int
+	order *list.List               // Most recent first
+	index map[string]*list.Element // Phrase -> element in order
+}
+
+func newOutputHistory(size int) *outputHistory {
+	return &outputHistory{size: size, order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// contains reports whether phrase is among the remembered phrases.
+func (history *outputHistory) contains(phrase string) bool {
+	_, found := history.index[phrase]
+	return found
+}
+
+// add remembers phrase as the most recently emitted, evicting the oldest phrase if the history is full.
+func (history *outputHistory) add(phrase string) {
+	if e, found := history.index[phrase]; found {
+		history.order.MoveToFront(e)
+		return
+	}
+
+	history.index[phrase] = history.order.PushFront(phrase)
+
+	if history.order.Len() > history.size {
+		oldest := history.order.Back()
+		history.order.Remove(oldest)
+		delete(history.index, oldest.Value.(string))
+	}
+}
+
+// Deduplicate makes the session remember the last size phrases it has generated and regenerate any phrase that
+// collides with one of them, so e.g. a trivia bot won't repeat itself. If no new phrase turns up after a number of
+// attempts, Generate fails with an error. A size of 0 turns deduplication off and forgets the remembered phrases.
+func (s *Session) Deduplicate(size int) {
+	if size <= 0 {
+		s.history = nil
+	} else {
+		s.history = newOutputHistory(size)
+	}
+}
+
+// Deduplicate turns on deduplication for the tree's default session. See Session.Deduplicate.
+func (tree *Tree) Deduplicate(size int) {
+	tree.defaultSession().Deduplicate(size)
+}
@@ -0,0 +1,161 @@
+package grammar
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// GenerateIndex generates phrase number n of id, e.g. to map user IDs or database keys to stable phrases without
+// storing them. The same n always gives the same phrase, whatever the state of the session, and is reduced modulo
+// CountPhrases(id), so every n is valid.
+//
+// Phrases are numbered in a canonical order of their derivations, like digits of a number with a different base for
+// each choice. Each index below CountPhrases(id) gives a different derivation, unless the grammar uses conditions or
+// loops (which CountPhrases overestimates) or exclusive substitutions of the same identifier. Branch weights are
+// ignored, and branches used up by exclusive substitutions or cooling down in the session are picked all the same,
+// without using them up or starting cooldowns.
+func (s *Session) GenerateIndex(id string, n uint64, options ...GenerateOption) (string, error) {
+	g := s.newGenerator(options)
+
+	if id == "" && len(s.tree.root.child) > 0 {
+		id = s.tree.root.child[len(s.tree.root.child)-1].Text
+	}
+
+	g.index = &indexDecoder{counter: phraseCounter{tree: s.tree, counts: make(map[*node]*big.Int),
+		counting: make(map[*node]bool)}}
+	count, err := g.index.counter.identifier(id)
+
+	if err != nil {
+		return "", err
+	}
+
+	if count.Sign() == 0 {
+		return "", fmt.Errorf("%s can't produce any phrases", id)
+	}
+
+	g.index.carry = []*big.Int{new(big.Int).Mod(new(big.Int).SetUint64(n), count)}
+
+	// Decoding starts from a fresh state, ignoring the branches used up and cooling down, and the session's own state
+	// is left as it was
+	saved, cooldowns := s.saveUsed(), s.cooldowns
+	s.uniqueUsed, s.cooldowns = make(map[string]int), make(map[string]int)
+
+	defer func() {
+		s.restoreUsed(saved)
+		s.cooldowns = cooldowns
+	}()
+
+	result, err := g.run(id)
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.Text, nil
+}
+
+// GenerateIndex generates phrase number n of id using the tree's default session. See Session.GenerateIndex.
+func (tree *Tree) GenerateIndex(id string, n uint64, options ...GenerateOption) (string, error) {
+	return tree.defaultSession().GenerateIndex(id, n, options...)
+}
+
+// An indexDecoder makes the choices of a generator from a phrase index (see GenerateIndex).
+//
+// The index is split up like a number in mixed radix: each choice between n options takes the current index modulo n
+// and leaves the quotient for the choices that follow. A branch or substitution first takes its share in the same
+// way, modulo the number of phrases it can produce, and then makes its own choices from that share alone, on a stack.
+type indexDecoder struct {
+	counter phraseCounter
+	carry   []*big.Int // The index left for the choices of each nested branch or substitution
+}
+
+// take takes a number in [0, n) from the index on top of the stack.
+func (d *indexDecoder) take(n *big.Int) *big.Int {
+	taken := new(big.Int)
+	top := d.carry[len(d.carry)-1]
+	top.DivMod(top, n, taken)
+	return taken
+}
+
+// next returns a choice in [0, n).
+func (d *indexDecoder) next(n int) int {
+	return int(d.take(big.NewInt(int64(n))).Int64())
+}
+
+// branch returns the branch of group to pick and enters it, so its choices are made from its share of the index. The
+// caller must leave the branch once it has been composed.
+func (d *indexDecoder) branch(group *node) (int, error) {
+	counts := make([]*big.Int, len(group.child))
+	total := new(big.Int)
+
+	for i := range group.child {
+		count, err := d.counter.node(&group.child[i])
+
+		if err != nil {
+			d.carry = append(d.carry, new(big.Int))
+			return 0, err
+		}
+
+		counts[i] = count
+		total.Add(total, count)
+	}
+
+	if total.Sign() == 0 {
+		d.carry = append(d.carry, new(big.Int))
+		return 0, nil
+	}
+
+	share := d.take(total)
+
+	for i, count := range counts {
+		if share.Cmp(count) < 0 {
+			d.carry = append(d.carry, share)
+			return i, nil
+		}
+
+		share.Sub(share, count)
+	}
+
+	// Unreachable, as share < total
+	d.carry = append(d.carry, share)
+	return len(counts) - 1, nil
+}
+
+// force enters branch i of group, which is forced rather than picked from the index. The index is taken from as if
+// the branch had been picked, so the choices of other groups are numbered as usual.
+func (d *indexDecoder) force(group *node, i int) {
+	pick, err := d.branch(group)
+
+	if err != nil || pick == i {
+		return
+	}
+
+	// The share of another branch may be too large for this one
+	if count, err := d.counter.node(&group.child[i]); err == nil && count.Sign() > 0 {
+		top := d.carry[len(d.carry)-1]
+		top.Mod(top, count)
+	}
+}
+
+// enter takes the share of the index of a substitution of id, so its choices are made from that share. The caller must
+// leave the substitution once it has been generated.
+func (d *indexDecoder) enter(id string) error {
+	count, err := d.counter.identifier(id)
+
+	if err != nil {
+		return err
+	}
+
+	if count.Sign() == 0 {
+		d.carry = append(d.carry, new(big.Int))
+		return nil
+	}
+
+	d.carry = append(d.carry, d.take(count))
+	return nil
+}
+
+// leave returns to the index of the enclosing branch or substitution.
+func (d *indexDecoder) leave() {
+	d.carry = d.carry[:len(d.carry)-1]
+}
@@ -0,0 +1,123 @@
+package grammar
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+)
+
+// Seed makes a call draw its random choices from a source seeded with seed, so the same seed (with the same grammar
+// and session state) always gives the same phrase.
+func Seed(seed uint64) GenerateOption {
+	return func(config *generateConfig) {
+		config.source, config.seed = nil, &seed
+	}
+}
+
+// applySeed gives the call a random source of its own if Seed was given, so calls sharing the option draw the same
+// choices.
+func (config *generateConfig) applySeed() {
+	if config.seed != nil {
+		config.source = newSource(*config.seed)
+	}
+}
+
+// randSource returns the random source a call with options draws from, leaving aside the streams of identifiers (see
+// SeedStream).
+func (s *Session) randSource(options []GenerateOption) rand.Source {
+	var config generateConfig
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	config.applySeed()
+
+	if config.source != nil {
+		return config.source
+	} else if s.rand != nil {
+		return s.rand
+	}
+
+	return s.source
+}
+
+// A JSONLField selects an optional field of the lines written by WriteJSONL. Fields can be combined with |.
+type JSONLField int
+
+const (
+	// JSONLSeed adds the seed of each phrase ("seed"), which regenerates it with the Seed option
+	JSONLSeed JSONLField = 1 << iota
+	// JSONLID adds the identifier generated ("id")
+	JSONLID
+	// JSONLTraceID adds the trace ID of each phrase ("trace_id"), for feedback with Session.Reinforce
+	JSONLTraceID
+	// JSONLMetadata adds the metadata of each phrase ("metadata"), see {#key=value}
+	JSONLMetadata
+)
+
+// jsonlRecord is a line written by WriteJSONL.
+type jsonlRecord struct {
+	Text     string            `json:"text"`
+	ID       string            `json:"id,omitempty"`
+	Seed     *uint64           `json:"seed,omitempty"`
+	TraceID  string            `json:"trace_id,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// WriteJSONL generates n phrases for id and writes them to w as JSON Lines, one object per phrase with the phrase as
+// "text" and the optional fields selected by fields, e.g.
+//
+//	{"text":"Hello, Alice!","id":"greeting","seed":8912347124}
+//
+// This is handy for producing synthetic corpora. The phrases are generated in the session as usual, so exclusive
+// substitutions and deduplication carry over from one phrase to the next. Seeds are drawn from the random source the
+// phrases would come from otherwise: that given by RandSource, set by SetRand or seeded by Seed.
+func (s *Session) WriteJSONL(w io.Writer, id string, n int, fields JSONLField, options ...GenerateOption) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	seeds := s.randSource(options)
+
+	for i := 0; i < n; i++ {
+		var record jsonlRecord
+		callOptions := options
+
+		if fields&JSONLSeed != 0 {
+			seed := seeds.Uint64()
+			record.Seed = &seed
+			callOptions = append(options[:len(options):len(options)], Seed(seed))
+		}
+
+		result, err := s.GenerateResult(id, callOptions...)
+
+		if err != nil {
+			return err
+		}
+
+		record.Text = result.Text
+
+		if fields&JSONLID != 0 {
+			record.ID = id
+		}
+
+		if fields&JSONLTraceID != 0 {
+			record.TraceID = result.TraceID
+		}
+
+		if fields&JSONLMetadata != 0 {
+			record.Metadata = result.Metadata
+		}
+
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteJSONL generates n phrases for id in the tree's default session and writes them as JSON Lines. See
+// Session.WriteJSONL.
+func (tree *Tree) WriteJSONL(w io.Writer, id string, n int, fields JSONLField, options ...GenerateOption) error {
+	return tree.defaultSession().WriteJSONL(w, id, n, fields, options...)
+}
@@ -0,0 +1,63 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// legend explains the symbols used by Format.
+var legend = []string{
+	"Legend:",
+	"  [    group of alternative branches, one of which is picked (numbered with DisplayGroupNumbers)",
+	"  *    branch made of several parts, listed below it",
+	"  {x}  substitution of the identifier x",
+}
+
+// summary returns a line for each top-level definition of the tree, counting its nodes and branches and giving the
+// depth of its deepest node.
+func (tree *Tree) summary() []string {
+	lines := []string{"Summary:"}
+
+	for i := range tree.root.child {
+		def := &tree.root.child[i]
+		lines = append(lines, fmt.Sprintf("  %s: %d nodes, %d branches, depth %d", def.Text, def.count(),
+			def.branches(), def.depth()))
+	}
+
+	return lines
+}
+
+// branches returns the number of branches of all groups below node.
+func (node *node) branches() int {
+	count := 0
+
+	for i := range node.child {
+		if node.internalType == group {
+			count++
+		}
+
+		count += node.child[i].branches()
+	}
+
+	return count
+}
+
+// depth returns the number of levels below node.
+func (node *node) depth() int {
+	deepest := 0
+
+	for i := range node.child {
+		deepest = max(deepest, 1+node.child[i].depth())
+	}
+
+	return deepest
+}
+
+// appendLegend adds the legend and summary to the lines of a formatted tree.
+func (tree *Tree) appendLegend(lines []string) string {
+	lines = append(lines, "")
+	lines = append(lines, legend...)
+	lines = append(lines, "")
+	lines = append(lines, tree.summary()...)
+	return strings.Join(lines, "\n")
+}
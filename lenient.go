@@ -0,0 +1,35 @@
+package grammar
+
+import (
+	"slices"
+	"strings"
+)
+
+// Lenient renders substitutions of identifiers that aren't defined as visible placeholders, e.g. ⟨villain⟩, instead
+// of failing, to preview grammars that are still being written. The Result (see GenerateResult) lists what was passed
+// over in Warnings. Generating an identifier that isn't defined directly still fails.
+func Lenient() GenerateOption {
+	return func(config *generateConfig) {
+		config.lenient = true
+	}
+}
+
+// placeholder returns what Lenient generation renders a substitution of id as if id isn't defined, recording a
+// warning, or false if it is.
+func (g *generator) placeholder(id string) (string, bool) {
+	id = strings.TrimPrefix(id, "*")
+
+	if _, found := g.config.pinned[id]; found {
+		return "", false
+	}
+
+	if _, found := g.config.resolvers[id]; found || g.findDefinition(id) != nil {
+		return "", false
+	}
+
+	if warning := "no such definition: " + id; !slices.Contains(g.result.Warnings, warning) {
+		g.result.Warnings = append(g.result.Warnings, warning)
+	}
+
+	return "⟨" + id + "⟩", true
+}
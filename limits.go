@@ -0,0 +1,89 @@
+package grammar
+
+import (
+	"io"
+	"os"
+)
+
+// A ParseOption alters how Parse, ParseFile and ParseFiles read a grammar.
+type ParseOption func(*parseConfig)
+
+type parseConfig struct {
+	maxSize   int    // Maximum input size in bytes, over all files; 0 is unlimited
+	maxTokens int    // Maximum number of tokens, over all files; 0 is unlimited
+	cache     *Cache // Reuses the tokens of unchanged files (see UseCache)
+}
+
+// MaxInputSize limits the size (in bytes) of the grammar, or the total size of all grammar files. Parsing fails with a
+// *LimitError if the input is larger. Files are never read further than the limit, so this protects a service that
+// accepts uploaded grammars from running out of memory.
+func MaxInputSize(n int) ParseOption {
+	return func(config *parseConfig) {
+		config.maxSize = n
+	}
+}
+
+// MaxTokens limits the number of tokens (words, brackets, directives and so on) in the grammar, or in all grammar files
+// together. Parsing fails with a *LimitError if there are more.
+func MaxTokens(n int) ParseOption {
+	return func(config *parseConfig) {
+		config.maxTokens = n
+	}
+}
+
+// newParseConfig applies options to the default configuration.
+func newParseConfig(options []ParseOption) parseConfig {
+	var config parseConfig
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	return config
+}
+
+// checkSize returns a *LimitError if size bytes exceed the maximum input size.
+func (config *parseConfig) checkSize(size int) error {
+	if config.maxSize > 0 && size > config.maxSize {
+		return &LimitError{Limit: "input size", Max: config.maxSize}
+	}
+
+	return nil
+}
+
+// checkTokens returns a *LimitError if n tokens exceed the maximum token count.
+func (config *parseConfig) checkTokens(n int) error {
+	if config.maxTokens > 0 && n > config.maxTokens {
+		return &LimitError{Limit: "token count", Max: config.maxTokens}
+	}
+
+	return nil
+}
+
+// readFile reads filename, of which at most remaining bytes are allowed before the maximum input size is exceeded.
+func (config *parseConfig) readFile(filename string, remaining int) ([]byte, error) {
+	if config.maxSize <= 0 {
+		return os.ReadFile(filename)
+	}
+
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	// Read one byte more than allowed, to tell whether there is more
+	contents, err := io.ReadAll(io.LimitReader(f, int64(remaining)+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(contents) > remaining {
+		return nil, &LimitError{Limit: "input size", Max: config.maxSize}
+	}
+
+	return contents, nil
+}
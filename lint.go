@@ -0,0 +1,135 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// LintThresholds are the limits checked by Lint, e.g. from a team's style rules. A zero limit isn't checked.
+type LintThresholds struct {
+	MaxBranches        int     // Maximum number of branches of a group
+	MaxDepth           int     // Maximum number of groups nested within each other in a definition
+	MaxLengthDeviation float64 // Maximum standard deviation of the length (in characters) of the phrases of a definition
+	Samples            int     // Number of phrases generated to estimate MaxLengthDeviation; 0 is 100
+}
+
+// A LintIssue is a definition or group exceeding a threshold, as found by Lint.
+type LintIssue struct {
+	ID      string // The definition
+	Source  string // Where the offending definition or group is, e.g. "names.g:12"
+	Message string // What is exceeded, e.g. "group has 40 branches (more than 30)"
+}
+
+func (issue LintIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", issue.Source, issue.ID, issue.Message)
+}
+
+// Lint checks every definition against thresholds and returns the issues found, in the order of the definitions. Phrase
+// lengths are estimated by generating phrases in a fresh, seeded session, so the result is the same every time.
+// Definitions whose phrases nest too deep or expand too much to generate (e.g. unbounded recursion) are left out.
+func (tree *Tree) Lint(thresholds LintThresholds) []LintIssue {
+	var ret []LintIssue
+
+	for i := range tree.root.child {
+		def := &tree.root.child[i]
+		ret = def.lintGroups(def, thresholds, 0, ret)
+
+		if thresholds.MaxLengthDeviation > 0 {
+			if deviation := tree.lengthDeviation(def.Text, thresholds.Samples); deviation > thresholds.MaxLengthDeviation {
+				ret = append(ret, LintIssue{ID: def.Text, Source: def.Source, Message: fmt.Sprintf(
+					"phrase length deviates by %.1f characters (more than %g)", deviation, thresholds.MaxLengthDeviation)})
+			}
+		}
+	}
+
+	return ret
+}
+
+// lintGroups appends the issues with the branch count and nesting depth of the groups below node to ret. depth is the
+// number of groups node is nested in.
+func (node *node) lintGroups(def *node, thresholds LintThresholds, depth int, ret []LintIssue) []LintIssue {
+	if node.internalType == group {
+		depth++
+
+		if thresholds.MaxBranches > 0 && len(node.child) > thresholds.MaxBranches {
+			ret = append(ret, LintIssue{ID: def.Text, Source: node.Source, Message: fmt.Sprintf(
+				"group has %d branches (more than %d)", len(node.child), thresholds.MaxBranches)})
+		}
+
+		// Report only the outermost group that is too deep
+		if thresholds.MaxDepth > 0 && depth == thresholds.MaxDepth+1 {
+			ret = append(ret, LintIssue{ID: def.Text, Source: node.Source, Message: fmt.Sprintf(
+				"groups are nested %d deep (more than %d)", depth+node.groupDepth(), thresholds.MaxDepth)})
+		}
+	}
+
+	for i := range node.child {
+		ret = node.child[i].lintGroups(def, thresholds, depth, ret)
+	}
+
+	return ret
+}
+
+// groupDepth returns the maximum number of groups nested within each other below node.
+func (node *node) groupDepth() int {
+	deepest := 0
+
+	for i := range node.child {
+		depth := node.child[i].groupDepth()
+
+		if node.child[i].internalType == group {
+			depth++
+		}
+
+		deepest = max(deepest, depth)
+	}
+
+	return deepest
+}
+
+// Limits of the phrases Lint generates, so that a runaway definition can't bring down the linter.
+const (
+	lintMaxDepth      = 64
+	lintMaxExpansions = 10000
+)
+
+// lengthDeviation returns the standard deviation of the length of samples phrases of id. Phrases that fail to
+// generate are left out, and a definition whose phrases exceed the limits of Lint isn't measured at all (0).
+func (tree *Tree) lengthDeviation(id string, samples int) float64 {
+	if samples <= 0 {
+		samples = 100
+	}
+
+	s := tree.NewSession()
+	s.Seed(1)
+
+	var lengths []float64
+	sum := 0.0
+
+	for i := 0; i < samples; i++ {
+		out, err := s.Generate(id, MaxDepth(lintMaxDepth), MaxExpansions(lintMaxExpansions))
+		var limit *LimitError
+
+		if errors.As(err, &limit) {
+			return 0
+		} else if err == nil {
+			lengths = append(lengths, float64(utf8.RuneCountInString(out)))
+			sum += lengths[len(lengths)-1]
+		}
+	}
+
+	if len(lengths) == 0 {
+		return 0
+	}
+
+	mean := sum / float64(len(lengths))
+	variance := 0.0
+
+	for _, length := range lengths {
+		variance += (length - mean) * (length - mean)
+	}
+
+	return math.Sqrt(variance / float64(len(lengths)))
+}
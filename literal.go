@@ -0,0 +1,104 @@
+package grammar
+
+import "strings"
+
+// literalBase offsets the characters of a `literal` into a private use plane of Unicode while the phrase is generated,
+// so that nothing done to the text (substitutions, spacing, case changes) touches them. decodeLiterals moves them back
+// when the phrase is finished.
+const literalBase = 0xF0000
+
+// encodeLiterals replaces each `literal` on a line of grammar text with its encoded characters, dropping the
+// backticks. A backtick without a closing one is left as it is, and so is a comment at the end of the line. It also
+// returns the column in line of each rune of the encoded line, followed by the column after the end of line.
+func encodeLiterals(line string) (string, []int) {
+	var ret strings.Builder
+	var columns []int
+	col := 0
+
+	for line != "" {
+		open, end := strings.IndexByte(line, '`'), -1
+
+		if open >= 0 && !strings.Contains(line[:open], "//") {
+			end = strings.IndexByte(line[open+1:], '`')
+		}
+
+		if end < 0 {
+			open = len(line)
+		}
+
+		for _, r := range line[:open] {
+			col++
+			ret.WriteRune(r)
+			columns = append(columns, col)
+		}
+
+		if open == len(line) {
+			break
+		}
+
+		col++ // The opening backtick
+
+		for _, r := range encodeLiteral(line[open+1 : open+1+end]) {
+			col++
+			ret.WriteRune(r)
+			columns = append(columns, col)
+		}
+
+		col++ // The closing backtick
+		line = line[open+end+2:]
+	}
+
+	return ret.String(), append(columns, col+1)
+}
+
+// encodeLiteral encodes the characters of s like those of a literal, so they come out of generation unchanged.
+func encodeLiteral(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x10000 {
+			return r + literalBase
+		}
+
+		return r
+	}, s)
+}
+
+// isLiteral returns whether r is an encoded character of a literal.
+func isLiteral(r rune) bool {
+	return r >= literalBase && r < literalBase+0x10000
+}
+
+// decodeLiterals restores the characters of the literals in s.
+func decodeLiterals(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isLiteral(r) {
+			return r - literalBase
+		}
+
+		return r
+	}, s)
+}
+
+// showLiterals restores the literals in s as they are written in a grammar, between backticks.
+func showLiterals(s string) string {
+	var ret strings.Builder
+	inside := false
+
+	for _, r := range s {
+		if isLiteral(r) != inside {
+			inside = !inside
+			ret.WriteByte('`')
+		}
+
+		if inside {
+			r -= literalBase
+		}
+
+		ret.WriteRune(r)
+	}
+
+	if inside {
+		ret.WriteByte('`')
+	}
+
+	return ret.String()
+}
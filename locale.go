@@ -0,0 +1,61 @@
+package grammar
+
+import (
+	"strings"
+)
+
+// Locale generates localized variants of definitions, so one tree can serve several languages. A definition is
+// localized by suffixing its identifier with a locale, e.g. greeting@en and greeting@sv.
+//
+// Every identifier (including those of substitutions) is resolved using the first of these that exists, for each
+// locale in order: the full locale (greeting@sv-FI), the language alone (greeting@sv), and after all locales the
+// identifier without a locale (greeting). An identifier which already has a locale, like {greeting@en}, is used as is.
+func Locale(locales ...string) GenerateOption {
+	return func(config *generateConfig) {
+		config.locales = append(config.locales, locales...)
+	}
+}
+
+// findDefinition returns the top-level node defining id, in the preferred locale if there is one.
+func (g *generator) findDefinition(id string) *node {
+	if len(g.config.locales) == 0 || strings.Contains(id, "@") {
+		return g.tree.findDefinition(id)
+	}
+
+	id = strings.TrimPrefix(id, "*")
+
+	for _, locale := range g.config.locales {
+		if def := g.tree.findDefinition(id + "@" + locale); def != nil {
+			return def
+		}
+
+		if language, _, found := strings.Cut(locale, "-"); found {
+			if def := g.tree.findDefinition(id + "@" + language); def != nil {
+				return def
+			}
+		}
+	}
+
+	return g.tree.findDefinition(id)
+}
+
+// definitionLocale returns the locale of the definition being generated, e.g. "de" for noun@de, or the most preferred
+// locale if the definition isn't localized.
+func (g *generator) definitionLocale() string {
+	if g.def != nil {
+		if _, locale, found := strings.Cut(g.def.Text, "@"); found {
+			return locale
+		}
+	}
+
+	return g.locale()
+}
+
+// locale returns the most preferred locale, or English if none was given.
+func (g *generator) locale() string {
+	if len(g.config.locales) == 0 {
+		return "en"
+	}
+
+	return g.config.locales[0]
+}
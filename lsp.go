@@ -0,0 +1,694 @@
+package grammar
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// ServeLSP runs a Language Server Protocol server for grammar files, reading requests from r and writing responses to w
+// until the client asks it to exit. Editors start it as a subprocess talking over stdin and stdout, e.g.
+//
+//	func main() {
+//		if err := grammar.ServeLSP(os.Stdin, os.Stdout); err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+//
+// The server provides diagnostics (syntax errors and substitutions of undefined identifiers), go to definition and
+// hover documentation (see //!doc) for {identifiers}, completion of identifiers after {, and semantic tokens for
+// highlighting (see Classify). Open documents are synchronized in full, and identifiers are looked up in all of them,
+// most recently opened last.
+func ServeLSP(r io.Reader, w io.Writer) error {
+	server := lspServer{in: bufio.NewReader(r), out: w, docs: make(map[string]*lspDocument)}
+	return server.serve()
+}
+
+// An lspServer holds the state of a language server session.
+type lspServer struct {
+	in    *bufio.Reader
+	out   io.Writer
+	docs  map[string]*lspDocument // Open documents by URI
+	order []string                // URIs in the order they were opened
+}
+
+// An lspDocument is an open grammar file.
+type lspDocument struct {
+	uri   string
+	lines []string
+	tree  *Tree // nil if the document doesn't parse
+	err   error // Why it doesn't
+}
+
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// Severities and kinds defined by the protocol
+const (
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+	lspCompleteVar     = 6
+	lspMethodAbsent    = -32601
+	lspBadParams       = -32602
+	lspInternalError   = -32603
+)
+
+// serve handles messages until exit.
+func (server *lspServer) serve() error {
+	for {
+		msg, err := server.read()
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if msg.Method == "exit" {
+			return nil
+		}
+
+		result, rpcErr := server.handle(msg)
+
+		// Notifications don't get a response
+		if msg.ID == nil {
+			continue
+		}
+
+		// A successful response must have a result, even if it's null
+		if result == nil && rpcErr == nil {
+			result = json.RawMessage("null")
+		}
+
+		if err := server.write(lspMessage{JSONRPC: "2.0", ID: msg.ID, Result: result, Error: rpcErr}); err != nil {
+			return err
+		}
+	}
+}
+
+// handle handles a request or notification and returns the result, if any.
+func (server *lspServer) handle(msg *lspMessage) (interface{}, *lspError) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // Full
+				"definitionProvider": true,
+				"hoverProvider":      true,
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"{"}},
+				"semanticTokensProvider": map[string]interface{}{
+					"legend": map[string]interface{}{"tokenTypes": lspTokenTypes, "tokenModifiers": []string{}},
+					"full":   true,
+				},
+			},
+			"serverInfo": map[string]string{"name": "grammar"},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{lspBadParams, err.Error()}
+		}
+
+		server.order = append(server.order, params.TextDocument.URI)
+		return nil, server.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{lspBadParams, err.Error()}
+		}
+
+		if n := len(params.ContentChanges); n > 0 {
+			return nil, server.update(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+
+		return nil, nil
+	case "textDocument/didClose":
+		var params lspTextDocumentPosition
+
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{lspBadParams, err.Error()}
+		}
+
+		uri := params.TextDocument.URI
+		delete(server.docs, uri)
+
+		for i, u := range server.order {
+			if u == uri {
+				server.order = append(server.order[:i], server.order[i+1:]...)
+				break
+			}
+		}
+
+		if err := server.publish(uri, []lspDiagnostic{}); err != nil {
+			return nil, &lspError{lspInternalError, err.Error()}
+		}
+
+		return nil, nil
+	case "textDocument/definition", "textDocument/hover", "textDocument/completion",
+		"textDocument/semanticTokens/full":
+		var params lspTextDocumentPosition
+
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{lspBadParams, err.Error()}
+		}
+
+		doc := server.docs[params.TextDocument.URI]
+
+		if doc == nil {
+			return nil, nil
+		}
+
+		switch msg.Method {
+		case "textDocument/definition":
+			return server.definition(doc, params.Position), nil
+		case "textDocument/hover":
+			return server.hover(doc, params.Position), nil
+		case "textDocument/semanticTokens/full":
+			return doc.semanticTokens(), nil
+		default:
+			return server.completion(), nil
+		}
+	}
+
+	if msg.ID != nil {
+		return nil, &lspError{lspMethodAbsent, "method not supported: " + msg.Method}
+	}
+
+	return nil, nil
+}
+
+// read reads a message, framed by a Content-Length header.
+func (server *lspServer) read() (*lspMessage, error) {
+	length := -1
+
+	for {
+		line, err := server.in.ReadString('\n')
+
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			break
+		}
+
+		if name, value, found := strings.Cut(line, ":"); found && strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length: %s", value)
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length")
+	}
+
+	body := make([]byte, length)
+
+	if _, err := io.ReadFull(server.in, body); err != nil {
+		return nil, err
+	}
+
+	var msg lspMessage
+
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// write writes a message, framed by a Content-Length header.
+func (server *lspServer) write(msg lspMessage) error {
+	body, err := json.Marshal(msg)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(server.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// update parses the new text of a document and publishes its diagnostics.
+func (server *lspServer) update(uri string, text string) *lspError {
+	doc := &lspDocument{uri: uri, lines: strings.Split(text, "\n")}
+	doc.tree, doc.err = parseInternal(tokenize(text, ""))
+	server.docs[uri] = doc
+
+	if err := server.publish(uri, server.diagnose(doc)); err != nil {
+		return &lspError{lspInternalError, err.Error()}
+	}
+
+	return nil
+}
+
+// publish sends the diagnostics of a document to the client.
+func (server *lspServer) publish(uri string, diagnostics []lspDiagnostic) error {
+	params, err := json.Marshal(map[string]interface{}{"uri": uri, "diagnostics": diagnostics})
+
+	if err != nil {
+		return err
+	}
+
+	return server.write(lspMessage{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics", Params: params})
+}
+
+// sourceLine matches the line number of a source position in an error message, e.g. ":12".
+var sourceLine = regexp.MustCompile(`:(\d+)\b`)
+
+// diagnose returns the problems in a document: syntax errors, or substitutions of identifiers which aren't defined in
+// any open document.
+func (server *lspServer) diagnose(doc *lspDocument) []lspDiagnostic {
+	ret := []lspDiagnostic{}
+
+	if doc.err != nil {
+		for _, parseErr := range ParseErrors(doc.err) {
+			ret = append(ret, doc.parseDiagnostic(parseErr))
+		}
+
+		if len(ret) > 0 {
+			return ret
+		}
+
+		line := 0
+
+		// The error mentions the source positions involved; the last one is where the problem was found
+		if matches := sourceLine.FindAllStringSubmatch(doc.err.Error(), -1); len(matches) > 0 {
+			line, _ = strconv.Atoi(matches[len(matches)-1][1])
+			line--
+		}
+
+		return append(ret, lspDiagnostic{Range: doc.lineRange(line), Severity: lspSeverityError, Source: "grammar",
+			Message: doc.err.Error()})
+	}
+
+	for line, text := range doc.lines {
+		for _, ref := range references(text) {
+			if server.find(ref.id) == nil {
+				ret = append(ret, lspDiagnostic{Range: doc.byteRange(line, ref.start, ref.end), Severity: lspSeverityWarning,
+					Source: "grammar", Message: "no such definition: " + ref.id})
+			}
+		}
+	}
+
+	return ret
+}
+
+// find looks up the definition of id in the open documents. Like Generate, it accepts localized definitions of id.
+func (server *lspServer) find(id string) (ret *lspDefinition) {
+	for _, uri := range server.order {
+		doc := server.docs[uri]
+
+		if doc == nil || doc.tree == nil {
+			continue
+		}
+
+		for i := range doc.tree.root.child {
+			def := &doc.tree.root.child[i]
+
+			if def.Text == id || strings.HasPrefix(def.Text, id+"@") {
+				ret = &lspDefinition{doc: doc, node: def}
+			}
+		}
+	}
+
+	return ret
+}
+
+// An lspDefinition is a definition in an open document.
+type lspDefinition struct {
+	doc  *lspDocument
+	node *node
+}
+
+// location returns where the identifier of the definition is.
+func (def *lspDefinition) location() lspLocation {
+	line := 0
+
+	if _, number, found := strings.Cut(def.node.Source, ":"); found {
+		line, _ = strconv.Atoi(number)
+		line--
+	}
+
+	start := 0
+
+	if line >= 0 && line < len(def.doc.lines) {
+		if p := strings.Index(def.doc.lines[line], def.node.Text); p >= 0 {
+			start = p
+		}
+	}
+
+	return lspLocation{URI: def.doc.uri, Range: def.doc.byteRange(line, start, start+len(def.node.Text))}
+}
+
+// definition returns the location of the definition of the identifier at pos, if any.
+func (server *lspServer) definition(doc *lspDocument, pos lspPosition) interface{} {
+	if ref, found := doc.referenceAt(pos); found {
+		if def := server.find(ref.id); def != nil {
+			return def.location()
+		}
+	}
+
+	return nil
+}
+
+// hover describes the identifier at pos: its documentation, number of branches and where it is defined.
+func (server *lspServer) hover(doc *lspDocument, pos lspPosition) interface{} {
+	ref, found := doc.referenceAt(pos)
+
+	if !found {
+		return nil
+	}
+
+	def := server.find(ref.id)
+
+	if def == nil {
+		return nil
+	}
+
+	d, _ := def.doc.tree.Lookup(def.node.Text)
+	text := fmt.Sprintf("**%s** (%d branches)", d.ID, d.Branches)
+
+	if d.Private {
+		text += ", private"
+	}
+
+	if d.Doc != "" {
+		text += "\n\n" + d.Doc
+	}
+
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": text},
+		"range":    doc.byteRange(pos.Line, ref.start, ref.end),
+	}
+}
+
+// completion lists the identifiers of all open documents.
+func (server *lspServer) completion() interface{} {
+	seen := make(map[string]bool)
+	items := []map[string]interface{}{}
+
+	for _, uri := range server.order {
+		doc := server.docs[uri]
+
+		if doc == nil || doc.tree == nil {
+			continue
+		}
+
+		for i := range doc.tree.root.child {
+			def := &doc.tree.root.child[i]
+
+			if !seen[def.Text] {
+				seen[def.Text] = true
+				items = append(items, map[string]interface{}{"label": def.Text, "kind": lspCompleteVar,
+					"documentation": def.directives.doc})
+			}
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i]["label"].(string) < items[j]["label"].(string) })
+	return items
+}
+
+// lspTokenTypes are the semantic token types for each TokenKind, in order.
+var lspTokenTypes = []string{"string", "function", "keyword", "variable", "comment", "macro", "operator"}
+
+// semanticTokens classifies the document (see Classify) and encodes the spans as the protocol wants: five numbers for
+// each, relative to the previous one.
+func (doc *lspDocument) semanticTokens() interface{} {
+	data := []int{}
+	lineStart := make([]int, len(doc.lines))
+
+	for i := 1; i < len(doc.lines); i++ {
+		lineStart[i] = lineStart[i-1] + len(doc.lines[i-1]) + 1
+	}
+
+	previousLine, previousChar := 0, 0
+
+	for _, span := range Classify(strings.Join(doc.lines, "\n")) {
+		line := span.Line - 1
+		text := doc.lines[line]
+		start := utf16Length(text[:span.Start-lineStart[line]])
+		length := utf16Length(text[span.Start-lineStart[line] : span.End-lineStart[line]])
+
+		if line != previousLine {
+			previousChar = 0
+		}
+
+		data = append(data, line-previousLine, start-previousChar, length, int(span.Kind), 0)
+		previousLine, previousChar = line, start
+	}
+
+	return map[string]interface{}{"data": data}
+}
+
+// A reference is an identifier substituted in a line of grammar, e.g. weekday in "on {*weekday:possessive}".
+type reference struct {
+	id         string
+	start, end int // Byte offsets of the identifier in the line
+}
+
+// references returns the identifiers substituted in a line. Substitutions which aren't identifiers (such as {\n},
+// {1-6} and metadata) are skipped, and comments are ignored.
+func references(line string) []reference {
+	var ret []reference
+
+	if p := strings.Index(line, "//"); p >= 0 {
+		line = line[:p]
+	}
+
+	for p := 0; p < len(line); {
+		open := strings.IndexByte(line[p:], '{')
+
+		if open < 0 {
+			break
+		}
+
+		open += p
+		end := strings.IndexByte(line[open:], '}')
+
+		if end < 0 {
+			break
+		}
+
+		end += open
+		inner := line[open+1 : end]
+		offset := open + 1
+		p = end + 1
+
+		if inner == "" || inner[0] == '\\' || inner[0] == '#' || inner[0] == '%' {
+			continue
+		}
+
+		// Articles refer to nothing, conditions refer to variables, captures to what they capture and loops to what they
+		// repeat
+		if strings.Contains(inner, "?") || article.MatchString(inner) {
+			continue
+		}
+
+		if match := repetition.FindStringSubmatch(inner); match != nil {
+			inner = match[1]
+		}
+
+		if name, captured, found := strings.Cut(inner, "="); found && variableName.MatchString(name) {
+			inner = captured
+			offset += len(name) + 1
+		}
+
+		var low, high int
+
+		if _, err := fmt.Sscanf(inner, "%d-%d", &low, &high); err == nil {
+			continue
+		}
+
+		// Paragraph sequences list several identifiers
+		if inner[0] == '+' || inner[0] == '~' {
+			start := offset + 1
+
+			for _, id := range strings.Split(inner[1:], ",") {
+				if trimmed := strings.TrimSpace(id); trimmed != "" {
+					at := start + strings.Index(id, trimmed)
+					ret = append(ret, reference{trimmed, at, at + len(trimmed)})
+				}
+
+				start += len(id) + 1
+			}
+
+			continue
+		}
+
+		for _, prefix := range []string{"^^", "~~", "*"} {
+			if strings.HasPrefix(inner, prefix) {
+				inner = inner[len(prefix):]
+				offset += len(prefix)
+			}
+		}
+
+		id, _, _ := strings.Cut(inner, ":")
+
+		if id != "" {
+			ret = append(ret, reference{id, offset, offset + len(id)})
+		}
+	}
+
+	return ret
+}
+
+// referenceAt returns the reference at a position, if any.
+func (doc *lspDocument) referenceAt(pos lspPosition) (reference, bool) {
+	if pos.Line < 0 || pos.Line >= len(doc.lines) {
+		return reference{}, false
+	}
+
+	line := doc.lines[pos.Line]
+	at := byteOffset(line, pos.Character)
+
+	for _, ref := range references(line) {
+		if at >= ref.start && at <= ref.end {
+			return ref, true
+		}
+	}
+
+	return reference{}, false
+}
+
+// lineRange returns the range of a whole line.
+func (doc *lspDocument) lineRange(line int) lspRange {
+	if line < 0 || line >= len(doc.lines) {
+		return lspRange{}
+	}
+
+	return doc.byteRange(line, 0, len(doc.lines[line]))
+}
+
+// parseDiagnostic returns the diagnostic for a syntax error, pointing out the offending token if there is one.
+func (doc *lspDocument) parseDiagnostic(err *ParseError) lspDiagnostic {
+	line := err.Line - 1
+	r := doc.lineRange(line)
+
+	if err.Column > 0 && line >= 0 && line < len(doc.lines) {
+		start := doc.columnOffset(line, err.Column)
+		r = doc.byteRange(line, start, start+len(err.Snippet))
+	}
+
+	return lspDiagnostic{Range: r, Severity: lspSeverityError, Source: "grammar", Message: err.Message}
+}
+
+// columnOffset converts a column in characters, starting at 1, to a byte offset within a line.
+func (doc *lspDocument) columnOffset(line int, column int) int {
+	n := 1
+
+	for offset := range doc.lines[line] {
+		if n == column {
+			return offset
+		}
+
+		n++
+	}
+
+	return len(doc.lines[line])
+}
+
+// byteRange converts byte offsets within a line to a range in UTF-16 code units, as the protocol wants.
+func (doc *lspDocument) byteRange(line int, start int, end int) lspRange {
+	text := ""
+
+	if line >= 0 && line < len(doc.lines) {
+		text = doc.lines[line]
+	}
+
+	start, end = min(start, len(text)), min(end, len(text))
+
+	return lspRange{Start: lspPosition{line, utf16Length(text[:start])}, End: lspPosition{line, utf16Length(text[:end])}}
+}
+
+// utf16Length returns the length of s in UTF-16 code units.
+func utf16Length(s string) int {
+	n := 0
+
+	for _, r := range s {
+		n += len(utf16.Encode([]rune{r}))
+	}
+
+	return n
+}
+
+// byteOffset converts a position in UTF-16 code units within line to a byte offset.
+func byteOffset(line string, character int) int {
+	n := 0
+
+	for i, r := range line {
+		if n >= character {
+			return i
+		}
+
+		n += len(utf16.Encode([]rune{r}))
+	}
+
+	return len(line)
+}
@@ -0,0 +1,282 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxMatchDepth limits the nesting of substitutions when matching, so recursive grammars can't recurse without end.
+const maxMatchDepth = 100
+
+// Matches determines whether phrase could have been generated from id, and if so returns a derivation: the branches
+// picked (Result.Branches) and what each substitution resolved to (Result.Substitutions), as if the phrase had been
+// generated with GenerateResult. This can be used to validate existing content against a grammar, or to parse user
+// input with one.
+//
+// Whitespace and case are ignored when matching, since generation adds and removes spaces and capitalizes letters.
+// Exclusive substitutions are matched like regular ones. Paragraph sequences ({+id} and {~id}), modifiers, loops,
+// plurals and conditions never match. The search gives up (and reports no match) after trying a large number of
+// derivations.
+func (tree *Tree) Matches(id string, phrase string) (*Result, bool) {
+	m := matcher{tree: tree}
+
+	for i, r := range phrase {
+		if !unicode.IsSpace(r) {
+			lower := string(unicode.ToLower(r))
+			m.target += lower
+
+			for range len(lower) {
+				m.offset = append(m.offset, i)
+			}
+		}
+	}
+
+	m.offset = append(m.offset, len(phrase))
+
+	found := m.identifier(id, 0, func(end int) bool {
+		return end == len(m.target)
+	})
+
+	if !found {
+		return nil, false
+	}
+
+	// Recover the text of each substitution from the original phrase
+	for i := range m.result.Substitutions {
+		s := &m.result.Substitutions[i]
+		s.Value = strings.TrimSpace(phrase[m.offset[m.starts[i]]:m.offset[m.ends[i]]])
+	}
+
+	m.result.Text = phrase
+	return &m.result, true
+}
+
+// A matcher searches for a derivation of a phrase by backtracking. Each method matches part of the grammar at a
+// position of the target and calls the continuation k with every position where that match could end, until k returns
+// true.
+type matcher struct {
+	tree   *Tree
+	target string // The phrase without whitespace, in lower case
+	offset []int  // The position in the original phrase of every byte of target, and its end
+
+	result Result
+	starts []int // Start of each substitution in target
+	ends   []int // End of each substitution in target
+	def    *node // The definition being matched
+	depth  int   // Nesting depth of substitutions
+	steps  int   // Number of nodes tried so far
+}
+
+// identifier matches the definition of id, recording it as a substitution.
+func (m *matcher) identifier(id string, pos int, k func(int) bool) bool {
+	var def *node
+
+	if id == "" && len(m.tree.root.child) > 0 {
+		def = &m.tree.root.child[len(m.tree.root.child)-1]
+	} else {
+		def = m.tree.findDefinition(id)
+	}
+
+	if def == nil || len(def.child) == 0 || m.depth >= maxMatchDepth {
+		return false
+	}
+
+	previous := m.def
+	m.def = def
+	m.depth++
+
+	found := m.node(&def.child[0], pos, func(end int) bool {
+		m.def = previous
+		m.depth--
+
+		if k(end) {
+			return true
+		}
+
+		m.def = def
+		m.depth++
+		return false
+	})
+
+	m.def = previous
+	m.depth--
+	return found
+}
+
+// substitution matches a substitution of id, recording it in the result.
+func (m *matcher) substitution(id string, pos int, k func(int) bool) bool {
+	i := len(m.result.Substitutions)
+	m.result.Substitutions = append(m.result.Substitutions, Substitution{ID: id, Depth: m.depth - 1})
+	m.starts = append(m.starts, pos)
+	m.ends = append(m.ends, pos)
+
+	match := func(end int) bool {
+		m.ends[i] = end
+		return k(end)
+	}
+
+	var found bool
+	var low, high int
+
+	if _, err := fmt.Sscanf(id, "%d-%d", &low, &high); err == nil {
+		found = m.number(low, high, pos, match)
+	} else {
+		found = m.identifier(id, pos, match)
+	}
+
+	if !found {
+		m.result.Substitutions = m.result.Substitutions[:i]
+		m.starts = m.starts[:i]
+		m.ends = m.ends[:i]
+	}
+
+	return found
+}
+
+// node matches node and its children.
+func (m *matcher) node(n *node, pos int, k func(int) bool) bool {
+	if m.steps++; m.steps > maxSearch {
+		return false
+	}
+
+	switch n.internalType {
+	case group:
+		for i := range n.child {
+			branches := len(m.result.Branches)
+			m.result.Branches = append(m.result.Branches, branchKey(m.def, n, i))
+
+			if m.node(&n.child[i], pos, k) {
+				return true
+			}
+
+			m.result.Branches = m.result.Branches[:branches]
+		}
+
+		return false
+	case text:
+		return m.text(n.Text, pos, func(end int) bool {
+			return m.children(n.child, end, k)
+		})
+	default:
+		return m.children(n.child, pos, k)
+	}
+}
+
+// children matches a sequence of nodes.
+func (m *matcher) children(nodes []node, pos int, k func(int) bool) bool {
+	if len(nodes) == 0 {
+		return k(pos)
+	}
+
+	return m.node(&nodes[0], pos, func(end int) bool {
+		return m.children(nodes[1:], end, k)
+	})
+}
+
+// text matches the text of a node, including its {substitutions}.
+func (m *matcher) text(s string, pos int, k func(int) bool) bool {
+	open := strings.IndexByte(s, '{')
+
+	if open < 0 {
+		return m.literal(s, pos, k)
+	}
+
+	end := strings.IndexByte(s[open:], '}')
+
+	if end < 0 {
+		return m.literal(s, pos, k)
+	}
+
+	inner := s[open+1 : open+end]
+	rest := s[open+end+1:]
+
+	return m.literal(s[:open], pos, func(p int) bool {
+		switch {
+		case strings.HasPrefix(inner, "\\") || strings.HasPrefix(inner, "#"):
+			return m.text(rest, p, k)
+		case strings.HasPrefix(inner, "+") || strings.HasPrefix(inner, "~"):
+			return false
+		case article.MatchString(inner):
+			// Any form of an article will do, whatever the gender of the noun
+			for _, form := range strings.Split(inner, "/") {
+				if m.literal(strings.ReplaceAll(form, "_", " "), p, func(end int) bool { return m.text(rest, end, k) }) {
+					return true
+				}
+			}
+
+			return false
+		default:
+			// Case markers before a substitution don't show up in the phrase
+			inner = strings.TrimPrefix(strings.TrimPrefix(inner, "^^"), "~~")
+
+			return m.substitution(inner, p, func(end int) bool {
+				return m.text(rest, end, k)
+			})
+		}
+	})
+}
+
+// literal matches plain text, without the control tokens that generation removes.
+func (m *matcher) literal(s string, pos int, k func(int) bool) bool {
+	var want strings.Builder
+
+	for _, word := range strings.Fields(s) {
+		if word == "_" || word == "<<" {
+			continue
+		}
+
+		word = strings.ReplaceAll(joinedDashes.Replace(word), "<<", "")
+
+		for _, marker := range []string{"^^", "~~", "^"} {
+			word = strings.TrimPrefix(word, marker)
+		}
+
+		for _, r := range decodeLiterals(word) {
+			if !unicode.IsSpace(r) {
+				want.WriteRune(unicode.ToLower(r))
+			}
+		}
+	}
+
+	if !strings.HasPrefix(m.target[pos:], want.String()) {
+		return false
+	}
+
+	return k(pos + want.Len())
+}
+
+// number matches a number between low and high.
+func (m *matcher) number(low int, high int, pos int, k func(int) bool) bool {
+	end := pos
+
+	if end < len(m.target) && m.target[end] == '-' {
+		end++
+	}
+
+	for end < len(m.target) {
+		r, size := utf8.DecodeRuneInString(m.target[end:])
+
+		if r < '0' || r > '9' {
+			break
+		}
+
+		end += size
+	}
+
+	// Try the longest number first; a shorter one may be followed by digits from the grammar
+	for ; end > pos; end-- {
+		var n int
+
+		if _, err := fmt.Sscanf(m.target[pos:end], "%d", &n); err != nil || n < low || n > high {
+			continue
+		}
+
+		if fmt.Sprint(n) == m.target[pos:end] && k(end) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A MergeStrategy decides what happens when two definitions have the same identifier, e.g. when merging trees with
+// Merge or with a //!merge directive.
+type MergeStrategy int
+
+const (
+	// MergeError treats the second definition as a mistake (the default)
+	MergeError MergeStrategy = iota
+	// MergeReplace keeps only the second definition
+	MergeReplace
+	// MergeAppend adds the branches of the second definition after those of the first
+	MergeAppend
+	// MergeInterleave alternates the branches of the two definitions, starting with the first
+	MergeInterleave
+)
+
+// mergeStrategies maps the names used by //!merge to strategies.
+var mergeStrategies = map[string]MergeStrategy{
+	"error":      MergeError,
+	"replace":    MergeReplace,
+	"append":     MergeAppend,
+	"interleave": MergeInterleave,
+}
+
+// Merge adds the definitions of other to the tree, so grammar packs can build on each other. Definitions of identifiers
+// the tree already has are combined according to strategies, or if an identifier isn't listed there, the //!merge
+// directive of the definition in other:
+//
+//	//!merge append
+//	animal [ wombat | platypus ]
+//
+// Without either, a duplicate identifier is an error. Merging is all or nothing: if there is an error, the tree is
+// left unchanged. Note that appending or interleaving branches changes the numbering of groups and branches of the
+// combined definition, so branch keys (see Session.Used) may no longer refer to the same branches.
+func (tree *Tree) Merge(other *Tree, strategies map[string]MergeStrategy) error {
+	defs := make([]node, 0, len(tree.root.child)+len(other.root.child))
+
+	for i := range tree.root.child {
+		defs = append(defs, tree.root.child[i].clone())
+	}
+
+	for i := range other.root.child {
+		def := other.root.child[i].clone()
+		strategy, found := strategies[def.Text]
+
+		if !found {
+			strategy = def.directives.merge
+		}
+
+		var err error
+
+		if defs, err = mergeDefinition(defs, def, strategy); err != nil {
+			return err
+		}
+	}
+
+	tree.root.child = defs
+	return nil
+}
+
+// mergeDuplicates combines the definitions of root which share an identifier, according to their //!merge directives.
+func mergeDuplicates(root *node) error {
+	defs := make([]node, 0, len(root.child))
+
+	for _, def := range root.child {
+		var err error
+
+		if defs, err = mergeDefinition(defs, def, def.directives.merge); err != nil {
+			return err
+		}
+	}
+
+	root.child = defs
+	return nil
+}
+
+// mergeDefinition adds def to defs, combining it with an existing definition of the same identifier using strategy.
+func mergeDefinition(defs []node, def node, strategy MergeStrategy) ([]node, error) {
+	i := 0
+
+	for i < len(defs) && defs[i].Text != def.Text {
+		i++
+	}
+
+	if i == len(defs) {
+		return append(defs, def), nil
+	}
+
+	existing := &defs[i]
+
+	switch strategy {
+	case MergeReplace:
+		// The new definition takes the place of the old, so the last definition stays the default
+		return append(append(defs[:i:i], defs[i+1:]...), def), nil
+	case MergeAppend, MergeInterleave:
+		if len(existing.child) != 1 || len(def.child) != 1 ||
+			existing.child[0].internalType != group || def.child[0].internalType != group {
+			return nil, newParseError(def.Source, 0, def.Text, "can't merge branches of %s (also defined at %s)", def.Text,
+				existing.Source)
+		}
+
+		// Renumber the groups of the new definition to follow those of the existing one
+		def.renumberGroups(existing.maxGroup())
+
+		a, b := existing.child[0].child, def.child[0].child
+		var branches []node
+
+		if strategy == MergeAppend {
+			branches = append(append(branches, a...), b...)
+		} else {
+			for j := 0; j < len(a) || j < len(b); j++ {
+				if j < len(a) {
+					branches = append(branches, a[j])
+				}
+
+				if j < len(b) {
+					branches = append(branches, b[j])
+				}
+			}
+		}
+
+		existing.child[0].child = branches
+		existing.child[0].exclusive = existing.child[0].exclusive || def.child[0].exclusive
+		return defs, nil
+	default:
+		return nil, newParseError(def.Source, 0, def.Text, "duplicate identifier \"%s\" (also defined at %s)", def.Text,
+			existing.Source).is(ErrDuplicateIdentifier)
+	}
+}
+
+// clone returns a deep copy of n, so it can be changed without affecting the original.
+func (n *node) clone() node {
+	ret := *n
+	ret.child = make([]node, len(n.child))
+
+	for i := range n.child {
+		ret.child[i] = n.child[i].clone()
+	}
+
+	return ret
+}
+
+// maxGroup returns the highest group number (e.g. 3 for "[3") in the subtree of node.
+func (node *node) maxGroup() int {
+	ret := 0
+
+	if node.internalType == group {
+		fmt.Sscanf(node.Text, "[%d", &ret)
+	}
+
+	for i := range node.child {
+		if n := node.child[i].maxGroup(); n > ret {
+			ret = n
+		}
+	}
+
+	return ret
+}
+
+// renumberGroups adds offset to the number of every group in the subtree of node.
+func (node *node) renumberGroups(offset int) {
+	if node.internalType == group {
+		var n int
+		fmt.Sscanf(node.Text, "[%d", &n)
+		node.Text = fmt.Sprintf("[%d", n+offset)
+	}
+
+	for i := range node.child {
+		node.child[i].renumberGroups(offset)
+	}
+}
+
+// mergeDirective reports whether directives contain a //!merge directive.
+func mergeDirective(directives []token) bool {
+	for _, d := range directives {
+		if fields := strings.Fields(strings.TrimPrefix(d.Text, "//!")); len(fields) > 0 && fields[0] == "merge" {
+			return true
+		}
+	}
+
+	return false
+}
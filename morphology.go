@@ -0,0 +1,336 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Morphology inflects words and phrases, for modifiers such as {verb:past} or {noun:plural}. Implement it to support
+// other languages, or more irregular words than the English default knows about.
+//
+// Inflect returns phrase in the given form, or false if it doesn't know the form.
+type Morphology interface {
+	Inflect(phrase string, form string) (string, bool)
+}
+
+// UseMorphology sets the Morphology that modifiers are routed through. The default is English.
+func UseMorphology(m Morphology) GenerateOption {
+	return func(config *generateConfig) {
+		config.morphology = m
+	}
+}
+
+// English is the default Morphology. It knows the most common irregular words, and applies the regular rules of
+// English spelling to everything else. Verb forms inflect the first word of a phrase ("pick up" becomes "picked up"),
+// other forms the last ("old cat" becomes "old cats"), except that the plural of "cup of tea" is "cups of tea". These
+// forms are supported:
+//
+//	past         walk → walked, go → went
+//	participle   walk → walked, go → gone
+//	ing          walk → walking, run → running
+//	present      walk → walks, go → goes (third person singular)
+//	plural       cat → cats, child → children
+//	possessive   cat → cat's, cats → cats'
+//	comparative  big → bigger, good → better, curious → more curious
+//	superlative  big → biggest, good → best, curious → most curious
+var English Morphology = english{}
+
+type english struct{}
+
+// irregularVerbs maps verbs to their past tense and past participle.
+var irregularVerbs = map[string][2]string{
+	"be": {"was", "been"}, "have": {"had", "had"}, "do": {"did", "done"}, "go": {"went", "gone"},
+	"say": {"said", "said"}, "make": {"made", "made"}, "take": {"took", "taken"}, "see": {"saw", "seen"},
+	"come": {"came", "come"}, "know": {"knew", "known"}, "get": {"got", "gotten"}, "give": {"gave", "given"},
+	"find": {"found", "found"}, "think": {"thought", "thought"}, "tell": {"told", "told"},
+	"become": {"became", "become"}, "leave": {"left", "left"}, "feel": {"felt", "felt"},
+	"bring": {"brought", "brought"}, "begin": {"began", "begun"}, "keep": {"kept", "kept"},
+	"hold": {"held", "held"}, "write": {"wrote", "written"}, "stand": {"stood", "stood"},
+	"hear": {"heard", "heard"}, "let": {"let", "let"}, "mean": {"meant", "meant"}, "set": {"set", "set"},
+	"meet": {"met", "met"}, "run": {"ran", "run"}, "pay": {"paid", "paid"}, "sit": {"sat", "sat"},
+	"speak": {"spoke", "spoken"}, "lead": {"led", "led"}, "read": {"read", "read"}, "grow": {"grew", "grown"},
+	"lose": {"lost", "lost"}, "fall": {"fell", "fallen"}, "send": {"sent", "sent"}, "build": {"built", "built"},
+	"draw": {"drew", "drawn"}, "break": {"broke", "broken"}, "spend": {"spent", "spent"}, "cut": {"cut", "cut"},
+	"rise": {"rose", "risen"}, "drive": {"drove", "driven"}, "buy": {"bought", "bought"}, "wear": {"wore", "worn"},
+	"choose": {"chose", "chosen"}, "eat": {"ate", "eaten"}, "fly": {"flew", "flown"}, "swim": {"swam", "swum"},
+	"sing": {"sang", "sung"}, "fight": {"fought", "fought"}, "throw": {"threw", "thrown"},
+	"catch": {"caught", "caught"}, "teach": {"taught", "taught"}, "sell": {"sold", "sold"}, "win": {"won", "won"},
+	"sleep": {"slept", "slept"}, "ride": {"rode", "ridden"}, "hide": {"hid", "hidden"}, "steal": {"stole", "stolen"},
+	"shoot": {"shot", "shot"}, "forget": {"forgot", "forgotten"}, "drink": {"drank", "drunk"},
+	"sink": {"sank", "sunk"}, "bite": {"bit", "bitten"}, "blow": {"blew", "blown"}, "dig": {"dug", "dug"},
+	"feed": {"fed", "fed"}, "flee": {"fled", "fled"}, "forgive": {"forgave", "forgiven"},
+	"freeze": {"froze", "frozen"}, "hang": {"hung", "hung"}, "hit": {"hit", "hit"}, "hurt": {"hurt", "hurt"},
+	"lay": {"laid", "laid"}, "light": {"lit", "lit"}, "put": {"put", "put"}, "quit": {"quit", "quit"},
+	"ring": {"rang", "rung"}, "seek": {"sought", "sought"}, "shake": {"shook", "shaken"},
+	"shine": {"shone", "shone"}, "shut": {"shut", "shut"}, "slay": {"slew", "slain"}, "strike": {"struck", "struck"},
+	"swear": {"swore", "sworn"}, "sweep": {"swept", "swept"}, "tear": {"tore", "torn"}, "wake": {"woke", "woken"},
+	"weep": {"wept", "wept"},
+}
+
+// irregularPresent maps verbs to their irregular third person singular.
+var irregularPresent = map[string]string{"be": "is", "have": "has", "do": "does", "go": "goes"}
+
+// irregularPlurals maps nouns to their irregular plurals.
+var irregularPlurals = map[string]string{
+	"man": "men", "woman": "women", "child": "children", "person": "people", "mouse": "mice", "louse": "lice",
+	"tooth": "teeth", "foot": "feet", "goose": "geese", "ox": "oxen", "sheep": "sheep", "fish": "fish",
+	"deer": "deer", "moose": "moose", "series": "series", "species": "species", "wolf": "wolves", "knife": "knives",
+	"life": "lives", "wife": "wives", "leaf": "leaves", "half": "halves", "elf": "elves", "dwarf": "dwarves",
+	"thief": "thieves", "shelf": "shelves", "loaf": "loaves", "calf": "calves", "self": "selves",
+	"hero": "heroes", "potato": "potatoes", "tomato": "tomatoes", "echo": "echoes", "cactus": "cacti",
+	"fungus": "fungi", "crisis": "crises", "phenomenon": "phenomena", "criterion": "criteria",
+}
+
+// irregularComparisons maps adjectives to their comparative and superlative.
+var irregularComparisons = map[string][2]string{
+	"good": {"better", "best"}, "well": {"better", "best"}, "bad": {"worse", "worst"}, "far": {"further", "furthest"},
+	"little": {"less", "least"}, "many": {"more", "most"}, "much": {"more", "most"},
+}
+
+// Inflect returns phrase in the given form, or false if the form isn't one of those listed for English.
+func (english) Inflect(phrase string, form string) (string, bool) {
+	var inflect func(string) string
+	first := false
+
+	switch form {
+	case "past":
+		inflect, first = func(w string) string { return pastTense(w, 0) }, true
+	case "participle":
+		inflect, first = func(w string) string { return pastTense(w, 1) }, true
+	case "ing":
+		inflect, first = presentParticiple, true
+	case "present":
+		inflect, first = thirdPerson, true
+	case "plural":
+		inflect = plural
+	case "possessive":
+		inflect = possessive
+	case "comparative":
+		inflect = func(w string) string { return compare(w, 0, "more") }
+	case "superlative":
+		inflect = func(w string) string { return compare(w, 1, "most") }
+	default:
+		return "", false
+	}
+
+	words := strings.Split(phrase, " ")
+	i := len(words) - 1
+
+	if first {
+		i = 0
+	} else if form == "plural" {
+		// The head of "cup of tea" is cup
+		for j := 1; j < len(words); j++ {
+			if words[j] == "of" {
+				i = j - 1
+				break
+			}
+		}
+	}
+
+	words[i] = keepCase(words[i], inflect(strings.ToLower(words[i])))
+	return strings.Join(words, " "), true
+}
+
+// keepCase capitalizes inflected if original was capitalized.
+func keepCase(original string, inflected string) string {
+	r, _ := utf8.DecodeRuneInString(original)
+
+	if !unicode.IsUpper(r) {
+		return inflected
+	}
+
+	if strings.ToUpper(original) == original && len(original) > 1 {
+		return strings.ToUpper(inflected)
+	}
+
+	first, size := utf8.DecodeRuneInString(inflected)
+	return string(unicode.ToUpper(first)) + inflected[size:]
+}
+
+// isVowel reports whether the byte b is a vowel.
+func isVowel(b byte) bool {
+	return strings.IndexByte("aeiou", b) >= 0
+}
+
+// doublesFinal reports whether the final consonant of w is doubled before a suffix, as in stop → stopped. This is
+// the case for short words ending in a single vowel followed by a single consonant.
+func doublesFinal(w string) bool {
+	n := len(w)
+
+	if n < 3 || n > 4 || strings.IndexByte("wxy", w[n-1]) >= 0 {
+		return false
+	}
+
+	if isVowel(w[n-1]) || !isVowel(w[n-2]) || isVowel(w[n-3]) {
+		return false
+	}
+
+	// Only one vowel in the whole word
+	return strings.IndexAny(w[:n-2], "aeiou") < 0
+}
+
+// endsInConsonantY reports whether w ends in a y following a consonant, as in carry.
+func endsInConsonantY(w string) bool {
+	n := len(w)
+	return n > 1 && w[n-1] == 'y' && !isVowel(w[n-2])
+}
+
+// pastTense returns the past tense (form 0) or past participle (form 1) of a verb.
+func pastTense(w string, form int) string {
+	if forms, found := irregularVerbs[w]; found {
+		return forms[form]
+	}
+
+	switch {
+	case strings.HasSuffix(w, "e"):
+		return w + "d"
+	case endsInConsonantY(w):
+		return w[:len(w)-1] + "ied"
+	case doublesFinal(w):
+		return w + w[len(w)-1:] + "ed"
+	}
+
+	return w + "ed"
+}
+
+// presentParticiple returns the -ing form of a verb.
+func presentParticiple(w string) string {
+	switch {
+	case w == "be" || w == "see" || w == "flee":
+		return w + "ing"
+	case strings.HasSuffix(w, "ie"):
+		return w[:len(w)-2] + "ying"
+	case strings.HasSuffix(w, "e") && !strings.HasSuffix(w, "ee") && !strings.HasSuffix(w, "ye") &&
+		!strings.HasSuffix(w, "oe"):
+		return w[:len(w)-1] + "ing"
+	case doublesFinal(w):
+		return w + w[len(w)-1:] + "ing"
+	}
+
+	return w + "ing"
+}
+
+// thirdPerson returns the third person singular present of a verb.
+func thirdPerson(w string) string {
+	if s, found := irregularPresent[w]; found {
+		return s
+	}
+
+	return sibilantSuffix(w)
+}
+
+// plural returns the plural of a noun.
+func plural(w string) string {
+	if s, found := irregularPlurals[w]; found {
+		return s
+	}
+
+	return sibilantSuffix(w)
+}
+
+// sibilantSuffix adds -s, -es or -ies to w as the spelling requires.
+func sibilantSuffix(w string) string {
+	switch {
+	case endsInConsonantY(w):
+		return w[:len(w)-1] + "ies"
+	case strings.HasSuffix(w, "s") || strings.HasSuffix(w, "x") || strings.HasSuffix(w, "z") ||
+		strings.HasSuffix(w, "ch") || strings.HasSuffix(w, "sh"):
+		return w + "es"
+	}
+
+	return w + "s"
+}
+
+// possessive returns the possessive form of a noun.
+func possessive(w string) string {
+	if strings.HasSuffix(w, "s") {
+		return w + "'"
+	}
+
+	return w + "'s"
+}
+
+// compare returns the comparative (form 0) or superlative (form 1) of an adjective. Adjectives with more than two
+// syllables, or two syllables not ending in y, use more (or most) instead of a suffix.
+func compare(w string, form int, more string) string {
+	if forms, found := irregularComparisons[w]; found {
+		return forms[form]
+	}
+
+	suffix := []string{"er", "est"}[form]
+
+	switch syllables(w) {
+	case 1:
+		switch {
+		case strings.HasSuffix(w, "e"):
+			return w + suffix[1:]
+		case endsInConsonantY(w):
+			return w[:len(w)-1] + "i" + suffix
+		case doublesFinal(w):
+			return w + w[len(w)-1:] + suffix
+		}
+
+		return w + suffix
+	case 2:
+		if endsInConsonantY(w) {
+			return w[:len(w)-1] + "i" + suffix
+		}
+	}
+
+	return more + " " + w
+}
+
+// syllables estimates the number of syllables in w by counting groups of vowels. A final silent e doesn't count.
+func syllables(w string) int {
+	w = strings.TrimSuffix(w, "e")
+	n := 0
+
+	for i := 0; i < len(w); i++ {
+		if (isVowel(w[i]) || w[i] == 'y' && i > 0) && (i == 0 || !(isVowel(w[i-1]) || w[i-1] == 'y')) {
+			n++
+		}
+	}
+
+	if n == 0 {
+		return 1
+	}
+
+	return n
+}
+
+// builtinModifiers are the modifiers that apply whatever the Morphology.
+var builtinModifiers = map[string]func(g *generator, value string) string{
+	"title":       func(g *generator, value string) string { return g.titleCase(value) },
+	"alternating": func(g *generator, value string) string { return AlternatingCase(value) },
+	"leet":        func(g *generator, value string) string { return Leet(value) },
+	"smallcaps":   func(g *generator, value string) string { return SmallCaps(value) },
+}
+
+// modify applies the modifiers (as in {verb:past:possessive}) to value, in order.
+func (g *generator) modify(value string, modifiers []string) (string, error) {
+	m := g.config.morphology
+
+	if m == nil {
+		m = English
+	}
+
+	for _, modifier := range modifiers {
+		if builtin, found := builtinModifiers[modifier]; found {
+			value = builtin(g, value)
+			continue
+		}
+
+		inflected, ok := m.Inflect(value, modifier)
+
+		if !ok {
+			return "", fmt.Errorf("unknown modifier %s", modifier)
+		}
+
+		value = inflected
+	}
+
+	return value, nil
+}
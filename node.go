@@ -2,6 +2,7 @@ package grammar
 
 import (
 	"fmt"
+	"strings"
 )
 
 type nodeType int
@@ -19,7 +20,12 @@ type node struct {
 	internalType nodeType
 	Text         string
 	child        []node
-	Source       string // Where this token originated
+	Source       string     // Where this token originated
+	directives   directives // Settings for a top-level definition (tag), given by //! directives
+	exclusive    bool       // Each branch of this group can only be used once (until reset)
+	weight       float64    // Weight of an empty branch relative to its siblings, given by _:4; 0 is the default of 1
+	tier         string     // Rarity tier of a branch, given by {#tier=rare} (see TierOdds)
+	comments     []string   // Comments written right before a definition or branch, e.g. "// formal", one per line
 }
 
 // Returns a text representation of an individual node.
@@ -30,7 +36,7 @@ func (node *node) formatNode(options []TreeFormatOption) string {
 	case root:
 		return "(root)"
 	case text:
-		return node.Text
+		return showLiterals(node.Text)
 	case tag:
 		return node.Text
 	case group:
@@ -46,13 +52,49 @@ func (node *node) formatNode(options []TreeFormatOption) string {
 	}
 }
 
+// grammarText reconstructs the grammar text of a node and its children, e.g. "good [ morning | evening ]".
+func (node *node) grammarText() string {
+	var parts []string
+
+	switch node.internalType {
+	case text, tag:
+		if node.weight > 0 {
+			parts = append(parts, fmt.Sprintf("%s:%g", showLiterals(node.Text), node.weight))
+		} else {
+			parts = append(parts, showLiterals(node.Text))
+		}
+	case group:
+		var branches []string
+
+		for i := range node.child {
+			branches = append(branches, node.child[i].grammarText())
+		}
+
+		if node.exclusive {
+			return "[* " + strings.Join(branches, " | ") + " ]"
+		}
+
+		return "[ " + strings.Join(branches, " | ") + " ]"
+	}
+
+	for i := range node.child {
+		parts = append(parts, node.child[i].grammarText())
+	}
+
+	return strings.Join(parts, " ")
+}
+
 type TreeFormatOption int
 
 const (
 	// Include source file and line number for each token
 	DisplaySource TreeFormatOption = iota
-	// Include unique group IDs (e.g. [23)
+	// Include group IDs (e.g. [23), unique within each definition
 	DisplayGroupNumbers
+	// Append a legend of the symbols used and a summary line for each identifier (nodes, branches, max depth)
+	DisplayLegend
+	// Include the comments written before definitions and branches, as nodes of their own
+	DisplayComments
 )
 
 func hasOption(find TreeFormatOption, in []TreeFormatOption) bool {
@@ -74,7 +116,7 @@ func (root *node) add(path []string, source string, nodeType nodeType) (*node, e
 		if len(path) == 1 {
 			add := node{Text: path[0], Source: source, internalType: nodeType}
 			group.child = append(group.child, add)
-			return &add, nil
+			return &group.child[len(group.child)-1], nil
 		}
 
 		// Otherwise, search the tree for the next element in the path
@@ -96,3 +138,27 @@ func (root *node) add(path []string, source string, nodeType nodeType) (*node, e
 	next:
 	}
 }
+
+// find returns the node at path, or nil if there is no such node. Like add, it prefers the most recent match.
+func (root *node) find(path []string) *node {
+	current := root
+
+	for _, find := range path {
+		var found *node
+
+		for i := len(current.child) - 1; i >= 0; i-- {
+			if current.child[i].Text == find {
+				found = &current.child[i]
+				break
+			}
+		}
+
+		if found == nil {
+			return nil
+		}
+
+		current = found
+	}
+
+	return current
+}
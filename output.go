@@ -0,0 +1,301 @@
+package grammar
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Wrap wraps the output at width columns. Lines are only broken between words, so a word longer than width gets a
+// line of its own. Existing line breaks (e.g. from {\n}) are kept.
+func Wrap(width int) GenerateOption {
+	return func(config *generateConfig) {
+		config.wrap = width
+	}
+}
+
+// Trim removes leading and trailing whitespace (including newlines) from the output.
+func Trim() GenerateOption {
+	return func(config *generateConfig) {
+		config.trim = true
+	}
+}
+
+// FinalNewline makes the output end with exactly one newline.
+func FinalNewline() GenerateOption {
+	return func(config *generateConfig) {
+		config.newline = true
+	}
+}
+
+// MaxNewlines collapses runs of more than n consecutive newlines (e.g. from repeated {\n} or {\p}) into n newlines.
+// MaxNewlines(1) removes all blank lines, and MaxNewlines(2) allows blank lines between paragraphs, but only one.
+func MaxNewlines(n int) GenerateOption {
+	return func(config *generateConfig) {
+		config.newlines = n
+	}
+}
+
+// Typography replaces straight quotes with curly ones, -- with an em dash and ... with an ellipsis in the output, for
+// text that is to be published as is. A quote at the start of the output or after whitespace or an opening bracket
+// opens; any other quote closes, so apostrophes come out as ’, as do those of common elisions such as 'tis and of
+// abbreviated years such as '90s and '99.
+func Typography() GenerateOption {
+	return func(config *generateConfig) {
+		config.typography = true
+	}
+}
+
+// finish applies the options that concern the final output, once the whole phrase has been generated. It fails if the
+// delimiters of the output are checked and don't pair up.
+func (g *generator) finish(out string) (string, error) {
+	// An empty token has nothing around it to tidy away if the phrase is nothing else, as from a branch [ _ ]
+	if out == "_" {
+		out = ""
+	}
+
+	out = g.resolveArticles(out, true)
+
+	if !g.config.ssml {
+		out = stripSpeech(out)
+	}
+
+	if g.config.synonyms != nil {
+		out = g.replaceSynonyms(out)
+	}
+
+	if g.config.typography {
+		out = typography(out)
+	}
+
+	if g.config.caseMode != CaseAsIs {
+		out = g.changeCase(out, g.config.caseMode)
+	}
+
+	if g.config.newlines > 0 {
+		out = collapseNewlines(out, g.config.newlines)
+	}
+
+	if g.config.trim {
+		out = strings.TrimSpace(out)
+	}
+
+	// Literals are still encoded, so their delimiters don't count
+	if g.config.balance != balanceIgnore {
+		var err error
+
+		if out, err = balance(out, g.delimiters(), g.config.balance == balanceClose); err != nil {
+			return "", err
+		}
+	}
+
+	if g.config.wrap > 0 {
+		out = wrap(out, g.config.wrap)
+	}
+
+	// Split while literals are still encoded, so each of them stays a single token
+	if g.config.tokens != nil {
+		*g.config.tokens = splitTokens(out)
+	}
+
+	out = decodeLiterals(out)
+
+	if g.config.ssml {
+		out = renderSSML(out)
+	}
+
+	if g.config.newline {
+		out = strings.TrimRight(out, "\n") + "\n"
+
+		if tokens := g.config.tokens; tokens != nil && len(*tokens) > 0 {
+			last := &(*tokens)[len(*tokens)-1]
+			last.Space = strings.TrimRight(last.Space, "\n") + "\n"
+		}
+	}
+
+	return out, nil
+}
+
+// elision matches an apostrophe standing for letters or digits left out at the start of a word, e.g. 'tis, '90s or
+// '99, which a quote after whitespace would otherwise take for an opening one. A word quoted as a whole, like '42', is
+// not an elision.
+var elision = regexp.MustCompile(`(?i)(^|[^\p{L}\p{N}'])'(tis|twas|twere|twill|em|cause|til|\d0s|\d\d)` +
+	`([^\p{L}\p{N}']|$)`)
+
+// typographic maps character sequences to their typographic replacements, in the order they are tried.
+var typographic = strings.NewReplacer("---", "—", "--", "—", "...", "…")
+
+// typography converts s to typographic quotes, dashes and ellipses (see Typography).
+func typography(s string) string {
+	s = typographic.Replace(s)
+	// Elisions may be one character apart, as in "'99 '05", so matches may overlap
+	for elided := elision.ReplaceAllString(s, "$1’$2$3"); elided != s; {
+		s, elided = elided, elision.ReplaceAllString(elided, "$1’$2$3")
+	}
+
+	var b strings.Builder
+	opening := true // Whether a quote here would open
+
+	for _, r := range s {
+		switch {
+		case r == '"' && opening:
+			b.WriteRune('“')
+		case r == '"':
+			b.WriteRune('”')
+		case r == '\'' && opening:
+			b.WriteRune('‘')
+		case r == '\'':
+			b.WriteRune('’')
+		default:
+			b.WriteRune(r)
+		}
+
+		opening = unicode.IsSpace(r) || strings.ContainsRune("([{—“‘", r) || r == '"' && opening || r == '\'' && opening
+	}
+
+	return b.String()
+}
+
+// collapseNewlines replaces every run of more than max newlines in s with max newlines.
+func collapseNewlines(s string, max int) string {
+	var b strings.Builder
+	run := 0
+
+	for _, r := range s {
+		if r == '\n' {
+			run++
+
+			if run > max {
+				continue
+			}
+		} else {
+			run = 0
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// wrap breaks each line of s between words so that no line is longer than width (unless a single word is).
+func wrap(s string, width int) string {
+	lines := strings.Split(s, "\n")
+
+	for i, line := range lines {
+		var wrapped []string
+		current := ""
+
+		for _, word := range strings.Fields(line) {
+			if current == "" {
+				current = word
+			} else if utf8.RuneCountInString(current)+1+utf8.RuneCountInString(word) <= width {
+				current += " " + word
+			} else {
+				wrapped = append(wrapped, current)
+				current = word
+			}
+		}
+
+		lines[i] = strings.Join(append(wrapped, current), "\n")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// caseMarkers lists the tokens that change the case of the following word, substitution or group, and the change.
+var caseMarkers = []struct {
+	marker string
+	change func(string) string
+}{
+	{"^^", strings.ToUpper},
+	{"~~", strings.ToLower},
+}
+
+// cutCaseMarkers checks whether s ends with case markers as separate tokens, and if so returns s without them and the
+// change they make together. Markers in a row apply from the inside out, so the first one decides, e.g. ^^ ~~ Hello
+// gives HELLO.
+func cutCaseMarkers(s string) (string, func(string) string, bool) {
+	change, found := func(s string) string { return s }, false
+
+	for cut := true; cut; {
+		cut = false
+
+		for _, m := range caseMarkers {
+			if before, ok := cutCaseMarker(strings.TrimRight(s, " "), m.marker); ok {
+				inner := change
+				change = func(s string) string { return m.change(inner(s)) }
+				s, cut, found = before, true, true
+			}
+		}
+	}
+
+	return s, change, found
+}
+
+// cutCaseMarker checks whether s ends with marker as a separate token, and if so returns s without it.
+func cutCaseMarker(s string, marker string) (string, bool) {
+	if s == marker {
+		return "", true
+	}
+
+	if strings.HasSuffix(s, " "+marker) {
+		return s[:len(s)-len(marker)], true
+	}
+
+	return s, false
+}
+
+// changeWordCase changes the case of each word preceded by case markers, removing them. As with cutCaseMarkers, the
+// first of several markers in a row decides.
+func changeWordCase(s string) string {
+	for _, m := range caseMarkers {
+		s = strings.ReplaceAll(s, m.marker+" ", m.marker)
+	}
+
+	for p := indexCaseMarker(s); p != -1; p = indexCaseMarker(s) {
+		var changes []func(string) string
+		rest := s[p:]
+
+		for cut := true; cut; {
+			cut = false
+
+			for _, m := range caseMarkers {
+				if after, ok := strings.CutPrefix(rest, m.marker); ok {
+					changes = append(changes, m.change)
+					rest, cut = after, true
+				}
+			}
+		}
+
+		end := strings.IndexAny(rest, " \n")
+
+		if end < 0 {
+			end = len(rest)
+		}
+
+		word := rest[:end]
+
+		for i := len(changes) - 1; i >= 0; i-- {
+			word = changes[i](word)
+		}
+
+		s = s[:p] + word + rest[end:]
+	}
+
+	return s
+}
+
+// indexCaseMarker returns the index of the first case marker in s, or -1 if there is none.
+func indexCaseMarker(s string) int {
+	first := -1
+
+	for _, m := range caseMarkers {
+		if p := strings.Index(s, m.marker); p != -1 && (first == -1 || p < first) {
+			first = p
+		}
+	}
+
+	return first
+}
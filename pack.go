@@ -0,0 +1,244 @@
+package grammar
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// manifestName is the name of the manifest file of a grammar pack.
+const manifestName = "pack.json"
+
+// A Manifest describes a grammar pack: a set of grammar files that can be shared and reused by other grammars. It is
+// kept in a file named pack.json in the directory of the pack, e.g.
+//
+//	{
+//	  "name": "fantasy",
+//	  "version": "1.2.0",
+//	  "entries": ["npc", "tavern"],
+//	  "files": ["*.g"],
+//	  "dependencies": ["../names"]
+//	}
+//
+// Files and dependencies are relative to the directory of the pack; files may be patterns, as for ParseFiles, and
+// default to all .g files. Each dependency is the directory of another pack.
+type Manifest struct {
+	Name         string   `json:"name"`         // Namespace of the identifiers of the pack
+	Version      string   `json:"version"`      // Version of the pack, for information only
+	Entries      []string `json:"entries"`      // Identifiers meant to be generated directly; empty allows all
+	Files        []string `json:"files"`        // Grammar files of the pack
+	Dependencies []string `json:"dependencies"` // Packs that the files of this one refer to
+}
+
+// LoadPack loads the grammar pack in the directory path (or with the manifest file path), along with the packs it
+// depends on, and returns them as one tree.
+//
+// Every identifier of a pack is put in the namespace of the pack: in a pack named fantasy, npc becomes fantasy.npc, and
+// references to it within the pack are changed to match. A pack refers to identifiers of the packs it depends on by
+// their full name, e.g. {names.first}. A pack depended on by several others is loaded once. If the manifest lists
+// entry points, they are the only identifiers of the tree that can be generated directly (see Tree.AllowEntries).
+func LoadPack(path string) (*Tree, error) {
+	loader := packLoader{loading: make(map[string]bool), loaded: make(map[string]bool)}
+	tree, manifest, err := loader.load(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Entries) > 0 {
+		entries := make([]string, len(manifest.Entries))
+
+		for i, entry := range manifest.Entries {
+			entries[i] = manifest.Name + "." + entry
+		}
+
+		tree.AllowEntries(entries...)
+	}
+
+	return tree, nil
+}
+
+// A packLoader loads a pack and its dependencies, each of them once.
+type packLoader struct {
+	loading map[string]bool // Packs being loaded, by directory, to detect cycles
+	loaded  map[string]bool // Packs already loaded, by directory
+}
+
+// readManifest reads the manifest of the pack at path, returning it along with the directory of the pack.
+func readManifest(path string) (*Manifest, string, error) {
+	dir := path
+
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		dir = filepath.Dir(path)
+	} else {
+		path = filepath.Join(path, manifestName)
+	}
+
+	contents, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	var manifest Manifest
+
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	if manifest.Name == "" || strings.ContainsAny(manifest.Name, " \t\n[]{}|") {
+		return nil, "", fmt.Errorf("%s: invalid pack name %q", path, manifest.Name)
+	}
+
+	if len(manifest.Files) == 0 {
+		manifest.Files = []string{"*.g"}
+	}
+
+	return &manifest, dir, nil
+}
+
+// load loads the pack at path and its dependencies. If the pack was loaded before, the tree is nil.
+func (loader *packLoader) load(path string) (*Tree, *Manifest, error) {
+	manifest, dir, err := readManifest(path)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dir, err = filepath.Abs(dir); err != nil {
+		return nil, nil, err
+	}
+
+	if loader.loading[dir] {
+		return nil, nil, fmt.Errorf("pack %s depends on itself", manifest.Name)
+	}
+
+	if loader.loaded[dir] {
+		return nil, manifest, nil
+	}
+
+	loader.loading[dir] = true
+	defer delete(loader.loading, dir)
+
+	patterns := make([]string, len(manifest.Files))
+
+	for i, f := range manifest.Files {
+		patterns[i] = filepath.Join(dir, f)
+	}
+
+	files, err := expandPaths(patterns)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("pack %s: %w", manifest.Name, err)
+	}
+
+	tree, err := parseFiles(files, parseConfig{})
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("pack %s: %w", manifest.Name, err)
+	}
+
+	tree.namespace(manifest.Name)
+
+	for _, dependency := range manifest.Dependencies {
+		other, _, err := loader.load(filepath.Join(dir, dependency))
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("pack %s: %w", manifest.Name, err)
+		}
+
+		if other == nil {
+			continue
+		}
+
+		if err := tree.Merge(other, nil); err != nil {
+			return nil, nil, fmt.Errorf("pack %s: %w", manifest.Name, err)
+		}
+	}
+
+	loader.loaded[dir] = true
+	return tree, manifest, nil
+}
+
+// namespace prefixes the identifiers defined in the tree with name and a dot, along with the substitutions that refer
+// to them.
+func (tree *Tree) namespace(name string) {
+	defined := make(map[string]bool, len(tree.root.child))
+
+	// A reference to an identifier may pick any of its localized definitions
+	for _, def := range tree.root.child {
+		id, _, _ := strings.Cut(def.Text, "@")
+		defined[def.Text], defined[id] = true, true
+	}
+
+	for i := range tree.root.child {
+		def := &tree.root.child[i]
+		def.Text = name + "." + def.Text
+
+		for j := range def.child {
+			def.child[j].namespace(name, defined)
+		}
+	}
+}
+
+// namespace prefixes the substitutions of node and its children that refer to defined identifiers with name and a dot.
+func (node *node) namespace(name string, defined map[string]bool) {
+	if node.internalType == text {
+		refs := append(references(node.Text), conditionalBranches(node.Text)...)
+		slices.SortFunc(refs, func(a, b reference) int { return a.start - b.start })
+
+		// Back to front, so the offsets of earlier references stay valid
+		for i := len(refs) - 1; i >= 0; i-- {
+			if ref := refs[i]; defined[ref.id] {
+				node.Text = node.Text[:ref.start] + name + "." + node.Text[ref.start:]
+			}
+		}
+	}
+
+	for i := range node.child {
+		node.child[i].namespace(name, defined)
+	}
+}
+
+// conditionalBranches returns the branches of the conditions in text, e.g. many and few in {n>5?many:few}. A branch
+// refers to an identifier if there is a definition of it, and is text otherwise.
+func conditionalBranches(text string) []reference {
+	var ret []reference
+
+	for p := 0; p < len(text); {
+		open := strings.IndexByte(text[p:], '{')
+
+		if open < 0 {
+			break
+		}
+
+		open += p
+		end := strings.IndexByte(text[open:], '}')
+
+		if end < 0 {
+			break
+		}
+
+		end += open
+		p = end + 1
+		question := strings.IndexByte(text[open:end], '?')
+
+		if question < 0 {
+			continue
+		}
+
+		start := open + question + 1
+		yes, no, _ := strings.Cut(text[start:end], ":")
+
+		for _, branch := range []reference{{yes, start, start + len(yes)}, {no, end - len(no), end}} {
+			if branch.id != "" {
+				ret = append(ret, branch)
+			}
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,72 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A ParseError is a syntax error in a grammar, as returned by Parse, ParseFile and ParseFiles. Editors can use its
+// position to point out the offending token.
+type ParseError struct {
+	File    string // The file, as given to ParseFiles; empty for Parse
+	Line    int    // Line number, starting at 1
+	Column  int    // Column (in characters) of the offending token, starting at 1; 0 if the error concerns a whole line
+	Message string // What is wrong, e.g. "stray ]"
+	Snippet string // The offending token, if any
+	kind    error  // The kind of error, if it has a sentinel (e.g. ErrUnterminatedGroup)
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("%s at %s:%d", err.Message, err.File, err.Line)
+}
+
+// Unwrap returns the kind of error, so errors.Is(err, ErrUnterminatedGroup) and the like work.
+func (err *ParseError) Unwrap() error {
+	return err.kind
+}
+
+// is sets the kind of error and returns err.
+func (err *ParseError) is(kind error) *ParseError {
+	err.kind = kind
+	return err
+}
+
+// ParseErrors returns the syntax errors in err, as returned by Parse, in the order they were found. Parse reports every
+// syntax error it finds at once, joining them with errors.Join if there are several; an editor can use ParseErrors to
+// point them all out.
+func ParseErrors(err error) []*ParseError {
+	var ret []*ParseError
+	var parseErr *ParseError
+
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			ret = append(ret, ParseErrors(err)...)
+		}
+	} else if errors.As(err, &parseErr) {
+		ret = append(ret, parseErr)
+	}
+
+	return ret
+}
+
+// newParseError returns a *ParseError at source (e.g. "names.g:12").
+func newParseError(source string, column int, snippet string, format string, args ...any) *ParseError {
+	err := ParseError{Column: column, Snippet: snippet, Message: fmt.Sprintf(format, args...)}
+
+	// Split at the last colon, as file names may contain colons too
+	if p := strings.LastIndexByte(source, ':'); p >= 0 {
+		err.File = source[:p]
+		err.Line, _ = strconv.Atoi(source[p+1:])
+	} else {
+		err.File = source
+	}
+
+	return &err
+}
+
+// tokenError returns a *ParseError pointing out t.
+func tokenError(t token, format string, args ...any) *ParseError {
+	return newParseError(t.Source, t.Column, t.Text, format, args...)
+}
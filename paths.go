@@ -0,0 +1,99 @@
+package grammar
+
+import (
+	"fmt"
+	"maps"
+)
+
+// A Branch is a branch of a group in a definition, as listed by Branches.
+type Branch struct {
+	Key  string // The branch, e.g. "diary/[1/3" (see LoadWeights)
+	Text string // The branch as written in the grammar
+}
+
+// Branches returns the branches of every group of id, outermost first, in the order of the grammar. Their keys are
+// stable: they only change when the definition of id itself does, so scripts can refer to them with ForceBranch and
+// ForbidBranch.
+func (tree *Tree) Branches(id string) ([]Branch, error) {
+	def := tree.findDefinition(id)
+
+	if def == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownIdentifier, id)
+	}
+
+	var ret []Branch
+	var walk func(n *node)
+
+	walk = func(n *node) {
+		for i := range n.child {
+			if n.internalType == group {
+				ret = append(ret, Branch{Key: branchKey(def, n, i), Text: n.child[i].grammarText()})
+			}
+
+			walk(&n.child[i])
+		}
+	}
+
+	walk(def)
+	return ret, nil
+}
+
+// ForceBranch makes Generate pick the branches with the given keys (see Branches), e.g. for a tutorial that always
+// shows the Monday variant of a diary entry first:
+//
+//	entry, err := tree.Generate("diary", grammar.ForceBranch("diary/[1/0"))
+//
+// Forcing a branch of a nested group doesn't force the branches leading up to it; force those too to make sure it is
+// reached. Generate fails if a key doesn't match a branch of the tree.
+func ForceBranch(keys ...string) GenerateOption {
+	return func(config *generateConfig) {
+		config.forceKeys = append(config.forceKeys, keys...)
+	}
+}
+
+// ForbidBranch keeps Generate from picking the branches with the given keys (see Branches), as if they were weighted
+// to zero. Generate fails if a key doesn't match a branch of the tree, or if every branch of a group is forbidden.
+func ForbidBranch(keys ...string) GenerateOption {
+	return func(config *generateConfig) {
+		config.forbidKeys = append(config.forbidKeys, keys...)
+	}
+}
+
+// pinBranches resolves the keys given to ForceBranch and ForbidBranch.
+func (g *generator) pinBranches() error {
+	if len(g.config.forceKeys) > 0 {
+		// The forced branches may be shared (see SmokeTest), so don't change them in place
+		forced := maps.Clone(g.config.forced)
+
+		if forced == nil {
+			forced = make(map[*node]int)
+		}
+
+		for _, key := range g.config.forceKeys {
+			_, group, i, err := g.tree.findBranch(key)
+
+			if err != nil {
+				return err
+			}
+
+			forced[group] = i
+		}
+
+		g.config.forced, g.config.forceKeys = forced, nil
+	}
+
+	for _, key := range g.config.forbidKeys {
+		if _, _, _, err := g.tree.findBranch(key); err != nil {
+			return err
+		}
+
+		if g.config.forbidden == nil {
+			g.config.forbidden = make(map[string]bool)
+		}
+
+		g.config.forbidden[key] = true
+	}
+
+	g.config.forbidKeys = nil
+	return nil
+}
@@ -0,0 +1,227 @@
+package grammar
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// caseModifiers are the modifiers that change the case of a substitution, but not its letters.
+var caseModifiers = map[string]bool{"title": true, "alternating": true}
+
+// Regexp returns a regular expression matching every phrase id can produce, e.g. for validators and log scrapers that
+// need to recognize generated text. It matches a superset of the phrases: it ignores case and spacing, and
+// substitutions it can't predict, like plural forms, conditions and inflections, match any text. Options given when
+// generating (such as Synonyms or Typography) aren't taken into account.
+//
+// Recursive definitions can't be expressed as a regular expression, so they are reported as an error.
+func (tree *Tree) Regexp(id string) (*regexp.Regexp, error) {
+	b := patternBuilder{tree: tree, patterns: make(map[*node]string), building: make(map[*node]bool)}
+
+	if id == "" && len(tree.root.child) > 0 {
+		id = tree.root.child[len(tree.root.child)-1].Text
+	}
+
+	pattern, err := b.identifier(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return regexp.Compile(`(?is)^\s*` + pattern + `\s*$`)
+}
+
+// patternBuilder builds the regular expressions of definitions (see Regexp), remembering the pattern of each.
+type patternBuilder struct {
+	tree     *Tree
+	patterns map[*node]string
+	building map[*node]bool // Definitions being built, to detect recursion
+}
+
+// identifier returns the pattern of a substitution of id, with modifiers if any.
+func (b *patternBuilder) identifier(id string) (string, error) {
+	modifiers := strings.Split(id, ":")
+	_, inflections := splitConstraints(modifiers[1:])
+
+	for _, modifier := range inflections {
+		if !caseModifiers[modifier] {
+			return `.*?`, nil
+		}
+	}
+
+	def := b.tree.findDefinition(modifiers[0])
+
+	if def == nil {
+		return "", fmt.Errorf("%w: %s", ErrUnknownIdentifier, strings.TrimPrefix(modifiers[0], "*"))
+	}
+
+	if pattern, found := b.patterns[def]; found {
+		return pattern, nil
+	}
+
+	if b.building[def] {
+		return "", fmt.Errorf("%s is recursive and can't be matched by a regular expression", def.Text)
+	}
+
+	b.building[def] = true
+	pattern, err := b.sequence(def.child)
+	delete(b.building, def)
+
+	if err != nil {
+		return "", err
+	}
+
+	b.patterns[def] = pattern
+	return pattern, nil
+}
+
+// sequence returns the pattern of nodes following each other.
+func (b *patternBuilder) sequence(nodes []node) (string, error) {
+	var parts []string
+
+	for i := range nodes {
+		part, err := b.node(&nodes[i])
+
+		if err != nil {
+			return "", err
+		}
+
+		parts = appendPattern(parts, part)
+	}
+
+	return strings.Join(parts, `\s*`), nil
+}
+
+// node returns the pattern of n: an alternation of its branches if it's a group, otherwise its parts in sequence.
+func (b *patternBuilder) node(n *node) (string, error) {
+	switch n.internalType {
+	case group:
+		branches := make([]string, len(n.child))
+
+		for i := range n.child {
+			var err error
+
+			if branches[i], err = b.node(&n.child[i]); err != nil {
+				return "", err
+			}
+		}
+
+		return "(?:" + strings.Join(branches, "|") + ")", nil
+	case text:
+		pattern, err := b.text(n.Text)
+
+		if err != nil {
+			return "", err
+		}
+
+		children, err := b.sequence(n.child)
+
+		if err != nil {
+			return "", err
+		}
+
+		return strings.Join(appendPattern([]string{pattern}, children), `\s*`), nil
+	default:
+		return b.sequence(n.child)
+	}
+}
+
+// text returns the pattern of the text of a node: its words, with control tokens left out, and its {...} sequences.
+func (b *patternBuilder) text(s string) (string, error) {
+	var parts []string
+
+	for s != "" {
+		open := strings.IndexByte(s, '{')
+		end := strings.IndexByte(s, '}')
+
+		if open < 0 || end < open {
+			open, end = len(s), len(s)-1
+		}
+
+		for _, word := range strings.Fields(s[:open]) {
+			word = joinedDashes.Replace(word)
+
+			for _, token := range []string{"<<", "^^", "~~", "^", "_"} {
+				word = strings.ReplaceAll(word, token, "")
+			}
+
+			parts = appendPattern(parts, regexp.QuoteMeta(decodeLiterals(word)))
+		}
+
+		if open == len(s) {
+			break
+		}
+
+		pattern, err := b.tag(s[open+1 : end])
+
+		if err != nil {
+			return "", fmt.Errorf("%w (%s)", err, s[open+1:end])
+		}
+
+		parts = appendPattern(parts, pattern)
+		s = s[end+1:]
+	}
+
+	return strings.Join(parts, `\s*`), nil
+}
+
+// tag returns the pattern of a single {...} sequence (without the braces).
+func (b *patternBuilder) tag(tag string) (string, error) {
+	switch classifyTag(tag) {
+	case tagEmpty, tagNewline, tagMetadata, tagParagraphBreak, tagSpeech:
+		return "", nil
+	case tagArticle:
+		forms := strings.Split(tag, "/")
+
+		for i := range forms {
+			forms[i] = regexp.QuoteMeta(forms[i])
+		}
+
+		return "(?:" + strings.Join(forms, "|") + ")", nil
+	case tagParagraphs:
+		if tag[0] == '~' {
+			// Shuffled paragraphs can come in any order
+			return `.*?`, nil
+		}
+
+		var parts []string
+
+		for _, id := range strings.Split(tag[1:], ",") {
+			part, err := b.identifier(strings.TrimPrefix(id, "="))
+
+			if err != nil {
+				return "", err
+			}
+
+			parts = appendPattern(parts, part)
+		}
+
+		return strings.Join(parts, `\s*`), nil
+	case tagBlank, tagPlural, tagConditional:
+		return `.*?`, nil
+	case tagRange:
+		return `-?\d+`, nil
+	case tagRepetition:
+		part, err := b.identifier(repetition.FindStringSubmatch(tag)[1])
+
+		if err != nil {
+			return "", err
+		}
+
+		return "(?:" + part + `(?:\s*` + part + ")*)?", nil
+	case tagCapture:
+		_, inner, _ := strings.Cut(tag, "=")
+		return b.tag(inner)
+	}
+
+	return b.identifier(tag)
+}
+
+// appendPattern appends pattern to parts, unless it's empty.
+func appendPattern(parts []string, pattern string) []string {
+	if pattern == "" {
+		return parts
+	}
+
+	return append(parts, pattern)
+}
@@ -0,0 +1,145 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Phonetics tells whether words rhyme or alliterate, for the rhyme and alliterate constraints of substitutions (see
+// UsePhonetics). Implement it with a pronouncing dictionary for better results than the spelling-based default.
+//
+// Rhyme returns a key for the rhyme of a word, and Onset a key for its initial sound; words with the same key rhyme or
+// alliterate.
+type Phonetics interface {
+	Rhyme(word string) string
+	Onset(word string) string
+}
+
+// UsePhonetics sets the Phonetics used by rhyme and alliterate constraints. The default is EnglishSpelling.
+func UsePhonetics(p Phonetics) GenerateOption {
+	return func(config *generateConfig) {
+		config.phonetics = p
+	}
+}
+
+// EnglishSpelling is the default Phonetics. It goes by English spelling rather than pronunciation: words rhyme if they
+// end the same from their last vowel on (cat and hat, light and night, but not bite and light), ignoring a silent e
+// (cake and lake), and alliterate if they start with the same letter, or the same digraph (ch, sh, th, ph or wh).
+var EnglishSpelling Phonetics = englishSpelling{}
+
+type englishSpelling struct{}
+
+func (englishSpelling) Rhyme(word string) string {
+	w := []rune(lastWord(word))
+	end := len(w)
+
+	// A final e after a consonant is silent, so the rhyme starts at the vowel before it
+	if end > 2 && w[end-1] == 'e' && !isVowelRune(w[end-2]) {
+		end--
+	}
+
+	start := end - 1
+
+	for start >= 0 && !isVowelRune(w[start]) {
+		start--
+	}
+
+	for start > 0 && isVowelRune(w[start-1]) {
+		start--
+	}
+
+	if start < 0 {
+		return string(w)
+	}
+
+	return string(w[start:])
+}
+
+func (englishSpelling) Onset(word string) string {
+	w := strings.ToLower(strings.TrimLeftFunc(word, func(r rune) bool { return !unicode.IsLetter(r) }))
+
+	for _, digraph := range []string{"ch", "sh", "th", "ph", "wh"} {
+		if strings.HasPrefix(w, digraph) {
+			return digraph
+		}
+	}
+
+	for _, r := range w {
+		return string(r)
+	}
+
+	return ""
+}
+
+// lastWord returns the letters of the last word of a phrase, in lower case.
+func lastWord(phrase string) string {
+	fields := strings.FieldsFunc(strings.ToLower(phrase), func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' })
+
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return strings.Trim(fields[len(fields)-1], "'")
+}
+
+// isVowelRune reports whether r is a vowel in spelling (y counts).
+func isVowelRune(r rune) bool {
+	return strings.ContainsRune("aeiouy", r)
+}
+
+// A constraint restricts a substitution to values that rhyme or alliterate with a captured variable, as in
+// {word:rhyme=a} or {word:alliterate=a}.
+type constraint struct {
+	kind     string // "rhyme" or "alliterate"
+	variable string
+}
+
+// splitConstraints separates the constraints from the inflections among modifiers.
+func splitConstraints(modifiers []string) ([]constraint, []string) {
+	var constraints []constraint
+	var rest []string
+
+	for _, modifier := range modifiers {
+		kind, variable, found := strings.Cut(modifier, "=")
+
+		if found && (kind == "rhyme" || kind == "alliterate") {
+			constraints = append(constraints, constraint{kind, variable})
+		} else {
+			rest = append(rest, modifier)
+		}
+	}
+
+	return constraints, rest
+}
+
+// satisfies checks value against constraints, returning an error for a constraint on an unknown variable.
+func (g *generator) satisfies(value string, constraints []constraint) (bool, error) {
+	p := g.config.phonetics
+
+	if p == nil {
+		p = EnglishSpelling
+	}
+
+	for _, c := range constraints {
+		other, found := g.variables[c.variable]
+
+		if !found {
+			return false, fmt.Errorf("no such variable: %s", c.variable)
+		}
+
+		switch c.kind {
+		case "rhyme":
+			// A word doesn't rhyme with itself
+			if lastWord(value) == lastWord(other) || p.Rhyme(value) != p.Rhyme(other) {
+				return false, nil
+			}
+		case "alliterate":
+			if p.Onset(value) != p.Onset(other) {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,106 @@
+package grammar
+
+import (
+	"slices"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Token is a word or a run of punctuation of a generated phrase, as returned by GenerateTokens.
+type Token struct {
+	Text  string // The word (e.g. "don't") or punctuation (e.g. "," or "?!")
+	Space string // Whitespace following the token, e.g. " " or "\n\n"; empty before punctuation
+}
+
+// GenerateTokens generates a phrase for id like Generate and returns it as tokens, for layout that treats words one by
+// one, like word-by-word animation or speech timing. Joining the Text and Space of every token gives the phrase as
+// Generate would return it (without leading whitespace). The tokens are taken from the phrase as generated, so each
+// literal (`...`) is a single token, whatever it contains.
+func (s *Session) GenerateTokens(id string, options ...GenerateOption) ([]Token, error) {
+	var tokens []Token
+
+	if _, err := s.Generate(id, append(slices.Clip(options), keepTokens(&tokens))...); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// GenerateTokens generates a phrase for id as tokens using the tree's default session. See Session.GenerateTokens.
+func (tree *Tree) GenerateTokens(id string, options ...GenerateOption) ([]Token, error) {
+	return tree.defaultSession().GenerateTokens(id, options...)
+}
+
+// keepTokens makes finish leave the tokens of the output in tokens.
+func keepTokens(tokens *[]Token) GenerateOption {
+	return func(config *generateConfig) {
+		config.tokens = tokens
+	}
+}
+
+// SplitTokens splits phrase into words and runs of punctuation (see Token). Apostrophes and hyphens between letters
+// are part of a word, so "don't" and "well-known" are single tokens.
+func SplitTokens(phrase string) []Token {
+	return splitTokens(phrase)
+}
+
+// splitTokens is SplitTokens for a phrase which may contain encoded literals. Each literal is a token of its own, and
+// the text of every token is decoded.
+func splitTokens(phrase string) []Token {
+	var ret []Token
+
+	for i := 0; i < len(phrase); {
+		r, size := utf8.DecodeRuneInString(phrase[i:])
+
+		if unicode.IsSpace(r) {
+			if len(ret) > 0 {
+				ret[len(ret)-1].Space += string(r)
+			}
+
+			i += size
+			continue
+		}
+
+		start := i
+		word := isWordRune(r)
+
+		if isLiteral(r) {
+			for i += size; i < len(phrase); i += size {
+				if r, size = utf8.DecodeRuneInString(phrase[i:]); !isLiteral(r) {
+					break
+				}
+			}
+
+			ret = append(ret, Token{Text: decodeLiterals(phrase[start:i])})
+			continue
+		}
+
+		for i += size; i < len(phrase); i += size {
+			r, size = utf8.DecodeRuneInString(phrase[i:])
+
+			if unicode.IsSpace(r) || isLiteral(r) {
+				break
+			}
+
+			// Keep apostrophes and hyphens between letters within the word
+			if word && (r == '\'' || r == '’' || r == '-') {
+				if next, _ := utf8.DecodeRuneInString(phrase[i+size:]); isWordRune(next) {
+					continue
+				}
+			}
+
+			if isWordRune(r) != word {
+				break
+			}
+		}
+
+		ret = append(ret, Token{Text: phrase[start:i]})
+	}
+
+	return ret
+}
+
+// isWordRune reports whether r is part of a word, rather than punctuation.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
@@ -0,0 +1,267 @@
+package grammar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pluralRules maps languages to functions giving the CLDR plural category of an integer. Languages not listed use the
+// rule of English.
+var pluralRules = map[string]func(n int) string{
+	"en": pluralOneOther, "de": pluralOneOther, "nl": pluralOneOther, "sv": pluralOneOther, "da": pluralOneOther,
+	"nb": pluralOneOther, "no": pluralOneOther, "fi": pluralOneOther, "et": pluralOneOther, "el": pluralOneOther,
+	"hu": pluralOneOther, "tr": pluralOneOther, "bg": pluralOneOther, "it": pluralOneOther, "es": pluralOneOther,
+	"ca": pluralOneOther,
+	"fr": pluralFrench, "pt": pluralFrench,
+	"ja": pluralOther, "zh": pluralOther, "ko": pluralOther, "vi": pluralOther, "th": pluralOther, "id": pluralOther,
+	"ru": pluralEastSlavic, "uk": pluralEastSlavic, "be": pluralEastSlavic,
+	"pl": pluralPolish,
+	"cs": pluralCzech, "sk": pluralCzech,
+	"lt": pluralLithuanian,
+	"lv": pluralLatvian,
+	"ar": pluralArabic,
+	"he": pluralHebrew,
+	"ga": pluralIrish,
+	"cy": pluralWelsh,
+	"sl": pluralSlovenian,
+	"hr": pluralSerbian, "sr": pluralSerbian, "bs": pluralSerbian,
+	"ro": pluralRomanian,
+}
+
+// PluralCategory returns the CLDR plural category of the integer n in a language, given as a locale such as "sv" or
+// "pt-BR": "zero", "one", "two", "few", "many" or "other".
+func PluralCategory(locale string, n int) string {
+	language, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	rule, found := pluralRules[language]
+
+	if !found {
+		rule = pluralOneOther
+	}
+
+	if n < 0 {
+		n = -n
+	}
+
+	return rule(n)
+}
+
+func pluralOneOther(n int) string {
+	if n == 1 {
+		return "one"
+	}
+
+	return "other"
+}
+
+func pluralFrench(n int) string {
+	switch {
+	case n == 0 || n == 1:
+		return "one"
+	case n != 0 && n%1000000 == 0:
+		return "many"
+	}
+
+	return "other"
+}
+
+func pluralOther(n int) string {
+	return "other"
+}
+
+func pluralEastSlavic(n int) string {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return "one"
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return "few"
+	}
+
+	return "many"
+}
+
+func pluralPolish(n int) string {
+	switch {
+	case n == 1:
+		return "one"
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return "few"
+	}
+
+	return "many"
+}
+
+func pluralCzech(n int) string {
+	switch {
+	case n == 1:
+		return "one"
+	case n >= 2 && n <= 4:
+		return "few"
+	}
+
+	return "other"
+}
+
+func pluralLithuanian(n int) string {
+	switch {
+	case n%10 == 1 && (n%100 < 11 || n%100 > 19):
+		return "one"
+	case n%10 >= 2 && (n%100 < 11 || n%100 > 19):
+		return "few"
+	}
+
+	return "other"
+}
+
+func pluralLatvian(n int) string {
+	switch {
+	case n%10 == 0 || n%100 >= 11 && n%100 <= 19:
+		return "zero"
+	case n%10 == 1 && n%100 != 11:
+		return "one"
+	}
+
+	return "other"
+}
+
+func pluralArabic(n int) string {
+	switch {
+	case n == 0:
+		return "zero"
+	case n == 1:
+		return "one"
+	case n == 2:
+		return "two"
+	case n%100 >= 3 && n%100 <= 10:
+		return "few"
+	case n%100 >= 11:
+		return "many"
+	}
+
+	return "other"
+}
+
+func pluralHebrew(n int) string {
+	switch {
+	case n == 1:
+		return "one"
+	case n == 2:
+		return "two"
+	}
+
+	return "other"
+}
+
+func pluralIrish(n int) string {
+	switch {
+	case n == 1:
+		return "one"
+	case n == 2:
+		return "two"
+	case n >= 3 && n <= 6:
+		return "few"
+	case n >= 7 && n <= 10:
+		return "many"
+	}
+
+	return "other"
+}
+
+func pluralWelsh(n int) string {
+	switch n {
+	case 0:
+		return "zero"
+	case 1:
+		return "one"
+	case 2:
+		return "two"
+	case 3:
+		return "few"
+	case 6:
+		return "many"
+	}
+
+	return "other"
+}
+
+func pluralSlovenian(n int) string {
+	switch {
+	case n%100 == 1:
+		return "one"
+	case n%100 == 2:
+		return "two"
+	case n%100 == 3 || n%100 == 4:
+		return "few"
+	}
+
+	return "other"
+}
+
+func pluralSerbian(n int) string {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return "one"
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return "few"
+	}
+
+	return "other"
+}
+
+func pluralRomanian(n int) string {
+	switch {
+	case n == 1:
+		return "one"
+	case n == 0 || n%100 >= 2 && n%100 <= 19:
+		return "few"
+	}
+
+	return "other"
+}
+
+// plural picks a form for the number in a captured variable, as in %n:one=item,other=items, by the plural rules of
+// the locale of the definition it is in, e.g. Polish for loot@pl, or of the preferred locale (see Locale) if that
+// definition isn't localized. If there is no form for the category, "other" is used. In a form, # stands for the
+// number and underscores for spaces.
+func (g *generator) plural(tag string) (string, error) {
+	name, list, found := strings.Cut(tag[1:], ":")
+
+	if !found {
+		return "", fmt.Errorf("plural %s lacks forms", tag)
+	}
+
+	value, found := g.variables[name]
+
+	if !found {
+		return "", fmt.Errorf("no such variable: %s", name)
+	}
+
+	n, err := strconv.Atoi(value)
+
+	if err != nil {
+		return "", fmt.Errorf("variable %s is not a whole number: %s", name, value)
+	}
+
+	forms := make(map[string]string)
+
+	for _, form := range strings.Split(list, ",") {
+		category, text, found := strings.Cut(form, "=")
+
+		if !found {
+			return "", fmt.Errorf("invalid plural form %s", form)
+		}
+
+		forms[category] = text
+	}
+
+	text, found := forms[PluralCategory(g.definitionLocale(), n)]
+
+	if !found {
+		if text, found = forms["other"]; !found {
+			return "", fmt.Errorf("plural %s lacks the form other", tag)
+		}
+	}
+
+	text = strings.ReplaceAll(text, "#", value)
+	return strings.ReplaceAll(text, "_", " "), nil
+}
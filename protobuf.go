@@ -0,0 +1,342 @@
+package grammar
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// MarshalProto encodes the tree in protocol buffer format, following the schema in grammar.proto, so it can be sent to
+// another process (e.g. over gRPC) and read with UnmarshalProto without parsing the grammar again. Sessions are not
+// included.
+func (tree *Tree) MarshalProto() ([]byte, error) {
+	var b protoBuffer
+
+	for i := range tree.root.child {
+		b.message(1, tree.root.child[i].marshalProto())
+	}
+
+	keys := make([]string, 0, len(tree.weights))
+
+	for key := range tree.weights {
+		keys = append(keys, key)
+	}
+
+	// Sorted, so the same tree always gives the same bytes
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var entry protoBuffer
+		entry.string(1, key)
+		entry.double(2, tree.weights[key])
+		b.message(2, entry)
+	}
+
+	entries := make([]string, 0, len(tree.entries))
+
+	for id := range tree.entries {
+		entries = append(entries, id)
+	}
+
+	sort.Strings(entries)
+
+	for _, id := range entries {
+		b.string(3, id)
+	}
+
+	for _, comment := range tree.root.comments {
+		b.string(4, comment)
+	}
+
+	return b, nil
+}
+
+// UnmarshalProto decodes a tree encoded by MarshalProto (or by any implementation of grammar.proto).
+func UnmarshalProto(data []byte) (*Tree, error) {
+	tree := Tree{root: node{internalType: root}}
+
+	err := readProto(data, func(field int, wire int, value uint64, bytes []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			var n node
+
+			if err := n.unmarshalProto(bytes); err != nil {
+				return err
+			}
+
+			tree.root.child = append(tree.root.child, n)
+		case field == 2 && wire == wireBytes:
+			var key string
+			var weight float64
+
+			err := readProto(bytes, func(field int, wire int, value uint64, bytes []byte) error {
+				if field == 1 && wire == wireBytes {
+					key = string(bytes)
+				} else if field == 2 && wire == wireFixed64 {
+					weight = math.Float64frombits(value)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			if tree.weights == nil {
+				tree.weights = make(map[string]float64)
+			}
+
+			tree.weights[key] = weight
+		case field == 3 && wire == wireBytes:
+			if tree.entries == nil {
+				tree.entries = make(map[string]bool)
+			}
+
+			tree.entries[string(bytes)] = true
+		case field == 4 && wire == wireBytes:
+			tree.root.comments = append(tree.root.comments, string(bytes))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid tree: %w", err)
+	}
+
+	return &tree, nil
+}
+
+// marshalProto encodes a node as a Node message.
+func (n *node) marshalProto() protoBuffer {
+	var b protoBuffer
+	b.varint(1, uint64(n.internalType))
+	b.string(2, n.Text)
+	b.string(3, n.Source)
+
+	for i := range n.child {
+		b.message(4, n.child[i].marshalProto())
+	}
+
+	if n.exclusive {
+		b.varint(5, 1)
+	}
+
+	if n.weight != 0 {
+		b.double(6, n.weight)
+	}
+
+	b.string(7, n.tier)
+
+	if d := n.directives; d.pool != "" || d.cooldown != 0 || d.doc != "" || d.merge != 0 || d.private ||
+		len(d.expect) > 0 || d.stock {
+		var directives protoBuffer
+		directives.string(1, d.pool)
+		directives.varint(2, uint64(d.cooldown))
+		directives.string(3, d.doc)
+		directives.varint(4, uint64(d.merge))
+
+		if d.private {
+			directives.varint(5, 1)
+		}
+
+		for _, e := range d.expect {
+			var expectation protoBuffer
+			expectation.string(1, e.text)
+			expectation.string(2, e.source)
+			directives.message(6, expectation)
+		}
+
+		if d.stock {
+			directives.varint(7, 1)
+		}
+
+		b.message(8, directives)
+	}
+
+	for _, comment := range n.comments {
+		b.string(9, comment)
+	}
+
+	return b
+}
+
+// unmarshalProto decodes a Node message into n.
+func (n *node) unmarshalProto(data []byte) error {
+	return readProto(data, func(field int, wire int, value uint64, bytes []byte) error {
+		switch {
+		case field == 1 && wire == wireVarint:
+			n.internalType = nodeType(value)
+		case field == 2 && wire == wireBytes:
+			n.Text = string(bytes)
+		case field == 3 && wire == wireBytes:
+			n.Source = string(bytes)
+		case field == 4 && wire == wireBytes:
+			var child node
+
+			if err := child.unmarshalProto(bytes); err != nil {
+				return err
+			}
+
+			n.child = append(n.child, child)
+		case field == 5 && wire == wireVarint:
+			n.exclusive = value != 0
+		case field == 6 && wire == wireFixed64:
+			n.weight = math.Float64frombits(value)
+		case field == 7 && wire == wireBytes:
+			n.tier = string(bytes)
+		case field == 8 && wire == wireBytes:
+			return n.directives.unmarshalProto(bytes)
+		case field == 9 && wire == wireBytes:
+			n.comments = append(n.comments, string(bytes))
+		}
+
+		return nil
+	})
+}
+
+// unmarshalProto decodes a Directives message into d.
+func (d *directives) unmarshalProto(data []byte) error {
+	return readProto(data, func(field int, wire int, value uint64, bytes []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			d.pool = string(bytes)
+		case field == 2 && wire == wireVarint:
+			d.cooldown = int(value)
+		case field == 3 && wire == wireBytes:
+			d.doc = string(bytes)
+		case field == 4 && wire == wireVarint:
+			d.merge = MergeStrategy(value)
+		case field == 5 && wire == wireVarint:
+			d.private = value != 0
+		case field == 6 && wire == wireBytes:
+			var text, source string
+
+			err := readProto(bytes, func(field int, wire int, value uint64, bytes []byte) error {
+				if field == 1 && wire == wireBytes {
+					text = string(bytes)
+				} else if field == 2 && wire == wireBytes {
+					source = string(bytes)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			e, err := parseExpectation(text, source)
+
+			if err != nil {
+				return err
+			}
+
+			d.expect = append(d.expect, e)
+		case field == 7 && wire == wireVarint:
+			d.stock = value != 0
+		}
+
+		return nil
+	})
+}
+
+// A protoBuffer builds a protocol buffer message. Fields with default values are left out, as in proto3.
+type protoBuffer []byte
+
+func (b *protoBuffer) key(field int, wire int) {
+	*b = binary.AppendUvarint(*b, uint64(field)<<3|uint64(wire))
+}
+
+func (b *protoBuffer) varint(field int, value uint64) {
+	if value != 0 {
+		b.key(field, wireVarint)
+		*b = binary.AppendUvarint(*b, value)
+	}
+}
+
+func (b *protoBuffer) double(field int, value float64) {
+	b.key(field, wireFixed64)
+	*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(value))
+}
+
+func (b *protoBuffer) bytes(field int, value []byte) {
+	b.key(field, wireBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(value)))
+	*b = append(*b, value...)
+}
+
+func (b *protoBuffer) string(field int, value string) {
+	if value != "" {
+		b.bytes(field, []byte(value))
+	}
+}
+
+func (b *protoBuffer) message(field int, value protoBuffer) {
+	b.bytes(field, value)
+}
+
+// readProto calls f with each field of a protocol buffer message: its number and wire type, and its value, which is
+// in value for numeric wire types and in bytes for length-delimited ones.
+func readProto(data []byte, f func(field int, wire int, value uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+
+		if n <= 0 {
+			return errors.New("truncated field key")
+		}
+
+		data = data[n:]
+		field, wire := int(key>>3), int(key&7)
+		var value uint64
+		var bytes []byte
+
+		switch wire {
+		case wireVarint:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("truncated varint")
+			}
+
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errors.New("truncated fixed64")
+			}
+
+			value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errors.New("truncated fixed32")
+			}
+
+			value, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errors.New("truncated length-delimited field")
+			}
+
+			bytes, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wire)
+		}
+
+		if err := f(field, wire, value, bytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
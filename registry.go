@@ -0,0 +1,111 @@
+package grammar
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Registry hosts several independent grammars in one process, each under a name, e.g. one for NPC names and one for
+// quest texts. Identifiers are addressed as "name:identifier". Grammars can be loaded, swapped and removed while the
+// registry is in use; it is safe for concurrent use.
+type Registry struct {
+	mu         sync.RWMutex
+	trees      map[string]*Tree
+	generating sync.Mutex // Serializes Generate, as the default sessions of the trees aren't safe for concurrent use
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{trees: make(map[string]*Tree)}
+}
+
+// Load parses files (as ParseFiles does) and puts the tree in the registry under name, replacing any tree there. If
+// parsing fails, the registry is left unchanged, so a broken edit doesn't take a working grammar offline.
+func (r *Registry) Load(name string, filenames ...string) error {
+	tree, err := ParseFiles(filenames)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Swap(name, tree)
+	return err
+}
+
+// Swap puts tree in the registry under name and returns the tree it replaces, or nil. Names can't contain a colon.
+func (r *Registry) Swap(name string, tree *Tree) (*Tree, error) {
+	if name == "" || strings.Contains(name, ":") {
+		return nil, fmt.Errorf("invalid grammar name %q", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.trees[name]
+	r.trees[name] = tree
+	return previous, nil
+}
+
+// Remove removes the tree under name, reporting whether there was one.
+func (r *Registry) Remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, found := r.trees[name]
+	delete(r.trees, name)
+	return found
+}
+
+// Tree returns the tree under name, or nil.
+func (r *Registry) Tree(name string) *Tree {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.trees[name]
+}
+
+// Names returns the names of the trees in the registry, in sorted order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ret := make([]string, 0, len(r.trees))
+
+	for name := range r.trees {
+		ret = append(ret, name)
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// Generate generates a phrase for ref, given as "name:identifier", from the tree under name in its default session.
+// Without an identifier ("name" or "name:"), the default identifier of the tree is generated.
+//
+// Calls are serialized. To generate in parallel, give each goroutine a session of its own, from Tree(name).NewSession.
+func (r *Registry) Generate(ref string, options ...GenerateOption) (string, error) {
+	result, err := r.GenerateResult(ref, options...)
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.Text, nil
+}
+
+// GenerateResult generates a phrase for ref like Generate, along with details on how it was generated.
+func (r *Registry) GenerateResult(ref string, options ...GenerateOption) (*Result, error) {
+	name, id, _ := strings.Cut(ref, ":")
+	tree := r.Tree(name)
+
+	if tree == nil {
+		return nil, fmt.Errorf("no grammar named %s", name)
+	}
+
+	r.generating.Lock()
+	defer r.generating.Unlock()
+
+	return tree.GenerateResult(id, options...)
+}
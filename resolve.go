@@ -0,0 +1,81 @@
+package grammar
+
+import (
+	"maps"
+	"slices"
+)
+
+// A Resolver computes the value of a substitution in code rather than in the grammar (see Resolve).
+type Resolver func(ctx *ResolveContext) (string, error)
+
+// A ResolveContext tells a Resolver what it is resolving.
+type ResolveContext struct {
+	ID        string            // The identifier substituted, without * or modifiers
+	Recent    []string          // The phrases most recently generated by the session, most recent first (see KeepRecent)
+	Variables map[string]string // The values captured so far in the phrase, e.g. by {n=1-20}
+}
+
+// Resolve makes every {id} substitution of a single call result in what resolver returns, much like Pin but computed
+// when the substitution is made. Resolvers are given the most recent phrases of the session, for continuity such as
+// "as I mentioned earlier" in conversational grammars:
+//
+//	recall := func(ctx *grammar.ResolveContext) (string, error) {
+//		if len(ctx.Recent) == 0 {
+//			return "", nil
+//		}
+//
+//		return "as I said, " + ctx.Recent[0], nil
+//	}
+//
+//	s.KeepRecent(5)
+//	s.Generate("reply", grammar.Resolve("recall", recall))
+//
+// A resolver takes precedence over a definition of id, if any. Modifiers ({id:title}) apply to what it returns. Use
+// several Resolve options to resolve several identifiers.
+func Resolve(id string, resolver Resolver) GenerateOption {
+	return func(config *generateConfig) {
+		if config.resolvers == nil {
+			config.resolvers = make(map[string]Resolver)
+		}
+
+		config.resolvers[id] = resolver
+	}
+}
+
+// resolve calls the resolver of id.
+func (g *generator) resolve(id string, resolver Resolver) (string, error) {
+	return resolver(&ResolveContext{ID: id, Recent: g.session.Recent(), Variables: maps.Clone(g.variables)})
+}
+
+// KeepRecent makes the session remember the last n phrases it has generated, for resolvers (see Resolve). A size of 0
+// forgets them.
+func (s *Session) KeepRecent(n int) {
+	s.recentSize = max(n, 0)
+
+	if len(s.recent) > s.recentSize {
+		s.recent = s.recent[:s.recentSize]
+	}
+}
+
+// Recent returns the phrases most recently generated by the session, most recent first (see KeepRecent).
+func (s *Session) Recent() []string {
+	return slices.Clone(s.recent)
+}
+
+// remember adds phrase to the recent phrases of the session, if it keeps any.
+func (s *Session) remember(phrase string) {
+	if s.recentSize == 0 {
+		return
+	}
+
+	s.recent = slices.Insert(s.recent, 0, phrase)
+
+	if len(s.recent) > s.recentSize {
+		s.recent = s.recent[:s.recentSize]
+	}
+}
+
+// KeepRecent makes the tree's default session remember its last n phrases. See Session.KeepRecent.
+func (tree *Tree) KeepRecent(n int) {
+	tree.defaultSession().KeepRecent(n)
+}
@@ -0,0 +1,315 @@
+package grammar
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// A Result is a generated phrase along with details on how it was generated.
+type Result struct {
+	Text          string            // The generated phrase
+	Substitutions []Substitution    // Every substitution made, in the order they appear in the grammar
+	Branches      []string          // Keys of the branches picked, in order (see Session.Used)
+	TraceID       string            // Identifies this generation for feedback (see Session.Reinforce)
+	Metadata      map[string]string // Metadata of the branches picked, given by {#key=value}
+	Blanks        []Blank           // Substitutions left for the user to fill in (see Blanks and Fill)
+	Decisions     *Decision         // The decision tree, if recorded (see RecordDecisions)
+	Warnings      []string          // Problems passed over by Lenient generation, e.g. "no such definition: villain"
+}
+
+// A Substitution records what a single {substitution} resolved to.
+type Substitution struct {
+	ID    string // The substitution as written, without braces, e.g. "weekday", "*weekday" or "1-6"
+	Value string // What it resolved to
+	Depth int    // 0 for substitutions made by the generated identifier, 1 for those made by them, and so on
+}
+
+// GenerateResult generates a phrase for id like Generate, but also returns what each substitution resolved to. Use it
+// to extract structured fields (e.g. the chosen weekday or the rolled number) from the generated text.
+func (tree *Tree) GenerateResult(id string, options ...GenerateOption) (*Result, error) {
+	return tree.defaultSession().GenerateResult(id, options...)
+}
+
+// GenerateResult generates a phrase for id along with details on how it was generated, like Tree.GenerateResult.
+func (s *Session) GenerateResult(id string, options ...GenerateOption) (*Result, error) {
+	g := s.newGenerator(options)
+
+	if err := g.checkEntry(id); err != nil {
+		return nil, err
+	}
+
+	s.generations++
+
+	result, err := g.runNew(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result.TraceID = s.traces.add(s.generations, result.Branches)
+	s.remember(result.Text)
+	g.countUsage()
+	return result, nil
+}
+
+// runNew is like run, but regenerates phrases the session has already emitted if it is deduplicating, and phrases
+// with blocked text.
+func (g *generator) runNew(id string) (*Result, error) {
+	s := g.session
+
+	if s.history == nil && g.config.blockWords == nil && g.config.blockPatterns == nil {
+		return g.run(id)
+	}
+
+	var blocked *BlockedError
+
+	for attempt := 0; attempt < maxRegenerate; attempt++ {
+		saved := g.saveState()
+		result, err := g.run(id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if blocked = g.blocked(result.Text); blocked == nil && s.history == nil {
+			return result, nil
+		}
+
+		if blocked == nil && !s.history.contains(result.Text) {
+			s.history.add(result.Text)
+			return result, nil
+		}
+
+		g.restoreState(saved)
+	}
+
+	if blocked != nil {
+		return nil, blocked
+	}
+
+	return nil, fmt.Errorf("no new phrase for %s after %d attempts", id, maxRegenerate)
+}
+
+// Values returns the values of all substitutions of id (e.g. "weekday"; with or without an exclusive * prefix), in
+// order.
+func (result *Result) Values(id string) []string {
+	var values []string
+
+	for _, s := range result.Substitutions {
+		if s.ID == id || s.ID == "*"+id {
+			values = append(values, s.Value)
+		}
+	}
+
+	return values
+}
+
+// substitute generates the identifier tag for a {substitution} and records the result.
+func (g *generator) substitute(tag string) (string, error) {
+	if g.expansions++; g.config.maxExpand > 0 && g.expansions > g.config.maxExpand {
+		return "", &LimitError{Limit: "expansion", Max: g.config.maxExpand}
+	}
+
+	if g.config.maxDepth > 0 && g.depth >= g.config.maxDepth {
+		chain := append(slices.Clone(g.chain), tag)
+		return "", &LimitError{Limit: "substitution depth", Max: g.config.maxDepth, Chain: chain}
+	}
+
+	i := len(g.result.Substitutions)
+	g.result.Substitutions = append(g.result.Substitutions, Substitution{ID: tag, Depth: g.depth})
+
+	// Modifiers follow the identifier, e.g. {verb:past}
+	modifiers := strings.Split(tag, ":")
+
+	if id := strings.TrimPrefix(modifiers[0], "*"); g.config.blanks[id] {
+		value := g.blank(id, modifiers[1:])
+		g.result.Substitutions[i].Value = value
+		return value, nil
+	}
+
+	if g.config.lenient {
+		if value, missing := g.placeholder(modifiers[0]); missing {
+			g.result.Substitutions[i].Value = value
+			return value, nil
+		}
+	}
+
+	constraints, inflections := splitConstraints(modifiers[1:])
+
+	// With constraints, regenerate until the value meets them, undoing the attempts that don't
+	var saved generatorState
+
+	if len(constraints) > 0 {
+		saved = g.saveState()
+	}
+
+	for attempt := 1; ; attempt++ {
+		done := g.decide(&Decision{Kind: "substitution", ID: tag})
+
+		if g.index != nil {
+			if err := g.index.enter(modifiers[0]); err != nil {
+				return "", err
+			}
+		}
+
+		g.depth++
+		g.chain = append(g.chain, tag)
+		value, err := g.generate(modifiers[0])
+		g.chain = g.chain[:len(g.chain)-1]
+		g.depth--
+
+		if g.index != nil {
+			g.index.leave()
+		}
+
+		done(value)
+
+		if err != nil {
+			return "", err
+		}
+
+		if value, err = g.modify(value, inflections); err != nil {
+			return "", err
+		}
+
+		ok, err := g.satisfies(value, constraints)
+
+		if err != nil {
+			return "", err
+		}
+
+		if ok {
+			g.result.Substitutions[i].Value = value
+			return value, nil
+		}
+
+		if attempt == maxRegenerate {
+			return "", fmt.Errorf("no expansion of %s meets its constraints after %d attempts", modifiers[0], attempt)
+		}
+
+		g.restoreState(saved)
+		saved = g.saveState()
+	}
+}
+
+// A generatorState is what an attempt at a substitution can change, so that the attempt can be undone (see saveState).
+type generatorState struct {
+	used          map[string]int
+	cooldowns     map[string]int
+	last          map[*node]int
+	variables     map[string]string
+	metadata      map[string]string
+	substitutions int
+	branches      int
+	blanks        int
+	warnings      int
+	expanded      int
+	articles      int
+	decisions     int
+}
+
+// saveState returns the state of the generator and its session, to be restored by restoreState if the phrase made from
+// here on is discarded.
+func (g *generator) saveState() generatorState {
+	state := generatorState{
+		used:          g.session.saveUsed(),
+		cooldowns:     maps.Clone(g.session.cooldowns),
+		last:          maps.Clone(g.last),
+		variables:     maps.Clone(g.variables),
+		metadata:      maps.Clone(g.result.Metadata),
+		substitutions: len(g.result.Substitutions),
+		branches:      len(g.result.Branches),
+		blanks:        len(g.result.Blanks),
+		warnings:      len(g.result.Warnings),
+		expanded:      len(g.expanded),
+		articles:      len(g.articles),
+	}
+
+	if g.decision != nil {
+		state.decisions = len(g.decision.Children)
+	}
+
+	return state
+}
+
+// restoreState restores a state returned by saveState.
+func (g *generator) restoreState(state generatorState) {
+	g.session.restoreUsed(state.used)
+	g.session.cooldowns = state.cooldowns
+	g.last = state.last
+	g.variables = state.variables
+	g.result.Metadata = state.metadata
+	g.result.Substitutions = g.result.Substitutions[:state.substitutions]
+	g.result.Branches = g.result.Branches[:state.branches]
+	g.result.Blanks = g.result.Blanks[:state.blanks]
+	g.result.Warnings = g.result.Warnings[:state.warnings]
+	g.expanded = g.expanded[:state.expanded]
+	g.articles = g.articles[:state.articles]
+
+	if g.decision != nil {
+		g.decision.Children = g.decision.Children[:state.decisions]
+	}
+}
+
+// annotate records metadata given as key=value (or just key, for a value of "true").
+func (g *generator) annotate(metadata string) {
+	key, value, found := strings.Cut(metadata, "=")
+
+	if !found {
+		value = "true"
+	}
+
+	if g.result.Metadata == nil {
+		g.result.Metadata = make(map[string]string)
+	}
+
+	g.result.Metadata[strings.TrimSpace(key)] = strings.TrimSpace(value)
+
+	if strings.TrimSpace(key) == "gender" {
+		g.agree(strings.TrimSpace(value))
+	}
+}
+
+// record records a substitution that doesn't expand an identifier, such as a random number.
+func (g *generator) record(id string, value string) {
+	g.result.Substitutions = append(g.result.Substitutions, Substitution{ID: id, Value: value, Depth: g.depth})
+}
+
+// GenerateMap generates a phrase for each of ids in one pass and returns them keyed by identifier, e.g. to build a
+// character sheet from "name", "title" and "motto". The phrases share a session, so exclusive substitutions are not
+// repeated across them, and each phrase is pinned once generated: if "motto" refers to {name}, it gets the same name.
+// Variables carry over too, so a phrase can test a number captured by an earlier one.
+//
+// The identifiers are generated in the order given.
+func (tree *Tree) GenerateMap(ids ...string) (map[string]string, error) {
+	return tree.defaultSession().GenerateMap(ids...)
+}
+
+// GenerateMap generates a phrase for each of ids in one pass, like Tree.GenerateMap.
+func (s *Session) GenerateMap(ids ...string) (map[string]string, error) {
+	ret := make(map[string]string, len(ids))
+	g := s.newGenerator(nil)
+	g.config.pinned = make(map[string]string)
+	s.generations++
+
+	for _, id := range ids {
+		if err := g.checkEntry(id); err != nil {
+			return nil, err
+		}
+
+		result, err := g.run(id)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w (%s)", err, id)
+		}
+
+		ret[id] = result.Text
+		g.countUsage()
+		g.config.pinned[strings.TrimPrefix(id, "*")] = result.Text
+		g.config.variables = g.variables
+	}
+
+	return ret, nil
+}
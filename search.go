@@ -0,0 +1,121 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxSearch is the maximum number of derivations tried when searching for one that satisfies all constraints.
+const maxSearch = 100000
+
+// errConstraint aborts a derivation as soon as it fails a constraint, so the search can backtrack.
+var errConstraint = errors.New("constraint not satisfied")
+
+// Require constrains every expansion of id to contain text, e.g. Require("season", "winter"). Several constraints may
+// be given, for the same or different identifiers.
+//
+// Rather than sampling phrases until one happens to satisfy the constraints, Generate searches the possible choices
+// depth-first (in random order) and backtracks as soon as an expansion fails its constraint. It returns an error if no
+// derivation can satisfy the constraints.
+func Require(id string, text string) GenerateOption {
+	return func(config *generateConfig) {
+		if config.required == nil {
+			config.required = make(map[string][]string)
+		}
+
+		config.required[id] = append(config.required[id], text)
+	}
+}
+
+// checkRequired returns errConstraint if the expansion of id lacks any text required by the constraints.
+func (g *generator) checkRequired(id string, expansion string) error {
+	for _, text := range g.config.required[id] {
+		if !strings.Contains(expansion, text) {
+			return errConstraint
+		}
+	}
+
+	return nil
+}
+
+// A choiceScript makes the random choices of a generator systematically, so that repeated attempts explore the space of
+// derivations depth-first rather than sampling it.
+//
+// Each choice starts out at a random offset and then proceeds through the remaining options in order, like compose()
+// does for exclusive substitutions. Choices are replayed from the start for each attempt; since the same choices lead
+// to the same derivation, only the last choice with options remaining needs to be advanced to backtrack.
+type choiceScript struct {
+	choices []scriptChoice
+	pos     int  // The next choice to replay
+	ordered bool // Start each choice at its first option rather than a random one (see WriteAll)
+}
+
+type scriptChoice struct {
+	n     int // Number of options
+	start int // Randomly chosen first option
+	tried int // Number of options tried before the current
+}
+
+// next returns the next choice in [0, n), either replayed or (past the end of the script) newly drawn.
+func (script *choiceScript) next(n int, draw func(int) int) int {
+	if script.pos == len(script.choices) {
+		choice := scriptChoice{n: n}
+
+		if !script.ordered {
+			choice.start = draw(n)
+		}
+
+		script.choices = append(script.choices, choice)
+	}
+
+	c := script.choices[script.pos]
+	script.pos++
+
+	return (c.start + c.tried) % c.n
+}
+
+// backtrack discards the choices not made by the last attempt and advances the deepest choice which has options left.
+// It returns false if every option of every choice has been tried.
+func (script *choiceScript) backtrack() bool {
+	script.choices = script.choices[:script.pos]
+	script.pos = 0
+
+	for len(script.choices) > 0 {
+		last := &script.choices[len(script.choices)-1]
+
+		if last.tried+1 < last.n {
+			last.tried++
+			return true
+		}
+
+		script.choices = script.choices[:len(script.choices)-1]
+	}
+
+	return false
+}
+
+// search generates id with choices made by a choiceScript, backtracking whenever a constraint fails.
+func (g *generator) search(id string) (string, error) {
+	g.script = &choiceScript{}
+	defer func() { g.script = nil }()
+
+	for attempt := 0; attempt < maxSearch; attempt++ {
+		// Exclusive substitutions made by failed attempts don't count
+		saved := g.session.saveUsed()
+		g.reset(id)
+		out, err := g.generate(id)
+
+		if !errors.Is(err, errConstraint) {
+			return out, err
+		}
+
+		g.session.restoreUsed(saved)
+
+		if !g.script.backtrack() {
+			return "", errors.New("constraints can't be satisfied")
+		}
+	}
+
+	return "", fmt.Errorf("no phrase satisfying the constraints found in %d attempts", maxSearch)
+}
@@ -0,0 +1,298 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Session holds the state that changes as phrases are generated from a Tree: the random source, the branches used by
+// exclusive substitutions, identifier streams and remembered phrases. Any number of sessions can share one Tree, each
+// generating independently of the others.
+//
+// Generating doesn't modify the Tree, so it can be shared between goroutines (e.g. the handlers of an HTTP server) as
+// long as each has a session of its own:
+//
+//	s := tree.NewSession()
+//	phrase, err := s.Generate("greeting")
+//
+// A Session itself isn't safe for concurrent use. Neither are the Generate methods of a Tree, which share its default
+// session.
+type Session struct {
+	tree       *Tree
+	source     *rand.PCG            // Default random source
+	rand       *rand.Rand           // Random source set with SetRand, used instead of source
+	uniqueUsed map[string]int       // Used branches (see branchKey and poolKey), and uses of stock (see stockKey)
+	streams    map[string]*rand.PCG // Independent random streams for individual identifiers
+	history    *outputHistory       // Recently generated phrases, if deduplicating
+
+	generations int            // Number of calls to Generate so far
+	cooldowns   map[string]int // The generation in which each branch with a cooldown was last picked
+
+	traces  traceLog           // Branches picked by recent generations (see Reinforce)
+	weights map[string]float64 // Weight factors learned from feedback, by branch key
+	entries map[string]bool    // Identifiers that can be generated directly; nil uses those of the tree
+	usage   *Usage             // Expansion counters, if tracking usage (see TrackUsage)
+	config  SessionConfig      // Output settings (see SetConfig)
+
+	recent     []string // Recently generated phrases, most recent first (see KeepRecent)
+	recentSize int      // Number of recent phrases to keep
+}
+
+// Reset clears the list of used unique substitutions.
+func (s *Session) Reset() {
+	s.uniqueUsed = make(map[string]int)
+}
+
+// Used returns the keys of all branches used up by exclusive substitutions, in sorted order. A key identifies a branch
+// by its definition, group number and index (e.g. "weekday/[1/4"); branches of pooled definitions also have a key for
+// the pool (e.g. "pool names: Alice").
+//
+// Keys don't depend on memory addresses, so they can be persisted and passed to SetUsed on a later run or on another
+// tree parsed from the same grammar. A branch with a limited stock (see //!stock) has a key with the number of times
+// it has been used, e.g. "stock joke/[1/2 3".
+func (s *Session) Used() []string {
+	keys := make([]string, 0, len(s.uniqueUsed))
+
+	for k, n := range s.uniqueUsed {
+		if strings.HasPrefix(k, stockPrefix) {
+			k = fmt.Sprintf("%s %d", k, n)
+		}
+
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// SetUsed replaces the used unique substitutions with keys, as returned by Used.
+func (s *Session) SetUsed(keys []string) {
+	s.Reset()
+	s.MarkUsed(keys...)
+}
+
+// MarkUsed marks the branches with keys (as returned by Used) as used, in addition to those used already. Unlike
+// SetUsed it doesn't forget the others, so content already shown to a user can be excluded bit by bit.
+func (s *Session) MarkUsed(keys ...string) {
+	for _, k := range keys {
+		// The key of a stock ends with the number of times it has been used
+		if p := strings.LastIndex(k, " "); strings.HasPrefix(k, stockPrefix) && p > len(stockPrefix) {
+			if n, err := strconv.Atoi(k[p+1:]); err == nil {
+				s.uniqueUsed[k[:p]] = max(s.uniqueUsed[k[:p]], n)
+				continue
+			}
+		}
+
+		s.uniqueUsed[k] = 1
+	}
+}
+
+// MarkUsedText marks the branch of the outermost group of id which reads text (as written in the grammar, e.g. "Alice")
+// as used, so exclusive substitutions of id no longer pick it. This is handy when the content shown to a user is
+// stored as text, e.g. in a database record. It fails if id has no such branch.
+func (s *Session) MarkUsedText(id string, text string) error {
+	def := s.tree.findDefinition(id)
+
+	if def == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownIdentifier, id)
+	}
+
+	if len(def.child) == 1 && def.child[0].internalType == group {
+		g := s.newGenerator(nil)
+		g.def = def
+		group := &def.child[0]
+
+		for i := range group.child {
+			if group.child[i].grammarText() == strings.TrimSpace(text) {
+				g.markUsed(group, i)
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%s has no branch %q", id, text)
+}
+
+// Remaining returns the branches of the outermost group of id that exclusive substitutions ({*id}) can still pick, as
+// written in the grammar, in order. Branches taken from a pool by other definitions (see //!pool) are left out too.
+// len(Remaining(id)) is the number of unique phrases left, e.g. to warn before a list of names runs dry.
+func (s *Session) Remaining(id string) ([]string, error) {
+	def := s.tree.findDefinition(id)
+
+	if def == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownIdentifier, id)
+	}
+
+	if len(def.child) != 1 || def.child[0].internalType != group {
+		return nil, nil
+	}
+
+	g := s.newGenerator(nil)
+	g.def = def
+	group := &def.child[0]
+	var ret []string
+
+	for i := range group.child {
+		if !g.used(group, i) {
+			ret = append(ret, group.child[i].grammarText())
+		}
+	}
+
+	return ret, nil
+}
+
+// saveUsed returns a copy of the used unique substitutions, so they can be restored if a phrase is discarded.
+func (s *Session) saveUsed() map[string]int {
+	saved := make(map[string]int, len(s.uniqueUsed))
+
+	for k, v := range s.uniqueUsed {
+		saved[k] = v
+	}
+
+	return saved
+}
+
+// restoreUsed restores the used unique substitutions from a copy made by saveUsed.
+func (s *Session) restoreUsed(saved map[string]int) {
+	s.uniqueUsed = saved
+}
+
+// SeedStream gives the identifier id its own random stream, seeded with seed. Choices made while expanding id are drawn
+// from this stream only, so the sequence of phrases it produces is reproducible and unaffected by other definitions
+// being added, removed or generated in between. Substitutions made from within id use their own streams (or the
+// default random source), so they don't perturb it either.
+func (s *Session) SeedStream(id string, seed int64) {
+	if s.streams == nil {
+		s.streams = make(map[string]*rand.PCG)
+	}
+
+	s.streams[id] = rand.NewPCG(uint64(seed), pcgIncrement)
+}
+
+// Seed reseeds the random source of the session, so that (for the same grammar and sequence of calls) it generates the
+// same phrases every time, e.g. in tests and demos. It replaces a source set with SetRand.
+func (s *Session) Seed(seed int64) {
+	s.source = rand.NewPCG(uint64(seed), pcgIncrement)
+	s.rand = nil
+}
+
+// SetRand makes the session draw its random choices from r, e.g. to share a source with the rest of a program. A
+// session using r can't be saved with Snapshot, since the state of r can't be read back.
+func (s *Session) SetRand(r *rand.Rand) {
+	s.rand = r
+}
+
+// A Snapshot is a copy of the generation state of a Session. Restoring it makes the session behave exactly as it did
+// when the snapshot was taken, e.g. to resume a saved game with identical future generation.
+//
+// All fields are exported, so snapshots can be persisted with encoding/json or encoding/gob.
+type Snapshot struct {
+	Rand        []byte              // State of the default random source
+	Streams     map[string][]byte   // State of the identifier streams
+	Used        []string            // Used branches, as returned by Used
+	HistorySize int                 // Size of the deduplication history; 0 if not deduplicating
+	History     []string            // Remembered phrases, most recent first
+	Generations int                 // Number of calls to Generate
+	Cooldowns   map[string]int      // The generation in which each branch with a cooldown was last picked
+	Weights     map[string]float64  // Weight factors learned from feedback (see Reinforce)
+	RecentSize  int                 // Number of recent phrases kept for resolvers; 0 if not keeping any (see KeepRecent)
+	Recent      []string            // Recent phrases, most recent first
+	Traces      map[string][]string // Branches picked by recent generations, by trace ID (see Reinforce)
+	TraceOrder  []string            // Trace IDs, oldest first
+}
+
+// Snapshot returns a copy of the current state of the session.
+func (s *Session) Snapshot() (*Snapshot, error) {
+	var err error
+
+	if s.rand != nil {
+		return nil, errors.New("can't snapshot a session with a random source set by SetRand")
+	}
+
+	snapshot := Snapshot{Used: s.Used(), Generations: s.generations, Cooldowns: make(map[string]int), Weights: s.Weights()}
+
+	for k, v := range s.cooldowns {
+		snapshot.Cooldowns[k] = v
+	}
+
+	snapshot.RecentSize, snapshot.Recent = s.recentSize, s.Recent()
+	snapshot.Traces, snapshot.TraceOrder = cloneTraces(s.traces.branches), slices.Clone(s.traces.order)
+
+	if snapshot.Rand, err = s.source.MarshalBinary(); err != nil {
+		return nil, err
+	}
+
+	if len(s.streams) > 0 {
+		snapshot.Streams = make(map[string][]byte, len(s.streams))
+
+		for id, stream := range s.streams {
+			if snapshot.Streams[id], err = stream.MarshalBinary(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if s.history != nil {
+		snapshot.HistorySize = s.history.size
+
+		for e := s.history.order.Front(); e != nil; e = e.Next() {
+			snapshot.History = append(snapshot.History, e.Value.(string))
+		}
+	}
+
+	return &snapshot, nil
+}
+
+// Restore returns the session to the state saved in snapshot. The snapshot can come from another session, as long as
+// the grammar is the same.
+func (s *Session) Restore(snapshot *Snapshot) error {
+	source := &rand.PCG{}
+
+	if err := source.UnmarshalBinary(snapshot.Rand); err != nil {
+		return err
+	}
+
+	streams := make(map[string]*rand.PCG, len(snapshot.Streams))
+
+	for id, state := range snapshot.Streams {
+		streams[id] = &rand.PCG{}
+
+		if err := streams[id].UnmarshalBinary(state); err != nil {
+			return err
+		}
+	}
+
+	s.source = source
+	s.rand = nil
+	s.streams = streams
+	s.generations = snapshot.Generations
+	s.cooldowns = make(map[string]int)
+
+	for k, v := range snapshot.Cooldowns {
+		s.cooldowns[k] = v
+	}
+
+	s.weights = make(map[string]float64, len(snapshot.Weights))
+
+	for k, v := range snapshot.Weights {
+		s.weights[k] = v
+	}
+
+	s.recent = slices.Clone(snapshot.Recent)
+	s.KeepRecent(snapshot.RecentSize)
+	s.traces = traceLog{branches: cloneTraces(snapshot.Traces), order: slices.Clone(snapshot.TraceOrder)}
+	s.SetUsed(snapshot.Used)
+	s.Deduplicate(snapshot.HistorySize)
+
+	// Add the oldest phrase first, so the most recent ends up in front
+	for i := len(snapshot.History) - 1; i >= 0 && s.history != nil; i-- {
+		s.history.add(snapshot.History[i])
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package grammar
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A SessionConfig holds the settings that shape the output of a Session, so sessions sharing one Tree can produce
+// output for different languages or displays without passing options on every call. Options given to a call add to
+// these settings, and its locales and limits are preferred to those of the session.
+type SessionConfig struct {
+	Locales    []string // Preferred locales, most preferred first (see Locale)
+	Joiner     string   // Separates the repetitions of a loop ({line*1-3}); "" is a single space
+	Typography bool     // Use typographic quotes, dashes and ellipses (see Typography)
+	Case       Case     // Case of the output
+
+	// Stop words of title case by language (e.g. "en"), for languages where they should differ from StopWords
+	StopWords map[string][]string
+
+	// Budgets guarding against grammars that blow up, e.g. user-authored ones in a service. Generation fails with a
+	// *LimitError when one is exceeded. A call may set its own with MaxLength, MaxExpansions and MaxDepth; 0 is
+	// unlimited.
+	MaxLength     int // Maximum output length in bytes (see MaxLength)
+	MaxExpansions int // Maximum number of substitutions (see MaxExpansions)
+	MaxDepth      int // Maximum nesting depth of substitutions (see MaxDepth)
+}
+
+// A Case changes the case of the output of a session (see SessionConfig).
+type Case int
+
+const (
+	// CaseAsIs leaves the output as generated
+	CaseAsIs Case = iota
+	// CaseUpper makes the output upper case
+	CaseUpper
+	// CaseLower makes the output lower case
+	CaseLower
+	// CaseTitle title cases the output by the conventions of the first locale (see TitleCase and StopWords)
+	CaseTitle
+	// CaseSentence capitalizes the first letter of the output
+	CaseSentence
+)
+
+// SetConfig replaces the output settings of the session.
+func (s *Session) SetConfig(config SessionConfig) {
+	config.Locales = slices.Clone(config.Locales)
+	config.StopWords = cloneStopWords(config.StopWords)
+	s.config = config
+}
+
+// Config returns the output settings of the session.
+func (s *Session) Config() SessionConfig {
+	config := s.config
+	config.Locales = slices.Clone(config.Locales)
+	config.StopWords = cloneStopWords(config.StopWords)
+	return config
+}
+
+// cloneStopWords returns a deep copy of stop words by language, so the caller's map can't change under a session.
+func cloneStopWords(stopWords map[string][]string) map[string][]string {
+	if stopWords == nil {
+		return nil
+	}
+
+	ret := make(map[string][]string, len(stopWords))
+
+	for language, words := range stopWords {
+		ret[language] = slices.Clone(words)
+	}
+
+	return ret
+}
+
+// SetConfig replaces the output settings of the tree's default session. See Session.SetConfig.
+func (tree *Tree) SetConfig(config SessionConfig) {
+	tree.defaultSession().SetConfig(config)
+}
+
+// applyConfig applies the settings of the session to the configuration of a call, after the options of the call.
+func (s *Session) applyConfig(config *generateConfig) {
+	config.locales = append(config.locales[:len(config.locales):len(config.locales)], s.config.Locales...)
+	config.joiner = s.config.Joiner
+	config.typography = config.typography || s.config.Typography
+	config.caseMode = s.config.Case
+
+	if config.maxLength == 0 {
+		config.maxLength = s.config.MaxLength
+	}
+
+	if config.maxExpand == 0 {
+		config.maxExpand = s.config.MaxExpansions
+	}
+
+	if config.maxDepth == 0 {
+		config.maxDepth = s.config.MaxDepth
+	}
+}
+
+// changeCase changes the case of out as given by mode.
+func (g *generator) changeCase(out string, mode Case) string {
+	switch mode {
+	case CaseUpper:
+		return strings.ToUpper(out)
+	case CaseLower:
+		return strings.ToLower(out)
+	case CaseTitle:
+		return g.titleCase(out)
+	case CaseSentence:
+		if p := strings.IndexFunc(out, unicode.IsLetter); p >= 0 {
+			r, size := utf8.DecodeRuneInString(out[p:])
+			return out[:p] + string(unicode.ToUpper(r)) + out[p+size:]
+		}
+	}
+
+	return out
+}
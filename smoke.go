@@ -0,0 +1,75 @@
+package grammar
+
+import (
+	"fmt"
+)
+
+// A BranchError reports a branch which could not be expanded, as found by SmokeTest.
+type BranchError struct {
+	Key string // The branch, e.g. "diary/[2/3" (see LoadWeights)
+	Err error  // What went wrong
+}
+
+func (e *BranchError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Err)
+}
+
+func (e *BranchError) Unwrap() error {
+	return e.Err
+}
+
+// SmokeTest expands every branch of every group of every definition at least once, and returns the branches which
+// failed to expand, e.g. because of a missing identifier or exhausted exclusive substitutions. It's meant for
+// validating grammars in CI: unlike generating phrases at random, it doesn't miss rare branches.
+//
+// Each branch is tested by generating its definition in a fresh session, with the branch and all the groups leading up
+// to it forced. Everything else (including nested substitutions) is chosen at random as usual, so a failure is reported
+// for the innermost branch responsible. Pass MaxLength to guard against grammars which may recurse without end.
+func (tree *Tree) SmokeTest(options ...GenerateOption) []*BranchError {
+	var ret []*BranchError
+
+	for i := range tree.root.child {
+		def := &tree.root.child[i]
+
+		for j := range def.child {
+			ret = append(ret, tree.smokeTest(def, &def.child[j], map[*node]int{}, options)...)
+		}
+	}
+
+	return ret
+}
+
+// smokeTest tests the branches of all groups in n (and below), forcing the branches in forced to reach them.
+func (tree *Tree) smokeTest(def *node, n *node, forced map[*node]int, options []GenerateOption) []*BranchError {
+	var ret []*BranchError
+
+	if n.internalType != group {
+		for i := range n.child {
+			ret = append(ret, tree.smokeTest(def, &n.child[i], forced, options)...)
+		}
+
+		return ret
+	}
+
+	for i := range n.child {
+		forced[n] = i
+
+		s := tree.NewSession()
+		g := s.newGenerator(options)
+		g.config.forced = forced
+
+		_, err := g.run(def.Text)
+		below := tree.smokeTest(def, &n.child[i], forced, options)
+
+		// Report the problem where it is: the branch itself only fails if none of the branches below it do
+		if err != nil && len(below) == 0 {
+			ret = append(ret, &BranchError{Key: branchKey(def, n, i), Err: err})
+		}
+
+		ret = append(ret, below...)
+
+		delete(forced, n)
+	}
+
+	return ret
+}
@@ -0,0 +1,110 @@
+package grammar
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// A Dictionary decides which words are spelled correctly, for Spellcheck. Implement it to plug in a spellchecker of
+// your choice, or use a WordList.
+type Dictionary interface {
+	Contains(word string) bool
+}
+
+// A WordList is a simple Dictionary of known words. Words are compared in lower case.
+type WordList map[string]bool
+
+// Contains reports whether word (in any case) is in the list.
+func (list WordList) Contains(word string) bool {
+	return list[strings.ToLower(word)]
+}
+
+// ReadWordList reads a word list with one word per line, like /usr/share/dict/words. Empty lines are ignored.
+func ReadWordList(r io.Reader) (WordList, error) {
+	list := make(WordList)
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" {
+			list[strings.ToLower(word)] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// A Misspelling is a word which isn't in the dictionary.
+type Misspelling struct {
+	Word   string // The word, as written
+	Source string // Where it was found, e.g. "names.g:12"
+}
+
+// Spellcheck checks every word of the text in the grammar against dict and returns those it doesn't contain, in the
+// order they appear. Misspellings in rarely picked branches can otherwise go unnoticed for a long time.
+//
+// Words joined to {substitutions}, numbers and control tokens are skipped. Words are split on anything but letters and
+// apostrophes, so "don't" is checked as one word and "well-known" as two.
+func (tree *Tree) Spellcheck(dict Dictionary) []Misspelling {
+	var ret []Misspelling
+
+	for i := range tree.root.child {
+		ret = tree.root.child[i].spellcheck(dict, ret)
+	}
+
+	return ret
+}
+
+// spellcheck appends the misspellings in the text of node and its children to ret.
+func (node *node) spellcheck(dict Dictionary, ret []Misspelling) []Misspelling {
+	if node.internalType == text {
+		for _, word := range words(node.Text) {
+			if !dict.Contains(word) {
+				ret = append(ret, Misspelling{Word: word, Source: node.Source})
+			}
+		}
+	}
+
+	for i := range node.child {
+		ret = node.child[i].spellcheck(dict, ret)
+	}
+
+	return ret
+}
+
+// words returns the words of s. Anything containing digits or {substitutions} (such as "{noun}s" or "{name}'s") is left
+// out, since it isn't a whole word.
+func words(s string) []string {
+	var ret []string
+
+	split := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	}
+
+	substitution := false
+
+	for _, field := range strings.Fields(s) {
+		// Suffixes like 's following a substitution belong to it
+		if strings.ContainsAny(field, "{}") || (substitution && field[0] == '\'') {
+			substitution = strings.ContainsAny(field, "{}")
+			continue
+		}
+
+		substitution = false
+
+		for _, word := range strings.FieldsFunc(field, split) {
+			word = strings.Trim(word, "'")
+
+			if word != "" && strings.IndexFunc(word, unicode.IsDigit) < 0 {
+				ret = append(ret, word)
+			}
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,143 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Speech markers are kept in the phrase as control characters around the encoded speech token until the output is
+// finished, when they are either rendered as SSML or removed.
+const (
+	speechOpen  = '\x01'
+	speechClose = '\x02'
+)
+
+// SSML renders the output as SSML (Speech Synthesis Markup Language), so it can be fed straight to a text-to-speech
+// engine. The phrase is escaped and wrapped in <speak>, line breaks become pauses, and speech tokens in the grammar
+// are rendered as tags:
+//
+//	{\pause}         a pause: <break/>
+//	{\pause=500ms}   a pause of a given length: <break time="500ms"/>
+//	{\em} {\/em}     emphasis on the words in between: <emphasis>...</emphasis>
+//
+// Without SSML, the speech tokens are left out of the output.
+func SSML() GenerateOption {
+	return func(config *generateConfig) {
+		config.ssml = true
+	}
+}
+
+// speechToken returns the marker for a speech token such as \pause=500ms or \em (without braces), or false if it isn't
+// one.
+func speechToken(token string) (string, bool) {
+	if !strings.HasPrefix(token, "\\") {
+		return "", false
+	}
+
+	token = token[1:]
+	name, _, _ := strings.Cut(token, "=")
+
+	// The token is encoded like a literal, so that changes to the case of the phrase don't touch it
+	switch name {
+	case "pause", "em", "/em":
+		return string(speechOpen) + encodeLiteral(token) + string(speechClose), true
+	}
+
+	return "", false
+}
+
+// stripSpeech removes speech markers from s, along with a space next to each, so they don't leave gaps.
+func stripSpeech(s string) string {
+	for open := strings.IndexRune(s, speechOpen); open >= 0; open = strings.IndexRune(s, speechOpen) {
+		end := strings.IndexRune(s[open:], speechClose)
+
+		if end < 0 {
+			break
+		}
+
+		end += open + 1
+
+		if open > 0 && s[open-1] == ' ' {
+			open--
+		} else if end < len(s) && s[end] == ' ' {
+			end++
+		}
+
+		s = s[:open] + s[end:]
+	}
+
+	return s
+}
+
+// renderSSML renders a finished phrase, with speech markers, as an SSML document.
+func renderSSML(s string) string {
+	var b strings.Builder
+	b.WriteString("<speak>")
+
+	for s != "" {
+		open := strings.IndexRune(s, speechOpen)
+
+		if open < 0 {
+			open = len(s)
+		}
+
+		writeSpeechText(&b, s[:open])
+
+		if open == len(s) {
+			break
+		}
+
+		end := strings.IndexRune(s[open:], speechClose)
+
+		if end < 0 {
+			break
+		}
+
+		name, value, found := strings.Cut(s[open+1:open+end], "=")
+
+		switch {
+		case name == "pause" && found:
+			fmt.Fprintf(&b, `<break time="%s"/>`, escapeXML(value))
+		case name == "pause":
+			b.WriteString("<break/>")
+		case name == "em":
+			b.WriteString("<emphasis>")
+		case name == "/em":
+			b.WriteString("</emphasis>")
+		}
+
+		s = s[open+end+1:]
+	}
+
+	b.WriteString("</speak>")
+	return b.String()
+}
+
+// writeSpeechText writes escaped text, turning line breaks into pauses: a strong one for a single line break, and an
+// extra strong one for a paragraph break.
+func writeSpeechText(b *strings.Builder, s string) {
+	for s != "" {
+		p := strings.IndexByte(s, '\n')
+
+		if p < 0 {
+			b.WriteString(escapeXML(s))
+			return
+		}
+
+		b.WriteString(escapeXML(strings.TrimRight(s[:p], " ")))
+		rest := strings.TrimLeft(s[p:], "\n ")
+
+		if strings.Count(s[p:len(s)-len(rest)], "\n") > 1 {
+			b.WriteString(`<break strength="x-strong"/>`)
+		} else {
+			b.WriteString(`<break strength="strong"/>`)
+		}
+
+		s = rest
+	}
+}
+
+// escapeXML escapes the characters which have a special meaning in XML.
+func escapeXML(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;").Replace(s)
+}
@@ -0,0 +1,76 @@
+package grammar
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A Histogram summarizes the phrases produced by repeated generation of an identifier.
+type Histogram struct {
+	Samples  int            // Number of phrases generated
+	Counts   map[string]int // Number of times each distinct phrase was generated
+	Distinct int            // Number of distinct phrases
+	Entropy  float64        // Shannon entropy of the observed distribution, in bits
+}
+
+// Histogram generates id n times and returns the frequency of each phrase along with some summary statistics, so that
+// authors can verify that the structure of a grammar gives the intended distribution.
+//
+// Every sample is generated independently in a session of its own, with exclusive substitutions reset in between, so
+// the default session of the tree is left untouched.
+func (tree *Tree) Histogram(id string, n int, options ...GenerateOption) (*Histogram, error) {
+	s := tree.NewSession()
+	h := Histogram{Counts: make(map[string]int)}
+
+	for i := 0; i < n; i++ {
+		s.Reset()
+
+		result, err := s.newGenerator(options).run(id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		h.Counts[result.Text]++
+		h.Samples++
+	}
+
+	h.Distinct = len(h.Counts)
+
+	for _, count := range h.Counts {
+		p := float64(count) / float64(h.Samples)
+		h.Entropy -= p * math.Log2(p)
+	}
+
+	return &h, nil
+}
+
+// String formats a histogram as a table, most frequent phrase first, followed by the summary statistics.
+func (h *Histogram) String() string {
+	phrases := make([]string, 0, len(h.Counts))
+
+	for phrase := range h.Counts {
+		phrases = append(phrases, phrase)
+	}
+
+	sort.Slice(phrases, func(i, j int) bool {
+		if h.Counts[phrases[i]] != h.Counts[phrases[j]] {
+			return h.Counts[phrases[i]] > h.Counts[phrases[j]]
+		}
+
+		return phrases[i] < phrases[j]
+	})
+
+	var lines []string
+
+	for _, phrase := range phrases {
+		count := h.Counts[phrase]
+		lines = append(lines, fmt.Sprintf("%6d %5.1f%%  %s", count, 100*float64(count)/float64(h.Samples), phrase))
+	}
+
+	lines = append(lines, fmt.Sprintf("%d samples, %d distinct, %.2f bits of entropy", h.Samples, h.Distinct, h.Entropy))
+
+	return strings.Join(lines, "\n")
+}
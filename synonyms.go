@@ -0,0 +1,58 @@
+package grammar
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Synonyms replaces words of the output with synonyms from dictionary, for variety without adding branches to the
+// grammar. Each word found in the dictionary (ignoring case) is replaced with probability (from 0 to 1) by one of its
+// synonyms, picked at random; a capitalized word gets a capitalized synonym. Only single words are looked up, but a
+// synonym can be several words:
+//
+//	tree.Generate("review", Synonyms(map[string][]string{"good": {"great", "fine", "very good"}}, 0.5))
+func Synonyms(dictionary map[string][]string, probability float64) GenerateOption {
+	return func(config *generateConfig) {
+		config.synonyms = make(map[string][]string, len(dictionary))
+
+		for word, synonyms := range dictionary {
+			config.synonyms[strings.ToLower(word)] = synonyms
+		}
+
+		config.synonymRate = probability
+	}
+}
+
+// replaceSynonyms replaces words of s with synonyms (see Synonyms).
+func (g *generator) replaceSynonyms(s string) string {
+	var b strings.Builder
+
+	for len(s) > 0 {
+		start := strings.IndexFunc(s, unicode.IsLetter)
+
+		if start < 0 {
+			break
+		}
+
+		end := strings.IndexFunc(s[start:], func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' && r != '-' })
+
+		if end < 0 {
+			end = len(s)
+		} else {
+			end += start
+		}
+
+		word := s[start:end]
+		b.WriteString(s[:start])
+
+		if synonyms := g.config.synonyms[strings.ToLower(word)]; len(synonyms) > 0 &&
+			g.draw(1000000) < int(g.config.synonymRate*1000000) {
+			word = keepCase(word, synonyms[g.draw(len(synonyms))])
+		}
+
+		b.WriteString(word)
+		s = s[end:]
+	}
+
+	return b.String() + s
+}
@@ -0,0 +1,245 @@
+package grammar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// tableReference matches a substitution that can be exported as a reference to a table, e.g. {weekday} or {*weekday}.
+var tableReference = regexp.MustCompile(`^\*?[^\s{}<>*^:=?%#+~/\\]+$`)
+
+// tableRange matches a substitution of a random number, e.g. {1-6}.
+var tableRange = regexp.MustCompile(`^\d+-\d+$`)
+
+// A tableEntry is an alternative of an exported table.
+type tableEntry struct {
+	Text   string  `json:"text"`
+	Weight float64 `json:"weight"`
+}
+
+// tableExport is the document written by ExportTables.
+type tableExport struct {
+	Start  string                  `json:"start"`
+	Tables map[string][]tableEntry `json:"tables"`
+}
+
+// ExportTables flattens the tree into plain choice tables and writes them to w as JSON, for runtimes other than this
+// package (e.g. a mobile client generating offline) to generate from the same grammar:
+//
+//	{
+//	  "start": "greeting",
+//	  "tables": {
+//	    "greeting": [{"text": "{greeting/[2} world", "weight": 1}],
+//	    "greeting/[2": [{"text": "hello", "weight": 3}, {"text": "hi", "weight": 1}]
+//	  }
+//	}
+//
+// Every definition becomes a table, and so does every nested group, named after its branch keys (see Branches). To
+// generate, pick an entry of the start table at random, in proportion to the weights, and replace each {name} in its
+// text with an entry of that table the same way, and each {a-b} with a random number from a to b.
+//
+// Weights given in the grammar, by rarity tiers or by LoadWeights are included; branches weighted to zero are left out.
+// Exclusive substitutions become ordinary ones. Other features have no equivalent in the tables, so the grammar may
+// only substitute identifiers, numbers and line breaks ({\n}), without modifiers or case markers, and mustn't be
+// recursive; ExportTables returns an error otherwise.
+func (tree *Tree) ExportTables(w io.Writer) error {
+	if len(tree.root.child) == 0 {
+		return ErrEmptyTree
+	}
+
+	e := tableExporter{
+		tree:       tree,
+		g:          tree.NewSession().newGenerator(nil),
+		tables:     make(map[string][]tableEntry),
+		references: make(map[string][]string),
+		checked:    make(map[string]bool),
+	}
+
+	for i := range tree.root.child {
+		if err := e.definition(&tree.root.child[i]); err != nil {
+			return err
+		}
+	}
+
+	for name := range e.tables {
+		if err := e.checkRecursion(name, map[string]bool{}); err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(tableExport{Start: tree.root.child[len(tree.root.child)-1].Text, Tables: e.tables})
+}
+
+// A tableExporter flattens a tree into tables (see ExportTables).
+type tableExporter struct {
+	tree       *Tree
+	g          *generator // Weighs branches
+	tables     map[string][]tableEntry
+	references map[string][]string // Tables referred to by each table
+	table      string              // The table being exported
+	checked    map[string]bool     // Tables known not to be recursive
+}
+
+// definition exports the table of def, along with those of its groups.
+func (e *tableExporter) definition(def *node) error {
+	e.g.def = def
+
+	if len(def.child) == 1 && def.child[0].internalType == group {
+		return e.group(def.Text, &def.child[0])
+	}
+
+	e.table = def.Text
+	text, err := e.template(def)
+
+	if err != nil {
+		return err
+	}
+
+	e.tables[def.Text] = []tableEntry{{Text: decodeLiterals(text), Weight: 1}}
+	return nil
+}
+
+// group exports the table name with the branches of group.
+func (e *tableExporter) group(name string, group *node) error {
+	weights := e.g.branchWeights(group)
+	entries := []tableEntry{}
+
+	for i := range group.child {
+		weight := 1.0
+
+		if weights != nil {
+			weight = weights[i]
+		}
+
+		if weight == 0 {
+			continue
+		}
+
+		e.table = name
+		text, err := e.template(&group.child[i])
+
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, tableEntry{Text: decodeLiterals(text), Weight: weight})
+	}
+
+	e.tables[name] = entries
+	return nil
+}
+
+// template returns the text of an entry for node, referring to the tables of nested groups, which are exported too.
+// Literals are left encoded, so they aren't tidied when the text of a nested node is joined with its parent's.
+func (e *tableExporter) template(n *node) (string, error) {
+	var parts []string
+	table := e.table
+
+	if n.internalType == text {
+		part, err := e.text(n)
+
+		if err != nil {
+			return "", err
+		}
+
+		parts = append(parts, part)
+	}
+
+	for i := range n.child {
+		child := &n.child[i]
+
+		if child.internalType != group {
+			part, err := e.template(child)
+
+			if err != nil {
+				return "", err
+			}
+
+			parts = append(parts, part)
+			continue
+		}
+
+		name := e.g.def.Text + "/" + child.Text
+
+		if err := e.group(name, child); err != nil {
+			return "", err
+		}
+
+		e.table = table
+		e.references[table] = append(e.references[table], name)
+		parts = append(parts, "{"+name+"}")
+	}
+
+	ret := tidySpaces(strings.Join(parts, " "))
+
+	if ret == "_" {
+		ret = ""
+	}
+
+	return ret, nil
+}
+
+// text checks that the text of n can be exported and returns it as it goes into a table.
+func (e *tableExporter) text(n *node) (string, error) {
+	ret := n.Text
+
+	// Braces in the text of a table refer to other tables, so a literal can't have any
+	if strings.ContainsAny(n.Text, string(rune(literalBase+'{'))+string(rune(literalBase+'}'))) {
+		return "", fmt.Errorf("literal with braces at %s can't be exported as a table", n.Source)
+	}
+
+	for _, tag := range sequences(n.Text) {
+		switch kind := classifyTag(tag); {
+		case kind == tagNewline:
+			ret = strings.Replace(ret, "{"+tag+"}", "\n", 1)
+		case kind == tagRange && tableRange.MatchString(tag):
+		case kind == tagSubstitution && tableReference.MatchString(tag):
+			id := strings.TrimPrefix(tag, "*")
+
+			if e.tree.findDefinition(id) == nil {
+				return "", fmt.Errorf("%w: %s (at %s)", ErrUnknownIdentifier, id, n.Source)
+			}
+
+			ret = strings.Replace(ret, "{"+tag+"}", "{"+id+"}", 1)
+			e.references[e.table] = append(e.references[e.table], id)
+		default:
+			return "", fmt.Errorf("{%s} at %s can't be exported as a table", tag, n.Source)
+		}
+	}
+
+	for _, marker := range []string{"<<", "<->", "<–>", "<—>", "^", "~~"} {
+		if strings.Contains(n.Text, marker) {
+			return "", fmt.Errorf("%s at %s can't be exported as a table", marker, n.Source)
+		}
+	}
+
+	return ret, nil
+}
+
+// checkRecursion returns an error if table name refers to itself, directly or through other tables. visiting holds the
+// tables on the way to it.
+func (e *tableExporter) checkRecursion(name string, visiting map[string]bool) error {
+	if e.checked[name] {
+		return nil
+	} else if visiting[name] {
+		return fmt.Errorf("%s is recursive and can't be exported as a table", name)
+	}
+
+	visiting[name] = true
+
+	for _, ref := range e.references[name] {
+		if err := e.checkRecursion(ref, visiting); err != nil {
+			return err
+		}
+	}
+
+	delete(visiting, name)
+	e.checked[name] = true
+	return nil
+}
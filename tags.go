@@ -0,0 +1,79 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A tagKind is the kind of a {...} sequence in the text of a branch (see classifyTag).
+type tagKind int
+
+const (
+	tagSubstitution   tagKind = iota // A substitution of an identifier, e.g. {weekday} or {*weekday:upper}
+	tagEmpty                         // {}, which is an error
+	tagBlank                         // A blank left by an earlier substitution (see Blanks)
+	tagNewline                       // A line break, {\n}
+	tagMetadata                      // Metadata, e.g. {#mood=grim}
+	tagParagraphBreak                // A paragraph break, {\p}
+	tagSpeech                        // A speech token, e.g. {\pause=500ms} (see SSML)
+	tagArticle                       // An article agreeing with the noun after it, e.g. {der/die/das}
+	tagParagraphs                    // A sequence of paragraphs, e.g. {+intro,body} or {~a,b}
+	tagRange                         // A random number, e.g. {1-6}
+	tagPlural                        // A plural form for a captured number, e.g. {%n:one=item,other=items}
+	tagRepetition                    // A loop, e.g. {line*1-5}
+	tagConditional                   // A condition on a captured value, e.g. {n>5?many:few}
+	tagCapture                       // A captured substitution, e.g. {n=1-20}
+)
+
+// classifyTag returns the kind of a {...} sequence, given without the braces. Generating, counting and matching
+// phrases and exporting tables all go by it, so they agree on what every sequence means.
+func classifyTag(tag string) tagKind {
+	switch {
+	case tag == "":
+		return tagEmpty
+	case tag[0] == '?':
+		return tagBlank
+	case tag == `\n`:
+		return tagNewline
+	case tag[0] == '#':
+		return tagMetadata
+	case tag == `\p`:
+		return tagParagraphBreak
+	}
+
+	if _, found := speechToken(tag); found {
+		return tagSpeech
+	}
+
+	switch {
+	case article.MatchString(tag):
+		return tagArticle
+	case tag[0] == '+' || tag[0] == '~':
+		return tagParagraphs
+	}
+
+	if _, _, found := parseRange(tag); found {
+		return tagRange
+	}
+
+	switch {
+	case tag[0] == '%':
+		return tagPlural
+	case repetition.MatchString(tag):
+		return tagRepetition
+	case strings.Contains(tag, "?"):
+		return tagConditional
+	}
+
+	if name, _, found := strings.Cut(tag, "="); found && variableName.MatchString(name) {
+		return tagCapture
+	}
+
+	return tagSubstitution
+}
+
+// parseRange returns the bounds of a random number range such as 1-6, or false if tag isn't one.
+func parseRange(tag string) (low int, high int, found bool) {
+	_, err := fmt.Sscanf("{"+tag+"}", "{%d-%d}", &low, &high)
+	return low, high, err == nil
+}
@@ -0,0 +1,123 @@
+package grammar
+
+import "strings"
+
+// tiers are the rarity tiers of branches, from most to least common.
+var tiers = []string{"common", "uncommon", "rare", "legendary"}
+
+// defaultTierOdds are the relative odds of the rarity tiers. With one branch of each tier, they are the percentages.
+var defaultTierOdds = map[string]float64{"common": 60, "uncommon": 25, "rare": 10, "legendary": 5}
+
+// TierOdds changes the odds of rarity tiers (see {#tier=...}), e.g. TierOdds(map[string]float64{"legendary": 20})
+// for a lucky roll. Tiers left out keep their default odds.
+func TierOdds(odds map[string]float64) GenerateOption {
+	return func(config *generateConfig) {
+		if config.tierOdds == nil {
+			config.tierOdds = make(map[string]float64)
+		}
+
+		for tier, n := range odds {
+			config.tierOdds[tier] = n
+		}
+	}
+}
+
+// MinTier makes branches with a rarity tier below tier never picked, e.g. MinTier("rare") for a boss drop. Branches
+// without a tier count as common. Groups without tiers are not affected, and neither is a group where no branch is of
+// the tier or above.
+func MinTier(tier string) GenerateOption {
+	return func(config *generateConfig) {
+		config.minTier = tierRank(tier)
+	}
+}
+
+// tierRank returns the position of tier in tiers, or -1 if there is no such tier.
+func tierRank(tier string) int {
+	for i, t := range tiers {
+		if t == tier {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// tiered reports whether any branch of group has a rarity tier.
+func (group *node) tiered() bool {
+	for i := range group.child {
+		if group.child[i].tier != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tierWeight returns the weight of a branch with tier (common if ""), given the odds and minimum tier of the call.
+func (g *generator) tierWeight(tier string) float64 {
+	if tier == "" {
+		tier = "common"
+	}
+
+	if tierRank(tier) < g.config.minTier {
+		return 0
+	}
+
+	if odds, found := g.config.tierOdds[tier]; found {
+		return odds
+	}
+
+	return defaultTierOdds[tier]
+}
+
+// findTiers sets the tier of every branch under node with tier metadata ({#tier=rare}) of its own, i.e. not inside a
+// nested group.
+func findTiers(node *node) error {
+	for i := range node.child {
+		branch := &node.child[i]
+
+		if node.internalType == group {
+			tier, err := branchTier(branch)
+
+			if err != nil {
+				return err
+			}
+
+			branch.tier = tier
+		}
+
+		if err := findTiers(branch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// branchTier returns the tier given by the tier metadata in the text of branch, outside nested groups.
+func branchTier(branch *node) (string, error) {
+	if branch.internalType == group {
+		return "", nil
+	}
+
+	for _, word := range strings.Fields(branch.Text) {
+		if tier, found := strings.CutPrefix(word, "{#tier="); found {
+			tier = strings.TrimSuffix(tier, "}")
+
+			if tierRank(tier) < 0 {
+				return "", newParseError(branch.Source, 0, word, "unknown tier %s (expecting %s)", tier,
+					strings.Join(tiers, ", "))
+			}
+
+			return tier, nil
+		}
+	}
+
+	for i := range branch.child {
+		if tier, err := branchTier(&branch.child[i]); tier != "" || err != nil {
+			return tier, err
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,109 @@
+package grammar
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// stopWords lists the words that title case keeps in lower case (unless they start or end the title), by language.
+// Languages without an entry are title cased without stop words.
+var stopWords = map[string][]string{
+	"en": {"a", "an", "the", "and", "but", "or", "nor", "for", "so", "yet", "as", "at", "by", "in", "of", "off", "on",
+		"per", "to", "up", "via", "vs"},
+	"fr": {"le", "la", "les", "l'", "un", "une", "des", "du", "de", "d'", "et", "ou", "mais", "à", "au", "aux", "en",
+		"par", "pour", "sur"},
+	"es": {"el", "la", "los", "las", "un", "una", "unos", "unas", "y", "e", "o", "u", "ni", "pero", "de", "del", "a",
+		"al", "en", "por", "con", "para"},
+	"it": {"il", "lo", "la", "i", "gli", "le", "un", "uno", "una", "e", "o", "ma", "di", "del", "della", "a", "al",
+		"da", "in", "con", "su", "per"},
+	"pt": {"o", "a", "os", "as", "um", "uma", "e", "ou", "mas", "de", "do", "da", "dos", "das", "em", "no", "na",
+		"por", "com", "para"},
+	"nl": {"de", "het", "een", "en", "of", "maar", "van", "in", "op", "te", "aan", "met", "voor"},
+}
+
+// StopWords returns the words that title case keeps in lower case (unless they start or end the title) in the language
+// of locale, e.g. "the" and "of" in English. It returns nil for languages without stop words. A session can use other
+// stop words (see SessionConfig).
+func StopWords(locale string) []string {
+	return slices.Clone(stopWords[language(locale)])
+}
+
+// language returns the language of locale, e.g. "pt" for "pt-BR".
+func language(locale string) string {
+	language, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	return language
+}
+
+// TitleCase capitalizes the words of a headline by the conventions of a language, given as a locale such as "en" or
+// "pt-BR": the first word, the last word and words after a colon are always capitalized, stop words (see StopWords)
+// are lower case, and other words get a capital first letter. Words with a capital letter already, like acronyms and
+// names such as "iPhone", are left as is.
+func TitleCase(phrase string, locale string) string {
+	return titleCase(phrase, stopWords[language(locale)])
+}
+
+// titleCase title cases s in the most preferred locale, with the stop words of the session if it has its own.
+func (g *generator) titleCase(s string) string {
+	if words, found := g.session.config.StopWords[language(g.locale())]; found {
+		return titleCase(s, words)
+	}
+
+	return TitleCase(s, g.locale())
+}
+
+// titleCase is TitleCase with the given stop words.
+func titleCase(phrase string, stopWords []string) string {
+	stop := make(map[string]bool)
+
+	for _, word := range stopWords {
+		stop[word] = true
+	}
+
+	words := strings.Split(phrase, " ")
+	last := len(words) - 1
+
+	for last > 0 && words[last] == "" {
+		last--
+	}
+
+	first := true
+
+	for i, word := range words {
+		if word == "" {
+			continue
+		}
+
+		if strings.IndexFunc(word, unicode.IsUpper) >= 0 {
+			// Leave acronyms and names alone
+		} else if !first && i != last && stop[strings.ToLower(strings.TrimRight(word, ",;"))] {
+			words[i] = strings.ToLower(word)
+		} else {
+			words[i] = capitalize(word)
+		}
+
+		first = strings.HasSuffix(word, ":")
+	}
+
+	return strings.Join(words, " ")
+}
+
+// capitalize upper cases the first letter of word, and of every part of a hyphenated word.
+func capitalize(word string) string {
+	parts := strings.Split(word, "-")
+
+	for i, part := range parts {
+		// Skip leading punctuation, as in "(Re)start" or a quoted word
+		start := strings.IndexFunc(part, unicode.IsLetter)
+
+		if start < 0 {
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(part[start:])
+		parts[i] = part[:start] + string(unicode.ToUpper(r)) + part[start+size:]
+	}
+
+	return strings.Join(parts, "-")
+}
@@ -3,11 +3,13 @@ package grammar
 import (
 	"strings"
 	"fmt"
+	"unicode/utf8"
 )
 
 type token struct {
 	Text   string
 	Source string
+	Column int // Column of the first character on its line, starting at 1
 }
 
 // tokenize splits an input grammar string and returns a slice of Token containing the individual words. Syntactic
@@ -22,14 +24,27 @@ func tokenize(input string, file string) []token {
 
 		var collect []token
 		source := fmt.Sprintf("%s:%d", file, lineNo+1) // Physical line number
+		// Literals are encoded first, so that nothing in them is taken for syntax. Tokens are looked up in the encoded
+		// line, whose columns map back to those of the line as written.
+		line, columns := encodeLiterals(line)
+		original, cursor := line, 0
 
 		// Strip whitespace
 		line = strings.ReplaceAll(line, "\t", "")
 
 		line = strings.Trim(line, " ")
 
+		// Keep a comment verbatim as a single token, after the rest of the line. A comment starting with //! is a
+		// directive; others are preserved in the tree.
+		var comment []token
+
+		if p := strings.Index(line, "//"); p >= 0 {
+			_, col := column(original, "//", 0)
+			comment = []token{{Text: strings.TrimSpace(line[p:]), Source: source, Column: columns[col-1]}}
+			line = line[:p]
+		}
+
 		// Add extra spaces around syntactic characters so they will separated properly
-		line = strings.Replace(line, "//", " // ", -1)
 		line = strings.Replace(line, "[", " [ ", -1)
 		line = strings.Replace(line, "]", " ] ", -1)
 		line = strings.Replace(line, "|", " | ", -1)
@@ -40,18 +55,28 @@ func tokenize(input string, file string) []token {
 		for _, t := range strings.Split(line, " ") {
 			t = strings.Trim(t, " ")
 
-			if t == "//" {
-				// Discard the rest of the line, but save what we already collected
-				ret = append(ret, collect...)
-				goto next_line
-			} else if t != "" {
-				collect = append(collect, token{Text: t, Source: source})
+			if t != "" {
+				offset, col := column(original, t, cursor)
+				cursor = offset + len(t)
+				collect = append(collect, token{Text: t, Source: source, Column: columns[col-1]})
 			}
 		}
 
 		ret = append(ret, collect...)
-	next_line:
+		ret = append(ret, comment...)
 	}
 
 	return ret
 }
+
+// column finds the first occurrence of t in line at or after the byte offset from, and returns its byte offset and its
+// column. If there is none (e.g. because tabs were stripped from t), it returns those of from.
+func column(line string, t string, from int) (int, int) {
+	from = min(from, len(line))
+
+	if p := strings.Index(line[from:], t); p >= 0 {
+		from += p
+	}
+
+	return from, utf8.RuneCountInString(line[:from]) + 1
+}
@@ -0,0 +1,52 @@
+package grammar
+
+import (
+	"strings"
+	"unicode"
+)
+
+// AlternatingCase alternates lower and upper case letters, starting with lower case ("sarcasm case"): "no way"
+// becomes "nO wAy". Other characters are left alone and don't break the pattern.
+func AlternatingCase(s string) string {
+	var b strings.Builder
+	upper := false
+
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			if upper {
+				r = unicode.ToUpper(r)
+			} else {
+				r = unicode.ToLower(r)
+			}
+
+			upper = !upper
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// leet maps letters to the digits that stand in for them in leetspeak.
+var leet = strings.NewReplacer("a", "4", "A", "4", "e", "3", "E", "3", "i", "1", "I", "1", "o", "0", "O", "0", "s", "5",
+	"S", "5", "t", "7", "T", "7")
+
+// Leet writes s in leetspeak, replacing letters with look-alike digits: "elite" becomes "3l173".
+func Leet(s string) string {
+	return leet.Replace(s)
+}
+
+// smallCaps maps the letters a-z to Unicode small capitals. There is no small capital x, so it stays as is.
+var smallCaps = []rune("ᴀʙᴄᴅᴇꜰɢʜɪᴊᴋʟᴍɴᴏᴘǫʀꜱᴛᴜᴠᴡxʏᴢ")
+
+// SmallCaps writes the letters a-z of s (in either case) as Unicode small capitals: "Hello" becomes "ʜᴇʟʟᴏ".
+func SmallCaps(s string) string {
+	return strings.Map(func(r rune) rune {
+		if lower := unicode.ToLower(r); lower >= 'a' && lower <= 'z' {
+			return smallCaps[lower-'a']
+		}
+
+		return r
+	}, s)
+}
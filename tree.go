@@ -2,13 +2,19 @@ package grammar
 
 import (
 	"fmt"
+	"math/rand/v2"
 	"strings"
 )
 
 // A Tree represents a grammar syntax tree.
+//
+// The state that changes as phrases are generated is kept in a Session. The Generate (and related) methods of a Tree
+// use a default session of its own; use NewSession to generate from several goroutines at once.
 type Tree struct {
-	root       node
-	uniqueUsed map[(*node)]bool
+	root    node
+	session *Session           // Default session
+	weights map[string]float64 // Branch weights by branch key (see LoadWeights)
+	entries map[string]bool    // Identifiers that can be generated directly; nil allows all (see AllowEntries)
 }
 
 // Count returns the number of nodes in a syntax tree.
@@ -31,7 +37,18 @@ func (node *node) count() int {
 // Accepts any number of [TreeFormatOption] to alter the output.
 func (tree *Tree) Format(options ...TreeFormatOption) string {
 	rawLines := tree.root.internalFormat("", options)
+
+	if hasOption(DisplayComments, options) {
+		for _, comment := range tree.root.comments {
+			rawLines = append(rawLines, formatLine{"└─ " + comment, ""})
+		}
+	}
 	lines := treeLines(rawLines, options)
+
+	if hasOption(DisplayLegend, options) {
+		return tree.appendLegend(lines)
+	}
+
 	return strings.Join(lines, "\n")
 }
 
@@ -46,6 +63,12 @@ func (node *node) internalFormat(prefix string, options []TreeFormatOption) []fo
 	var collect []formatLine
 
 	for _, node := range node.child {
+		if hasOption(DisplayComments, options) {
+			for _, comment := range node.comments {
+				collect = append(collect, formatLine{prefix + "└─ " + comment, ""})
+			}
+		}
+
 		// Describe this node. Put source in the right column; decide later if we'll use it.
 		collect = append(collect, formatLine{prefix + "└─ " + node.formatNode(options), node.Source})
 		// Ask children to describe themselves. Nudge them a bit to the right by adding to the prefix.
@@ -121,7 +144,64 @@ func treeLines(input []formatLine, options []TreeFormatOption) []string {
 	return ret
 }
 
-// Reset clears the list of used unique substitutions.
+// Reset clears the list of used unique substitutions of the tree's default session.
 func (tree *Tree) Reset() {
-	tree.uniqueUsed = make(map[*node]bool)
+	tree.defaultSession().Reset()
+}
+
+// Used returns the used unique substitutions of the tree's default session. See Session.Used.
+func (tree *Tree) Used() []string {
+	return tree.defaultSession().Used()
+}
+
+// SetUsed replaces the used unique substitutions of the tree's default session. See Session.SetUsed.
+func (tree *Tree) SetUsed(keys []string) {
+	tree.defaultSession().SetUsed(keys)
+}
+
+// MarkUsed marks branches as used in the tree's default session. See Session.MarkUsed.
+func (tree *Tree) MarkUsed(keys ...string) {
+	tree.defaultSession().MarkUsed(keys...)
+}
+
+// MarkUsedText marks the branch of id reading text as used in the tree's default session. See Session.MarkUsedText.
+func (tree *Tree) MarkUsedText(id string, text string) error {
+	return tree.defaultSession().MarkUsedText(id, text)
+}
+
+// Remaining returns the branches of id left for exclusive substitutions in the tree's default session. See
+// Session.Remaining.
+func (tree *Tree) Remaining(id string) ([]string, error) {
+	return tree.defaultSession().Remaining(id)
+}
+
+// SeedStream gives the identifier id its own random stream in the tree's default session. See Session.SeedStream.
+func (tree *Tree) SeedStream(id string, seed int64) {
+	tree.defaultSession().SeedStream(id, seed)
+}
+
+// Seed reseeds the random source of the tree's default session. See Session.Seed.
+func (tree *Tree) Seed(seed int64) {
+	tree.defaultSession().Seed(seed)
+}
+
+// SetRand makes the tree's default session draw its random choices from r. See Session.SetRand.
+func (tree *Tree) SetRand(r *rand.Rand) {
+	tree.defaultSession().SetRand(r)
+}
+
+// NewSession returns a new Session for generating phrases from the tree, with state of its own.
+func (tree *Tree) NewSession() *Session {
+	s := Session{tree: tree, source: rand.NewPCG(rand.Uint64(), rand.Uint64()), cooldowns: make(map[string]int)}
+	s.Reset()
+	return &s
+}
+
+// defaultSession returns the session used by the tree's own methods, creating it if needed.
+func (tree *Tree) defaultSession() *Session {
+	if tree.session == nil {
+		tree.session = tree.NewSession()
+	}
+
+	return tree.session
 }
@@ -0,0 +1,82 @@
+package grammar
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// A TruncateOption changes where Truncate cuts a phrase. Options can be combined with |.
+type TruncateOption int
+
+const (
+	// TruncateStopWords drops stop words (see StopWords) from the end, so a label doesn't end with "of the"
+	TruncateStopWords TruncateOption = 1 << iota
+	// TruncatePunctuation drops dangling punctuation, such as commas, dashes and opening brackets, from the end
+	TruncatePunctuation
+)
+
+// dangling lists the punctuation that TruncatePunctuation removes from the end of a truncated phrase.
+const dangling = ",;:-–—([{/&\"'“‘«"
+
+// Truncate shortens phrase to at most limit characters, e.g. to derive a UI label from longer generated text. It cuts
+// between words, unless the first word alone is too long. A phrase that fits is returned unchanged; otherwise the
+// words are joined by single spaces. Stop words are those of the language of locale (see StopWords).
+//
+//	Truncate("The Lord of the Rings", 14, "en", TruncateStopWords)  // The Lord
+func Truncate(phrase string, limit int, locale string, options TruncateOption) string {
+	if utf8.RuneCountInString(phrase) <= limit {
+		return phrase
+	}
+
+	if limit <= 0 {
+		return ""
+	}
+
+	words := strings.Fields(phrase)
+	length := 0
+	n := 0
+
+	for ; n < len(words); n++ {
+		if length += utf8.RuneCountInString(words[n]) + min(n, 1); length > limit {
+			break
+		}
+	}
+
+	if n == 0 {
+		return string([]rune(phrase)[:limit])
+	}
+
+	stop := make(map[string]bool)
+
+	if options&TruncateStopWords != 0 {
+		for _, word := range stopWords[language(locale)] {
+			stop[word] = true
+		}
+	}
+
+	words = words[:n]
+
+	// Keep at least one word, however it ends
+	for len(words) > 1 {
+		last := words[len(words)-1]
+
+		if options&TruncatePunctuation != 0 {
+			last = strings.TrimRight(last, dangling)
+		}
+
+		if last != "" && !stop[strings.ToLower(last)] {
+			words[len(words)-1] = last
+			break
+		}
+
+		words = words[:len(words)-1]
+	}
+
+	if options&TruncatePunctuation != 0 {
+		if last := strings.TrimRight(words[0], dangling); len(words) == 1 && last != "" {
+			words[0] = last
+		}
+	}
+
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,68 @@
+package grammar
+
+// Usage counts how often the definitions and branches of a tree were expanded in the phrases a session generated (see
+// Session.TrackUsage).
+type Usage struct {
+	Phrases     int            // Number of phrases generated
+	Definitions map[string]int // Number of expansions of each definition, by identifier
+	Branches    map[string]int // Number of times each branch was picked, by branch key (see Session.Used)
+}
+
+// TrackUsage makes the session count how often each definition and branch is expanded from now on, e.g. so a live game
+// can report which content players actually see. Only phrases that are returned count, not those regenerated because
+// of Deduplicate or BlockWords. Calling it again starts counting from zero.
+func (s *Session) TrackUsage() {
+	s.usage = &Usage{Definitions: make(map[string]int), Branches: make(map[string]int)}
+}
+
+// Usage returns a copy of the usage counters of the session, or nil if it isn't tracking usage.
+func (s *Session) Usage() *Usage {
+	if s.usage == nil {
+		return nil
+	}
+
+	ret := Usage{
+		Phrases:     s.usage.Phrases,
+		Definitions: make(map[string]int, len(s.usage.Definitions)),
+		Branches:    make(map[string]int, len(s.usage.Branches)),
+	}
+
+	for id, n := range s.usage.Definitions {
+		ret.Definitions[id] = n
+	}
+
+	for key, n := range s.usage.Branches {
+		ret.Branches[key] = n
+	}
+
+	return &ret
+}
+
+// TrackUsage makes the tree's default session count expansions. See Session.TrackUsage.
+func (tree *Tree) TrackUsage() {
+	tree.defaultSession().TrackUsage()
+}
+
+// Usage returns the usage counters of the tree's default session. See Session.Usage.
+func (tree *Tree) Usage() *Usage {
+	return tree.defaultSession().Usage()
+}
+
+// countUsage adds the expansions made for the last phrase to the usage counters, if the session is tracking usage.
+func (g *generator) countUsage() {
+	usage := g.session.usage
+
+	if usage == nil {
+		return
+	}
+
+	usage.Phrases++
+
+	for _, id := range g.expanded {
+		usage.Definitions[id]++
+	}
+
+	for _, key := range g.result.Branches {
+		usage.Branches[key]++
+	}
+}
@@ -0,0 +1,144 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// An UndefinedError reports a substitution of an identifier which isn't defined, as found by Validate.
+type UndefinedError struct {
+	ID     string // The identifier
+	Source string // Where it is substituted, e.g. "quests.g:12"
+}
+
+func (err *UndefinedError) Error() string {
+	return fmt.Sprintf("%s: no such definition: %s", err.Source, err.ID)
+}
+
+func (err *UndefinedError) Unwrap() error {
+	return ErrUnknownIdentifier
+}
+
+// A CycleError reports a definition which can never finish expanding, because every branch substitutes itself in the
+// end, e.g. a [ {b} ] b [ {a} ]. It is found by Validate.
+type CycleError struct {
+	ID     string // The identifier
+	Source string // Where it is defined
+}
+
+func (err *CycleError) Error() string {
+	return fmt.Sprintf("%s: %s can never finish expanding; every branch substitutes it again", err.Source, err.ID)
+}
+
+// Validate checks that every identifier substituted in the tree is defined and that every definition can finish
+// expanding. It returns an *UndefinedError for each undefined identifier and a *CycleError for each definition caught
+// in a cycle of substitutions (joined with errors.Join), or nil. Unlike generating, it finds problems in rarely picked
+// branches too, so it's meant to be called right after parsing, or in CI.
+//
+// An identifier counts as defined if it has a definition in any locale (e.g. greeting@en). Identifiers that are only
+// supplied when generating, with Pin or Blanks, are reported too.
+func (tree *Tree) Validate() error {
+	var errs []error
+
+	tree.root.validate(tree, &errs)
+	terminating := tree.terminating()
+
+	for i := range tree.root.child {
+		if def := &tree.root.child[i]; !terminating[def] {
+			errs = append(errs, &CycleError{ID: def.Text, Source: def.Source})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// terminating returns the definitions that can finish expanding: those with a branch whose substitutions can all
+// finish expanding. It starts with none and adds definitions until nothing changes.
+func (tree *Tree) terminating() map[*node]bool {
+	ret := make(map[*node]bool)
+
+	for changed := true; changed; {
+		changed = false
+
+		for i := range tree.root.child {
+			if def := &tree.root.child[i]; !ret[def] && tree.terminates(def, ret) {
+				ret[def] = true
+				changed = true
+			}
+		}
+	}
+
+	return ret
+}
+
+// terminates reports whether node can finish expanding, given the definitions known to.
+func (tree *Tree) terminates(node *node, terminating map[*node]bool) bool {
+	if node.internalType == group {
+		for i := range node.child {
+			if tree.terminates(&node.child[i], terminating) {
+				return true
+			}
+		}
+
+		return len(node.child) == 0
+	}
+
+	if node.internalType == text {
+		for _, tag := range sequences(node.Text) {
+			// Conditions may pick a branch without substitutions, and loops may repeat nothing
+			if match := repetition.FindStringSubmatch(tag); strings.Contains(tag, "?") || match != nil && match[2] == "0" {
+				continue
+			}
+
+			for _, ref := range references("{" + tag + "}") {
+				// Undefined identifiers are reported as such
+				if def := tree.findDefinition(strings.TrimPrefix(ref.id, "=")); def != nil && !terminating[def] {
+					return false
+				}
+			}
+		}
+	}
+
+	for i := range node.child {
+		if !tree.terminates(&node.child[i], terminating) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validate appends an *UndefinedError to errs for every undefined identifier substituted in node and its children.
+func (node *node) validate(tree *Tree, errs *[]error) {
+	if node.internalType == text {
+		for _, ref := range references(node.Text) {
+			if id := strings.TrimPrefix(ref.id, "="); !tree.defined(id) {
+				*errs = append(*errs, &UndefinedError{ID: id, Source: node.Source})
+			}
+		}
+	}
+
+	for i := range node.child {
+		node.child[i].validate(tree, errs)
+	}
+}
+
+// defined reports whether id has a definition, in any locale unless id has one of its own.
+func (tree *Tree) defined(id string) bool {
+	if tree.findDefinition(id) != nil {
+		return true
+	}
+
+	if strings.Contains(id, "@") {
+		return false
+	}
+
+	for i := range tree.root.child {
+		if strings.HasPrefix(tree.root.child[i].Text, id+"@") {
+			return true
+		}
+	}
+
+	return false
+}
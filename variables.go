@@ -0,0 +1,143 @@
+package grammar
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// variableName matches the name of a variable.
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// condition matches a condition such as n>5 or mood==dark.
+var condition = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(>=|<=|==|!=|>|<)(.*)$`)
+
+// capture expands inner (an identifier or a number range) as a substitution and remembers the result in the variable
+// name, for conditions later in the phrase.
+func (g *generator) capture(name string, inner string) (string, error) {
+	var value string
+	var err error
+	var low, high int
+
+	if _, scanErr := fmt.Sscanf(inner, "%d-%d", &low, &high); scanErr == nil {
+		value = strconv.Itoa(g.random(low, high))
+		g.record(name+"="+inner, value)
+	} else if value, err = g.substitute(inner); err != nil {
+		return "", err
+	}
+
+	if g.variables == nil {
+		g.variables = make(map[string]string)
+	}
+
+	g.variables[name] = value
+	return value, nil
+}
+
+// conditional evaluates a conditional such as n>5?many:few and expands the branch it picks. A branch which is a
+// defined identifier is substituted; anything else is used as text, with underscores for spaces.
+func (g *generator) conditional(tag string) (string, error) {
+	test, branches, _ := strings.Cut(tag, "?")
+	yes, no, _ := strings.Cut(branches, ":")
+
+	ok, err := g.test(test)
+
+	if err != nil {
+		return "", err
+	}
+
+	branch := no
+
+	if ok {
+		branch = yes
+	}
+
+	if branch != "" && g.findDefinition(branch) != nil {
+		return g.substitute(branch)
+	}
+
+	return strings.ReplaceAll(branch, "_", " "), nil
+}
+
+// test evaluates a condition on a captured variable. Numbers are compared numerically, anything else as text.
+func (g *generator) test(test string) (bool, error) {
+	match := condition.FindStringSubmatch(test)
+
+	if match == nil {
+		return false, fmt.Errorf("invalid condition %s", test)
+	}
+
+	name, op, operand := match[1], match[2], match[3]
+	value, found := g.variables[name]
+
+	if !found {
+		return false, fmt.Errorf("no such variable: %s", name)
+	}
+
+	var cmp int
+	a, errA := strconv.ParseFloat(value, 64)
+	b, errB := strconv.ParseFloat(operand, 64)
+
+	if errA == nil && errB == nil {
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(value, operand)
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// repetition matches a loop such as line*1-5 or *name*3.
+var repetition = regexp.MustCompile(`^(\*?[^*]+)\*(\d+)(?:-(\d+))?$`)
+
+// repeat expands a loop such as line*1-5: the substitution before * is made a random number of times in the range
+// (or an exact number of times, as in line*3), with independent choices each time, and the results joined by spaces.
+func (g *generator) repeat(match []string) (string, error) {
+	low, _ := strconv.Atoi(match[2])
+	high := low
+
+	if match[3] != "" {
+		high, _ = strconv.Atoi(match[3])
+	}
+
+	if high < low {
+		return "", fmt.Errorf("invalid repetition %s-%s", match[2], match[3])
+	}
+
+	var parts []string
+
+	for n := g.random(low, high); n > 0; n-- {
+		part, err := g.substitute(match[1])
+
+		if err != nil {
+			return "", err
+		}
+
+		parts = append(parts, part)
+	}
+
+	if g.config.joiner != "" {
+		return strings.Join(parts, g.config.joiner), nil
+	}
+
+	return strings.Join(parts, " "), nil
+}
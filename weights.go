@@ -0,0 +1,312 @@
+package grammar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LoadWeights reads a weight profile in JSON format and replaces the branch weights of the tree with it. The profile
+// maps branch keys (see Session.Used) to weights, e.g.
+//
+//	{
+//	  "weekday/[1/4": 3,
+//	  "weekday/[1/5": 0.5,
+//	  "weekday/[1/6": 0
+//	}
+//
+// Branches have a weight of 1 unless the profile says otherwise; a branch with weight 3 is three times as likely to be
+// picked as its siblings. A weight of 0 means the branch is never picked, unless all of its siblings have weight 0 as
+// well. This allows tuning the frequency of content without editing the grammar itself.
+//
+// The profile is checked against the tree before it is applied, so if any key doesn't match a branch, or any weight is
+// negative, an error is returned and the previous weights are kept.
+func (tree *Tree) LoadWeights(r io.Reader) error {
+	var profile map[string]float64
+
+	if err := json.NewDecoder(r).Decode(&profile); err != nil {
+		return fmt.Errorf("weight profile: %w", err)
+	}
+
+	for key, weight := range profile {
+		if _, _, _, err := tree.findBranch(key); err != nil {
+			return err
+		}
+
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return fmt.Errorf("invalid weight %v for %s", weight, key)
+		}
+	}
+
+	tree.weights = profile
+	return nil
+}
+
+// findBranch looks up a branch key such as "weekday/[1/4" and returns the definition, group and index of the branch.
+func (tree *Tree) findBranch(key string) (def *node, group *node, index int, err error) {
+	slash := strings.LastIndex(key, "/")
+	groupStart := strings.LastIndex(key, "/[")
+
+	if slash < 0 || groupStart < 0 || groupStart >= slash {
+		return nil, nil, 0, fmt.Errorf("malformed branch key %s", key)
+	}
+
+	id, groupText := key[:groupStart], key[groupStart+1:slash]
+
+	if index, err = strconv.Atoi(key[slash+1:]); err != nil {
+		return nil, nil, 0, fmt.Errorf("malformed branch key %s", key)
+	}
+
+	def = tree.root.find([]string{id})
+
+	if def == nil {
+		return nil, nil, 0, fmt.Errorf("%w: %s (in branch key %s)", ErrUnknownIdentifier, id, key)
+	}
+
+	group = def.findGroup(groupText)
+
+	if group == nil || index < 0 || index >= len(group.child) {
+		return nil, nil, 0, fmt.Errorf("no such branch: %s", key)
+	}
+
+	return def, group, index, nil
+}
+
+// findGroup searches the subtree of node for the group with the given text (e.g. "[3").
+func (node *node) findGroup(text string) *node {
+	for i := range node.child {
+		child := &node.child[i]
+
+		if child.internalType == group && child.Text == text {
+			return child
+		}
+
+		if found := child.findGroup(text); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// branchWeights returns the weights of the branches of group, or nil if none of them are weighted.
+func (g *generator) branchWeights(group *node) []float64 {
+	tiered := group.tiered()
+
+	if len(g.tree.weights) == 0 && len(g.session.weights) == 0 && !group.weighted() && !tiered {
+		return nil
+	}
+
+	var weights []float64
+	total := 0.0
+
+	for i := range group.child {
+		key := branchKey(g.def, group, i)
+		weight, found := g.weight(key)
+
+		// A weight in the grammar (_:4) applies unless the weight profile says otherwise
+		if _, profiled := g.tree.weights[key]; group.child[i].weight > 0 && !profiled {
+			weight, found = weight*group.child[i].weight, true
+		}
+
+		if tiered {
+			weight, found = weight*g.tierWeight(group.child[i].tier), true
+		}
+
+		if !found {
+			weight = 1
+		} else if weights == nil {
+			// The first explicit weight; all previous branches have the default
+			weights = make([]float64, i, len(group.child))
+
+			for j := range weights {
+				weights[j] = 1
+			}
+		}
+
+		if weights != nil {
+			weights = append(weights, weight)
+		}
+
+		total += weight
+	}
+
+	if total == 0 {
+		// All weighted to zero; pick among them evenly
+		return nil
+	}
+
+	return weights
+}
+
+// weight returns the weight of the branch with the given key, and whether it has been weighted at all: by the tree (see
+// LoadWeights), by feedback to the session (see Reinforce) or both.
+func (g *generator) weight(key string) (float64, bool) {
+	weight, found := g.tree.weights[key]
+
+	if !found {
+		weight = 1
+	}
+
+	if factor, adjusted := g.session.weights[key]; adjusted {
+		return weight * factor, true
+	}
+
+	return weight, found
+}
+
+// choose randomly picks a branch of group, taking branch weights into account, unless a branch of group is forced (see
+// ForceBranch).
+func (g *generator) choose(group *node, weights []float64) int {
+	if forced, isForced := g.config.forced[group]; isForced {
+		if g.index != nil {
+			g.index.force(group, forced)
+		}
+
+		return forced
+	}
+
+	if g.index != nil {
+		// Entered here, left by composeBranch
+		pick, _ := g.index.branch(group)
+		return pick
+	}
+
+	if weights == nil {
+		return g.random(0, len(group.child)-1)
+	}
+
+	draw := func(n int) int {
+		return pickWeighted(weights, g.draw)
+	}
+
+	if g.script != nil {
+		return g.script.next(len(group.child), draw)
+	}
+
+	return draw(len(group.child))
+}
+
+// emptyWeight matches an empty token with a weight, e.g. _:4 or _:0.5.
+var emptyWeight = regexp.MustCompile(`^_:(\d+(?:\.\d+)?)$`)
+
+// weighted reports whether any branch of group has a weight given in the grammar.
+func (group *node) weighted() bool {
+	for i := range group.child {
+		if group.child[i].weight > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// weighEmptyBranches gives the empty branches written as _:4 under node their weight, leaving the text _. The weight
+// is only allowed on a branch of its own.
+func weighEmptyBranches(node *node) error {
+	for i := range node.child {
+		branch := &node.child[i]
+
+		if node.internalType == group && branch.internalType == text && len(branch.child) == 0 {
+			if match := emptyWeight.FindStringSubmatch(branch.Text); match != nil {
+				weight, _ := strconv.ParseFloat(match[1], 64)
+
+				if weight <= 0 {
+					return newParseError(branch.Source, 0, branch.Text, "invalid weight %s", branch.Text)
+				}
+
+				branch.Text, branch.weight = "_", weight
+				continue
+			}
+		}
+
+		if branch.internalType == text {
+			for _, word := range strings.Fields(branch.Text) {
+				if emptyWeight.MatchString(word) {
+					return newParseError(branch.Source, 0, word, "weighted %s must be a branch of its own", word)
+				}
+			}
+		}
+
+		if err := weighEmptyBranches(branch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pickWeighted picks an index of weights, with odds in proportion to its weight. Random numbers come from draw, which
+// returns a number in [0, n). At least one weight must be above zero.
+func pickWeighted(weights []float64, draw func(n int) int) int {
+	total := 0.0
+
+	for _, weight := range weights {
+		total += weight
+	}
+
+	// A random float in [0, total), with 53 bits of precision
+	r := float64(draw(1<<53)) / (1 << 53) * total
+
+	for i, weight := range weights {
+		if r < weight {
+			return i
+		}
+
+		r -= weight
+	}
+
+	// Rounding errors may leave us past the end; pick the last index that can be picked
+	for i := len(weights) - 1; i > 0; i-- {
+		if weights[i] > 0 {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// stockPrefix starts the keys of stocks. Identifiers can't contain spaces, so these never clash with branch keys.
+const stockPrefix = "stock "
+
+// stockKey identifies the stock of a branch (see //!stock), which counts the uses of the branch.
+func stockKey(branch string) string {
+	return stockPrefix + branch
+}
+
+// consumed returns the number of times branch i of group has been used by exclusive substitutions.
+func (g *generator) consumed(group *node, i int) int {
+	return g.session.uniqueUsed[stockKey(branchKey(g.def, group, i))]
+}
+
+// consume takes one use from the stock of branch i of group, given what remains of the stock of each branch (see
+// remainingStock), using the branch up when nothing is left.
+func (g *generator) consume(group *node, i int, remaining []float64) {
+	g.session.uniqueUsed[stockKey(branchKey(g.def, group, i))]++
+
+	if remaining[i] <= 1 {
+		g.markUsed(group, i)
+	}
+}
+
+// remainingStock returns the weights of the branches of group less what exclusive substitutions have used of them
+// (see //!stock).
+func (g *generator) remainingStock(group *node, weights []float64) []float64 {
+	ret := make([]float64, len(group.child))
+
+	for i := range ret {
+		ret[i] = 1
+
+		if weights != nil {
+			ret[i] = weights[i]
+		}
+
+		ret[i] = math.Max(0, ret[i]-float64(g.consumed(group, i)))
+	}
+
+	return ret
+}